@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// banReasonLogger logs why the new bans are applied, with ban_reason_log. The LOG rules
+// of deny_log match whole sets, so the kernel logs can't tell the scenarios apart.
+type banReasonLogger struct {
+	format  string
+	prefix  string
+	backend string
+}
+
+// newBanReasonLogger returns nil if ban_reason_log is disabled, a nil logger ignores all bans.
+func newBanReasonLogger(config *cfg.BouncerConfig) *banReasonLogger {
+	if !config.BanReasonLog {
+		return nil
+	}
+
+	return &banReasonLogger{
+		format:  config.BanReasonLogFormat,
+		prefix:  config.DenyLogPrefix,
+		backend: config.Mode,
+	}
+}
+
+func optional(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+func (l *banReasonLogger) banned(d *models.Decision) {
+	if l == nil {
+		return
+	}
+
+	r := strings.NewReplacer(
+		"{prefix}", l.prefix,
+		"{value}", *d.Value,
+		"{scope}", optional(d.Scope),
+		"{scenario}", optional(d.Scenario),
+		"{origin}", optional(d.Origin),
+		"{duration}", optional(d.Duration),
+		"{backend}", l.backend,
+	)
+
+	log.Info(r.Replace(l.format))
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/pkg/ptr"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+)
+
+const (
+	// blocklists don't expire, ipset caps the timeout of its entries to ~24 days anyway
+	blocklistDuration = "87600h"
+)
+
+// blocklist applies the IPs and ranges listed in files, one per line.
+type blocklist struct {
+	files []string
+	// the values currently applied, with the file they come from
+	loaded map[string]string
+}
+
+func newBlocklist(files []string) *blocklist {
+	return &blocklist{
+		files:  files,
+		loaded: make(map[string]string),
+	}
+}
+
+func readBlocklistFile(path string, values map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read blocklist: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		valid := net.ParseIP(line) != nil
+		if !valid {
+			_, _, err := net.ParseCIDR(line)
+			valid = err == nil
+		}
+
+		if !valid {
+			log.Warningf("%s:%d: ignoring invalid IP or range '%s'", path, lineno, line)
+			continue
+		}
+
+		values[line] = path
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("while reading %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func blocklistDecision(value string, path string) *models.Decision {
+	scope := "Ip"
+	if strings.Contains(value, "/") {
+		scope = "Range"
+	}
+
+	return &models.Decision{
+		Value:    ptr.Of(value),
+		Scope:    ptr.Of(scope),
+		Type:     ptr.Of("ban"),
+		Duration: ptr.Of(blocklistDuration),
+		Origin:   ptr.Of(backend.BlocklistOrigin),
+		Scenario: ptr.Of("blocklist " + path),
+	}
+}
+
+// load reads the files again, and returns the decisions to add and to delete since
+// the previous load. Nothing changes if a file can't be read.
+func (b *blocklist) load() ([]*models.Decision, []*models.Decision, error) {
+	values := make(map[string]string)
+
+	for _, path := range b.files {
+		if err := readBlocklistFile(path, values); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	added := []*models.Decision{}
+	deleted := []*models.Decision{}
+
+	for value, path := range values {
+		if _, ok := b.loaded[value]; !ok {
+			added = append(added, blocklistDecision(value, path))
+		}
+	}
+
+	for value, path := range b.loaded {
+		if _, ok := values[value]; !ok {
+			deleted = append(deleted, blocklistDecision(value, path))
+		}
+	}
+
+	b.loaded = values
+
+	log.Infof("%d entries in blocklists: %d new, %d removed", len(values), len(added), len(deleted))
+
+	return added, deleted, nil
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/pkg/ptr"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+)
+
+const (
+	controlDuration = "4h"
+)
+
+// controlRequest is a command received on the control socket, one JSON object per line:
+//
+//	{"command": "list"}
+//	{"command": "check", "value": "192.168.1.1"}
+//	{"command": "add", "value": "192.168.1.0/24", "duration": "1h"}
+//	{"command": "delete", "value": "192.168.1.0/24"}
+//	{"command": "flush"}
+type controlRequest struct {
+	Command  string `json:"command"`
+	Value    string `json:"value"`
+	Duration string `json:"duration"`
+}
+
+type controlResponse struct {
+	Error  string        `json:"error,omitempty"`
+	Bans   []backend.Ban `json:"bans,omitempty"`
+	Banned *bool         `json:"banned,omitempty"`
+}
+
+// controlCommand is handed to the goroutine processing the decisions, so that
+// the firewall is never modified concurrently.
+type controlCommand struct {
+	request controlRequest
+	reply   chan controlResponse
+}
+
+// manualDecision builds the decision for a ban requested on the control socket.
+func manualDecision(value string, duration string) *models.Decision {
+	scope := "Ip"
+	if strings.Contains(value, "/") {
+		scope = "Range"
+	}
+
+	if duration == "" {
+		duration = controlDuration
+	}
+
+	return &models.Decision{
+		Value:    ptr.Of(value),
+		Scope:    ptr.Of(scope),
+		Type:     ptr.Of("ban"),
+		Duration: ptr.Of(duration),
+		Origin:   ptr.Of(backend.ControlOrigin),
+		Scenario: ptr.Of("manual ban from the control socket"),
+	}
+}
+
+func handleControl(b *backend.BackendCTX, req controlRequest) controlResponse {
+	fail := func(err error) controlResponse {
+		return controlResponse{Error: err.Error()}
+	}
+
+	switch req.Command {
+	case "list":
+		return controlResponse{Bans: b.Bans()}
+	case "check":
+		banned, err := b.IsBanned(req.Value)
+		if err != nil {
+			return fail(err)
+		}
+
+		return controlResponse{Banned: &banned}
+	case "add", "delete":
+		if req.Value == "" {
+			return fail(fmt.Errorf("'%s' requires a value", req.Command))
+		}
+
+		d := manualDecision(req.Value, req.Duration)
+
+		var err error
+		if req.Command == "add" {
+			err = b.Add(d)
+		} else {
+			err = b.Delete(d)
+		}
+
+		if err != nil && !errors.Is(err, backend.ErrSkipped) {
+			return fail(err)
+		}
+
+		if err := b.Commit(); err != nil {
+			return fail(err)
+		}
+
+		log.Infof("%s '%s' from the control socket", req.Command, req.Value)
+
+		return controlResponse{}
+	case "flush":
+		log.Info("flushing the firewall from the control socket")
+
+		if err := b.Flush(); err != nil {
+			return fail(err)
+		}
+
+		return controlResponse{}
+	default:
+		return fail(fmt.Errorf("unknown command '%s'", req.Command))
+	}
+}
+
+func serveControlConn(ctx context.Context, conn net.Conn, commands chan<- controlCommand) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+
+	for scanner.Scan() {
+		var resp controlResponse
+
+		cmd := controlCommand{reply: make(chan controlResponse, 1)}
+		if err := json.Unmarshal(scanner.Bytes(), &cmd.request); err != nil {
+			resp = controlResponse{Error: fmt.Sprintf("invalid request: %s", err)}
+		} else {
+			select {
+			case commands <- cmd:
+			case <-ctx.Done():
+				return
+			}
+			resp = <-cmd.reply
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			log.Debugf("control socket: %s", err)
+			return
+		}
+	}
+}
+
+// listenControl creates the control socket in a directory only the owner can enter, and
+// moves it to path once its permissions are set: it's never reachable by the others.
+func listenControl(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the control socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "socket")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on control socket: %w", err)
+	}
+
+	// it's not at the address it was created at anymore, the caller removes it
+	listener.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to set permissions on control socket: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to move the control socket to %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+// serveControl listens on a unix socket for commands. The socket is only accessible
+// by the owner of the process, since it allows to change the content of the firewall.
+func serveControl(ctx context.Context, path string, commands chan<- controlCommand) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove stale control socket: %w", err)
+	}
+
+	listener, err := listenControl(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer listener.Close()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	log.Infof("Serving control socket at %s", path)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fmt.Errorf("control socket: %w", err)
+		}
+
+		go serveControlConn(ctx, conn, commands)
+	}
+}
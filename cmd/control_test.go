@@ -0,0 +1,89 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControlSocketPermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "control.sock")
+
+	commands := make(chan controlCommand)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() { done <- serveControl(ctx, path, commands) }()
+
+	var conn net.Conn
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("unable to connect to the control socket: %s", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("control socket has permissions %o, want 600", perm)
+	}
+
+	// only the socket is left in the directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("the directory of the control socket holds %d entries", len(entries))
+	}
+
+	go func() {
+		cmd := <-commands
+		cmd.reply <- controlResponse{Error: "stopped"}
+	}()
+
+	if _, err := conn.Write([]byte(`{"command": "list"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp controlResponse
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatalf("no response from the control socket: %v", scanner.Err())
+	}
+
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil || resp.Error != "stopped" {
+		t.Fatalf("unexpected response %q (%v)", scanner.Text(), err)
+	}
+
+	cancel()
+	<-done
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the control socket is left behind: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+)
+
+// the size of a page of /debug/bans, by default and at most
+const (
+	debugBansLimit    = 1000
+	debugBansMaxLimit = 10000
+)
+
+// bansHandler serves the decisions applied to the firewall, as the bouncer remembers
+// them. It only exposes the bans, not the configuration.
+type bansHandler struct {
+	backend *backend.BackendCTX
+	token   string
+}
+
+type bansPage struct {
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Bans   []backend.Ban `json:"bans"`
+}
+
+// queryInt returns the value of an integer query parameter, def if it's missing.
+func queryInt(r *http.Request, name string, def int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func (h *bansHandler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) == 1
+}
+
+// ServeHTTP answers a page of the bans, sorted by value: ?offset=0&limit=1000.
+func (h *bansHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	offset, ok := queryInt(r, "offset", 0)
+	if !ok {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	limit, ok := queryInt(r, "limit", debugBansLimit)
+	if !ok || limit == 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	if limit > debugBansMaxLimit {
+		limit = debugBansMaxLimit
+	}
+
+	bans := h.backend.Bans()
+	page := bansPage{Total: len(bans), Offset: offset, Bans: []backend.Ban{}}
+
+	if offset < len(bans) {
+		end := offset + limit
+		if end > len(bans) {
+			end = len(bans)
+		}
+
+		page.Bans = bans[offset:end]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Errorf("unable to write the bans: %s", err)
+	}
+}
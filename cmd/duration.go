@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/pkg/ptr"
+)
+
+// capDurations returns the decisions with their duration limited to max, no limit if
+// max is 0. The decisions that are too long are copied before being shortened.
+func capDurations(decisions []*models.Decision, max time.Duration) []*models.Decision {
+	if max <= 0 {
+		return decisions
+	}
+
+	ret := make([]*models.Decision, 0, len(decisions))
+
+	for _, d := range decisions {
+		if d == nil || d.Duration == nil {
+			ret = append(ret, d)
+			continue
+		}
+
+		duration, err := time.ParseDuration(*d.Duration)
+		if err != nil || duration <= max {
+			ret = append(ret, d)
+			continue
+		}
+
+		if d.Value != nil {
+			log.Infof("shortening the ban of '%s' from %s to max_duration %s", *d.Value, *d.Duration, max)
+		}
+
+		capped := *d
+		capped.Duration = ptr.Of(max.String())
+		ret = append(ret, &capped)
+	}
+
+	return ret
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+func TestCapDurations(t *testing.T) {
+	long := newPolledDecision("192.0.2.1", "2160h")
+	short := newPolledDecision("192.0.2.2", "4h")
+	exact := newPolledDecision("192.0.2.3", "168h")
+
+	capped := capDurations([]*models.Decision{long, short, exact}, 7*24*time.Hour)
+
+	if got := polledValues(capped); got != "192.0.2.1 168h0m0s,192.0.2.2 4h,192.0.2.3 168h" {
+		t.Fatalf("capped durations: %s", got)
+	}
+
+	// the decision is copied, the one received from the LAPI is left as is
+	if *long.Duration != "2160h" {
+		t.Fatalf("the original decision lasts %s", *long.Duration)
+	}
+
+	// under the cap, the decisions are passed through
+	if capped[1] != short || capped[2] != exact {
+		t.Fatal("a decision under max_duration was copied")
+	}
+}
+
+func TestCapDurationsUnset(t *testing.T) {
+	decisions := []*models.Decision{newPolledDecision("192.0.2.1", "2160h")}
+
+	if got := capDurations(decisions, 0); len(got) != 1 || got[0] != decisions[0] || *got[0].Duration != "2160h" {
+		t.Fatalf("without max_duration, got %s", polledValues(got))
+	}
+}
+
+func TestCapDurationsMalformed(t *testing.T) {
+	value := "192.0.2.1"
+	decisions := []*models.Decision{nil, {Value: &value}, newPolledDecision("192.0.2.2", "forever")}
+
+	got := capDurations(decisions, time.Hour)
+
+	for i := range decisions {
+		if got[i] != decisions[i] {
+			t.Fatalf("decision %d was changed", i)
+		}
+	}
+}
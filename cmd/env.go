@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// environment variables taking precedence over api_url and api_key
+const (
+	envLAPIURL = "CROWDSEC_LAPI_URL"
+	envLAPIKey = "CROWDSEC_LAPI_KEY"
+)
+
+// maskKey hides all but the first characters of an API key, for logging.
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+
+	return key[:4] + "****"
+}
+
+// envOverrides sets the LAPI url and key from the environment, if not empty.
+func envOverrides(bouncer *csbouncer.StreamBouncer) {
+	if url := os.Getenv(envLAPIURL); url != "" {
+		log.Debugf("using api_url %s from %s", url, envLAPIURL)
+		bouncer.APIUrl = url
+	}
+
+	if key := os.Getenv(envLAPIKey); key != "" {
+		log.Debugf("using api_key %s from %s", maskKey(key), envLAPIKey)
+		bouncer.APIKey = key
+	}
+}
+
+// loadAPIKey reads the LAPI key of the configuration file again, with the environment
+// overrides, for when the LAPI refused the one the bouncer started with.
+func loadAPIKey(configPath string) (string, error) {
+	configBytes, err := cfg.MergedConfig(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	bouncer := &csbouncer.StreamBouncer{}
+	if err := bouncer.ConfigReader(bytes.NewReader(cfg.ExpandEnv(configBytes))); err != nil {
+		return "", err
+	}
+
+	envOverrides(bouncer)
+
+	return bouncer.APIKey, nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+)
+
+func TestEnvOverrides(t *testing.T) {
+	t.Setenv(envLAPIURL, "http://lapi.example:8080/")
+	t.Setenv(envLAPIKey, "from-env")
+
+	bouncer := &csbouncer.StreamBouncer{APIUrl: "http://127.0.0.1:8080/", APIKey: "from-file"}
+	envOverrides(bouncer)
+
+	if bouncer.APIUrl != "http://lapi.example:8080/" || bouncer.APIKey != "from-env" {
+		t.Fatalf("api_url %s, api_key %s", bouncer.APIUrl, bouncer.APIKey)
+	}
+}
+
+func TestNoEnvOverride(t *testing.T) {
+	t.Setenv(envLAPIURL, "")
+	t.Setenv(envLAPIKey, "")
+
+	bouncer := &csbouncer.StreamBouncer{APIUrl: "http://127.0.0.1:8080/", APIKey: "from-file"}
+	envOverrides(bouncer)
+
+	if bouncer.APIUrl != "http://127.0.0.1:8080/" || bouncer.APIKey != "from-file" {
+		t.Fatalf("api_url %s, api_key %s", bouncer.APIUrl, bouncer.APIKey)
+	}
+}
+
+func TestMaskKey(t *testing.T) {
+	for key, want := range map[string]string{"": "****", "abcd": "****", "abcdef123456": "abcd****"} {
+		if got := maskKey(key); got != want {
+			t.Errorf("%s masked as %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestLoadAPIKey(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "crowdsec-firewall-bouncer.yaml")
+	content := "mode: dry-run\napi_url: http://127.0.0.1:8080/\napi_key: ${TEST_BOUNCER_KEY}\n"
+
+	if err := os.WriteFile(configPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(envLAPIKey, "")
+	t.Setenv("TEST_BOUNCER_KEY", "expanded")
+
+	key, err := loadAPIKey(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "expanded" {
+		t.Fatalf("api_key %s, want the expanded variable", key)
+	}
+
+	// the environment takes precedence over the file
+	t.Setenv(envLAPIKey, "from-env")
+
+	if key, err = loadAPIKey(configPath); err != nil || key != "from-env" {
+		t.Fatalf("api_key %s (%v), want the one of %s", key, err, envLAPIKey)
+	}
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// healthStatus tracks the state reported by the /health endpoint.
+type healthStatus struct {
+	mu            sync.Mutex
+	mode          string
+	lapi          bool
+	backendReady  bool
+	streamRunning bool
+	lastDecisions time.Time
+	// why the LAPI refused the credentials of the bouncer, if it did
+	authError string
+}
+
+type healthReport struct {
+	Healthy       bool       `json:"healthy"`
+	Backend       string     `json:"backend"`
+	BackendReady  bool       `json:"backend_ready"`
+	StreamRunning bool       `json:"stream_running"`
+	LastDecisions *time.Time `json:"last_decisions,omitempty"`
+	AuthError     string     `json:"auth_error,omitempty"`
+}
+
+// newHealthStatus returns the status of a bouncer, lapi tells whether it gets decisions from the LAPI.
+func newHealthStatus(mode string, lapi bool) *healthStatus {
+	return &healthStatus{
+		mode: mode,
+		lapi: lapi,
+	}
+}
+
+func (h *healthStatus) setBackendReady(ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.backendReady = ready
+}
+
+func (h *healthStatus) setStreamRunning(running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.streamRunning = running
+}
+
+// setAuthError records whether the last request to the LAPI was refused because of the
+// credentials: the bouncer is unhealthy until a request is accepted.
+func (h *healthStatus) setAuthError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var authErr *lapiAuthError
+	if errors.As(err, &authErr) {
+		h.authError = authErr.Error()
+	} else {
+		h.authError = ""
+	}
+}
+
+// decisionsReceived records the time of the last batch of decisions received from the LAPI.
+func (h *healthStatus) decisionsReceived() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastDecisions = time.Now()
+}
+
+func (h *healthStatus) report() healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := healthReport{
+		Healthy:       h.backendReady && (h.streamRunning || !h.lapi) && h.authError == "",
+		Backend:       h.mode,
+		BackendReady:  h.backendReady,
+		StreamRunning: h.streamRunning,
+		AuthError:     h.authError,
+	}
+
+	if !h.lastDecisions.IsZero() {
+		last := h.lastDecisions
+		r.LastDecisions = &last
+	}
+
+	return r
+}
+
+// ServeHTTP answers 200 if the backend is initialized and the decision stream is running
+// (if there is one) with accepted credentials, 503 otherwise.
+func (h *healthStatus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r := h.report()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !r.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		log.Errorf("unable to write health report: %s", err)
+	}
+}
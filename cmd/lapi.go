@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/apiclient"
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+)
+
+const lapiInitialBackoff = time.Second
+
+// connectLAPI opens the decision stream once, to check that the LAPI accepts it.
+func connectLAPI(ctx context.Context, s *lapiStream) error {
+	resp, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// waitForLAPI makes sure the decision stream can be opened before running the bouncer,
+// since the stream gives up right away if the LAPI is not reachable (ie. crowdsec is
+// still starting). The delay between two attempts is doubled each time, up to maxBackoff.
+func waitForLAPI(ctx context.Context, s *lapiStream, retries int, maxBackoff time.Duration) error {
+	backoff := lapiInitialBackoff
+
+	err := connectLAPI(ctx, s)
+	for i := 0; err != nil && i < retries; i++ {
+		// a refused key won't fix itself, unlike a LAPI that is still starting
+		var authErr *lapiAuthError
+		if errors.As(err, &authErr) {
+			log.Errorf("%s, retrying in %s (%d/%d)", err, backoff, i+1, retries)
+		} else {
+			log.Warningf("unable to connect to the LAPI: %s, retrying in %s (%d/%d)", err, backoff, i+1, retries)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		err = connectLAPI(ctx, s)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to connect to the LAPI: %w", err)
+	}
+
+	return nil
+}
+
+// lapiProbe tells whether the LAPI answers, whatever the status of its response: a
+// refused key is reported by the decision stream.
+func lapiProbe(bouncer *csbouncer.StreamBouncer) func(ctx context.Context) error {
+	// the transport of the client (TLS, unix socket) without the API key one, which logs
+	// each failed attempt as an error
+	transport := bouncer.APIClient.GetClient().Transport
+	if t, ok := transport.(*apiclient.APIKeyTransport); ok {
+		transport = t.Transport
+	}
+
+	client := &http.Client{Transport: transport}
+
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, bouncer.APIUrl, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+}
+
+// waitLAPIReachable waits up to timeout for the LAPI to answer before the firewall is set
+// up, for a bouncer started before crowdsec when the systemd ordering isn't enough. The delay
+// between two attempts is doubled each time, up to maxBackoff.
+func waitLAPIReachable(ctx context.Context, probe func(ctx context.Context) error, timeout time.Duration, maxBackoff time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	backoff := lapiInitialBackoff
+
+	for {
+		err := probe(ctx)
+		if err == nil {
+			log.Infof("the LAPI is reachable after %s", time.Since(start).Round(time.Second))
+			return nil
+		}
+
+		deadline, _ := ctx.Deadline()
+		log.Infof("waiting for the LAPI: %s, retrying in %s (%s left)", err, backoff, time.Until(deadline).Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the LAPI is not reachable after %s: %w", timeout, err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+)
+
+// freeAddress returns an address nothing listens on yet.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return addr
+}
+
+// newProbedBouncer returns the probe of a LAPI at addr, through the library client.
+func newProbedBouncer(t *testing.T, addr string) func(ctx context.Context) error {
+	t.Helper()
+
+	bouncer := &csbouncer.StreamBouncer{APIUrl: "http://" + addr + "/", APIKey: "key", TickerInterval: "10s"}
+
+	if err := bouncer.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return lapiProbe(bouncer)
+}
+
+func TestWaitLAPIReachable(t *testing.T) {
+	addr := freeAddress(t)
+	probe := newProbedBouncer(t, addr)
+
+	// crowdsec comes up after the bouncer, and refuses the key of the probe
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})}
+	defer server.Close()
+
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		server.Serve(listener)
+	}()
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	start := time.Now()
+
+	if err := waitLAPIReachable(context.Background(), probe, 10*time.Second, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("the LAPI was reached after %s", elapsed)
+	}
+
+	waits := 0
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.InfoLevel && strings.HasPrefix(entry.Message, "waiting for the LAPI") {
+			waits++
+		}
+	}
+
+	// at 0s and 1s, then reached at 2s
+	if waits < 2 {
+		t.Fatalf("%d waits logged at info", waits)
+	}
+}
+
+func TestWaitLAPIReachableTimeout(t *testing.T) {
+	probe := newProbedBouncer(t, freeAddress(t))
+
+	start := time.Now()
+
+	err := waitLAPIReachable(context.Background(), probe, 1500*time.Millisecond, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "the LAPI is not reachable after 1.5s") {
+		t.Fatalf("waited with %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("gave up after %s", elapsed)
+	}
+}
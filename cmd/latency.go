@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how many of the last batches the summary is computed on
+	latencySamplesSize = 1024
+	// how often the summary is logged, if decisions have been applied meanwhile
+	latencyReportInterval = 10 * time.Minute
+)
+
+// latencySamples keeps the time taken to apply the last batches of decisions, for
+// the summary of the logs. The histogram of the metrics holds all of them.
+type latencySamples struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	// batches recorded since the last summary
+	recorded int
+}
+
+var applyLatency = &latencySamples{samples: make([]time.Duration, 0, latencySamplesSize)}
+
+func (l *latencySamples) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencySamplesSize {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+		l.next = (l.next + 1) % latencySamplesSize
+	}
+
+	l.recorded++
+}
+
+// quantiles returns the median and the 99th percentile of the samples, their number, and
+// the number of batches recorded since the previous call.
+func (l *latencySamples) quantiles() (p50 time.Duration, p99 time.Duration, samples int, recorded int) {
+	l.mu.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	recorded = l.recorded
+	l.recorded = 0
+	l.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, 0, 0, recorded
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[len(sorted)/2], sorted[len(sorted)*99/100], len(sorted), recorded
+}
+
+// reportLatency logs the summary of the time taken to apply the decisions every
+// latencyReportInterval, until the context is cancelled.
+func reportLatency(ctx context.Context) {
+	t := time.NewTicker(latencyReportInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p50, p99, samples, recorded := applyLatency.quantiles()
+			if recorded == 0 {
+				continue
+			}
+
+			log.Infof("%d batches of decisions applied in the last %s, the last %d took %s (p50) and %s (p99)",
+				recorded, latencyReportInterval, samples, p50, p99)
+		}
+	}
+}
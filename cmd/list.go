@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// listedBan is a ban printed by the list command. Scenario and TTL are empty when
+// read from the firewall, if it doesn't keep them.
+type listedBan struct {
+	Value    string `json:"value"`
+	Scope    string `json:"scope"`
+	Scenario string `json:"scenario,omitempty"`
+	TTL      string `json:"ttl,omitempty"`
+}
+
+// queryControl asks a running bouncer for the bans it applied.
+func queryControl(path string) ([]backend.Ban, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: "list"}); err != nil {
+		return nil, err
+	}
+
+	var resp controlResponse
+
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+
+	return resp.Bans, nil
+}
+
+func scopeOf(value string) string {
+	if strings.Contains(value, "/") {
+		return "range"
+	}
+
+	return "ip"
+}
+
+func formatTTL(ttl time.Duration) string {
+	if ttl <= 0 {
+		return ""
+	}
+
+	return ttl.Round(time.Second).String()
+}
+
+// activeBans returns the bans from the control socket of the running bouncer if
+// there is one, otherwise it reads the content of the firewall.
+func activeBans(b *backend.BackendCTX, config *cfg.BouncerConfig) ([]listedBan, error) {
+	ret := []listedBan{}
+
+	if config.ControlSocket != "" {
+		bans, err := queryControl(config.ControlSocket)
+		if err == nil {
+			for _, ban := range bans {
+				ret = append(ret, listedBan{
+					Value:    ban.Value,
+					Scope:    ban.Scope,
+					Scenario: ban.Scenario,
+					TTL:      formatTTL(time.Until(ban.Until)),
+				})
+			}
+
+			return ret, nil
+		}
+
+		log.Warningf("unable to query the control socket, reading the firewall: %s", err)
+	}
+
+	entries, err := b.List()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the bans: %w", err)
+	}
+
+	for _, e := range entries {
+		ret = append(ret, listedBan{
+			Value: e.Value,
+			Scope: scopeOf(e.Value),
+			TTL:   formatTTL(e.TTL),
+		})
+	}
+
+	return ret, nil
+}
+
+func printBans(w io.Writer, bans []listedBan, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(bans)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VALUE\tSCOPE\tSCENARIO\tTTL")
+
+	for _, ban := range bans {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ban.Value, ban.Scope, ban.Scenario, ban.TTL)
+	}
+
+	return tw.Flush()
+}
+
+// listBans implements the list command, it only reads the firewall.
+func listBans(b *backend.BackendCTX, config *cfg.BouncerConfig, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	format := flags.String("o", "table", "output format: table or json")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown output format '%s'", *format)
+	}
+
+	bans, err := activeBans(b, config)
+	if err != nil {
+		return err
+	}
+
+	return printBans(os.Stdout, bans, *format)
+}
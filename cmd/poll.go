@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+	"github.com/asians-cloud/firewall-bouncer/pkg/jitter"
+)
+
+// a decision pulled again is only applied again if it bans for longer than this,
+// since its remaining duration changes slightly between two pulls
+const pollDeadlineTolerance = time.Minute
+
+type polledDecision struct {
+	decision *models.Decision
+	deadline time.Time
+}
+
+// poller pulls all the active decisions of the LAPI, or of its database, periodically,
+// and sends the difference with the previous pull as a stream response.
+type poller struct {
+	pull     decisionSource
+	health   *healthStatus
+	interval time.Duration
+	// the decisions sent so far, by scope and value
+	applied map[string]polledDecision
+	// whether a pull has succeeded, the first one is sent even if empty
+	pulled bool
+	stream chan *models.DecisionsStreamResponse
+}
+
+func newPoller(pull decisionSource, interval time.Duration, health *healthStatus) *poller {
+	return &poller{
+		pull:     pull,
+		health:   health,
+		interval: interval,
+		applied:  make(map[string]polledDecision),
+		stream:   make(chan *models.DecisionsStreamResponse),
+	}
+}
+
+func decisionKey(decision *models.Decision) string {
+	return backend.DecisionScope(decision) + ":" + *decision.Value
+}
+
+// diff returns the decisions that are new or ban for longer since the previous pull,
+// and the ones that are gone, and records the pulled decisions.
+func (p *poller) diff(decisions []*models.Decision, now time.Time) *models.DecisionsStreamResponse {
+	ret := &models.DecisionsStreamResponse{
+		New:     []*models.Decision{},
+		Deleted: []*models.Decision{},
+	}
+
+	pulled := make(map[string]polledDecision, len(decisions))
+
+	// the LAPI may have several decisions for a value, the longest one wins
+	for _, d := range decisions {
+		entry := polledDecision{decision: d, deadline: decisionDeadline(d, now)}
+
+		key := decisionKey(d)
+		if current, ok := pulled[key]; !ok || entry.deadline.After(current.deadline) {
+			pulled[key] = entry
+		}
+	}
+
+	for key, entry := range pulled {
+		previous, ok := p.applied[key]
+		if ok && !entry.deadline.After(previous.deadline.Add(pollDeadlineTolerance)) {
+			pulled[key] = previous
+			continue
+		}
+
+		ret.New = append(ret.New, entry.decision)
+	}
+
+	for key, entry := range p.applied {
+		if _, ok := pulled[key]; !ok {
+			ret.Deleted = append(ret.Deleted, entry.decision)
+		}
+	}
+
+	p.applied = pulled
+
+	return ret
+}
+
+// decisionDeadline returns when a decision expires, now if its duration is missing or invalid.
+func decisionDeadline(decision *models.Decision, now time.Time) time.Time {
+	if decision.Duration == nil {
+		return now
+	}
+
+	duration, err := time.ParseDuration(*decision.Duration)
+	if err != nil {
+		return now
+	}
+
+	return now.Add(duration)
+}
+
+func (p *poller) poll(ctx context.Context) {
+	decisions, err := p.pull(ctx)
+
+	p.health.setStreamRunning(err == nil)
+	p.health.setAuthError(err)
+
+	if err != nil {
+		log.Errorf("%s, retrying in %s", err, p.interval)
+		return
+	}
+
+	changes := p.diff(decisions, time.Now())
+	if len(changes.New) == 0 && len(changes.Deleted) == 0 && p.pulled {
+		return
+	}
+
+	p.pulled = true
+
+	select {
+	case <-ctx.Done():
+	case p.stream <- changes:
+	}
+}
+
+// Run pulls the decisions right away, then every interval until the context is cancelled.
+// The LAPI or its database being unreachable is not fatal, the next pull catches up.
+func (p *poller) Run(ctx context.Context) {
+	ticker := jitter.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+func newPolledDecision(value string, duration string) *models.Decision {
+	scope := "Ip"
+
+	return &models.Decision{Value: &value, Scope: &scope, Duration: &duration}
+}
+
+func polledValues(decisions []*models.Decision) string {
+	ret := []string{}
+	for _, d := range decisions {
+		ret = append(ret, *d.Value+" "+*d.Duration)
+	}
+
+	sort.Strings(ret)
+
+	return strings.Join(ret, ",")
+}
+
+func TestPollDiff(t *testing.T) {
+	p := newPoller(nil, time.Minute, newHealthStatus("dry-run", true))
+	now := time.Now()
+
+	changes := p.diff([]*models.Decision{
+		newPolledDecision("192.0.2.1", "4h"),
+		newPolledDecision("192.0.2.2", "4h"),
+		// the longest decision of a value wins
+		newPolledDecision("192.0.2.3", "1h"),
+		newPolledDecision("192.0.2.3", "2h"),
+	}, now)
+
+	if got := polledValues(changes.New); got != "192.0.2.1 4h,192.0.2.2 4h,192.0.2.3 2h" || len(changes.Deleted) != 0 {
+		t.Fatalf("first pull: new %s, deleted %s", got, polledValues(changes.Deleted))
+	}
+
+	// an hour later: 192.0.2.1 is unchanged, 192.0.2.2 is extended, 192.0.2.3 is gone
+	later := now.Add(time.Hour)
+
+	changes = p.diff([]*models.Decision{
+		newPolledDecision("192.0.2.1", "3h"),
+		newPolledDecision("192.0.2.2", "24h"),
+		newPolledDecision("192.0.2.4", "1h"),
+	}, later)
+
+	if got := polledValues(changes.New); got != "192.0.2.2 24h,192.0.2.4 1h" {
+		t.Fatalf("second pull: new %s", got)
+	}
+
+	if got := polledValues(changes.Deleted); got != "192.0.2.3 2h" {
+		t.Fatalf("second pull: deleted %s", got)
+	}
+
+	// nothing changed
+	changes = p.diff([]*models.Decision{
+		newPolledDecision("192.0.2.1", "3h"),
+		newPolledDecision("192.0.2.2", "24h"),
+		newPolledDecision("192.0.2.4", "1h"),
+	}, later.Add(time.Second))
+
+	if len(changes.New) != 0 || len(changes.Deleted) != 0 {
+		t.Fatalf("third pull: new %s, deleted %s", polledValues(changes.New), polledValues(changes.Deleted))
+	}
+}
+
+func TestPollSendsFirstEmptyPull(t *testing.T) {
+	pulls := 0
+
+	p := newPoller(func(ctx context.Context) ([]*models.Decision, error) {
+		pulls++
+		if pulls == 1 {
+			return nil, errors.New("LAPI unreachable")
+		}
+
+		return nil, nil
+	}, time.Minute, newHealthStatus("dry-run", true))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a failed pull sends nothing
+	p.poll(ctx)
+
+	go p.poll(ctx)
+
+	select {
+	case changes := <-p.stream:
+		if len(changes.New) != 0 || len(changes.Deleted) != 0 {
+			t.Fatalf("new %s, deleted %s", polledValues(changes.New), polledValues(changes.Deleted))
+		}
+	case <-ctx.Done():
+		t.Fatal("the first successful pull was not sent")
+	}
+}
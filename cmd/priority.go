@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"path"
+	"sort"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// decisionPriorities orders the decisions by the priority of their scenario, so that the
+// critical bans of a large batch (ie. the replay of a reconnection) are applied first.
+type decisionPriorities []cfg.DecisionPriority
+
+// of returns the priority given by the first pattern matching the scenario of a decision,
+// 0 if none matches. The patterns are validated by the config loader.
+func (p decisionPriorities) of(decision *models.Decision) int {
+	if decision == nil {
+		return 0
+	}
+
+	scenario := ""
+	if decision.Scenario != nil {
+		scenario = *decision.Scenario
+	}
+
+	for _, priority := range p {
+		if ok, _ := path.Match(priority.Scenario, scenario); ok {
+			return priority.Priority
+		}
+	}
+
+	return 0
+}
+
+// groups splits the decisions by priority, the highest first, keeping their order within
+// a priority. Without priorities, all the decisions are in a single group.
+func (p decisionPriorities) groups(decisions []*models.Decision) [][]*models.Decision {
+	if len(p) == 0 {
+		return [][]*models.Decision{decisions}
+	}
+
+	byPriority := make(map[int][]*models.Decision)
+	for _, d := range decisions {
+		priority := p.of(d)
+		byPriority[priority] = append(byPriority[priority], d)
+	}
+
+	levels := maps.Keys(byPriority)
+	sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+
+	ret := make([][]*models.Decision, 0, len(levels))
+	for _, level := range levels {
+		ret = append(ret, byPriority[level])
+	}
+
+	return ret
+}
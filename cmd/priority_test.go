@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+func newScenarioDecision(value string, scenario string) *models.Decision {
+	d := newPolledDecision(value, "4h")
+	d.Scenario = &scenario
+
+	return d
+}
+
+var testPriorities = decisionPriorities{
+	{Scenario: "crowdsecurity/ssh-*", Priority: 10},
+	{Scenario: "crowdsecurity/ssh-slow-bf", Priority: 1},
+	{Scenario: "crowdsecurity/http-*", Priority: 5},
+}
+
+func mixedBatch() []*models.Decision {
+	return []*models.Decision{
+		newScenarioDecision("192.0.2.1", "crowdsecurity/port-scan"),
+		newScenarioDecision("192.0.2.2", "crowdsecurity/http-probing"),
+		newScenarioDecision("192.0.2.3", "crowdsecurity/ssh-bf"),
+		newScenarioDecision("192.0.2.4", "crowdsecurity/port-scan"),
+		// the first matching pattern wins
+		newScenarioDecision("192.0.2.5", "crowdsecurity/ssh-slow-bf"),
+		newScenarioDecision("192.0.2.6", "crowdsecurity/http-bad-user-agent"),
+		newScenarioDecision("192.0.2.7", "crowdsecurity/ssh-bf"),
+	}
+}
+
+func decisionValues(decisions []*models.Decision) string {
+	ret := []string{}
+	for _, d := range decisions {
+		ret = append(ret, *d.Value)
+	}
+
+	return strings.Join(ret, ",")
+}
+
+func TestPriorityGroups(t *testing.T) {
+	got := []string{}
+	for _, group := range testPriorities.groups(mixedBatch()) {
+		got = append(got, decisionValues(group))
+	}
+
+	// by priority, in their order of arrival within a priority
+	want := []string{"192.0.2.3,192.0.2.5,192.0.2.7", "192.0.2.2,192.0.2.6", "192.0.2.1,192.0.2.4"}
+
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("groups %v, want %v", got, want)
+	}
+}
+
+func TestPriorityGroupsDisabled(t *testing.T) {
+	groups := decisionPriorities(nil).groups(mixedBatch())
+
+	if len(groups) != 1 || decisionValues(groups[0]) != decisionValues(mixedBatch()) {
+		t.Fatalf("without priorities, the decisions are reordered: %v", groups)
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	q := newDecisionQueue(cfg.RateLimitConfig{DecisionsPerSecond: 3, QueueSize: 100, HighWaterMark: 80}, testPriorities, "dry-run")
+
+	q.push(mixedBatch(), false)
+
+	got := []string{}
+	for len(q.queue) > 0 {
+		now := q.last
+		batch := []*models.Decision{}
+		for _, queued := range q.take(now.Add(rateLimitTick * 10)) {
+			batch = append(batch, queued.decision)
+		}
+
+		got = append(got, decisionValues(batch))
+	}
+
+	// the critical bans received later are applied before the routine ones already queued
+	want := []string{"192.0.2.3,192.0.2.5,192.0.2.7", "192.0.2.2,192.0.2.6,192.0.2.1", "192.0.2.4"}
+
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("batches %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"container/heap"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+	"github.com/asians-cloud/firewall-bouncer/pkg/notifier"
+)
+
+// how often the queued decisions are applied, by batches of the tokens gained meanwhile
+const rateLimitTick = 100 * time.Millisecond
+
+type queuedDecision struct {
+	decision *models.Decision
+	deleted  bool
+	priority int
+	// order of arrival, among the decisions of the same priority
+	seq uint64
+	// scope:value, the decisions of the same value pop in their order of arrival
+	key string
+}
+
+// decisionHeap pops the queued decisions by priority, then in their order of arrival.
+type decisionHeap []queuedDecision
+
+func (h decisionHeap) Len() int { return len(h) }
+
+func (h decisionHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h decisionHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *decisionHeap) Push(x any) { *h = append(*h, x.(queuedDecision)) }
+
+func (h *decisionHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return last
+}
+
+// decisionQueue applies the decisions at a bounded rate, with a token bucket holding up
+// to a second of decisions. The ones beyond the rate wait by priority (decision_priorities)
+// and in their order of arrival, the ones that don't fit in the queue are dropped.
+type decisionQueue struct {
+	rate       float64
+	tokens     float64
+	last       time.Time
+	size       int
+	queue      decisionHeap
+	priorities decisionPriorities
+	seq        uint64
+	// the number of queued decisions of each scope:value
+	queued map[string]int
+	// the label of the metrics
+	backend string
+	// the depth above which a warning is logged, once until the queue drains below it
+	highWater      int
+	aboveHighWater bool
+}
+
+func newDecisionQueue(config cfg.RateLimitConfig, priorities decisionPriorities, backend string) *decisionQueue {
+	metrics.DecisionQueueCapacity.WithLabelValues(backend).Set(float64(config.QueueSize))
+
+	highWater := config.QueueSize * config.HighWaterMark / 100
+	if highWater < 1 {
+		highWater = 1
+	}
+
+	return &decisionQueue{
+		rate:       float64(config.DecisionsPerSecond),
+		tokens:     float64(config.DecisionsPerSecond),
+		last:       time.Now(),
+		size:       config.QueueSize,
+		priorities: priorities,
+		queued:     make(map[string]int),
+		backend:    backend,
+		highWater:  highWater,
+	}
+}
+
+// depthChanged reports the depth of the queue, and warns when it crosses the high-water mark.
+func (q *decisionQueue) depthChanged() {
+	depth := len(q.queue)
+
+	metrics.DecisionQueueDepth.WithLabelValues(q.backend).Set(float64(depth))
+
+	switch {
+	case depth >= q.highWater && !q.aboveHighWater:
+		q.aboveHighWater = true
+		log.Warningf("the rate limit queue holds %d decisions out of %d, raise rate_limit.decisions_per_second "+
+			"or rate_limit.queue_size before the new ones are dropped", depth, q.size)
+	case depth < q.highWater && q.aboveHighWater:
+		q.aboveHighWater = false
+		log.Infof("the rate limit queue is back below %d decisions", q.highWater)
+	}
+}
+
+// push queues decisions, they are removed from the firewall if deleted is true.
+func (q *decisionQueue) push(decisions []*models.Decision, deleted bool) {
+	dropped := 0
+
+	for _, d := range decisions {
+		if len(q.queue) >= q.size {
+			dropped++
+			continue
+		}
+
+		key := decisionKey(d)
+		priority := q.priorities.of(d)
+
+		// a ban replacing a queued unban of the same value must not be applied before it
+		if q.queued[key] > 0 {
+			q.raise(key, priority)
+		}
+
+		heap.Push(&q.queue, queuedDecision{decision: d, deleted: deleted, priority: priority, seq: q.seq, key: key})
+		q.queued[key]++
+		q.seq++
+	}
+
+	if dropped > 0 {
+		log.Warningf("the rate limit queue is full, %d decisions dropped", dropped)
+		metrics.TotalDroppedDecisions.WithLabelValues(q.backend).Add(float64(dropped))
+	}
+
+	q.depthChanged()
+}
+
+// raise gives at least priority to the queued decisions of key, so that they still pop before
+// a newer decision of the same value.
+func (q *decisionQueue) raise(key string, priority int) {
+	raised := false
+
+	for i := range q.queue {
+		if q.queue[i].key == key && q.queue[i].priority < priority {
+			q.queue[i].priority = priority
+			raised = true
+		}
+	}
+
+	if raised {
+		heap.Init(&q.queue)
+	}
+}
+
+// take returns the queued decisions the tokens gained since the last call allow to apply.
+func (q *decisionQueue) take(now time.Time) []queuedDecision {
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	if q.tokens > q.rate {
+		q.tokens = q.rate
+	}
+
+	q.last = now
+
+	n := int(q.tokens)
+	if n > len(q.queue) {
+		n = len(q.queue)
+	}
+
+	q.tokens -= float64(n)
+
+	ret := make([]queuedDecision, 0, n)
+	for i := 0; i < n; i++ {
+		queued := heap.Pop(&q.queue).(queuedDecision)
+
+		q.queued[queued.key]--
+		if q.queued[queued.key] == 0 {
+			delete(q.queued, queued.key)
+		}
+
+		ret = append(ret, queued)
+	}
+
+	q.depthChanged()
+
+	return ret
+}
+
+// apply adds and deletes the decisions allowed by the rate limit, by priority and in their order of arrival.
+func (q *decisionQueue) apply(b *backend.BackendCTX, config *cfg.BouncerConfig, n *notifier.Notifier) {
+	batch := q.take(time.Now())
+
+	for len(batch) > 0 {
+		// the longest run of additions or deletions, applied and committed at once
+		end := 1
+		for end < len(batch) && batch[end].deleted == batch[0].deleted {
+			end++
+		}
+
+		decisions := make([]*models.Decision, 0, end)
+		for _, queued := range batch[:end] {
+			decisions = append(decisions, queued.decision)
+		}
+
+		if batch[0].deleted {
+			deleteDecisions(b, decisions, config)
+		} else {
+			addDecisions(b, decisions, config, n)
+		}
+
+		batch = batch[end:]
+	}
+}
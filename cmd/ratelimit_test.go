@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+func newQueuedDecisions(n int) []*models.Decision {
+	ret := make([]*models.Decision, 0, n)
+	for i := 0; i < n; i++ {
+		ret = append(ret, newPolledDecision(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "4h"))
+	}
+
+	return ret
+}
+
+func TestRateLimit(t *testing.T) {
+	q := newDecisionQueue(cfg.RateLimitConfig{DecisionsPerSecond: 100, QueueSize: 10000, HighWaterMark: 80}, nil, "dry-run")
+	q.push(newQueuedDecisions(5000), false)
+
+	// a second of decisions right away, then the rate over 10 seconds
+	now := q.last
+	taken := len(q.take(now))
+
+	if taken != 100 {
+		t.Fatalf("%d decisions applied at once, want the 100 of the bucket", taken)
+	}
+
+	for i := 0; i < 100; i++ {
+		now = now.Add(rateLimitTick)
+		taken += len(q.take(now))
+	}
+
+	if taken < 1095 || taken > 1100 {
+		t.Fatalf("%d decisions applied in 10s at 100/s with a burst of 100", taken)
+	}
+
+	if len(q.queue) != 5000-taken {
+		t.Fatalf("%d decisions left in the queue", len(q.queue))
+	}
+}
+
+func TestRateLimitBucket(t *testing.T) {
+	q := newDecisionQueue(cfg.RateLimitConfig{DecisionsPerSecond: 10, QueueSize: 1000, HighWaterMark: 80}, nil, "dry-run")
+	now := q.last
+
+	// the tokens unused while the queue is empty are capped to a second of decisions
+	q.take(now.Add(time.Minute))
+	q.push(newQueuedDecisions(100), false)
+
+	if taken := len(q.take(now.Add(time.Minute))); taken != 10 {
+		t.Fatalf("%d decisions applied after an idle minute, want 10", taken)
+	}
+}
+
+func TestRateLimitQueueFull(t *testing.T) {
+	q := newDecisionQueue(cfg.RateLimitConfig{DecisionsPerSecond: 10, QueueSize: 50, HighWaterMark: 80}, nil, "dry-run")
+
+	q.push(newQueuedDecisions(30), true)
+	q.push(newQueuedDecisions(30), false)
+
+	if len(q.queue) != 50 {
+		t.Fatalf("the queue holds %d decisions, want 50", len(q.queue))
+	}
+
+	if !q.aboveHighWater {
+		t.Fatal("the queue is above its high-water mark without a warning")
+	}
+
+	// in their order of arrival, the dropped decisions are the last ones
+	batch := q.take(q.last)
+	if len(batch) != 10 || !batch[0].deleted || *batch[0].decision.Value != "10.0.0.0" || *batch[9].decision.Value != "10.0.0.9" {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+}
+
+func TestRateLimitMetrics(t *testing.T) {
+	// a label of its own, the metrics are shared by the tests
+	dropped := metrics.TotalDroppedDecisions.WithLabelValues("metrics-test")
+	before := testutil.ToFloat64(dropped)
+
+	q := newDecisionQueue(cfg.RateLimitConfig{DecisionsPerSecond: 10, QueueSize: 20, HighWaterMark: 80}, nil, "metrics-test")
+
+	if got := testutil.ToFloat64(metrics.DecisionQueueCapacity.WithLabelValues("metrics-test")); got != 20 {
+		t.Fatalf("queue capacity %v, want 20", got)
+	}
+
+	q.push(newQueuedDecisions(15), false)
+
+	if got := testutil.ToFloat64(dropped) - before; got != 0 {
+		t.Fatalf("%v decisions dropped before the queue is full", got)
+	}
+
+	// 5 fit, 10 don't
+	q.push(newQueuedDecisions(15), true)
+
+	if got := testutil.ToFloat64(dropped) - before; got != 10 {
+		t.Fatalf("%v decisions dropped, want 10", got)
+	}
+
+	if got := testutil.ToFloat64(metrics.DecisionQueueDepth.WithLabelValues("metrics-test")); got != 20 {
+		t.Fatalf("queue depth %v, want 20", got)
+	}
+
+	q.take(q.last)
+
+	if got := testutil.ToFloat64(metrics.DecisionQueueDepth.WithLabelValues("metrics-test")); got != 10 {
+		t.Fatalf("queue depth %v after applying 10 decisions, want 10", got)
+	}
+
+	// back below the high-water mark of 16
+	if q.aboveHighWater {
+		t.Fatal("the queue is still above its high-water mark")
+	}
+}
+
+func TestRateLimitReplacedBan(t *testing.T) {
+	config, err := cfg.NewConfig(strings.NewReader("mode: dry-run\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := backend.NewBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	typed := func(d *models.Decision) *models.Decision {
+		d.Type = &config.SupportedDecisionsTypes[0]
+		return d
+	}
+
+	q := newDecisionQueue(cfg.RateLimitConfig{DecisionsPerSecond: 100, QueueSize: 100, HighWaterMark: 80}, testPriorities, "dry-run")
+
+	q.push([]*models.Decision{typed(newScenarioDecision("192.0.2.1", "crowdsecurity/port-scan"))}, false)
+	q.apply(b, config, nil)
+
+	// the stream replaces the ban by one of a higher priority, the deletion comes first
+	q.push([]*models.Decision{typed(newScenarioDecision("192.0.2.1", "crowdsecurity/port-scan"))}, true)
+	q.push([]*models.Decision{typed(newScenarioDecision("192.0.2.1", "crowdsecurity/ssh-bf"))}, false)
+	q.apply(b, config, nil)
+
+	banned, err := b.IsBanned("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !banned {
+		t.Fatal("the new ban was removed by the deletion of the one it replaces")
+	}
+
+	if len(q.queued) != 0 {
+		t.Fatalf("decisions left counted as queued: %v", q.queued)
+	}
+}
+
+func TestRateLimitReplacedBanOrder(t *testing.T) {
+	q := newDecisionQueue(cfg.RateLimitConfig{DecisionsPerSecond: 100, QueueSize: 100, HighWaterMark: 80}, testPriorities, "dry-run")
+
+	q.push([]*models.Decision{
+		newScenarioDecision("192.0.2.1", "crowdsecurity/port-scan"),
+		newScenarioDecision("192.0.2.2", "crowdsecurity/port-scan"),
+		newScenarioDecision("192.0.2.3", "crowdsecurity/http-probing"),
+	}, true)
+	q.push([]*models.Decision{newScenarioDecision("192.0.2.1", "crowdsecurity/ssh-bf")}, false)
+
+	got := []string{}
+	for _, queued := range q.take(q.last) {
+		got = append(got, fmt.Sprintf("%s:%t", *queued.decision.Value, queued.deleted))
+	}
+
+	// the deletion of 192.0.2.1 goes with the ban replacing it, the others keep their priority
+	if want := "192.0.2.1:true,192.0.2.1:false,192.0.2.3:true,192.0.2.2:true"; strings.Join(got, ",") != want {
+		t.Fatalf("applied %s, want %s", strings.Join(got, ","), want)
+	}
+}
@@ -3,14 +3,17 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -20,57 +23,151 @@ import (
 
 	"github.com/asians-cloud/crowdsec/pkg/models"
 	csbouncer "github.com/asians-cloud/go-cs-bouncer"
-	"github.com/crowdsecurity/go-cs-lib/pkg/csdaemon"
+	"github.com/crowdsecurity/go-cs-lib/pkg/ptr"
 	"github.com/crowdsecurity/go-cs-lib/pkg/version"
 
 	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
 	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/database"
+	"github.com/asians-cloud/firewall-bouncer/pkg/jitter"
 	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+	"github.com/asians-cloud/firewall-bouncer/pkg/notifier"
+	"github.com/asians-cloud/firewall-bouncer/pkg/pusher"
 )
 
 const (
 	name = "crowdsec-firewall-bouncer"
 )
 
-func backendCleanup(backend *backend.BackendCTX) {
+func backendCleanup(backend *backend.BackendCTX, config *cfg.BouncerConfig) {
+	if !*config.FlushOnShutdown {
+		log.Info("Leaving the bans in place, they expire with their timeout")
+		return
+	}
+
 	log.Info("Shutting down backend")
 	if err := backend.ShutDown(); err != nil {
 		log.Errorf("while shutting down backend: %s", err)
+		return
 	}
+
+	log.Info("Backend shut down")
 }
 
-func HandleSignals(ctx context.Context) error {
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+// flushBackend empties the firewall tables without connecting to the LAPI. The backend is
+// created without flush_on_startup, so that the entries are counted by ShutDown instead of
+// being flushed by Init.
+func flushBackend(backend *backend.BackendCTX) error {
+	if err := backend.Init(); err != nil {
+		return err
+	}
 
-	select {
-	case s := <-signalChan:
-		switch s {
-		case syscall.SIGTERM:
-			return fmt.Errorf("received SIGTERM")
-		case syscall.SIGINT:
-			return fmt.Errorf("received SIGINT")
-		}
-	case <-ctx.Done():
-		return ctx.Err()
+	log.Info("Flushing backend")
+	if err := backend.ShutDown(); err != nil {
+		return fmt.Errorf("while flushing backend: %w", err)
 	}
+
 	return nil
 }
 
-func deleteDecisions(backend *backend.BackendCTX, decisions []*models.Decision, config *cfg.BouncerConfig) {
+// reloadConfig applies the logging options of the configuration file, and warns
+// about the changes that require a restart. The caller applies the others, such as
+// the allowlist. It returns the new configuration, nil if it's invalid.
+func reloadConfig(configPath string, current *cfg.BouncerConfig, verbose bool) *cfg.BouncerConfig {
+	log.Info("Reloading configuration")
+
+	configBytes, err := cfg.MergedConfig(configPath)
+	if err != nil {
+		log.Errorf("unable to read config file, keeping the current configuration: %s", err)
+		return nil
+	}
+
+	config, err := cfg.NewConfig(bytes.NewReader(configBytes))
+	if err != nil {
+		log.Errorf("unable to load configuration, keeping the current one: %s", err)
+		return nil
+	}
+
+	if verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	for _, option := range current.RestartRequired(config) {
+		log.Warningf("option '%s' has changed, restart the bouncer to apply it", option)
+	}
+
+	log.Infof("Configuration reloaded, log level is %s", log.GetLevel())
+
+	return config
+}
+
+// HandleSignals reloads the config on SIGHUP, and returns on SIGTERM or SIGINT. The
+// bouncer then has drainTimeout to stop.
+func HandleSignals(ctx context.Context, drainTimeout time.Duration, reload func()) error {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case s := <-signalChan:
+			switch s {
+			case syscall.SIGTERM:
+				return stopping("SIGTERM", signalChan, drainTimeout)
+			case syscall.SIGINT:
+				return stopping("SIGINT", signalChan, drainTimeout)
+			case syscall.SIGHUP:
+				reload()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// decisionLogger returns a logger with the details of a decision as fields.
+func decisionLogger(d *models.Decision, config *cfg.BouncerConfig) *log.Entry {
+	fields := log.Fields{
+		"ip":      *d.Value,
+		"backend": config.Mode,
+	}
+
+	if d.Duration != nil {
+		fields["duration"] = *d.Duration
+	}
+
+	if d.Scenario != nil {
+		fields["scenario"] = *d.Scenario
+	}
+
+	return log.WithFields(fields)
+}
+
+func deleteDecisions(b *backend.BackendCTX, decisions []*models.Decision, config *cfg.BouncerConfig) {
 	nbDeletedDecisions := 0
 	for _, d := range decisions {
+		if d == nil || d.Value == nil || d.Type == nil {
+			log.Errorf("ignoring malformed decision: %+v", d)
+			metrics.TotalDecisionParseErrors.Inc()
+			continue
+		}
 		if !slices.Contains(config.SupportedDecisionsTypes, strings.ToLower(*d.Type)) {
 			log.Debugf("decisions for ip '%s' will not be deleted because its type is '%s'", *d.Value, *d.Type)
 			continue
 		}
-		if err := backend.Delete(d); err != nil {
+		if err := b.Delete(d); err != nil {
+			if errors.Is(err, backend.ErrSkipped) {
+				log.Debug(err)
+				continue
+			}
 			if !strings.Contains(err.Error(), "netlink receive: no such file or directory") {
 				log.Errorf("unable to delete decision for '%s': %s", *d.Value, err)
 			}
 			continue
 		}
-		log.Debugf("deleted %s", *d.Value)
+		decisionLogger(d, config).Debug("deleted decision")
+		metrics.TotalProcessedDecisions.WithLabelValues("delete").Inc()
+		origin, scenario := backend.SourceLabels(d)
+		metrics.ProcessedDecisionsBySource.WithLabelValues("delete", origin, scenario).Inc()
 		nbDeletedDecisions++
 	}
 
@@ -80,7 +177,7 @@ func deleteDecisions(backend *backend.BackendCTX, decisions []*models.Decision,
 	}
 	if nbDeletedDecisions > 0 {
 		log.Debug("committing expired decisions")
-		if err := backend.Commit(); err != nil {
+		if err := b.Commit(); err != nil {
 			log.Errorf("unable to commit expired decisions %v", err)
 			return
 		}
@@ -89,19 +186,36 @@ func deleteDecisions(backend *backend.BackendCTX, decisions []*models.Decision,
 	}
 }
 
-func addDecisions(backend *backend.BackendCTX, decisions []*models.Decision, config *cfg.BouncerConfig) {
+func addDecisions(b *backend.BackendCTX, decisions []*models.Decision, config *cfg.BouncerConfig, n *notifier.Notifier) {
+	start := time.Now()
+	reasons := newBanReasonLogger(config)
 	nbNewDecisions := 0
+	// notified once they are committed
+	added := make([]*models.Decision, 0, len(decisions))
 	for _, d := range decisions {
+		if d == nil || d.Value == nil || d.Type == nil {
+			log.Errorf("ignoring malformed decision: %+v", d)
+			metrics.TotalDecisionParseErrors.Inc()
+			continue
+		}
 		if !slices.Contains(config.SupportedDecisionsTypes, strings.ToLower(*d.Type)) {
 			log.Debugf("decisions for ip '%s' will not be added because its type is '%s'", *d.Value, *d.Type)
 			continue
 		}
-		if err := backend.Add(d); err != nil {
+		if err := b.Add(d); err != nil {
+			if errors.Is(err, backend.ErrSkipped) {
+				log.Debug(err)
+				continue
+			}
 			log.Errorf("unable to insert decision for '%s': %s", *d.Value, err)
 			continue
 		}
 
-		log.Debugf("Adding '%s' for '%s'", *d.Value, *d.Duration)
+		decisionLogger(d, config).Debug("added decision")
+		metrics.TotalProcessedDecisions.WithLabelValues("add").Inc()
+		origin, scenario := backend.SourceLabels(d)
+		metrics.ProcessedDecisionsBySource.WithLabelValues("add", origin, scenario).Inc()
+		added = append(added, d)
 		nbNewDecisions++
 	}
 
@@ -111,11 +225,23 @@ func addDecisions(backend *backend.BackendCTX, decisions []*models.Decision, con
 	}
 	if nbNewDecisions > 0 {
 		log.Debug("committing added decisions")
-		if err := backend.Commit(); err != nil {
+		if err := b.Commit(); err != nil {
 			log.Errorf("unable to commit add decisions %v", err)
 			return
 		}
 		log.Debug("committed added decisions")
+
+		for _, d := range added {
+			n.Banned(d)
+			reasons.banned(d)
+		}
+
+		elapsed := time.Since(start)
+		applyLatency.record(elapsed)
+		for i := 0; i < nbNewDecisions; i++ {
+			metrics.DecisionApplyDuration.Observe(elapsed.Seconds())
+		}
+
 		log.Infof("%d %s added", nbNewDecisions, noun)
 	}
 }
@@ -125,13 +251,16 @@ func Execute() error {
 	configPath := flag.String("c", "", "path to crowdsec-firewall-bouncer.yaml")
 	verbose := flag.Bool("v", false, "set verbose mode")
 	bouncerVersion := flag.Bool("V", false, "display version and exit")
-	testConfig := flag.Bool("t", false, "test config and exit")
+	showVersion := flag.Bool("version", false, "display version and build info and exit")
+	testConfig := flag.Bool("t", false, "test config and exit, without changing the firewall")
 	showConfig := flag.Bool("T", false, "show full config (.yaml + .yaml.local) and exit")
+	dryRun := flag.Bool("dry-run", false, "log the firewall changes instead of applying them")
+	flush := flag.Bool("flush", false, "remove all the bans from the firewall and exit")
 
 	flag.Parse()
 
-	if *bouncerVersion {
-		fmt.Print(version.FullString())
+	if *bouncerVersion || *showVersion || flag.Arg(0) == "version" {
+		printVersion(os.Stdout)
 		return nil
 	}
 
@@ -158,75 +287,417 @@ func Execute() error {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	if *dryRun {
+		config.DryRun = true
+	}
+
+	if config.DryRun {
+		log.Warning("dry-run enabled, the firewall will not be modified")
+	}
+
+	if config.AuditMode {
+		log.Warning("audit mode enabled, the banned traffic is counted but not denied")
+	}
+
 	log.Infof("Starting crowdsec-firewall-bouncer %s", version.String())
 
+	// before the backends start their periodic tasks
+	jitter.Percent = config.IntervalJitter
+
+	// Init leaves the tables alone, ShutDown reports how many entries each one held
+	if *flush {
+		config.FlushOnStartup = ptr.Of(false)
+	}
+
 	backend, err := backend.NewBackend(config)
 	if err != nil {
 		return err
 	}
 
-	if err = backend.Init(); err != nil {
-		return err
+	if flag.Arg(0) == "list" {
+		return listBans(backend, config, flag.Args()[1:])
 	}
 
-	defer backendCleanup(backend)
+	if *flush {
+		return flushBackend(backend)
+	}
 
 	bouncer := &csbouncer.StreamBouncer{}
-	err = bouncer.ConfigReader(bytes.NewReader(configBytes))
+	err = bouncer.ConfigReader(bytes.NewReader(cfg.ExpandEnv(configBytes)))
 	if err != nil {
 		return err
 	}
 
-	bouncer.UserAgent = fmt.Sprintf("%s/%s", name, version.String())
-	if err := bouncer.Init(); err != nil {
-		return fmt.Errorf("unable to configure bouncer: %w", err)
+	envOverrides(bouncer)
+
+	if config.APIUnixSocket != "" && bouncer.APIUrl == "" {
+		bouncer.APIUrl = unixSocketURL
+	}
+
+	useDatabase := config.LAPIMode == cfg.LAPIModeDatabase
+	// without a LAPI, only the blocklist files are applied
+	useLAPI := !useDatabase && (bouncer.APIUrl != "" || len(config.BlocklistFiles) == 0)
+
+	// nil when there is neither a LAPI nor a database
+	var pull decisionSource
+
+	switch {
+	case useDatabase:
+		db, err := database.Open(context.Background(), config.Database)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		pull = databaseDecisions(db, config)
+
+		log.Infof("reading the decisions from the %s database of the LAPI", config.Database.Type)
+	case useLAPI:
+		bouncer.UserAgent = fmt.Sprintf("%s/%s", name, version.String())
+		if err := checkLAPIAuth(bouncer); err != nil {
+			return err
+		}
+
+		if err := bouncer.Init(); err != nil {
+			return fmt.Errorf("unable to configure bouncer: %w", err)
+		}
+
+		if bouncer.APIUrl == "" {
+			return fmt.Errorf("config does not contain 'api_url'")
+		}
+
+		if config.APIUnixSocket != "" {
+			if err := checkUnixSocket(config.APIUnixSocket); err != nil {
+				return err
+			}
+
+			if err := useUnixSocket(bouncer, config.APIUnixSocket); err != nil {
+				return err
+			}
+
+			log.Infof("connecting to the LAPI through %s", config.APIUnixSocket)
+		}
+
+		log.Debugf("using LAPI %s with key %s", bouncer.APIUrl, maskKey(bouncer.APIKey))
+
+		pull = lapiDecisions(bouncer, config)
+	default:
+		log.Info("no api_url, only the blocklist files are applied")
 	}
 
+	// the firewall has not been touched yet
 	if *testConfig {
 		log.Info("config is valid")
 		return nil
 	}
 
+	if config.StartupDelay != "" {
+		// already validated by the config loader
+		delay, _ := time.ParseDuration(config.StartupDelay)
+		log.Infof("waiting %s before starting", delay)
+		time.Sleep(delay)
+	}
+
+	if config.WaitForLAPI != "" && useLAPI {
+		// already validated by the config loader
+		timeout, _ := time.ParseDuration(config.WaitForLAPI)
+		maxBackoff, _ := time.ParseDuration(config.LAPIMaxBackoff)
+
+		if err := waitLAPIReachable(context.Background(), lapiProbe(bouncer), timeout, maxBackoff); err != nil {
+			return err
+		}
+	}
+
+	if flag.Arg(0) == "sync" {
+		if pull == nil {
+			return fmt.Errorf("sync requires api_url or lapi_mode %s", cfg.LAPIModeDatabase)
+		}
+
+		return syncFirewall(context.Background(), backend, pull, config)
+	}
+
+	health := newHealthStatus(config.Mode, pull != nil)
+	systemd := newSystemdNotifier()
+
+	if err = backend.Init(); err != nil {
+		return err
+	}
+
+	health.setBackendReady(true)
+
+	if config.SelfTest {
+		backend.SelfTest()
+	}
+
+	// the bans kept by flush_on_startup: false are not added again
+	if config.ImportExistingBans || !*config.FlushOnStartup {
+		imported, err := backend.ImportExisting()
+		if err != nil {
+			return fmt.Errorf("unable to import the bans of the firewall: %w", err)
+		}
+
+		log.Infof("%d bans already in the firewall, they won't be added again", imported)
+	}
+
+	// if the LAPI can't be reached, the decision stream will catch up once it's available
+	if config.SyncOnStartup && pull != nil {
+		syncCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := syncFirewall(syncCtx, backend, pull, config); err != nil {
+			log.Warningf("unable to sync the firewall with the decisions: %s", err)
+		}
+		cancel()
+	}
+
+	defer backendCleanup(backend, config)
+
 	if bouncer.InsecureSkipVerify != nil {
 		log.Debugf("InsecureSkipVerify is set to %t", *bouncer.InsecureSkipVerify)
 	}
 
 	g, ctx := errgroup.WithContext(context.Background())
 
-	g.Go(func() error {
-		bouncer.RunStream(ctx)
-		return fmt.Errorf("stream api init failed")
-	})
+	// a nil channel never fires, without a LAPI nor its database
+	var stream <-chan *models.DecisionsStreamResponse
+
+	switch {
+	case useDatabase:
+		// already validated by the config loader
+		interval, _ := time.ParseDuration(config.UpdateFrequency)
+		p := newPoller(pull, interval, health)
+		stream = p.stream
+
+		log.Infof("reading the decisions every %s", p.interval)
+
+		g.Go(func() error {
+			p.Run(ctx)
+			return ctx.Err()
+		})
+	case useLAPI && config.LAPIMode == cfg.LAPIModePoll:
+		p := newPoller(pull, bouncer.TickerIntervalDuration, health)
+		stream = p.stream
+
+		log.Infof("pulling the decisions every %s", p.interval)
+
+		g.Go(func() error {
+			p.Run(ctx)
+			return ctx.Err()
+		})
+	case useLAPI:
+		s, err := newLAPIStream(bouncer, config.APIUnixSocket, health)
+		if err != nil {
+			return err
+		}
+
+		s.reloadKey = func() (string, error) { return loadAPIKey(*configPath) }
+
+		stream = s.stream
+
+		g.Go(func() error {
+			// already validated by the config loader
+			maxBackoff, _ := time.ParseDuration(config.LAPIMaxBackoff)
+
+			for {
+				if err := waitForLAPI(ctx, s, *config.LAPIRetries, maxBackoff); err != nil {
+					return err
+				}
+
+				err := s.Run(ctx)
+
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				log.Errorf("%s, reconnecting", err)
+			}
+		})
+	}
+
+	if config.PrometheusConfig.Interval != "" {
+		// already validated by the config loader
+		metrics.MetricCollectionInterval, _ = time.ParseDuration(config.PrometheusConfig.Interval)
+	}
+
+	collectMetrics := config.Mode == cfg.IptablesMode || config.Mode == cfg.NftablesMode || config.Mode == cfg.PfMode ||
+		config.Mode == cfg.WindowsMode || config.Mode == cfg.ExaBGPMode
+
+	// metrics_push sends the counters collected for the exporter
+	if collectMetrics && (config.PrometheusConfig.Enabled || config.MetricsPush.Enabled()) {
+		go backend.CollectMetrics()
+	}
 
 	if config.PrometheusConfig.Enabled {
-		if config.Mode == cfg.IptablesMode || config.Mode == cfg.NftablesMode {
-			go backend.CollectMetrics()
-			prometheus.MustRegister(metrics.TotalDroppedBytes, metrics.TotalDroppedPackets, metrics.TotalActiveBannedIPs)
+		if collectMetrics {
+			prometheus.MustRegister(metrics.TotalDroppedBytes, metrics.TotalDroppedPackets, metrics.TotalActiveBannedIPs,
+				metrics.ActiveBannedIPsByFamily, metrics.ActiveBansBySource)
 		}
-		prometheus.MustRegister(csbouncer.TotalLAPICalls, csbouncer.TotalLAPIError)
+		prometheus.MustRegister(csbouncer.TotalLAPICalls, csbouncer.TotalLAPIError, metrics.TotalProcessedDecisions,
+			metrics.ProcessedDecisionsBySource, metrics.TotalDecisionParseErrors, metrics.TotalDroppedNotifications,
+			metrics.TotalFilteredDecisions, metrics.TotalExpiredDecisions, metrics.DecisionQueueDepth,
+			metrics.DecisionQueueCapacity, metrics.TotalDroppedDecisions, metrics.DecisionApplyDuration,
+			metrics.TotalLAPIAuthErrors)
 		go func() {
 			http.Handle("/metrics", promhttp.Handler())
+			http.Handle("/health", health)
+			if config.PrometheusConfig.DebugBans {
+				http.Handle("/debug/bans", &bansHandler{backend: backend, token: config.PrometheusConfig.DebugToken})
+			}
 			listenOn := net.JoinHostPort(
 				config.PrometheusConfig.ListenAddress,
 				config.PrometheusConfig.ListenPort,
 			)
 			log.Infof("Serving metrics at %s", listenOn+"/metrics")
+			log.Infof("Serving health status at %s", listenOn+"/health")
+			if config.PrometheusConfig.DebugBans {
+				log.Infof("Serving the bans at %s", listenOn+"/debug/bans")
+			}
 			log.Error(http.ListenAndServe(listenOn, nil))
 		}()
 	}
+	commands := make(chan controlCommand)
+
+	if config.ControlSocket != "" {
+		g.Go(func() error {
+			return serveControl(ctx, config.ControlSocket, commands)
+		})
+	}
+
+	notify := notifier.New(config)
+	go notify.Run(ctx)
+
+	var usageClient *http.Client
+
+	usageURL := ""
+
+	if config.MetricsPush.LAPI {
+		if !useLAPI {
+			return fmt.Errorf("metrics_push.lapi requires api_url")
+		}
+
+		usageClient = bouncer.APIClient.GetClient()
+
+		usageURL, err = url.JoinPath(bouncer.APIUrl, "v1/usage-metrics")
+		if err != nil {
+			return fmt.Errorf("metrics_push.lapi: %w", err)
+		}
+	}
+
+	push := pusher.New(config, version.String(), backend.LastMetrics, usageClient, usageURL)
+	go push.Run(ctx)
+	go reportLatency(ctx)
+
+	blocklist := newBlocklist(config.BlocklistFiles)
+	reloadBlocklist := make(chan struct{}, 1)
+	// the last configuration reloaded, for the options applied live
+	reloaded := make(chan *cfg.BouncerConfig, 1)
+
+	if len(config.BlocklistFiles) > 0 {
+		reloadBlocklist <- struct{}{}
+	}
+
+	// a nil channel never fires, when reconciliation is disabled
+	var reconcile <-chan time.Time
+
+	if config.ReconcileInterval != "" {
+		// already validated by the config loader
+		interval, _ := time.ParseDuration(config.ReconcileInterval)
+		if interval > 0 {
+			ticker := jitter.NewTicker(interval)
+			defer ticker.Stop()
+			reconcile = ticker.C
+		}
+	}
+
+	// the firewalls whose entries don't expire by themselves are swept between two batches
+	var sweep <-chan time.Time
+
+	if interval := backend.SweepInterval(); interval > 0 {
+		ticker := jitter.NewTicker(interval)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+
+	// already validated by the config loader
+	maxDuration, _ := time.ParseDuration(config.MaxDuration)
+	priorities := decisionPriorities(config.DecisionPriorities)
+
+	// the pings stop if the decisions are not processed anymore
+	heartbeat := systemd.Heartbeat()
+
+	// a nil queue applies the decisions right away
+	var (
+		queue     *decisionQueue
+		applyNext <-chan time.Time
+	)
+
+	if config.RateLimit.DecisionsPerSecond > 0 {
+		queue = newDecisionQueue(config.RateLimit, priorities, config.Mode)
+		ticker := time.NewTicker(rateLimitTick)
+		defer ticker.Stop()
+		applyNext = ticker.C
+
+		log.Infof("applying at most %d decisions per second", config.RateLimit.DecisionsPerSecond)
+	}
+
 	g.Go(func() error {
 		log.Infof("Processing new and deleted decisions . . .")
 		for {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case decisions := <-bouncer.Stream:
-                          log.Info(decisions)
+			case <-reloadBlocklist:
+				added, deleted, err := blocklist.load()
+				if err != nil {
+					log.Errorf("keeping the current blocklists: %s", err)
+					continue
+				}
+				deleteDecisions(backend, deleted, config)
+				addDecisions(backend, added, config, notify)
+
+				if pull == nil {
+					systemd.Ready()
+				}
+			case reloadedConfig := <-reloaded:
+				backend.Reload(reloadedConfig)
+
+				removed, added, err := backend.SetAllowlist(reloadedConfig.Allowlist)
+				if err != nil {
+					log.Errorf("unable to apply the allowlist: %s", err)
+				}
+				if removed+added > 0 {
+					if err := backend.Commit(); err != nil {
+						log.Errorf("unable to commit the allowlist changes: %s", err)
+						continue
+					}
+					log.Infof("allowlist reloaded, %d bans removed and %d added", removed, added)
+				}
+			case <-heartbeat:
+				systemd.Ping()
+			case <-reconcile:
+				backend.Reconcile()
+			case now := <-sweep:
+				backend.Sweep(now)
+			case cmd := <-commands:
+				cmd.reply <- handleControl(backend, cmd.request)
+			case decisions := <-stream:
+				log.Info(decisions)
 				if decisions == nil {
 					continue
 				}
-				deleteDecisions(backend, decisions.Deleted, config)
-				addDecisions(backend, decisions.New, config)
+				health.decisionsReceived()
+				if queue != nil {
+					queue.push(decisions.Deleted, true)
+					queue.push(capDurations(decisions.New, maxDuration), false)
+					queue.apply(backend, config, notify)
+				} else {
+					deleteDecisions(backend, decisions.Deleted, config)
+					// each priority is committed before the next one is added
+					for _, group := range priorities.groups(capDurations(decisions.New, maxDuration)) {
+						addDecisions(backend, group, config, notify)
+					}
+				}
+				systemd.Ready()
+			case <-applyNext:
+				queue.apply(backend, config, notify)
 			}
 		}
 	})
@@ -239,15 +710,42 @@ func Execute() error {
 		}
 	}
 
-	_ = csdaemon.NotifySystemd(log.StandardLogger())
-
 	g.Go(func() error {
-		return HandleSignals(ctx)
+		// already validated by the config loader
+		drainTimeout, _ := time.ParseDuration(config.ShutdownTimeout)
+
+		// the reloads are compared to the previous one, not to the startup configuration
+		current := config
+
+		return HandleSignals(ctx, drainTimeout, func() {
+			if next := reloadConfig(*configPath, current, *verbose); next != nil {
+				current = next
+				// only the latest configuration matters
+				select {
+				case <-reloaded:
+				default:
+				}
+				reloaded <- next
+			}
+
+			if len(config.BlocklistFiles) > 0 {
+				select {
+				case reloadBlocklist <- struct{}{}:
+				default:
+					// a reload is already pending
+				}
+			}
+		})
 	})
 
-	if err := g.Wait(); err != nil {
+	err = g.Wait()
+	systemd.Stopping()
+
+	if err != nil && !errors.Is(err, errTerminated) {
 		return fmt.Errorf("process terminated with error: %w", err)
 	}
 
+	log.Info("decisions processing stopped")
+
 	return nil
 }
@@ -0,0 +1,277 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+func writeConfig(t *testing.T, path string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+
+	configPath := filepath.Join(t.TempDir(), "crowdsec-firewall-bouncer.yaml")
+	writeConfig(t, configPath, "mode: dry-run\nlog_level: info\n")
+
+	current, err := cfg.NewConfig(mustOpen(t, configPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if log.GetLevel() != log.InfoLevel {
+		t.Fatalf("log level is %s before the reload", log.GetLevel())
+	}
+
+	writeConfig(t, configPath, "mode: dry-run\nlog_level: debug\nprometheus:\n  interval: 30s\n")
+
+	// SIGHUP would stop the test binary if it arrived before HandleSignals listens to it
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGHUP)
+	defer signal.Stop(ignored)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan *cfg.BouncerConfig, 1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- HandleSignals(ctx, time.Second, func() {
+			if next := reloadConfig(configPath, current, false); next != nil {
+				select {
+				case reloaded <- next:
+				default:
+				}
+			}
+		})
+	}()
+
+	// the signals sent before HandleSignals is ready are lost
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeout := time.After(5 * time.Second)
+
+	var next *cfg.BouncerConfig
+
+	for next == nil {
+		select {
+		case <-ticker.C:
+			if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+				t.Fatal(err)
+			}
+		case next = <-reloaded:
+		case <-timeout:
+			t.Fatal("the configuration was not reloaded on SIGHUP")
+		}
+	}
+
+	if log.GetLevel() != log.DebugLevel {
+		t.Fatalf("log level is %s after the reload, want debug", log.GetLevel())
+	}
+
+	if next.PrometheusConfig.Interval != "30s" {
+		t.Fatalf("prometheus interval is '%s' after the reload", next.PrometheusConfig.Interval)
+	}
+
+	// applied live, not reported as requiring a restart
+	if options := current.RestartRequired(next); len(options) != 0 {
+		t.Fatalf("restart required for %v", options)
+	}
+
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("HandleSignals returned %v", err)
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+
+	return f
+}
+
+func TestBackendCleanup(t *testing.T) {
+	for _, flush := range []bool{true, false} {
+		config, err := cfg.NewConfig(strings.NewReader(fmt.Sprintf("mode: dry-run\nflush_on_shutdown: %t\n", flush)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := backend.NewBackend(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hook := test.NewGlobal()
+
+		backendCleanup(b, config)
+
+		shutDown := false
+		for _, entry := range hook.AllEntries() {
+			shutDown = shutDown || entry.Message == "backend.ShutDown() called"
+		}
+
+		hook.Reset()
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+		if shutDown != flush {
+			t.Fatalf("flush_on_shutdown: %t, the backend was shut down: %t", flush, shutDown)
+		}
+	}
+}
+
+// drained is set once TestDrain has stopped HandleSignals, whose timeout then listens to
+// the signals until the test binary exits: another SIGTERM would exit it.
+var drained bool
+
+func TestDrain(t *testing.T) {
+	if drained {
+		t.Skip("SIGTERM can only be handled once by the test binary")
+	}
+
+	drained = true
+
+	config, err := cfg.NewConfig(strings.NewReader("mode: dry-run\nflush_on_shutdown: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := backend.NewBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the signals would stop the test binary if they arrived before HandleSignals listens to them
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(ignored)
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	stream := make(chan []*models.Decision)
+	applying := make(chan struct{})
+	release := make(chan struct{})
+	listening := make(chan struct{}, 1)
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	// like the decision loop of Execute, a batch being applied is finished before returning
+	g.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case decisions := <-stream:
+				close(applying)
+				<-release
+				addDecisions(b, decisions, config, nil)
+			}
+		}
+	})
+
+	// the drain timeout would exit the test binary
+	g.Go(func() error {
+		return HandleSignals(ctx, time.Hour, func() {
+			select {
+			case listening <- struct{}{}:
+			default:
+			}
+		})
+	})
+
+	// HandleSignals listens to the signals once it reloads on SIGHUP
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeout := time.After(5 * time.Second)
+
+	for ready := false; !ready; {
+		select {
+		case <-ticker.C:
+			if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+				t.Fatal(err)
+			}
+		case <-listening:
+			ready = true
+		case <-timeout:
+			t.Fatal("the signals are not handled")
+		}
+	}
+
+	ban := newPolledDecision("192.0.2.1", "4h")
+	ban.Type = &config.SupportedDecisionsTypes[0]
+
+	stream <- []*models.Decision{ban}
+	<-applying
+
+	// only once, a second one exits right away
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	// the decision loop is asked to stop while the batch is still being applied
+	<-ctx.Done()
+	close(release)
+
+	if err := g.Wait(); !errors.Is(err, errTerminated) {
+		t.Fatalf("stopped with %v", err)
+	}
+
+	backendCleanup(b, config)
+
+	added, committed, shutDowns := false, false, 0
+
+	for _, entry := range hook.AllEntries() {
+		switch entry.Message {
+		case "backend.Add() called with 192.0.2.1":
+			added = true
+		case "backend.Commit() called":
+			committed = shutDowns == 0
+		case "backend.ShutDown() called":
+			shutDowns++
+		}
+	}
+
+	if !added || !committed {
+		t.Fatal("the batch received before SIGTERM wasn't applied before the shutdown")
+	}
+
+	if shutDowns != 1 {
+		t.Fatalf("the backend was shut down %d times", shutDowns)
+	}
+}
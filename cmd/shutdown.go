@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errTerminated is returned by HandleSignals when the bouncer is asked to stop, it's not a failure.
+var errTerminated = errors.New("terminated")
+
+// terminate bounds the drain following the first SIGTERM or SIGINT: the bouncer exits
+// right away on a second one, or when the timeout expires (ie. pfctl is stuck).
+func terminate(signals <-chan os.Signal, timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case s := <-signals:
+			if s == syscall.SIGHUP {
+				continue
+			}
+
+			log.Errorf("received another signal (%s) while stopping, exiting now", s)
+		case <-deadline:
+			log.Errorf("unable to stop within %s, exiting now", timeout)
+		}
+
+		os.Exit(1)
+	}
+}
+
+// stopping logs the signal and starts the drain timeout.
+func stopping(name string, signals <-chan os.Signal, timeout time.Duration) error {
+	log.Infof("received %s, applying the pending decisions and stopping (send it again to exit now)", name)
+
+	go terminate(signals, timeout)
+
+	return fmt.Errorf("%w by %s", errTerminated, name)
+}
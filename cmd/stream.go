@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+// the largest event of the decision stream
+const streamBufferSize = 1 << 16
+
+// checkLAPIAuth makes sure the bouncer can authenticate to the LAPI, with an API key,
+// a client certificate (mTLS) or both.
+func checkLAPIAuth(bouncer *csbouncer.StreamBouncer) error {
+	if (bouncer.CertPath == "") != (bouncer.KeyPath == "") {
+		return fmt.Errorf("cert_path and key_path must be set together")
+	}
+
+	if bouncer.APIKey == "" && bouncer.CertPath == "" {
+		return fmt.Errorf("config does not contain 'api_key' nor 'cert_path' and 'key_path'")
+	}
+
+	return nil
+}
+
+// lapiTLSConfig returns the TLS config of the connections to the LAPI: the CA to verify
+// it with, added to the system ones, and the client certificate if there is one.
+func lapiTLSConfig(bouncer *csbouncer.StreamBouncer) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if bouncer.InsecureSkipVerify != nil {
+		config.InsecureSkipVerify = *bouncer.InsecureSkipVerify
+	}
+
+	if bouncer.CAPath != "" {
+		ca, err := os.ReadFile(bouncer.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA certificate: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in '%s'", bouncer.CAPath)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if bouncer.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(bouncer.CertPath, bouncer.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// lapiAuthError is returned when the LAPI refuses the credentials of the bouncer, ie. a revoked
+// or expired API key. The bouncer keeps running without receiving any decision until they're fixed.
+type lapiAuthError struct {
+	status int
+}
+
+func (e *lapiAuthError) Error() string {
+	return fmt.Sprintf("the LAPI refused the credentials of the bouncer (HTTP %d), no decision will be received: "+
+		"check api_key or the client certificate ('cscli bouncers list' on the LAPI)", e.status)
+}
+
+// authFailure returns a lapiAuthError if the LAPI answered with status because of the credentials.
+func authFailure(status int) error {
+	if status != http.StatusUnauthorized && status != http.StatusForbidden {
+		return nil
+	}
+
+	metrics.TotalLAPIAuthErrors.Inc()
+
+	return &lapiAuthError{status: status}
+}
+
+// lapiStream reads the decision stream of the LAPI. It replaces the one of the bouncer
+// library, which doesn't use the client certificate nor the CA of the config.
+type lapiStream struct {
+	bouncer *csbouncer.StreamBouncer
+	client  *http.Client
+	stream  chan *models.DecisionsStreamResponse
+	health  *healthStatus
+	// returns the API key to retry with once the LAPI refused the current one, if set
+	reloadKey func() (string, error)
+}
+
+// newLAPIStream returns the stream of a LAPI, reached through unixSocket if it's not empty.
+func newLAPIStream(bouncer *csbouncer.StreamBouncer, unixSocket string, health *healthStatus) (*lapiStream, error) {
+	tlsConfig, err := lapiTLSConfig(bouncer)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if unixSocket != "" {
+		transport.DialContext = unixSocketDialer(unixSocket)
+	}
+
+	return &lapiStream{
+		bouncer: bouncer,
+		client:  &http.Client{Transport: transport},
+		stream:  make(chan *models.DecisionsStreamResponse),
+		health:  health,
+	}, nil
+}
+
+// url returns the address of the decision stream, with the filters of the config.
+func (s *lapiStream) url() string {
+	opts := s.bouncer.Opts
+	params := url.Values{}
+
+	for name, value := range map[string]string{
+		"scopes":                   opts.Scopes,
+		"scenarios_containing":     opts.ScenariosContaining,
+		"scenarios_not_containing": opts.ScenariosNotContaining,
+		"origins":                  opts.Origins,
+	} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+
+	if opts.Startup {
+		params.Set("startup", "true")
+	}
+
+	ret := strings.TrimSuffix(s.bouncer.APIUrl, "/") + "/v1/decisions-stream"
+	if len(params) > 0 {
+		ret += "?" + params.Encode()
+	}
+
+	return ret
+}
+
+// connect opens the decision stream, it stays open until the context is cancelled.
+func (s *lapiStream) connect(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("User-Agent", s.bouncer.UserAgent)
+
+	if s.bouncer.APIKey != "" {
+		req.Header.Set("X-Api-Key", s.bouncer.APIKey)
+	}
+
+	csbouncer.TotalLAPICalls.Inc()
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		csbouncer.TotalLAPIError.Inc()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		csbouncer.TotalLAPIError.Inc()
+
+		if err := authFailure(resp.StatusCode); err != nil {
+			s.health.setAuthError(err)
+			s.reauth()
+
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	s.health.setAuthError(nil)
+
+	return resp, nil
+}
+
+// reauth reads the API key again after the LAPI refused it, so that the next attempt uses
+// a key registered again (ie. with 'cscli bouncers add') without restarting the bouncer.
+func (s *lapiStream) reauth() {
+	if s.reloadKey == nil || s.bouncer.APIKey == "" {
+		return
+	}
+
+	key, err := s.reloadKey()
+	if err != nil {
+		log.Errorf("unable to read the API key again: %s", err)
+		return
+	}
+
+	if key != "" && key != s.bouncer.APIKey {
+		log.Infof("api_key has changed (%s), using it for the next attempt", maskKey(key))
+		s.bouncer.APIKey = key
+	}
+}
+
+// Run sends the events of the decision stream until the context is cancelled, or the
+// LAPI closes the stream.
+func (s *lapiStream) Run(ctx context.Context) error {
+	resp, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// running once the LAPI accepted the stream, until it ends
+	s.health.setStreamRunning(true)
+	defer s.health.setStreamRunning(false)
+
+	reader := csbouncer.NewEventStreamReader(resp.Body, streamBufferSize)
+
+	for {
+		event, err := reader.ReadEvent()
+
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, io.EOF):
+			return fmt.Errorf("the LAPI closed the decision stream")
+		case err != nil:
+			return fmt.Errorf("unable to read the decision stream: %w", err)
+		}
+
+		if len(event) == 0 || string(event) == "[]" {
+			continue
+		}
+
+		data := &models.DecisionsStreamResponse{
+			New:     []*models.Decision{},
+			Deleted: []*models.Decision{},
+		}
+
+		if err := json.Unmarshal(event, data); err != nil {
+			log.Errorf("ignoring a malformed event of the decision stream: %s", err)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case s.stream <- data:
+		}
+	}
+}
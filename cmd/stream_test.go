@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+)
+
+func newTestStream(t *testing.T, handler http.HandlerFunc) (*lapiStream, *healthStatus) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	health := newHealthStatus("dry-run", true)
+
+	s, err := newLAPIStream(&csbouncer.StreamBouncer{APIUrl: server.URL, APIKey: "key"}, "", health)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, health
+}
+
+func TestStreamRunningAfterResponse(t *testing.T) {
+	connected := make(chan struct{})
+	release := make(chan struct{})
+
+	s, health := newTestStream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		close(connected)
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() { done <- s.Run(ctx) }()
+
+	// the LAPI hasn't answered yet
+	time.Sleep(50 * time.Millisecond)
+
+	if health.report().StreamRunning {
+		t.Fatal("the stream is running before the LAPI answered")
+	}
+
+	close(release)
+	<-connected
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !health.report().StreamRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("the stream is not running after the LAPI answered")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if health.report().StreamRunning {
+		t.Fatal("the stream is still running after it ended")
+	}
+}
+
+func TestStreamNotRunningOnError(t *testing.T) {
+	s, health := newTestStream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("no error for a 500 response")
+	}
+
+	if health.report().StreamRunning {
+		t.Fatal("the stream is running after a failed connection")
+	}
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/database"
+)
+
+// decisionSource returns all the active decisions, of the supported types.
+type decisionSource func(ctx context.Context) ([]*models.Decision, error)
+
+// lapiDecisions pulls the decisions from the LAPI.
+func lapiDecisions(bouncer *csbouncer.StreamBouncer, config *cfg.BouncerConfig) decisionSource {
+	return func(ctx context.Context) ([]*models.Decision, error) {
+		opts := bouncer.Opts
+		opts.Startup = true
+
+		resp, r, err := bouncer.APIClient.Decisions.GetStream(ctx, opts)
+		csbouncer.TotalLAPICalls.Inc()
+
+		if err != nil {
+			csbouncer.TotalLAPIError.Inc()
+
+			if r != nil && r.Response != nil {
+				if authErr := authFailure(r.Response.StatusCode); authErr != nil {
+					return nil, authErr
+				}
+			}
+
+			return nil, fmt.Errorf("unable to get the decisions from the LAPI: %w", err)
+		}
+
+		return supportedDecisions(resp.New, config), nil
+	}
+}
+
+// databaseDecisions reads the decisions from the database of the LAPI.
+func databaseDecisions(db *database.Reader, config *cfg.BouncerConfig) decisionSource {
+	return func(ctx context.Context) ([]*models.Decision, error) {
+		decisions, err := db.Decisions(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return supportedDecisions(decisions, config), nil
+	}
+}
+
+// supportedDecisions returns the valid decisions of the types the bouncer applies.
+func supportedDecisions(decisions []*models.Decision, config *cfg.BouncerConfig) []*models.Decision {
+	ret := []*models.Decision{}
+
+	for _, d := range decisions {
+		if d == nil || d.Value == nil || d.Type == nil {
+			continue
+		}
+
+		if slices.Contains(config.SupportedDecisionsTypes, strings.ToLower(*d.Type)) {
+			ret = append(ret, d)
+		}
+	}
+
+	return ret
+}
+
+// syncFirewall makes the firewall match the decisions of the LAPI: the bans missing
+// from the firewall are added, the ones without a decision anymore are removed.
+// The entries of the blocklist files are kept.
+func syncFirewall(ctx context.Context, b *backend.BackendCTX, pull decisionSource, config *cfg.BouncerConfig) error {
+	decisions, err := pull(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("%d active decisions", len(decisions))
+
+	wanted := decisions
+
+	if len(config.BlocklistFiles) > 0 {
+		blocklisted, _, err := newBlocklist(config.BlocklistFiles).load()
+		if err != nil {
+			return err
+		}
+
+		wanted = append(slices.Clone(decisions), blocklisted...)
+	}
+
+	removed, err := b.RemoveStale(wanted)
+	if err != nil {
+		return fmt.Errorf("unable to remove the stale bans: %w", err)
+	}
+
+	log.Infof("%d stale bans removed from the firewall", removed)
+
+	// already validated by the config loader
+	maxDuration, _ := time.ParseDuration(config.MaxDuration)
+
+	addDecisions(b, capDurations(decisions, maxDuration), config, nil)
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	log "github.com/sirupsen/logrus"
+)
+
+// systemdNotifier tells systemd when the bouncer enforces the decisions, and pings its
+// watchdog. It does nothing when the bouncer is not run by systemd with Type=notify.
+type systemdNotifier struct {
+	enabled  bool
+	ready    sync.Once
+	watchdog time.Duration
+}
+
+func newSystemdNotifier() *systemdNotifier {
+	s := &systemdNotifier{enabled: os.Getenv("NOTIFY_SOCKET") != ""}
+	if !s.enabled {
+		log.Debug("Not running under systemd")
+		return s
+	}
+
+	watchdog, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.Warningf("ignoring the systemd watchdog: %s", err)
+	}
+
+	s.watchdog = watchdog
+
+	return s
+}
+
+func (s *systemdNotifier) notify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.Errorf("unable to notify systemd: %s", err)
+	}
+}
+
+// Ready tells systemd that the service is up, the first time it's called.
+func (s *systemdNotifier) Ready() {
+	if !s.enabled {
+		return
+	}
+
+	s.ready.Do(func() {
+		s.notify(daemon.SdNotifyReady)
+		log.Debug("Systemd notified")
+	})
+}
+
+// Stopping tells systemd that the service is shutting down.
+func (s *systemdNotifier) Stopping() {
+	if !s.enabled {
+		return
+	}
+
+	s.notify(daemon.SdNotifyStopping)
+}
+
+// Heartbeat returns a channel firing twice per watchdog period, nil without a watchdog.
+// The ticker is never stopped, it lives as long as the bouncer.
+func (s *systemdNotifier) Heartbeat() <-chan time.Time {
+	if s.watchdog == 0 {
+		return nil
+	}
+
+	log.Debugf("pinging the systemd watchdog every %s", s.watchdog/2)
+
+	return time.NewTicker(s.watchdog / 2).C
+}
+
+// Ping tells the systemd watchdog that the bouncer is alive.
+func (s *systemdNotifier) Ping() {
+	s.notify(daemon.SdNotifyWatchdog)
+}
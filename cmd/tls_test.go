@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+)
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and its key to dir.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "firewall-bouncer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client-key.pem")
+
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+
+	return cert, certPath, keyPath
+}
+
+// newMTLSServer returns a LAPI requiring a client certificate signed by client, and the
+// path of its CA certificate. The requests of the stream are sent to received.
+func newMTLSServer(t *testing.T, client *x509.Certificate, received chan<- *http.Request) (*httptest.Server, string) {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(client)
+
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caPath, "CERTIFICATE", server.Certificate().Raw)
+
+	return server, caPath
+}
+
+func TestMTLS(t *testing.T) {
+	cert, certPath, keyPath := writeClientCert(t, t.TempDir())
+	received := make(chan *http.Request, 1)
+	server, caPath := newMTLSServer(t, cert, received)
+
+	bouncer := &csbouncer.StreamBouncer{APIUrl: server.URL, CertPath: certPath, KeyPath: keyPath, CAPath: caPath}
+
+	if err := checkLAPIAuth(bouncer); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newLAPIStream(bouncer, "", newHealthStatus("dry-run", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := s.connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	r := <-received
+
+	if len(r.TLS.PeerCertificates) != 1 || r.TLS.PeerCertificates[0].Subject.CommonName != "firewall-bouncer" {
+		t.Fatal("the LAPI didn't receive the client certificate")
+	}
+
+	// without an API key, none is sent
+	if _, ok := r.Header["X-Api-Key"]; ok {
+		t.Fatal("an empty API key is sent")
+	}
+}
+
+func TestMTLSWithAPIKey(t *testing.T) {
+	cert, certPath, keyPath := writeClientCert(t, t.TempDir())
+	received := make(chan *http.Request, 1)
+	server, caPath := newMTLSServer(t, cert, received)
+
+	bouncer := &csbouncer.StreamBouncer{APIUrl: server.URL, APIKey: "key", CertPath: certPath, KeyPath: keyPath, CAPath: caPath}
+
+	s, err := newLAPIStream(bouncer, "", newHealthStatus("dry-run", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if r := <-received; r.Header.Get("X-Api-Key") != "key" || len(r.TLS.PeerCertificates) != 1 {
+		t.Fatal("the LAPI didn't receive both the API key and the client certificate")
+	}
+}
+
+func TestMTLSWithoutCertificate(t *testing.T) {
+	cert, _, _ := writeClientCert(t, t.TempDir())
+	server, caPath := newMTLSServer(t, cert, make(chan *http.Request, 1))
+
+	s, err := newLAPIStream(&csbouncer.StreamBouncer{APIUrl: server.URL, APIKey: "key", CAPath: caPath}, "", newHealthStatus("dry-run", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server certificate is verified with the CA, the handshake fails on the missing client certificate
+	if resp, err := s.connect(context.Background()); err == nil {
+		resp.Body.Close()
+		t.Fatal("connected to a LAPI requiring a client certificate without one")
+	}
+}
+
+func TestUnknownCA(t *testing.T) {
+	cert, certPath, keyPath := writeClientCert(t, t.TempDir())
+	server, _ := newMTLSServer(t, cert, make(chan *http.Request, 1))
+
+	// the client certificate isn't the CA of the server
+	s, err := newLAPIStream(&csbouncer.StreamBouncer{APIUrl: server.URL, CertPath: certPath, KeyPath: keyPath, CAPath: certPath}, "", newHealthStatus("dry-run", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := s.connect(context.Background()); err == nil {
+		resp.Body.Close()
+		t.Fatal("connected to a LAPI whose certificate isn't signed by ca_cert_path")
+	}
+}
+
+func TestCheckLAPIAuth(t *testing.T) {
+	tests := []struct {
+		bouncer csbouncer.StreamBouncer
+		valid   bool
+	}{
+		{csbouncer.StreamBouncer{APIKey: "key"}, true},
+		{csbouncer.StreamBouncer{CertPath: "cert.pem", KeyPath: "key.pem"}, true},
+		{csbouncer.StreamBouncer{APIKey: "key", CertPath: "cert.pem", KeyPath: "key.pem"}, true},
+		{csbouncer.StreamBouncer{}, false},
+		{csbouncer.StreamBouncer{CertPath: "cert.pem"}, false},
+		{csbouncer.StreamBouncer{APIKey: "key", KeyPath: "key.pem"}, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		if err := checkLAPIAuth(&tt.bouncer); (err == nil) != tt.valid {
+			t.Fatalf("%+v: got %v", tt.bouncer, err)
+		}
+	}
+}
+
+func TestLAPITLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bouncer := range []*csbouncer.StreamBouncer{
+		{CAPath: filepath.Join(dir, "missing.pem")},
+		{CAPath: notPEM},
+		{CertPath: notPEM, KeyPath: notPEM},
+	} {
+		if _, err := lapiTLSConfig(bouncer); err == nil {
+			t.Fatalf("%+v: no error", bouncer)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/apiclient"
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+)
+
+// the api_url of a LAPI reached through its unix socket, when the configuration has none
+const unixSocketURL = "http://localhost/"
+
+// unixSocketDialer connects to the socket whatever the address of the request.
+func unixSocketDialer(path string) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	return func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
+
+// checkUnixSocket makes sure the LAPI listens on the socket.
+func checkUnixSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("api_unix_socket: %w", err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("api_unix_socket: %s is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("api_unix_socket: %w", err)
+	}
+
+	return conn.Close()
+}
+
+// useUnixSocket makes the client of the bouncer library connect through the socket, after Init.
+// It uses an API key transport over the default one, or its own transport for the certificates.
+func useUnixSocket(bouncer *csbouncer.StreamBouncer, path string) error {
+	client := bouncer.APIClient.GetClient()
+
+	switch t := client.Transport.(type) {
+	case *apiclient.APIKeyTransport:
+		transport, ok := t.Transport.(*http.Transport)
+		if t.Transport == nil {
+			transport, ok = http.DefaultTransport.(*http.Transport).Clone(), true
+		}
+
+		if !ok {
+			return fmt.Errorf("api_unix_socket: unexpected transport %T of the LAPI client", t.Transport)
+		}
+
+		transport.DialContext = unixSocketDialer(path)
+		t.Transport = transport
+	case *http.Transport:
+		t.DialContext = unixSocketDialer(path)
+	default:
+		return fmt.Errorf("api_unix_socket: unexpected transport %T of the LAPI client", client.Transport)
+	}
+
+	return nil
+}
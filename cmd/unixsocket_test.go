@@ -0,0 +1,129 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	csbouncer "github.com/asians-cloud/go-cs-bouncer"
+)
+
+// newUnixSocketServer returns the path of the socket of a LAPI, whose requests are sent to received.
+func newUnixSocketServer(t *testing.T, received chan<- *http.Request) string {
+	t.Helper()
+
+	// t.TempDir can exceed the maximum length of a socket path
+	dir, err := os.MkdirTemp("", "lapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "lapi.sock")
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return path
+}
+
+func TestUnixSocketStream(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	path := newUnixSocketServer(t, received)
+
+	if err := checkUnixSocket(path); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newLAPIStream(&csbouncer.StreamBouncer{APIUrl: unixSocketURL, APIKey: "key"}, path, newHealthStatus("dry-run", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if r := <-received; r.Header.Get("X-Api-Key") != "key" {
+		t.Fatal("the LAPI didn't receive the API key through the socket")
+	}
+}
+
+func TestUnixSocketLibraryClient(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	path := newUnixSocketServer(t, received)
+
+	bouncer := &csbouncer.StreamBouncer{APIUrl: unixSocketURL, APIKey: "key", TickerInterval: "10s"}
+
+	if err := bouncer.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := useUnixSocket(bouncer, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// no TCP server listens on localhost, the request can only go through the socket
+	resp, err := bouncer.APIClient.GetClient().Get(unixSocketURL + "v1/decisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if r := <-received; r.Header.Get("X-Api-Key") != "key" || r.URL.Path != "/v1/decisions" {
+		t.Fatalf("the LAPI received %s without the API key", r.URL.Path)
+	}
+}
+
+func TestCheckUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := checkUnixSocket(filepath.Join(dir, "missing.sock")); err == nil {
+		t.Fatal("a missing socket is accepted")
+	}
+
+	file := filepath.Join(dir, "lapi.sock")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkUnixSocket(file); err == nil {
+		t.Fatal("a regular file is accepted as a socket")
+	}
+
+	// left behind by a LAPI that stopped
+	stale := filepath.Join(dir, "stale.sock")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	if err := checkUnixSocket(stale); err == nil {
+		t.Fatal("a socket nothing listens on is accepted")
+	}
+}
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/crowdsecurity/go-cs-lib/pkg/version"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/backend"
+)
+
+// printVersion writes the build information asked for in the bug reports. It doesn't
+// need the config, the version, commit and date are set with -ldflags (see the Makefile).
+func printVersion(w io.Writer) {
+	fmt.Fprint(w, version.FullString())
+	fmt.Fprintf(w, "Commit: %s\n", version.Tag)
+	fmt.Fprintf(w, "Platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(w, "Backends: %s\n", strings.Join(backend.SupportedModes(runtime.GOOS), ", "))
+}
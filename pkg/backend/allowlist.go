@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// allowlist holds the networks that must never be banned.
+type allowlist []*net.IPNet
+
+// parseNetwork reads an IP or a range in CIDR notation.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return network, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address '%s'", value)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func newAllowlist(entries []string) (allowlist, error) {
+	ret := make(allowlist, 0, len(entries))
+
+	for _, entry := range entries {
+		network, err := parseNetwork(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("allowlist: %w", err)
+		}
+
+		ret = append(ret, network)
+	}
+
+	return ret, nil
+}
+
+// overlaps tells whether banning the value (an IP or a range) would ban an allowed address.
+// It returns the allowlist entry in question.
+func (a allowlist) overlaps(value string) (*net.IPNet, bool) {
+	network, err := parseNetwork(value)
+	if err != nil {
+		// not an address (ie. a country or an AS), let the backend deal with it
+		return nil, false
+	}
+
+	for _, allowed := range a {
+		if allowed.Contains(network.IP) || network.Contains(allowed.IP) {
+			return allowed, true
+		}
+	}
+
+	return nil, false
+}
+
+// SetAllowlist replaces the allowlist: the bans it now covers are removed from the firewalls,
+// and the decisions skipped because of the entries it doesn't have anymore are applied, for
+// the time they have left. It returns the number of bans removed and added, the caller
+// commits them. The current allowlist is kept if the new one is invalid.
+func (b *BackendCTX) SetAllowlist(entries []string) (int, int, error) {
+	a, err := newAllowlist(entries)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	b.allowlist = a
+
+	var (
+		removed, added int
+		errs           []error
+	)
+
+	for _, decision := range b.cache.pending() {
+		allowed, ok := a.overlaps(*decision.Value)
+		if !ok {
+			continue
+		}
+
+		log.Infof("removing the ban on '%s', it overlaps with allowed %s", *decision.Value, allowed)
+
+		if err := b.Delete(decision); err != nil {
+			errs = append(errs, fmt.Errorf("unable to remove '%s': %w", *decision.Value, err))
+			continue
+		}
+
+		b.allowed.added(decision)
+		removed++
+	}
+
+	for _, decision := range b.allowed.pending() {
+		if _, ok := a.overlaps(*decision.Value); ok {
+			continue
+		}
+
+		log.Infof("'%s' is not allowed anymore, applying its decision", *decision.Value)
+
+		b.allowed.deleted(decision)
+
+		if err := b.Add(decision); err != nil {
+			if !errors.Is(err, ErrSkipped) {
+				errs = append(errs, fmt.Errorf("unable to add '%s': %w", *decision.Value, err))
+			}
+
+			continue
+		}
+
+		added++
+	}
+
+	return removed, added, errors.Join(errs...)
+}
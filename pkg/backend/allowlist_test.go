@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAllowedDecisionRemovesBan(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist, err := newAllowlist([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.allowlist = allowlist
+
+	// skipped, the caller doesn't commit anything
+	if err := b.Add(newDecision("192.0.2.1", "Ip", 2*time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("allowed decision returned %v", err)
+	}
+
+	assertBanned(t, fw)
+}
+
+func TestSetAllowlistRemovesBan(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	for _, value := range []string{"192.0.2.1", "198.51.100.1"} {
+		if err := b.Add(newDecision(value, "Ip", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, added, err := b.SetAllowlist([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 || added != 0 {
+		t.Fatalf("%d bans removed and %d added, want 1 removed", removed, added)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "198.51.100.1")
+}
+
+func TestSetAllowlistAppliesSkippedDecision(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	if _, _, err := b.SetAllowlist([]string{"192.0.2.0/24", "2001:db8::/32"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("allowed decision returned %v", err)
+	}
+
+	// still allowed by the remaining entry
+	if err := b.Add(newDecision("2001:db8::1", "Ip", time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("allowed decision returned %v", err)
+	}
+
+	removed, added, err := b.SetAllowlist([]string{"2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 0 || added != 1 {
+		t.Fatalf("%d bans removed and %d added, want 1 added", removed, added)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1")
+
+	// not applied again by the next reload
+	if _, added, err := b.SetAllowlist([]string{"2001:db8::/32"}); err != nil || added != 0 {
+		t.Fatalf("reloading the same allowlist adds %d bans: %v", added, err)
+	}
+}
+
+func TestSetAllowlistExpiredDecision(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	if _, _, err := b.SetAllowlist([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("allowed decision returned %v", err)
+	}
+
+	// the decision was deleted by the LAPI while allowed, it's not applied anymore
+	if err := b.Delete(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil && !errors.Is(err, ErrSkipped) {
+		t.Fatal(err)
+	}
+
+	if _, added, err := b.SetAllowlist(nil); err != nil || added != 0 {
+		t.Fatalf("removing the allowlist adds %d bans: %v", added, err)
+	}
+}
+
+func TestSetAllowlistInvalid(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	if _, _, err := b.SetAllowlist([]string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := b.SetAllowlist([]string{"not an address"}); err == nil {
+		t.Fatal("an invalid allowlist is accepted")
+	}
+
+	// the current allowlist is kept
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("allowed decision returned %v", err)
+	}
+}
@@ -1,101 +1,889 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
-	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 
 	"github.com/asians-cloud/crowdsec/pkg/models"
 	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
-	"github.com/asians-cloud/firewall-bouncer/pkg/dryrun"
-	"github.com/asians-cloud/firewall-bouncer/pkg/iptables"
-	"github.com/asians-cloud/firewall-bouncer/pkg/nftables"
-	"github.com/asians-cloud/firewall-bouncer/pkg/pf"
+	"github.com/asians-cloud/firewall-bouncer/pkg/geoip"
+	"github.com/asians-cloud/firewall-bouncer/pkg/jitter"
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
 	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
 type BackendCTX struct {
 	firewall types.Backend
+	// firewalls dedicated to the decisions of an origin, with their own tables
+	origins   map[string]types.Backend
+	geoip     networkResolver
+	asn       networkResolver
+	cache     *decisionCache
+	allowlist allowlist
+	// decisions skipped because of the allowlist, applied if it stops covering them
+	allowed *decisionCache
+	// maximum number of bans by address family, and whether to remove the oldest ones to make room
+	maxBanned map[string]int
+	evict     bool
+	// shortest prefix of the ranges by address family
+	minPrefix map[string]int
+	durations durationOverrides
+	scenarios scenarioFilter
+	// firewalls of extra_modes, receiving all the decisions
+	extra        map[string]types.Backend
+	allOrNothing bool
+	// only remove the bans of the cache on shutdown, the sets may hold entries of another tool
+	flushOwned bool
+	// ignore the decisions that have already expired
+	skipExpired bool
+	// entries found in the firewalls at startup, with import_existing_bans
+	imported *importedBans
+	// the counters of the default firewall collected last, for metrics_push
+	metricsMu   sync.Mutex
+	lastMetrics *types.Metrics
+	// the tickers of the metrics collection, reset when the interval is reloaded
+	metricsTickers []*jitter.Ticker
+}
+
+// reloader is implemented by the firewalls applying some options of a reloaded
+// configuration without being restarted.
+type reloader interface {
+	Reload(config *cfg.BouncerConfig)
+}
+
+// networkResolver returns the networks of a country or an AS, ie. from a geoip database.
+type networkResolver interface {
+	Networks(key string) ([]string, error)
+}
+
+// ErrSkipped is returned when a decision is deliberately not applied to the firewall.
+var ErrSkipped = errors.New("decision skipped")
+
+// sorted returns the firewalls of a map, sorted by name.
+func sorted(firewalls map[string]types.Backend) []types.Backend {
+	names := maps.Keys(firewalls)
+	slices.Sort(names)
+
+	ret := make([]types.Backend, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, firewalls[name])
+	}
+
+	return ret
+}
+
+// all returns the default firewall followed by the ones dedicated to an origin, and the extra ones.
+func (b *BackendCTX) all() []types.Backend {
+	ret := append([]types.Backend{b.firewall}, sorted(b.origins)...)
+
+	return append(ret, sorted(b.extra)...)
+}
+
+// firewallFor returns the firewall in charge of a decision, according to its origin.
+func (b *BackendCTX) firewallFor(decision *models.Decision) types.Backend {
+	if decision.Origin != nil {
+		if fw, ok := b.origins[strings.ToLower(*decision.Origin)]; ok {
+			return fw
+		}
+	}
+
+	return b.firewall
+}
+
+// firewallsFor returns all the firewalls applying a decision.
+func (b *BackendCTX) firewallsFor(decision *models.Decision) []types.Backend {
+	return append([]types.Backend{b.firewallFor(decision)}, sorted(b.extra)...)
+}
+
+// addTo adds a decision to its firewalls. With all-or-nothing, a decision refused by one
+// of them is removed from the others. Otherwise it's kept by the ones accepting it, and
+// it fails only if they all refuse it.
+func (b *BackendCTX) addTo(decision *models.Decision) error {
+	var (
+		added []types.Backend
+		errs  []error
+	)
+
+	for _, fw := range b.firewallsFor(decision) {
+		if err := fw.Add(decision); err != nil {
+			errs = append(errs, err)
+			if b.allOrNothing {
+				break
+			}
+
+			continue
+		}
+
+		added = append(added, fw)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	err := errors.Join(errs...)
+
+	if b.allOrNothing {
+		for _, fw := range added {
+			if derr := fw.Delete(decision); derr != nil {
+				log.Errorf("unable to remove '%s' from the firewalls accepting it: %s", *decision.Value, derr)
+			}
+		}
+
+		return err
+	}
+
+	if len(added) == 0 {
+		return err
+	}
+
+	log.Errorf("'%s' is not applied by all the firewalls: %s", *decision.Value, err)
+
+	return nil
+}
+
+// deleteFrom removes a decision from its firewalls. A removal can't be undone, so
+// with all-or-nothing it fails if one of them fails, and otherwise if they all fail.
+func (b *BackendCTX) deleteFrom(decision *models.Decision) error {
+	firewalls := b.firewallsFor(decision)
+
+	var errs []error
+
+	for _, fw := range firewalls {
+		if err := fw.Delete(decision); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err := errors.Join(errs...)
+
+	if err == nil || b.allOrNothing || len(errs) == len(firewalls) {
+		return err
+	}
+
+	log.Errorf("'%s' is not removed from all the firewalls: %s", *decision.Value, err)
+
+	return nil
 }
 
 func (b *BackendCTX) Init() error {
-	return b.firewall.Init()
+	for _, fw := range b.all() {
+		if err := fw.Init(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
+// Commit applies the changes of all the firewalls, even if some fail.
 func (b *BackendCTX) Commit() error {
-	return b.firewall.Commit()
+	var errs []error
+
+	for _, fw := range b.all() {
+		if err := fw.Commit(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func (b *BackendCTX) ShutDown() error {
-	return b.firewall.ShutDown()
+	var errs []error
+
+	if b.flushOwned {
+		if err := b.removeOwned(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	b.cache.reset()
+	b.allowed.reset()
+	b.imported.reset()
+
+	for _, fw := range b.all() {
+		if err := fw.ShutDown(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeOwned removes the bans of the cache from the firewalls, which then leave the
+// other entries of their sets in place.
+func (b *BackendCTX) removeOwned() error {
+	decisions := b.cache.all()
+
+	log.Infof("flush_mode %s: removing the %d bans of the bouncer", cfg.FlushModeOwned, len(decisions))
+
+	for _, decision := range decisions {
+		if err := b.Delete(decision); err != nil {
+			log.Errorf("unable to remove '%s': %s", *decision.Value, err)
+		}
+	}
+
+	return b.Commit()
+}
+
+// expand returns the decisions to apply to the firewall for a decision, resolving
+// country and AS decisions to the networks allocated to the country or announced
+// by the AS. The firewalls apply them in batches on commit.
+func (b *BackendCTX) expand(decision *models.Decision) ([]*models.Decision, error) {
+	if decision.Scope == nil {
+		return []*models.Decision{decision}, nil
+	}
+
+	var resolver networkResolver
+
+	switch DecisionScope(decision) {
+	case "country":
+		if b.geoip == nil {
+			return nil, fmt.Errorf("country decision for '%s' but no geoip database is configured", *decision.Value)
+		}
+
+		resolver = b.geoip
+	case "as":
+		if b.asn == nil {
+			return nil, fmt.Errorf("AS decision for '%s' but no asn database is configured", *decision.Value)
+		}
+
+		resolver = b.asn
+	default:
+		return []*models.Decision{decision}, nil
+	}
+
+	networks, err := resolver.Networks(*decision.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	banned := make([]string, 0, len(networks))
+
+	for _, network := range networks {
+		if allowed, ok := b.allowlist.overlaps(network); ok {
+			log.Infof("not banning %s from %s %s, it overlaps with allowed %s", network, DecisionScope(decision), *decision.Value, allowed)
+			continue
+		}
+
+		banned = append(banned, network)
+	}
+
+	return networkDecisions(decision, banned), nil
+}
+
+// networkDecisions returns the range decisions banning networks on behalf of a decision.
+func networkDecisions(decision *models.Decision, networks []string) []*models.Decision {
+	ret := make([]*models.Decision, 0, len(networks))
+
+	for _, network := range networks {
+		value := network
+		scope := "Range"
+		d := *decision
+		d.Value = &value
+		d.Scope = &scope
+		ret = append(ret, &d)
+	}
+
+	return ret
+}
+
+// resolved tells whether a decision is applied as the networks it's resolved to.
+func resolved(decision *models.Decision) bool {
+	switch DecisionScope(decision) {
+	case "country", "as":
+		return true
+	}
+
+	return false
+}
+
+// applied returns the decisions applied to the firewalls for a decision already added: the
+// networks a country or an AS was resolved to at the time, since the databases may have
+// been refreshed since then.
+func (b *BackendCTX) applied(decision *models.Decision) ([]*models.Decision, error) {
+	if networks, ok := b.cache.appliedNetworks(decision); ok {
+		return networkDecisions(decision, networks), nil
+	}
+
+	return b.expand(decision)
 }
 
 func (b *BackendCTX) Add(decision *models.Decision) error {
-	return b.firewall.Add(decision)
+	if err := b.checkScope(decision); err != nil {
+		return err
+	}
+
+	if err := validateDecision(decision); err != nil {
+		return err
+	}
+
+	decision = normalize(decision)
+
+	if err := b.checkPrefix(decision); err != nil {
+		return err
+	}
+
+	if !b.scenarios.allows(decision) {
+		metrics.TotalFilteredDecisions.Inc()
+		return fmt.Errorf("%w: scenario of '%s' is filtered out", ErrSkipped, *decision.Value)
+	}
+
+	// the overrides would give a new lifetime to a decision that is over
+	if b.skipExpired {
+		if left, ok := remaining(decision, time.Now()); ok && left <= 0 {
+			metrics.TotalExpiredDecisions.Inc()
+			return fmt.Errorf("%w: the decision for '%s' expired %s ago", ErrSkipped, *decision.Value, -left.Round(time.Second))
+		}
+	}
+
+	decision = b.durations.apply(decision)
+
+	if allowed, ok := b.allowlist.overlaps(*decision.Value); ok {
+		log.Infof("ignoring decision for '%s', it overlaps with allowed %s", *decision.Value, allowed)
+
+		// the allowlist may have changed since the decision was applied. The caller
+		// doesn't commit the skipped decisions, so the ban is removed right away.
+		if b.cache.has(decision) {
+			if err := b.Delete(decision); err != nil {
+				return err
+			}
+
+			if err := b.Commit(); err != nil {
+				return fmt.Errorf("unable to remove the ban of allowed '%s': %w", *decision.Value, err)
+			}
+
+			log.Infof("ban of '%s' removed, it's allowed now", *decision.Value)
+		}
+
+		b.allowed.added(decision)
+
+		return fmt.Errorf("%w: '%s' is allowed", ErrSkipped, *decision.Value)
+	}
+
+	if !b.cache.needsAdd(decision) {
+		return fmt.Errorf("%w: '%s' is already banned", ErrSkipped, *decision.Value)
+	}
+
+	if !b.cache.has(decision) {
+		if err := b.makeRoom(decisionFamily(decision)); err != nil {
+			return err
+		}
+	}
+
+	if b.imported.claim(decision, time.Now()) {
+		b.cache.added(decision)
+		return fmt.Errorf("%w: '%s' is already in the firewall", ErrSkipped, *decision.Value)
+	}
+
+	decisions, err := b.expand(decision)
+	if err != nil {
+		return err
+	}
+
+	// a country or an AS added again after a refresh of its database
+	if err := b.removeDropped(decision, decisions); err != nil {
+		return err
+	}
+
+	for _, d := range decisions {
+		if err := b.addTo(d); err != nil {
+			return err
+		}
+	}
+
+	b.cache.added(decision)
+
+	if resolved(decision) {
+		networks := make([]string, 0, len(decisions))
+		for _, d := range decisions {
+			networks = append(networks, *d.Value)
+		}
+
+		b.cache.setNetworks(decision, networks)
+	}
+
+	return nil
+}
+
+// removeDropped removes from the firewalls the networks a decision was resolved to when it
+// was applied, and that it doesn't resolve to anymore.
+func (b *BackendCTX) removeDropped(decision *models.Decision, decisions []*models.Decision) error {
+	previous, ok := b.cache.appliedNetworks(decision)
+	if !ok {
+		return nil
+	}
+
+	current := make(map[string]struct{}, len(decisions))
+	for _, d := range decisions {
+		current[*d.Value] = struct{}{}
+	}
+
+	dropped := []string{}
+
+	for _, network := range previous {
+		if _, ok := current[network]; !ok {
+			dropped = append(dropped, network)
+		}
+	}
+
+	for _, d := range networkDecisions(decision, dropped) {
+		if err := b.deleteFrom(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeRoom makes sure a new decision can be added without exceeding max_banned_ips,
+// evicting the oldest decisions of the family if needed.
+func (b *BackendCTX) makeRoom(family string) error {
+	limit := b.maxBanned[family]
+	if limit == 0 {
+		return nil
+	}
+
+	for b.cache.count(family) >= limit {
+		if !b.evict {
+			return fmt.Errorf("%w: the maximum of %d %s bans is reached", ErrSkipped, limit, family)
+		}
+
+		oldest := b.cache.oldest(family)
+		if oldest == nil {
+			return nil
+		}
+
+		log.Infof("the maximum of %d %s bans is reached, evicting '%s'", limit, family, *oldest.Value)
+
+		if err := b.Delete(oldest); err != nil {
+			return fmt.Errorf("unable to evict '%s': %w", *oldest.Value, err)
+		}
+	}
+
+	return nil
 }
 
 func (b *BackendCTX) Delete(decision *models.Decision) error {
-	return b.firewall.Delete(decision)
+	if err := b.checkScope(decision); err != nil {
+		return err
+	}
+
+	if err := validateDecision(decision); err != nil {
+		return err
+	}
+
+	decision = normalize(decision)
+
+	b.allowed.deleted(decision)
+
+	// the firewalls may hold bans the cache doesn't know, ie. imported ones or the ones
+	// left by a previous run, they are removed all the same
+	b.imported.release(decision)
+
+	decisions, err := b.applied(decision)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range decisions {
+		if err := b.deleteFrom(d); err != nil {
+			return err
+		}
+	}
+
+	b.cache.deleted(decision)
+
+	return nil
 }
 
-func (b *BackendCTX) CollectMetrics() {
-	b.firewall.CollectMetrics()
+// SweepInterval returns how often Sweep must run, the shortest interval of the
+// firewalls, 0 if none of them needs it.
+func (b *BackendCTX) SweepInterval() time.Duration {
+	var ret time.Duration
+
+	for _, fw := range b.all() {
+		s, ok := fw.(types.Sweeper)
+		if !ok {
+			continue
+		}
+
+		if interval := s.SweepInterval(); interval > 0 && (ret == 0 || interval < ret) {
+			ret = interval
+		}
+	}
+
+	return ret
 }
 
-func isPFSupported(runtimeOS string) bool {
-	var supported bool
+// Sweep removes the expired entries of the firewalls whose entries don't expire by
+// themselves, in case the delete events of their decisions were missed, and forgets
+// the expired decisions. It must not run while a batch of decisions is being applied.
+func (b *BackendCTX) Sweep(now time.Time) {
+	for _, fw := range b.all() {
+		s, ok := fw.(types.Sweeper)
+		if !ok {
+			continue
+		}
 
-	switch runtimeOS {
-	case "openbsd", "freebsd":
-		supported = true
-	default:
-		supported = false
+		values := s.Expired(now)
+		if len(values) == 0 {
+			continue
+		}
+
+		log.Debugf("removing %d expired entries", len(values))
+
+		for _, value := range values {
+			value := value
+			decision := &models.Decision{Value: &value}
+
+			b.imported.release(decision)
+
+			if err := fw.Delete(decision); err != nil {
+				log.Errorf("unable to remove the expired entry '%s': %s", value, err)
+			}
+		}
+
+		if err := fw.Commit(); err != nil {
+			log.Errorf("unable to commit the expired entries: %s", err)
+		}
 	}
 
-	return supported
+	if expired := b.cache.expire(now); expired > 0 {
+		log.Debugf("%d expired decisions forgotten", expired)
+	}
 }
 
-func NewBackend(config *cfg.BouncerConfig) (*BackendCTX, error) {
-	var err error
+// Reconcile checks that the tables of the firewalls still exist. The tables that have been
+// removed by someone else are created again, with the decisions they should contain.
+func (b *BackendCTX) Reconcile() {
+	for _, fw := range b.all() {
+		r, ok := fw.(types.Reconciler)
+		if !ok {
+			continue
+		}
 
-	b := &BackendCTX{}
-	log.Printf("backend type : %s", config.Mode)
-	if config.DisableIPV6 {
-		log.Println("IPV6 is disabled")
+		missing, err := r.Missing()
+		if err != nil {
+			log.Errorf("unable to check the firewall tables: %s", err)
+			continue
+		}
+
+		if !missing {
+			continue
+		}
+
+		log.Warning("the firewall tables have been removed or flushed, creating them again")
+
+		if err := r.Recreate(); err != nil {
+			log.Errorf("unable to create the firewall tables again: %s", err)
+			continue
+		}
+
+		// they went away with the tables
+		b.imported.reset()
+
+		restored := 0
+
+		for _, decision := range b.cache.pending() {
+			if !slices.Contains(b.firewallsFor(decision), fw) {
+				continue
+			}
+
+			decisions, err := b.applied(decision)
+			if err != nil {
+				log.Errorf("unable to restore decision for '%s': %s", *decision.Value, err)
+				continue
+			}
+
+			for _, d := range decisions {
+				if err := fw.Add(d); err != nil {
+					log.Errorf("unable to restore decision for '%s': %s", *d.Value, err)
+				}
+			}
+
+			restored++
+		}
+
+		if err := fw.Commit(); err != nil {
+			log.Errorf("unable to restore decisions: %s", err)
+			continue
+		}
+
+		log.Infof("%d decisions restored", restored)
+	}
+}
+
+// SelfTest checks that the bans of each firewall are enforced, the result is only logged
+// since the bouncer still works if the rules are added later.
+func (b *BackendCTX) SelfTest() {
+	for _, fw := range b.all() {
+		tester, ok := fw.(types.SelfTester)
+		if !ok {
+			continue
+		}
+
+		if err := tester.SelfTest(); err != nil {
+			log.Warningf("self-test failed, the bans will NOT block any traffic: %s", err)
+			continue
+		}
+
+		log.Info("self-test passed, the firewall rules use the bouncer tables")
 	}
-	switch config.Mode {
-	case cfg.IptablesMode, cfg.IpsetMode:
-		if runtime.GOOS != "linux" {
-			return nil, fmt.Errorf("iptables and ipset is linux only")
+}
+
+// Flush removes all the bans from the firewall, and prepares it for new ones.
+func (b *BackendCTX) Flush() error {
+	if err := b.ShutDown(); err != nil {
+		return err
+	}
+
+	return b.Init()
+}
+
+// Bans returns the decisions currently applied to the firewall.
+func (b *BackendCTX) Bans() []Ban {
+	return b.cache.bans()
+}
+
+// List reads the bans back from the firewalls, for the ones that support it.
+func (b *BackendCTX) List() ([]types.Entry, error) {
+	ret := []types.Entry{}
+
+	for _, fw := range b.all() {
+		lister, ok := fw.(types.Lister)
+		if !ok {
+			continue
 		}
-		b.firewall, err = iptables.NewIPTables(config)
+
+		entries, err := lister.List()
 		if err != nil {
 			return nil, err
 		}
-	case cfg.NftablesMode:
-		if runtime.GOOS != "linux" {
-			return nil, fmt.Errorf("nftables is linux only")
+
+		ret = append(ret, entries...)
+	}
+
+	return ret, nil
+}
+
+// IsBanned tells whether an IP is banned, directly or as part of a range.
+func (b *BackendCTX) IsBanned(ip string) (bool, error) {
+	target, err := parseNetwork(ip)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ban := range b.cache.bans() {
+		network, err := parseNetwork(ban.Value)
+		if err != nil {
+			continue
+		}
+
+		if network.Contains(target.IP) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// exportMetrics sets the gauges from the counters of a firewall.
+func exportMetrics(snapshot types.Metrics) {
+	metrics.TotalDroppedPackets.Set(snapshot.DroppedPackets)
+	metrics.TotalDroppedBytes.Set(snapshot.DroppedBytes)
+	metrics.TotalActiveBannedIPs.Set(snapshot.Banned())
+
+	for family, count := range snapshot.BannedByFamily {
+		metrics.ActiveBannedIPsByFamily.WithLabelValues(family).Set(count)
+	}
+}
+
+// CollectMetrics exports the counters of the default firewall, and the sources of all
+// the bans, every metrics interval.
+func (b *BackendCTX) CollectMetrics() {
+	go b.collectSourceMetrics()
+
+	t := b.metricsTicker()
+
+	for range t.C {
+		snapshot, err := b.firewall.CollectMetrics()
+		if errors.Is(err, types.ErrMetricsUnsupported) {
+			log.Warningf("%s, the firewall metrics are disabled", err)
+			return
+		}
+
+		if err != nil {
+			log.Errorf("can't collect the firewall metrics: %s", err)
+			continue
+		}
+
+		exportMetrics(snapshot)
+
+		b.metricsMu.Lock()
+		b.lastMetrics = &snapshot
+		b.metricsMu.Unlock()
+	}
+}
+
+// metricsTicker returns a ticker of the metrics interval, which follows its reloads.
+func (b *BackendCTX) metricsTicker() *jitter.Ticker {
+	b.metricsMu.Lock()
+	defer b.metricsMu.Unlock()
+
+	t := jitter.NewTicker(metrics.MetricCollectionInterval)
+	b.metricsTickers = append(b.metricsTickers, t)
+
+	return t
+}
+
+// Reload applies the options of a reloaded configuration that don't require a restart:
+// the metrics interval, and the ones the firewalls reload themselves.
+func (b *BackendCTX) Reload(config *cfg.BouncerConfig) {
+	interval := metrics.DefaultMetricCollectionInterval
+	if config.PrometheusConfig.Interval != "" {
+		// already validated by the config loader
+		interval, _ = time.ParseDuration(config.PrometheusConfig.Interval)
+	}
+
+	b.metricsMu.Lock()
+	if interval != metrics.MetricCollectionInterval {
+		log.Infof("collecting the metrics every %s", interval)
+		metrics.MetricCollectionInterval = interval
+
+		for _, t := range b.metricsTickers {
+			t.Reset(interval)
+		}
+	}
+	b.metricsMu.Unlock()
+
+	for _, fw := range b.all() {
+		if r, ok := fw.(reloader); ok {
+			r.Reload(config)
 		}
-		b.firewall, err = nftables.NewNFTables(config)
+	}
+}
+
+// LastMetrics returns the counters collected last by CollectMetrics, false until there are some.
+func (b *BackendCTX) LastMetrics() (types.Metrics, bool) {
+	b.metricsMu.Lock()
+	defer b.metricsMu.Unlock()
+
+	if b.lastMetrics == nil {
+		return types.Metrics{}, false
+	}
+
+	return *b.lastMetrics, true
+}
+
+// originConfig returns the configuration of the firewall dedicated to an origin.
+func originConfig(config *cfg.BouncerConfig, blacklists cfg.OriginBlacklists) *cfg.BouncerConfig {
+	ret := *config
+	ret.BlacklistsIpv4 = blacklists.Ipv4
+	ret.BlacklistsIpv6 = blacklists.Ipv6
+	// nftables tables are removed on shutdown, don't share them with the default firewall
+	ret.Nftables.Ipv4.Table = blacklists.Ipv4
+	ret.Nftables.Ipv6.Table = blacklists.Ipv6
+
+	return &ret
+}
+
+func NewBackend(config *cfg.BouncerConfig) (*BackendCTX, error) {
+	var err error
+
+	b := &BackendCTX{
+		origins:      make(map[string]types.Backend),
+		extra:        make(map[string]types.Backend),
+		allOrNothing: config.ExtraModesPolicy == cfg.AllOrNothing,
+		flushOwned:   config.FlushMode == cfg.FlushModeOwned,
+		skipExpired:  *config.SkipExpiredDecisions,
+		cache:        newDecisionCache(),
+		allowed:      newDecisionCache(),
+		imported:     newImportedBans(),
+		maxBanned: map[string]int{
+			"ipv4": config.MaxBannedIPs.Ipv4,
+			"ipv6": config.MaxBannedIPs.Ipv6,
+		},
+		minPrefix: map[string]int{
+			"ipv4": config.MinPrefixLength.Ipv4,
+			"ipv6": config.MinPrefixLength.Ipv6,
+		},
+		evict:     config.MaxBannedIPs.Policy == cfg.EvictOldest,
+		durations: config.DurationOverrides,
+		scenarios: scenarioFilter{include: config.IncludeScenarios, exclude: config.ExcludeScenarios},
+	}
+
+	b.allowlist, err = newAllowlist(config.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.GeoIPDatabase != "" {
+		b.geoip, err = geoip.NewResolver(config.GeoIPDatabase)
 		if err != nil {
 			return nil, err
 		}
-	case "pf":
-		if !isPFSupported(runtime.GOOS) {
-			log.Warning("pf mode can only work with openbsd and freebsd. It is available on other platforms only for testing purposes")
+	}
+
+	if config.ASNDatabase != "" {
+		b.asn, err = geoip.NewASNResolver(config.ASNDatabase)
+		if err != nil {
+			return nil, err
 		}
-		b.firewall, err = pf.NewPF(config)
+	}
+	log.Printf("backend type : %s", config.Mode)
+	if config.DisableIPV4 {
+		log.Println("IPV4 is disabled")
+	}
+	if config.DisableIPV6 {
+		log.Println("IPV6 is disabled")
+	}
+
+	b.firewall, err = newFirewall(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for origin, blacklists := range config.OriginBlacklists {
+		log.Infof("decisions from origin '%s' go to %s and %s", origin, blacklists.Ipv4, blacklists.Ipv6)
+		b.origins[origin], err = newFirewall(originConfig(config, blacklists))
 		if err != nil {
 			return nil, err
 		}
-	case "dry-run":
-		b.firewall, err = dryrun.NewDryRun(config)
+	}
+
+	for _, mode := range config.ExtraModes {
+		log.Infof("the decisions are also applied by %s (%s)", mode, config.ExtraModesPolicy)
+
+		modeConfig := *config
+		modeConfig.Mode = mode
+
+		b.extra[mode], err = newFirewall(&modeConfig)
 		if err != nil {
 			return nil, err
 		}
-	default:
-		return b, fmt.Errorf("firewall '%s' is not supported", config.Mode)
 	}
+
+	if config.CoalesceRanges {
+		log.Info("overlapping and adjacent ranges are merged")
+
+		b.firewall = newCoalescer(b.firewall)
+		for origin, fw := range b.origins {
+			b.origins[origin] = newCoalescer(fw)
+		}
+
+		for mode, fw := range b.extra {
+			b.extra[mode] = newCoalescer(fw)
+		}
+	}
+
 	return b, nil
 }
@@ -0,0 +1,286 @@
+package backend
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+// decisionCache remembers the decisions applied to the firewall, to avoid
+// sending them again when the LAPI replays them (ie. when the stream reconnects).
+type decisionCache struct {
+	mu        sync.Mutex
+	deadlines map[string]time.Time
+	decisions map[string]*models.Decision
+	// when the decisions were last applied
+	applied map[string]time.Time
+	// keys of the decisions by address family, in insertion order
+	order    map[string]*list.List
+	elements map[string]*list.Element
+	// the networks a country or an AS decision was resolved to when it was applied
+	networks map[string][]string
+}
+
+// Ban is a decision applied to the firewall.
+type Ban struct {
+	Value    string    `json:"value"`
+	Scope    string    `json:"scope"`
+	Scenario string    `json:"scenario,omitempty"`
+	Applied  time.Time `json:"applied"`
+	Until    time.Time `json:"until"`
+}
+
+func newDecisionCache() *decisionCache {
+	c := &decisionCache{}
+	c.init()
+
+	return c
+}
+
+func (c *decisionCache) init() {
+	c.deadlines = make(map[string]time.Time)
+	c.decisions = make(map[string]*models.Decision)
+	c.applied = make(map[string]time.Time)
+	c.order = make(map[string]*list.List)
+	c.elements = make(map[string]*list.Element)
+	c.networks = make(map[string][]string)
+}
+
+// decisionFamily returns "ipv4" or "ipv6" for the decisions on addresses and ranges,
+// and an empty string for the others (ie. countries).
+func decisionFamily(decision *models.Decision) string {
+	network, err := parseNetwork(*decision.Value)
+	if err != nil {
+		return ""
+	}
+
+	if network.IP.To4() != nil {
+		return "ipv4"
+	}
+
+	return "ipv6"
+}
+
+func cacheKey(decision *models.Decision) string {
+	return DecisionScope(decision) + ":" + *decision.Value
+}
+
+func decisionDeadline(decision *models.Decision, now time.Time) time.Time {
+	if decision.Duration == nil {
+		return now
+	}
+
+	duration, err := time.ParseDuration(*decision.Duration)
+	if err != nil {
+		return now
+	}
+
+	return now.Add(duration)
+}
+
+// needsAdd tells whether a decision would ban for longer than what is already applied.
+func (c *decisionCache) needsAdd(decision *models.Decision) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, ok := c.deadlines[cacheKey(decision)]
+	if !ok {
+		return true
+	}
+
+	return decisionDeadline(decision, time.Now()).After(current)
+}
+
+func (c *decisionCache) added(decision *models.Decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(decision)
+	now := time.Now()
+
+	c.deadlines[key] = decisionDeadline(decision, now)
+	c.decisions[key] = decision
+	c.applied[key] = now
+
+	if _, ok := c.elements[key]; ok {
+		return
+	}
+
+	family := decisionFamily(decision)
+	if c.order[family] == nil {
+		c.order[family] = list.New()
+	}
+
+	c.elements[key] = c.order[family].PushBack(key)
+}
+
+// has tells whether a decision has been applied to the firewall.
+func (c *decisionCache) has(decision *models.Decision) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.deadlines[cacheKey(decision)]
+
+	return ok
+}
+
+func (c *decisionCache) deleted(decision *models.Decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(decision)
+
+	delete(c.deadlines, key)
+	delete(c.decisions, key)
+	delete(c.applied, key)
+	delete(c.networks, key)
+
+	if el, ok := c.elements[key]; ok {
+		c.order[decisionFamily(decision)].Remove(el)
+		delete(c.elements, key)
+	}
+}
+
+// expire forgets the decisions whose deadline is before now, and returns how many there were.
+func (c *decisionCache) expire(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expired := 0
+
+	for key, deadline := range c.deadlines {
+		if !deadline.Before(now) {
+			continue
+		}
+
+		if el, ok := c.elements[key]; ok {
+			c.order[decisionFamily(c.decisions[key])].Remove(el)
+			delete(c.elements, key)
+		}
+
+		delete(c.deadlines, key)
+		delete(c.decisions, key)
+		delete(c.applied, key)
+		delete(c.networks, key)
+
+		expired++
+	}
+
+	return expired
+}
+
+// setNetworks records the networks a decision was resolved to, for the ones that are not
+// applied as they are.
+func (c *decisionCache) setNetworks(decision *models.Decision, networks []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.networks[cacheKey(decision)] = networks
+}
+
+// appliedNetworks returns the networks recorded for a decision, false if there are none.
+func (c *decisionCache) appliedNetworks(decision *models.Decision) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	networks, ok := c.networks[cacheKey(decision)]
+
+	return networks, ok
+}
+
+// count returns the number of decisions applied for an address family.
+func (c *decisionCache) count(family string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.order[family] == nil {
+		return 0
+	}
+
+	return c.order[family].Len()
+}
+
+// oldest returns the first decision applied for an address family, nil if there is none.
+func (c *decisionCache) oldest(family string) *models.Decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.order[family] == nil || c.order[family].Len() == 0 {
+		return nil
+	}
+
+	key, _ := c.order[family].Front().Value.(string)
+
+	return c.decisions[key]
+}
+
+// bans returns the applied decisions, with the time they expire.
+func (c *decisionCache) bans() []Ban {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make([]Ban, 0, len(c.deadlines))
+
+	for key, deadline := range c.deadlines {
+		scope, value, _ := strings.Cut(key, ":")
+		ban := Ban{Value: value, Scope: scope, Applied: c.applied[key], Until: deadline}
+
+		if d, ok := c.decisions[key]; ok && d.Scenario != nil {
+			ban.Scenario = *d.Scenario
+		}
+
+		ret = append(ret, ban)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Value < ret[j].Value })
+
+	return ret
+}
+
+// all returns the decisions applied to the firewall, expired or not.
+func (c *decisionCache) all() []*models.Decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make([]*models.Decision, 0, len(c.decisions))
+	for _, decision := range c.decisions {
+		ret = append(ret, decision)
+	}
+
+	return ret
+}
+
+func (c *decisionCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.init()
+}
+
+// pending returns copies of the applied decisions that have not expired yet, with
+// their duration updated to the time left.
+func (c *decisionCache) pending() []*models.Decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	ret := make([]*models.Decision, 0, len(c.decisions))
+
+	for key, decision := range c.decisions {
+		left := c.deadlines[key].Sub(now)
+		if left <= 0 {
+			continue
+		}
+
+		d := *decision
+		duration := left.Round(time.Second).String()
+		d.Duration = &duration
+		ret = append(ret, &d)
+	}
+
+	return ret
+}
@@ -0,0 +1,320 @@
+package backend
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// coalescedEntry is a decision given to the coalescer, or a network applied to the firewall.
+type coalescedEntry struct {
+	decision *models.Decision
+	// zero if the decision doesn't expire
+	deadline time.Time
+}
+
+// coalescer is a firewall that merges the overlapping and adjacent networks of its
+// decisions before applying them, to save space in the sets. The decisions are only
+// recorded by Add and Delete, the firewall is updated on Commit with the difference
+// between the merged networks and the ones already applied.
+type coalescer struct {
+	types.Backend
+	mu sync.Mutex
+	// the decisions, by value
+	members map[string]coalescedEntry
+	// the networks applied to the firewall
+	applied map[netip.Prefix]coalescedEntry
+}
+
+func newCoalescer(fw types.Backend) *coalescer {
+	c := &coalescer{Backend: fw}
+	c.reset()
+
+	return c
+}
+
+func (c *coalescer) reset() {
+	c.members = make(map[string]coalescedEntry)
+	c.applied = make(map[netip.Prefix]coalescedEntry)
+}
+
+// parsePrefix returns the network of an IP address or range.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(value); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("'%s' is not a valid IP address or range", value)
+	}
+
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix.Masked(), nil
+}
+
+// parent returns the network containing p and its sibling.
+func parent(p netip.Prefix) netip.Prefix {
+	return netip.PrefixFrom(p.Addr(), p.Bits()-1).Masked()
+}
+
+// sortPrefixes sorts networks by address, the largest first for a given address so
+// that they come before the networks they contain.
+func sortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+}
+
+// contains tells whether network a contains network b.
+func contains(a netip.Prefix, b netip.Prefix) bool {
+	return a.Bits() <= b.Bits() && a.Contains(b.Addr())
+}
+
+// aggregate returns the smallest sorted list of networks covering exactly the given
+// sorted networks.
+func aggregate(sorted []netip.Prefix) []netip.Prefix {
+	ret := []netip.Prefix{}
+
+	for _, p := range sorted {
+		if n := len(ret); n > 0 && contains(ret[n-1], p) {
+			continue
+		}
+
+		ret = append(ret, p)
+
+		// merge the siblings, the parent may be the sibling of the previous network
+		for n := len(ret); n >= 2; n = len(ret) {
+			a, b := ret[n-2], ret[n-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().BitLen() != b.Addr().BitLen() || parent(a) != parent(b) {
+				break
+			}
+
+			ret = append(ret[:n-2], parent(a))
+		}
+	}
+
+	return ret
+}
+
+func (c *coalescer) Add(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	if _, err := parsePrefix(*decision.Value); err != nil {
+		return err
+	}
+
+	entry := coalescedEntry{decision: decision}
+
+	if decision.Duration != nil {
+		duration, err := time.ParseDuration(*decision.Duration)
+		if err != nil {
+			return err
+		}
+
+		entry.deadline = time.Now().Add(duration)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.members[*decision.Value] = entry
+
+	return nil
+}
+
+func (c *coalescer) Delete(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.members, *decision.Value)
+
+	return nil
+}
+
+// later tells whether deadline a is after b, a zero deadline being the latest.
+func later(a time.Time, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return a.IsZero() && !b.IsZero()
+	}
+
+	return a.After(b)
+}
+
+// merged returns the networks to apply, each one with the latest deadline of the
+// decisions it covers. The expired decisions are forgotten, since the firewall
+// has removed them already.
+func (c *coalescer) merged(now time.Time) map[netip.Prefix]coalescedEntry {
+	entries := make(map[netip.Prefix]coalescedEntry, len(c.members))
+
+	for value, entry := range c.members {
+		if !entry.deadline.IsZero() && entry.deadline.Before(now) {
+			delete(c.members, value)
+			continue
+		}
+
+		// validated by Add
+		p, _ := parsePrefix(value)
+		if current, ok := entries[p]; !ok || later(entry.deadline, current.deadline) {
+			entries[p] = entry
+		}
+	}
+
+	prefixes := maps.Keys(entries)
+	sortPrefixes(prefixes)
+
+	networks := aggregate(prefixes)
+	ret := make(map[netip.Prefix]coalescedEntry, len(networks))
+
+	// both lists are sorted, the network containing a prefix is the same or comes after
+	// the one containing the previous prefix
+	i := 0
+
+	for _, p := range prefixes {
+		for !contains(networks[i], p) {
+			i++
+		}
+
+		entry := entries[p]
+		if merged, ok := ret[networks[i]]; !ok || later(entry.deadline, merged.deadline) {
+			ret[networks[i]] = entry
+		}
+	}
+
+	return ret
+}
+
+// networkDecision returns the decision applying a merged network to the firewall.
+func networkDecision(network netip.Prefix, entry coalescedEntry, now time.Time) *models.Decision {
+	d := *entry.decision
+
+	value := network.String()
+	scope := "Range"
+
+	if network.IsSingleIP() {
+		value = network.Addr().String()
+		scope = "Ip"
+	}
+
+	d.Value = &value
+	d.Scope = &scope
+
+	if !entry.deadline.IsZero() {
+		duration := entry.deadline.Sub(now).Truncate(time.Second).String()
+		d.Duration = &duration
+	}
+
+	return &d
+}
+
+func (c *coalescer) Commit() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	merged := c.merged(now)
+
+	deleted, added := 0, 0
+
+	// the networks that have changed, or have to be applied again with a later deadline
+	for network, entry := range c.applied {
+		if next, ok := merged[network]; ok && !later(next.deadline, entry.deadline) {
+			continue
+		}
+
+		if err := c.Backend.Delete(entry.decision); err != nil {
+			return err
+		}
+
+		delete(c.applied, network)
+		deleted++
+	}
+
+	for network, entry := range merged {
+		if _, ok := c.applied[network]; ok {
+			continue
+		}
+
+		d := networkDecision(network, entry, now)
+		if err := c.Backend.Add(d); err != nil {
+			return err
+		}
+
+		c.applied[network] = coalescedEntry{decision: d, deadline: entry.deadline}
+		added++
+	}
+
+	if deleted+added > 0 {
+		log.Debugf("%d decisions merged into %d networks: %d removed, %d added", len(c.members), len(c.applied), deleted, added)
+	}
+
+	return c.Backend.Commit()
+}
+
+func (c *coalescer) ShutDown() error {
+	c.mu.Lock()
+	c.reset()
+	c.mu.Unlock()
+
+	return c.Backend.ShutDown()
+}
+
+// Missing and Recreate let the firewall be reconciled. The decisions are added
+// again after the tables are created, they must all be applied on the next commit.
+func (c *coalescer) Missing() (bool, error) {
+	r, ok := c.Backend.(types.Reconciler)
+	if !ok {
+		return false, nil
+	}
+
+	return r.Missing()
+}
+
+func (c *coalescer) Recreate() error {
+	c.mu.Lock()
+	c.reset()
+	c.mu.Unlock()
+
+	return c.Backend.(types.Reconciler).Recreate()
+}
+
+func (c *coalescer) List() ([]types.Entry, error) {
+	l, ok := c.Backend.(types.Lister)
+	if !ok {
+		return nil, nil
+	}
+
+	return l.List()
+}
+
+func (c *coalescer) SelfTest() error {
+	t, ok := c.Backend.(types.SelfTester)
+	if !ok {
+		return nil
+	}
+
+	return t.SelfTest()
+}
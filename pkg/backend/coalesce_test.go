@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{"overlap", []string{"192.0.2.0/24", "192.0.2.1/32", "192.0.2.128/25"}, "192.0.2.0/24"},
+		{"adjacent", []string{"192.0.2.0/25", "192.0.2.128/25"}, "192.0.2.0/24"},
+		{"adjacent chain", []string{"192.0.2.0/26", "192.0.2.64/26", "192.0.2.128/25"}, "192.0.2.0/24"},
+		{"adjacent hosts", []string{"192.0.2.2/32", "192.0.2.3/32"}, "192.0.2.2/31"},
+		{"not siblings", []string{"192.0.2.1/32", "192.0.2.2/32"}, "192.0.2.1/32,192.0.2.2/32"},
+		{"duplicate", []string{"192.0.2.1/32", "192.0.2.1/32"}, "192.0.2.1/32"},
+		{"families", []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"}, "0.0.0.0/0,::/0"},
+	}
+
+	for _, tt := range tests {
+		prefixes := []netip.Prefix{}
+		for _, v := range tt.values {
+			prefixes = append(prefixes, netip.MustParsePrefix(v))
+		}
+
+		sortPrefixes(prefixes)
+
+		got := []string{}
+		for _, p := range aggregate(prefixes) {
+			got = append(got, p.String())
+		}
+
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s: aggregated to %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	fw := newFakeFirewall()
+	c := newCoalescer(fw)
+
+	for _, value := range []string{"192.0.2.0/25", "192.0.2.128/25", "192.0.2.1", "198.51.100.1"} {
+		if err := c.Add(newDecision(value, "Range", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.0/24", "198.51.100.1")
+
+	// the networks it was merged into are split again
+	if err := c.Delete(newDecision("192.0.2.128/25", "Range", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.0/25", "198.51.100.1")
+
+	// 192.0.2.1 is still covered by its own decision
+	if err := c.Delete(newDecision("192.0.2.0/25", "Range", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1", "198.51.100.1")
+}
+
+func TestCoalescerDuplicate(t *testing.T) {
+	fw := newFakeFirewall()
+	c := newCoalescer(fw)
+
+	for i := 0; i < 2; i++ {
+		if err := c.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1")
+
+	if err := c.Delete(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// the layout of time.Time.String, which some LAPI versions use for until
+const untilStringLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// remaining returns the time left before a decision expires: from until if the LAPI sent
+// it, which also covers the time the decision waited in the bouncer, otherwise from the
+// duration, which is relative to the response of the LAPI. ok is false if neither can be read.
+func remaining(decision *models.Decision, now time.Time) (time.Duration, bool) {
+	if decision.Until != "" {
+		for _, layout := range []string{time.RFC3339Nano, untilStringLayout} {
+			if until, err := time.Parse(layout, decision.Until); err == nil {
+				return until.Sub(now), true
+			}
+		}
+	}
+
+	if decision.Duration == nil {
+		return 0, false
+	}
+
+	duration, err := time.ParseDuration(*decision.Duration)
+	if err != nil {
+		return 0, false
+	}
+
+	return duration, true
+}
+
+// durationOverrides changes the duration of the decisions according to their scenario.
+type durationOverrides []cfg.DurationOverride
+
+// apply returns the decision with the duration of the first matching override, or
+// the decision itself if there is none. The original decision is not modified.
+func (o durationOverrides) apply(decision *models.Decision) *models.Decision {
+	scenario := ""
+	if decision.Scenario != nil {
+		scenario = *decision.Scenario
+	}
+
+	for _, override := range o {
+		if !strings.HasPrefix(scenario, override.Scenario) {
+			continue
+		}
+
+		if decision.Duration != nil && *decision.Duration == override.Duration {
+			return decision
+		}
+
+		log.Debugf("duration of '%s' (%s) overridden to %s", *decision.Value, scenario, override.Duration)
+
+		duration := override.Duration
+		d := *decision
+		d.Duration = &duration
+
+		return &d
+	}
+
+	return decision
+}
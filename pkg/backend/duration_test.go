@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDurationOverrides(t *testing.T) {
+	overrides := durationOverrides{
+		{Scenario: "crowdsecurity/http-cve", Duration: "720h"},
+		{Scenario: "crowdsecurity/ssh-", Duration: "4h"},
+		// the default
+		{Scenario: "", Duration: "1h"},
+	}
+
+	tests := []struct {
+		scenario string
+		want     string
+	}{
+		{"crowdsecurity/http-cve-2021-41773", "720h"},
+		{"crowdsecurity/ssh-bf", "4h"},
+		{"crowdsecurity/ssh-slow-bf", "4h"},
+		{"crowdsecurity/http-probing", "1h"},
+		{"", "1h"},
+	}
+
+	for _, tt := range tests {
+		d := newDecision("192.0.2.1", "Ip", 24*time.Hour)
+		scenario := tt.scenario
+		d.Scenario = &scenario
+
+		got := overrides.apply(d)
+		if *got.Duration != tt.want {
+			t.Errorf("%s: duration %s, want %s", tt.scenario, *got.Duration, tt.want)
+		}
+
+		// the decision of the LAPI is copied
+		if *d.Duration != "24h0m0s" {
+			t.Fatalf("%s: the original duration was changed to %s", tt.scenario, *d.Duration)
+		}
+	}
+}
+
+func TestDurationOverridesWithoutDefault(t *testing.T) {
+	overrides := durationOverrides{{Scenario: "crowdsecurity/ssh-", Duration: "4h"}}
+
+	d := newDecision("192.0.2.1", "Ip", 24*time.Hour)
+	scenario := "crowdsecurity/http-probing"
+	d.Scenario = &scenario
+
+	if got := overrides.apply(d); got != d {
+		t.Fatalf("the duration was changed to %s without a matching override", *got.Duration)
+	}
+
+	// nor without a scenario
+	if got := overrides.apply(newDecision("192.0.2.1", "Ip", time.Hour)); *got.Duration != "1h0m0s" {
+		t.Fatalf("the duration was changed to %s without a scenario", *got.Duration)
+	}
+}
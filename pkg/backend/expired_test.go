@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+func TestRemaining(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		duration string
+		until    string
+		want     time.Duration
+		ok       bool
+	}{
+		{"duration", "3h59m", "", 3*time.Hour + 59*time.Minute, true},
+		{"past due", "-5m", "", -5 * time.Minute, true},
+		// until also covers the time the decision waited in the bouncer
+		{"until", "4h", "2024-05-01T13:00:00Z", time.Hour, true},
+		{"until passed", "4h", "2024-05-01T11:00:00Z", -time.Hour, true},
+		{"until of the stream", "4h", "2024-05-01 12:30:00.123 +0000 UTC", 30*time.Minute + 123*time.Millisecond, true},
+		{"invalid until", "4h", "tomorrow", 4 * time.Hour, true},
+		{"invalid duration", "forever", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		d := newDecision("192.0.2.1", "Ip", 0)
+		d.Duration = &tt.duration
+		d.Until = tt.until
+
+		got, ok := remaining(d, now)
+		if got != tt.want || ok != tt.ok {
+			t.Fatalf("%s: got %s, %t, want %s, %t", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSkipExpired(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+	b.skipExpired = true
+	// the overrides don't give a new lifetime to the expired decisions
+	b.durations = durationOverrides{{Scenario: "", Duration: "24h"}}
+
+	expired := testutil.ToFloat64(metrics.TotalExpiredDecisions)
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", -time.Minute)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("a past-due decision gives %v", err)
+	}
+
+	past := newDecision("192.0.2.2", "Ip", time.Hour)
+	past.Until = time.Now().Add(-time.Second).Format(time.RFC3339Nano)
+
+	if err := b.Add(past); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("a decision until the past gives %v", err)
+	}
+
+	if err := b.Add(newDecision("192.0.2.3", "Ip", time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.3")
+
+	if got := testutil.ToFloat64(metrics.TotalExpiredDecisions) - expired; got != 2 {
+		t.Fatalf("%v decisions counted as expired, want 2", got)
+	}
+}
+
+func TestSkipExpiredDisabled(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", -time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1")
+}
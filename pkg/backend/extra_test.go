@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestExtraBackend returns a backend applying the decisions to a default firewall and an extra one.
+func newTestExtraBackend(allOrNothing bool) (*BackendCTX, *fakeFirewall, *fakeFirewall) {
+	fw := newFakeFirewall()
+	extra := newFakeFirewall()
+
+	b := newTestBackend(fw)
+	b.extra["exabgp"] = extra
+	b.allOrNothing = allOrNothing
+
+	return b, fw, extra
+}
+
+func TestExtraModes(t *testing.T) {
+	for _, allOrNothing := range []bool{false, true} {
+		b, fw, extra := newTestExtraBackend(allOrNothing)
+
+		if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		assertBanned(t, fw, "192.0.2.1")
+		assertBanned(t, extra, "192.0.2.1")
+
+		if err := b.Delete(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		assertBanned(t, fw)
+		assertBanned(t, extra)
+
+		if err := b.ShutDown(); err != nil {
+			t.Fatal(err)
+		}
+
+		if fw.shutdowns != 1 || extra.shutdowns != 1 {
+			t.Fatalf("all-or-nothing %t: shut down %d and %d times", allOrNothing, fw.shutdowns, extra.shutdowns)
+		}
+	}
+}
+
+func TestExtraModesBestEffort(t *testing.T) {
+	b, fw, extra := newTestExtraBackend(false)
+	extra.refuse["192.0.2.1"] = true
+
+	// applied by the firewalls accepting it
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	fw.refuse["192.0.2.2"] = true
+	extra.refuse["192.0.2.2"] = true
+
+	// refused by all of them
+	if err := b.Add(newDecision("192.0.2.2", "Ip", time.Hour)); err == nil {
+		t.Fatal("a decision refused by all the firewalls is accepted")
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1")
+	assertBanned(t, extra)
+}
+
+func TestExtraModesAllOrNothing(t *testing.T) {
+	b, fw, extra := newTestExtraBackend(true)
+	extra.refuse["192.0.2.1"] = true
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err == nil {
+		t.Fatal("a decision refused by a firewall is accepted")
+	}
+
+	if err := b.Add(newDecision("192.0.2.2", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed from the firewall accepting it
+	assertBanned(t, fw, "192.0.2.2")
+	assertBanned(t, extra, "192.0.2.2")
+}
+
+func TestExtraModesCommitError(t *testing.T) {
+	b, fw, extra := newTestExtraBackend(false)
+	extra.commitErr = errors.New("pipe closed")
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the other firewalls are committed anyway
+	if err := b.Commit(); !errors.Is(err, extra.commitErr) {
+		t.Fatalf("commit gives %v", err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1")
+	assertBanned(t, extra)
+
+	if fw.commits != 1 || extra.commits != 1 {
+		t.Fatalf("committed %d and %d times", fw.commits, extra.commits)
+	}
+}
@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// fakeFirewall applies the changes to an in-memory table on commit.
+type fakeFirewall struct {
+	mu        sync.Mutex
+	table     map[string]bool
+	toAdd     []string
+	toDelete  []string
+	commits   int
+	shutdowns int
+	// Add fails for these values
+	refuse map[string]bool
+	// Commit fails if set, without applying the changes
+	commitErr error
+	// List reports these values as added by someone else
+	foreign map[string]bool
+	// ShutDown leaves the table in place, like a firewall sharing it
+	keep bool
+	// List reports the time left of these values
+	ttl map[string]time.Duration
+	// the scope each value was last added with
+	scopes map[string]string
+}
+
+func newFakeFirewall() *fakeFirewall {
+	return &fakeFirewall{
+		table:   make(map[string]bool),
+		refuse:  make(map[string]bool),
+		foreign: make(map[string]bool),
+		ttl:     make(map[string]time.Duration),
+		scopes:  make(map[string]string),
+	}
+}
+
+func (f *fakeFirewall) Init() error { return nil }
+
+func (f *fakeFirewall) ShutDown() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.shutdowns++
+	if !f.keep {
+		f.table = make(map[string]bool)
+	}
+
+	return nil
+}
+
+func (f *fakeFirewall) Add(decision *models.Decision) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.refuse[*decision.Value] {
+		return errors.New("refused")
+	}
+
+	f.toAdd = append(f.toAdd, *decision.Value)
+
+	if decision.Scope != nil {
+		f.scopes[*decision.Value] = *decision.Scope
+	}
+
+	return nil
+}
+
+func (f *fakeFirewall) Delete(decision *models.Decision) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.toDelete = append(f.toDelete, *decision.Value)
+
+	// the deletions are applied first, a decision added then deleted isn't applied
+	for i, value := range f.toAdd {
+		if value == *decision.Value {
+			f.toAdd = append(f.toAdd[:i], f.toAdd[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeFirewall) Commit() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commits++
+
+	if f.commitErr != nil {
+		f.toAdd, f.toDelete = nil, nil
+		return f.commitErr
+	}
+
+	for _, value := range f.toDelete {
+		delete(f.table, value)
+	}
+
+	for _, value := range f.toAdd {
+		f.table[value] = true
+	}
+
+	f.toAdd, f.toDelete = nil, nil
+
+	return nil
+}
+
+func (f *fakeFirewall) CollectMetrics() (types.Metrics, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return types.Metrics{BannedByFamily: map[string]float64{"ipv4": float64(len(f.table))}}, nil
+}
+
+func (f *fakeFirewall) List() ([]types.Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ret := []types.Entry{}
+	for value := range f.table {
+		ret = append(ret, types.Entry{Value: value, TTL: f.ttl[value], Foreign: f.foreign[value]})
+	}
+
+	return ret, nil
+}
+
+// pending returns the values waiting to be added on commit, sorted.
+func (f *fakeFirewall) pending() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ret := append([]string{}, f.toAdd...)
+	sort.Strings(ret)
+
+	return ret
+}
+
+// banned returns the values in the table, sorted.
+func (f *fakeFirewall) banned() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ret := make([]string, 0, len(f.table))
+	for value := range f.table {
+		ret = append(ret, value)
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// newTestBackend returns a backend applying the decisions to fw, without limits.
+func newTestBackend(fw types.Backend) *BackendCTX {
+	return &BackendCTX{
+		firewall:  fw,
+		origins:   make(map[string]types.Backend),
+		extra:     make(map[string]types.Backend),
+		cache:     newDecisionCache(),
+		allowed:   newDecisionCache(),
+		imported:  newImportedBans(),
+		maxBanned: map[string]int{},
+		minPrefix: map[string]int{},
+	}
+}
+
+func newDecision(value string, scope string, duration time.Duration) *models.Decision {
+	d := duration.String()
+	decisionType := "ban"
+
+	return &models.Decision{Value: &value, Scope: &scope, Duration: &d, Type: &decisionType}
+}
+
+func assertBanned(t *testing.T, fw *fakeFirewall, want ...string) {
+	t.Helper()
+
+	got := fw.banned()
+	sort.Strings(want)
+
+	if len(got) != len(want) {
+		t.Fatalf("banned %v, want %v", got, want)
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("banned %v, want %v", got, want)
+		}
+	}
+}
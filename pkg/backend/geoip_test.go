@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeResolver returns the networks of its map, which the tests change like a database refresh.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) Networks(key string) ([]string, error) {
+	networks, ok := r[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown key '%s'", key)
+	}
+
+	return networks, nil
+}
+
+func TestCountryDecision(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+	b.geoip = fakeResolver{"FR": {"192.0.2.0/24", "198.51.100.0/24"}}
+
+	if err := b.Add(newDecision("FR", "Country", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.0/24", "198.51.100.0/24")
+
+	if err := b.Delete(newDecision("FR", "country", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
+
+func TestCountryDeleteAfterRefresh(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+	resolver := fakeResolver{"FR": {"192.0.2.0/24", "198.51.100.0/24"}}
+	b.geoip = resolver
+
+	if err := b.Add(newDecision("FR", "Country", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the database has been refreshed, the networks applied before are removed anyway
+	resolver["FR"] = []string{"203.0.113.0/24"}
+
+	if err := b.Delete(newDecision("FR", "Country", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
+
+func TestCountryAddAfterRefresh(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+	resolver := fakeResolver{"FR": {"192.0.2.0/24", "198.51.100.0/24"}}
+	b.geoip = resolver
+
+	if err := b.Add(newDecision("FR", "Country", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// extending the ban applies the new networks, and removes the ones the country lost
+	resolver["FR"] = []string{"198.51.100.0/24", "203.0.113.0/24"}
+
+	if err := b.Add(newDecision("FR", "Country", 2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "198.51.100.0/24", "203.0.113.0/24")
+
+	if err := b.Delete(newDecision("FR", "Country", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
+
+func TestASDecisionWithoutDatabase(t *testing.T) {
+	b := newTestBackend(newFakeFirewall())
+
+	if err := b.Add(newDecision("AS64496", "AS", time.Hour)); err == nil {
+		t.Fatal("an AS decision is applied without an asn database")
+	}
+}
@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// a decision lasting a bit longer than an imported entry doesn't need to be added again,
+// the timeouts of the sets are rounded to the second
+const importSlack = time.Minute
+
+// importedBans are the entries found in the firewalls at startup, with import_existing_bans.
+// They become regular bans when the LAPI sends their decision again, and are never
+// removed on shutdown otherwise: the bouncer doesn't know where they come from.
+type importedBans struct {
+	mu sync.Mutex
+	// the time the entries expire by canonical value, zero if the firewall doesn't tell
+	until map[string]time.Time
+}
+
+func newImportedBans() *importedBans {
+	return &importedBans{until: make(map[string]time.Time)}
+}
+
+// importable tells whether a decision can match an imported entry: the countries and
+// AS are applied as several networks.
+func importable(decision *models.Decision) bool {
+	return decisionFamily(decision) != ""
+}
+
+// claim removes the entry of a decision, and tells whether it already bans for as long
+// as the decision, so that it doesn't need to be added.
+func (i *importedBans) claim(decision *models.Decision, now time.Time) bool {
+	if !importable(decision) {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := canonicalValue(*decision.Value)
+
+	until, ok := i.until[key]
+	if !ok {
+		return false
+	}
+
+	delete(i.until, key)
+
+	return until.IsZero() || !decisionDeadline(decision, now).After(until.Add(importSlack))
+}
+
+// release removes the entry of a decision, and tells whether there was one.
+func (i *importedBans) release(decision *models.Decision) bool {
+	if !importable(decision) {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := canonicalValue(*decision.Value)
+
+	if _, ok := i.until[key]; !ok {
+		return false
+	}
+
+	delete(i.until, key)
+
+	return true
+}
+
+func (i *importedBans) reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.until = make(map[string]time.Time)
+}
+
+// ImportExisting reads the bans already in the firewalls after Init, so that the decisions
+// replayed by the LAPI for them don't add them again. Since the origin of a decision is
+// unknown until it's received, an entry is imported if it's in the default firewall or
+// the one of an origin, and in every extra firewall. It returns the number of entries imported.
+func (b *BackendCTX) ImportExisting() (int, error) {
+	listed := func(fw types.Backend) (map[string]time.Duration, error) {
+		lister, ok := fw.(types.Lister)
+		if !ok {
+			return nil, fmt.Errorf("a firewall can't list its bans (%T)", fw)
+		}
+
+		entries, err := lister.List()
+		if err != nil {
+			return nil, err
+		}
+
+		ret := make(map[string]time.Duration, len(entries))
+		for _, entry := range entries {
+			ret[canonicalValue(entry.Value)] = entry.TTL
+		}
+
+		return ret, nil
+	}
+
+	candidates := make(map[string]time.Duration)
+
+	for _, fw := range append([]types.Backend{b.firewall}, sorted(b.origins)...) {
+		entries, err := listed(fw)
+		if err != nil {
+			return 0, err
+		}
+
+		for value, ttl := range entries {
+			candidates[value] = ttl
+		}
+	}
+
+	for _, fw := range sorted(b.extra) {
+		entries, err := listed(fw)
+		if err != nil {
+			return 0, err
+		}
+
+		for value, ttl := range candidates {
+			other, ok := entries[value]
+			if !ok {
+				delete(candidates, value)
+				continue
+			}
+
+			// the first to expire
+			if other != 0 && (ttl == 0 || other < ttl) {
+				candidates[value] = other
+			}
+		}
+	}
+
+	now := time.Now()
+
+	b.imported.mu.Lock()
+	defer b.imported.mu.Unlock()
+
+	for value, ttl := range candidates {
+		until := time.Time{}
+		if ttl > 0 {
+			until = now.Add(ttl)
+		}
+
+		b.imported.until[value] = until
+	}
+
+	log.Debugf("%d entries of the firewalls imported", len(candidates))
+
+	return len(candidates), nil
+}
@@ -0,0 +1,127 @@
+package backend
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportExisting(t *testing.T) {
+	fw := newFakeFirewall()
+	// found at startup, the first without timeout
+	fw.table["192.0.2.1"] = true
+	fw.table["192.0.2.2/32"] = true
+	fw.ttl["192.0.2.2/32"] = 4 * time.Hour
+	fw.table["192.0.2.3"] = true
+	fw.ttl["192.0.2.3"] = 10 * time.Minute
+
+	b := newTestBackend(fw)
+
+	imported, err := b.ImportExisting()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if imported != 3 {
+		t.Fatalf("%d entries imported, want 3", imported)
+	}
+
+	// the stream replays the decisions of the entries, and a new one
+	for _, value := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+		err := b.Add(newDecision(value, "Ip", 4*time.Hour))
+
+		switch value {
+		case "192.0.2.1", "192.0.2.2":
+			if !errors.Is(err, ErrSkipped) {
+				t.Fatalf("%s is added again: %v", value, err)
+			}
+		default:
+			if err != nil {
+				t.Fatalf("%s: %s", value, err)
+			}
+		}
+	}
+
+	// the entry expiring before its decision is extended
+	if got := strings.Join(fw.pending(), ","); got != "192.0.2.3,192.0.2.4" {
+		t.Fatalf("added %s, want the entry expiring too soon and the new decision", got)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the claimed entries are regular bans, the next replay with the time left is a no-op too
+	if err := b.Add(newDecision("192.0.2.1", "Ip", 3*time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("%s is added again: %v", "192.0.2.1", err)
+	}
+
+	// and they are removed with their decision
+	if err := b.Delete(newDecision("192.0.2.1", "Ip", 4*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.2/32", "192.0.2.3", "192.0.2.4")
+}
+
+func TestImportExistingDelete(t *testing.T) {
+	fw := newFakeFirewall()
+	fw.table["192.0.2.1"] = true
+
+	b := newTestBackend(fw)
+
+	if _, err := b.ImportExisting(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the LAPI removes the decision of an entry before replaying it
+	if err := b.Delete(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+
+	// not imported anymore
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(fw.pending(), ","); got != "192.0.2.1" {
+		t.Fatalf("added %s", got)
+	}
+}
+
+func TestImportExistingExtraModes(t *testing.T) {
+	b, fw, extra := newTestExtraBackend(false)
+
+	fw.table["192.0.2.1"] = true
+	fw.table["192.0.2.2"] = true
+	extra.table["192.0.2.2"] = true
+
+	imported, err := b.ImportExisting()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the entries found in all the firewalls
+	if imported != 1 {
+		t.Fatalf("%d entries imported, want 1", imported)
+	}
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Add(newDecision("192.0.2.2", "Ip", time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("192.0.2.2 is added again: %v", err)
+	}
+}
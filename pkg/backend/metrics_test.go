@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+func TestExportMetrics(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if err := b.Add(newDecision(value, "Ip", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := fw.CollectMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshot.BannedByFamily) != 1 || snapshot.BannedByFamily["ipv4"] != 3 || snapshot.Banned() != 3 {
+		t.Fatalf("snapshot %+v", snapshot)
+	}
+
+	snapshot.BannedByFamily["ipv6"] = 2
+	snapshot.DroppedPackets = 14
+	snapshot.DroppedBytes = 800
+
+	exportMetrics(snapshot)
+
+	if got := testutil.ToFloat64(metrics.TotalActiveBannedIPs); got != 5 {
+		t.Fatalf("%v active bans exported, want 5", got)
+	}
+
+	for family, want := range map[string]float64{"ipv4": 3, "ipv6": 2} {
+		if got := testutil.ToFloat64(metrics.ActiveBannedIPsByFamily.WithLabelValues(family)); got != want {
+			t.Fatalf("%v active %s bans exported, want %v", got, family, want)
+		}
+	}
+
+	if got := testutil.ToFloat64(metrics.TotalDroppedPackets); got != 14 {
+		t.Fatalf("%v dropped packets exported, want 14", got)
+	}
+
+	if got := testutil.ToFloat64(metrics.TotalDroppedBytes); got != 800 {
+		t.Fatalf("%v dropped bytes exported, want 800", got)
+	}
+}
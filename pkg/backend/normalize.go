@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"strings"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+// the scopes the firewalls apply by their lowercase spellings, the LAPI and the lists
+// don't agree on the case (ie. "Ip", "ip" or "IP")
+var scopeAliases = map[string]string{
+	"ip":      "Ip",
+	"ipv4":    "Ip",
+	"ipv6":    "Ip",
+	"range":   "Range",
+	"cidr":    "Range",
+	"network": "Range",
+	"country": "Country",
+	"as":      "AS",
+	"asn":     "AS",
+}
+
+// DecisionScope returns the lowercase scope of a decision with the aliases resolved,
+// ie. "range" for "CIDR", "ip" if it has none. An unknown scope is only lowercased.
+func DecisionScope(decision *models.Decision) string {
+	if decision.Scope == nil {
+		return "ip"
+	}
+
+	scope := strings.ToLower(strings.TrimSpace(*decision.Scope))
+	if canonical, ok := scopeAliases[scope]; ok {
+		return strings.ToLower(canonical)
+	}
+
+	return scope
+}
+
+// normalize returns the decision with its value and scope in canonical form, so that the
+// equivalent spellings of an address share their ban in the cache and the firewalls.
+// The original decision is not modified.
+func normalize(decision *models.Decision) *models.Decision {
+	value := canonicalValue(*decision.Value)
+
+	scope := decision.Scope
+	if scope != nil {
+		if canonical, ok := scopeAliases[DecisionScope(decision)]; ok && canonical != *scope {
+			scope = &canonical
+		}
+	}
+
+	if value == *decision.Value && scope == decision.Scope {
+		return decision
+	}
+
+	d := *decision
+	d.Value = &value
+	d.Scope = scope
+
+	return &d
+}
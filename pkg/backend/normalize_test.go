@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+func TestNormalizeSpellings(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	if err := b.Add(newDecision("::ffff:192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1")
+
+	// the same address, already banned for longer
+	for value, scope := range map[string]string{"192.0.2.1": "Ip", "::ffff:192.0.2.1": "ip"} {
+		if err := b.Add(newDecision(value, scope, time.Minute)); !errors.Is(err, ErrSkipped) {
+			t.Fatalf("%s: got %v, want it to be skipped", value, err)
+		}
+	}
+
+	if err := b.Delete(newDecision("::ffff:192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
+
+func TestNormalizeRange(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	if err := b.Add(newDecision("2001:0DB8::1/64", "Range", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "2001:db8::/64")
+}
+
+func TestDecisionScope(t *testing.T) {
+	tests := []struct {
+		scope *string
+		want  string
+	}{
+		{nil, "ip"},
+		{strPtr("Ip"), "ip"},
+		{strPtr("ip"), "ip"},
+		{strPtr("IP"), "ip"},
+		{strPtr(" ip "), "ip"},
+		{strPtr("IPv4"), "ip"},
+		{strPtr("ipv6"), "ip"},
+		{strPtr("Range"), "range"},
+		{strPtr("range"), "range"},
+		{strPtr("CIDR"), "range"},
+		{strPtr("Network"), "range"},
+		{strPtr("country"), "country"},
+		{strPtr("AS"), "as"},
+		{strPtr("asn"), "as"},
+		{strPtr("Session"), "session"},
+	}
+
+	for _, tt := range tests {
+		value := "192.0.2.1"
+
+		if got := DecisionScope(&models.Decision{Value: &value, Scope: tt.scope}); got != tt.want {
+			t.Fatalf("scope %v: got '%s', want '%s'", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestScopeCasings(t *testing.T) {
+	tests := []struct {
+		value string
+		scope string
+		want  string
+	}{
+		{"192.0.2.1", "Ip", "Ip"},
+		{"192.0.2.2", "ip", "Ip"},
+		{"192.0.2.3", "IP", "Ip"},
+		{"192.0.2.4", "ipv4", "Ip"},
+		{"2001:db8::1", "Ip", "Ip"},
+		{"2001:db8::2", "ip", "Ip"},
+		{"2001:db8::3", "IPv6", "Ip"},
+		{"198.51.100.0/24", "Range", "Range"},
+		{"203.0.113.0/24", "range", "Range"},
+		{"192.0.2.128/25", "CIDR", "Range"},
+		{"2001:db8:1::/48", "RANGE", "Range"},
+		{"2001:db8:2::/48", "network", "Range"},
+	}
+
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	want := []string{}
+
+	for _, tt := range tests {
+		if err := b.Add(newDecision(tt.value, tt.scope, time.Hour)); err != nil {
+			t.Fatalf("%s %s: %s", tt.scope, tt.value, err)
+		}
+
+		want = append(want, tt.value)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, want...)
+
+	for _, tt := range tests {
+		if got := fw.scopes[tt.value]; got != tt.want {
+			t.Fatalf("%s %s reached the firewall as %s, want %s", tt.scope, tt.value, got, tt.want)
+		}
+	}
+
+	// the bans are found whatever the casing of the delete
+	for _, tt := range tests {
+		scope := strings.ToUpper(tt.scope)
+		if scope == "IPV4" || scope == "IPV6" {
+			scope = "ip"
+		}
+
+		if err := b.Delete(newDecision(tt.value, scope, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
+
+func TestScopeCasingsShareBan(t *testing.T) {
+	b := newTestBackend(newFakeFirewall())
+
+	if err := b.Add(newDecision("192.0.2.1", "IP", 2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("got %v, want the shorter ban to be skipped", err)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+// flushableFirewall reports its table missing once it has been flushed from outside.
+type flushableFirewall struct {
+	*fakeFirewall
+	recreated int
+}
+
+func (f *flushableFirewall) Missing() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.table) == 0, nil
+}
+
+func (f *flushableFirewall) Recreate() error {
+	f.recreated++
+	return nil
+}
+
+func TestReconcileFlushedTable(t *testing.T) {
+	fw := &flushableFirewall{fakeFirewall: newFakeFirewall()}
+	b := newTestBackend(fw)
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Add(newDecision("198.51.100.0/24", "Range", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Reconcile()
+
+	if fw.recreated != 0 {
+		t.Fatal("the table was recreated while it's there")
+	}
+
+	// ie. "nft flush ruleset"
+	fw.table = make(map[string]bool)
+
+	b.Reconcile()
+
+	if fw.recreated != 1 {
+		t.Fatalf("the table was recreated %d times, want 1", fw.recreated)
+	}
+
+	assertBanned(t, fw.fakeFirewall, "192.0.2.1", "198.51.100.0/24")
+}
@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/dryrun"
+	"github.com/asians-cloud/firewall-bouncer/pkg/exabgp"
+	"github.com/asians-cloud/firewall-bouncer/pkg/iptables"
+	"github.com/asians-cloud/firewall-bouncer/pkg/nftables"
+	"github.com/asians-cloud/firewall-bouncer/pkg/pf"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+	"github.com/asians-cloud/firewall-bouncer/pkg/windows"
+)
+
+// firewallBackend creates the firewall of a mode, on the OSes it runs on.
+type firewallBackend struct {
+	new func(config *cfg.BouncerConfig) (types.Backend, error)
+	// any OS if empty
+	os []string
+}
+
+func (f firewallBackend) supports(runtimeOS string) bool {
+	return len(f.os) == 0 || slices.Contains(f.os, runtimeOS)
+}
+
+// the firewalls by mode, in the order SupportedModes lists them: the first one
+// supported by an OS is its default
+var registry = []struct {
+	mode string
+	firewallBackend
+}{
+	{cfg.NftablesMode, firewallBackend{new: nftables.NewNFTables, os: []string{"linux"}}},
+	{cfg.IptablesMode, firewallBackend{new: iptables.NewIPTables, os: []string{"linux"}}},
+	{cfg.IpsetMode, firewallBackend{new: iptables.NewIPTables, os: []string{"linux"}}},
+	{cfg.WindowsMode, firewallBackend{new: windows.NewWindows, os: []string{"windows"}}},
+	{cfg.PfMode, firewallBackend{new: pf.NewPF, os: []string{"openbsd", "freebsd"}}},
+	{cfg.ExaBGPMode, firewallBackend{new: exabgp.NewExaBGP}},
+	{cfg.DryRunMode, firewallBackend{new: dryrun.NewDryRun}},
+}
+
+// SupportedModes returns the firewall modes available on an OS, the default one first.
+func SupportedModes(runtimeOS string) []string {
+	modes := []string{}
+
+	for _, entry := range registry {
+		if entry.supports(runtimeOS) {
+			modes = append(modes, entry.mode)
+		}
+	}
+
+	return modes
+}
+
+// lookupFirewall returns the firewall of a mode, or why it can't be used on an OS.
+func lookupFirewall(mode string, runtimeOS string) (firewallBackend, error) {
+	for _, entry := range registry {
+		if entry.mode != mode {
+			continue
+		}
+
+		if !entry.supports(runtimeOS) {
+			return firewallBackend{}, fmt.Errorf("backend '%s' not supported on %s (only on %s), the backends available are %s",
+				mode, runtimeOS, strings.Join(entry.os, ", "), strings.Join(SupportedModes(runtimeOS), ", "))
+		}
+
+		return entry.firewallBackend, nil
+	}
+
+	return firewallBackend{}, fmt.Errorf("firewall '%s' is not supported", mode)
+}
+
+func newFirewall(config *cfg.BouncerConfig) (types.Backend, error) {
+	backend, err := lookupFirewall(config.Mode, runtime.GOOS)
+	if err != nil {
+		return nil, err
+	}
+
+	fw, err := backend.new(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the methods would be called on nil later
+	if fw == nil {
+		return nil, fmt.Errorf("backend '%s' could not be created", config.Mode)
+	}
+
+	return fw, nil
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// withRegistry replaces the firewalls by mode for the duration of a test.
+func withRegistry(t *testing.T, mode string, fw firewallBackend) {
+	saved := registry
+	t.Cleanup(func() { registry = saved })
+
+	registry = []struct {
+		mode string
+		firewallBackend
+	}{{mode, fw}}
+}
+
+func TestNewFirewallError(t *testing.T) {
+	withRegistry(t, "stub", firewallBackend{new: func(*cfg.BouncerConfig) (types.Backend, error) {
+		return nil, errors.New("stub backend is not supported on this platform")
+	}})
+
+	fw, err := newFirewall(&cfg.BouncerConfig{Mode: "stub"})
+	if err == nil || fw != nil {
+		t.Fatalf("newFirewall returned %v, %v", fw, err)
+	}
+}
+
+func TestNewFirewallNil(t *testing.T) {
+	// a backend returning neither a firewall nor an error
+	withRegistry(t, "stub", firewallBackend{new: func(*cfg.BouncerConfig) (types.Backend, error) {
+		return nil, nil
+	}})
+
+	fw, err := newFirewall(&cfg.BouncerConfig{Mode: "stub"})
+	if err == nil || fw != nil {
+		t.Fatalf("newFirewall returned %v, %v", fw, err)
+	}
+}
+
+func TestNewFirewallUnsupportedOS(t *testing.T) {
+	other := "freebsd"
+	if runtime.GOOS == other {
+		other = "linux"
+	}
+
+	withRegistry(t, "stub", firewallBackend{new: func(*cfg.BouncerConfig) (types.Backend, error) {
+		return newFakeFirewall(), nil
+	}, os: []string{other}})
+
+	fw, err := newFirewall(&cfg.BouncerConfig{Mode: "stub"})
+	if err == nil || fw != nil {
+		t.Fatalf("newFirewall returned %v, %v", fw, err)
+	}
+}
+
+func TestUnsupportedPairings(t *testing.T) {
+	tests := []struct {
+		mode string
+		os   string
+	}{
+		{cfg.PfMode, "linux"},
+		{cfg.PfMode, "windows"},
+		{cfg.NftablesMode, "freebsd"},
+		{cfg.NftablesMode, "openbsd"},
+		{cfg.NftablesMode, "windows"},
+		{cfg.IptablesMode, "freebsd"},
+		{cfg.IptablesMode, "windows"},
+		{cfg.IpsetMode, "openbsd"},
+		{cfg.WindowsMode, "linux"},
+		{cfg.WindowsMode, "freebsd"},
+	}
+
+	for _, tt := range tests {
+		_, err := lookupFirewall(tt.mode, tt.os)
+
+		want := "backend '" + tt.mode + "' not supported on " + tt.os
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Fatalf("%s on %s: got %v, want '%s'", tt.mode, tt.os, err, want)
+		}
+	}
+}
+
+func TestSupportedPairings(t *testing.T) {
+	for _, goos := range []string{"linux", "freebsd", "openbsd", "windows", "darwin"} {
+		for _, mode := range SupportedModes(goos) {
+			if _, err := lookupFirewall(mode, goos); err != nil {
+				t.Fatalf("%s on %s: %s", mode, goos, err)
+			}
+		}
+	}
+
+	// the first mode is the default of the OS
+	for goos, want := range map[string]string{"linux": cfg.NftablesMode, "freebsd": cfg.PfMode, "windows": cfg.WindowsMode, "darwin": cfg.ExaBGPMode} {
+		if got := SupportedModes(goos)[0]; got != want {
+			t.Fatalf("the default mode of %s is %s, want %s", goos, got, want)
+		}
+	}
+}
+
+func TestUnknownMode(t *testing.T) {
+	if _, err := lookupFirewall("ipfw", "freebsd"); err == nil || !strings.Contains(err.Error(), "'ipfw' is not supported") {
+		t.Fatalf("an unknown mode gives %v", err)
+	}
+}
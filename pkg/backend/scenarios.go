@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"path"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+// the origins of the decisions made by the bouncer itself, the scenario filters don't apply to them
+const (
+	BlocklistOrigin = "blocklist-file"
+	ControlOrigin   = "control-socket"
+)
+
+// scenarioFilter selects the decisions to apply according to their scenario, with
+// glob patterns (ie. "crowdsecurity/ssh-*"). An empty include list matches all the
+// scenarios, and exclude wins over include.
+type scenarioFilter struct {
+	include []string
+	exclude []string
+}
+
+// matchAny tells whether a scenario matches one of the patterns, which are validated by the config loader.
+func matchAny(patterns []string, scenario string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, scenario); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows tells whether a decision must be applied.
+func (f scenarioFilter) allows(decision *models.Decision) bool {
+	if decision.Origin != nil && (*decision.Origin == BlocklistOrigin || *decision.Origin == ControlOrigin) {
+		return true
+	}
+
+	scenario := ""
+	if decision.Scenario != nil {
+		scenario = *decision.Scenario
+	}
+
+	if matchAny(f.exclude, scenario) {
+		return false
+	}
+
+	return len(f.include) == 0 || matchAny(f.include, scenario)
+}
@@ -0,0 +1,79 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+func newScenarioDecision(scenario string, origin string) *models.Decision {
+	d := newDecision("192.0.2.1", "Ip", time.Hour)
+	d.Scenario = &scenario
+	d.Origin = &origin
+
+	return d
+}
+
+func TestScenarioFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   scenarioFilter
+		scenario string
+		want     bool
+	}{
+		{"no filter", scenarioFilter{}, "crowdsecurity/ssh-bf", true},
+		{"include glob", scenarioFilter{include: []string{"crowdsecurity/ssh-*"}}, "crowdsecurity/ssh-bf", true},
+		{"include exact", scenarioFilter{include: []string{"crowdsecurity/ssh-bf"}}, "crowdsecurity/ssh-bf", true},
+		{"not included", scenarioFilter{include: []string{"crowdsecurity/ssh-*"}}, "crowdsecurity/http-probing", false},
+		// the * doesn't cross the / of the author
+		{"glob in the author", scenarioFilter{include: []string{"*"}}, "crowdsecurity/ssh-bf", false},
+		{"any author", scenarioFilter{include: []string{"*/ssh-bf"}}, "someone/ssh-bf", true},
+		{"excluded", scenarioFilter{exclude: []string{"crowdsecurity/http-*"}}, "crowdsecurity/http-probing", false},
+		{"not excluded", scenarioFilter{exclude: []string{"crowdsecurity/http-*"}}, "crowdsecurity/ssh-bf", true},
+		{"exclude wins", scenarioFilter{include: []string{"crowdsecurity/*"}, exclude: []string{"crowdsecurity/ssh-slow-bf"}}, "crowdsecurity/ssh-slow-bf", false},
+		{"included, another excluded", scenarioFilter{include: []string{"crowdsecurity/*"}, exclude: []string{"crowdsecurity/ssh-slow-bf"}}, "crowdsecurity/ssh-bf", true},
+		{"no scenario, include", scenarioFilter{include: []string{"crowdsecurity/*"}}, "", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filter.allows(newScenarioDecision(tt.scenario, "crowdsec")); got != tt.want {
+			t.Fatalf("%s: allows %s: %t, want %t", tt.name, tt.scenario, got, tt.want)
+		}
+	}
+}
+
+func TestScenarioFilterOwnDecisions(t *testing.T) {
+	filter := scenarioFilter{include: []string{"crowdsecurity/ssh-*"}, exclude: []string{"*"}}
+
+	for _, origin := range []string{BlocklistOrigin, ControlOrigin} {
+		if !filter.allows(newScenarioDecision("", origin)) {
+			t.Fatalf("the %s decisions are filtered out", origin)
+		}
+	}
+}
+
+func TestScenarioFilteredOut(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+	b.scenarios = scenarioFilter{exclude: []string{"crowdsecurity/http-*"}}
+	filtered := testutil.ToFloat64(metrics.TotalFilteredDecisions)
+
+	if err := b.Add(newScenarioDecision("crowdsecurity/http-probing", "crowdsec")); !errors.Is(err, ErrSkipped) {
+		t.Fatalf("a filtered out decision gives %v", err)
+	}
+
+	if got := testutil.ToFloat64(metrics.TotalFilteredDecisions) - filtered; got != 1 {
+		t.Fatalf("%v decisions counted as filtered out", got)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
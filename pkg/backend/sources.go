@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+// SourceLabels returns the origin and scenario labels of a decision in the metrics.
+func SourceLabels(decision *models.Decision) (string, string) {
+	origin, scenario := "", ""
+
+	if decision.Origin != nil {
+		origin = *decision.Origin
+	}
+
+	if decision.Scenario != nil {
+		scenario = *decision.Scenario
+	}
+
+	return metrics.SourceLabels(origin, scenario)
+}
+
+// collectSourceMetrics counts the applied decisions by origin and scenario, every
+// metrics interval. The cache knows them whatever the firewall.
+func (b *BackendCTX) collectSourceMetrics() {
+	t := b.metricsTicker()
+
+	for range t.C {
+		counts := make(map[[2]string]int)
+
+		for _, decision := range b.cache.all() {
+			origin, scenario := SourceLabels(decision)
+			counts[[2]string{origin, scenario}]++
+		}
+
+		metrics.ActiveBansBySource.Reset()
+
+		for labels, count := range counts {
+			metrics.ActiveBansBySource.WithLabelValues(labels[0], labels[1]).Set(float64(count))
+		}
+	}
+}
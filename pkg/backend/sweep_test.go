@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+// sweepingFirewall returns the values of its expired list on the first sweep.
+type sweepingFirewall struct {
+	*fakeFirewall
+	expired  []string
+	interval time.Duration
+}
+
+func (f *sweepingFirewall) Expired(now time.Time) []string {
+	ret := f.expired
+	f.expired = nil
+
+	return ret
+}
+
+func (f *sweepingFirewall) SweepInterval() time.Duration {
+	return f.interval
+}
+
+func TestDeleteUnknownBan(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	// left by a previous run, the cache doesn't know it
+	fw.table["192.0.2.1"] = true
+
+	if err := b.Delete(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw)
+}
+
+func TestSweep(t *testing.T) {
+	fw := &sweepingFirewall{fakeFirewall: newFakeFirewall(), interval: time.Minute}
+	b := newTestBackend(fw)
+	b.extra["other"] = newFakeFirewall()
+
+	if b.SweepInterval() != time.Minute {
+		t.Fatalf("sweep interval is %s", b.SweepInterval())
+	}
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Add(newDecision("192.0.2.2", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	fw.expired = []string{"192.0.2.1"}
+	b.Sweep(time.Now().Add(2 * time.Hour))
+
+	assertBanned(t, fw.fakeFirewall, "192.0.2.2")
+
+	// the cache forgot the expired decisions, so the LAPI can send them again
+	if b.cache.has(newDecision("192.0.2.1", "Ip", time.Hour)) || b.cache.has(newDecision("192.0.2.2", "Ip", time.Hour)) {
+		t.Fatal("the expired decisions are still cached")
+	}
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw.fakeFirewall, "192.0.2.1", "192.0.2.2")
+}
+
+func TestSweepIntervalWithoutSweeper(t *testing.T) {
+	if interval := newTestBackend(newFakeFirewall()).SweepInterval(); interval != 0 {
+		t.Fatalf("sweep interval is %s without a firewall to sweep", interval)
+	}
+}
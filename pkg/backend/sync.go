@@ -0,0 +1,104 @@
+package backend
+
+import (
+	"golang.org/x/exp/slices"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// canonicalValue returns the value of an address or a network as the firewalls list it,
+// and the value itself if it's neither (ie. a country).
+func canonicalValue(value string) string {
+	canonical, err := types.CanonicalValue(value)
+	if err != nil {
+		return value
+	}
+
+	return canonical
+}
+
+// wanted returns the values a firewall should contain according to the decisions.
+func (b *BackendCTX) wanted(fw types.Backend, decisions []*models.Decision) map[string]struct{} {
+	ret := make(map[string]struct{})
+
+	for _, decision := range decisions {
+		if b.checkScope(decision) != nil || checkDecision(decision) != nil || !slices.Contains(b.firewallsFor(decision), fw) {
+			continue
+		}
+
+		decision = normalize(decision)
+
+		if _, ok := b.allowlist.overlaps(*decision.Value); ok {
+			continue
+		}
+
+		expanded, err := b.applied(decision)
+		if err != nil {
+			continue
+		}
+
+		for _, d := range expanded {
+			ret[canonicalValue(*d.Value)] = struct{}{}
+		}
+	}
+
+	return ret
+}
+
+// RemoveStale deletes the bans that are in the firewalls but not in the decisions, ie.
+// the ones whose delete event was missed while the bouncer was stopped. Only the
+// firewalls that can be read back are checked, and the foreign entries of the tables
+// shared with someone else are left in place. It returns the number of bans removed.
+func (b *BackendCTX) RemoveStale(decisions []*models.Decision) (int, error) {
+	removed := 0
+
+	for _, fw := range b.all() {
+		lister, ok := fw.(types.Lister)
+		if !ok {
+			continue
+		}
+
+		entries, err := lister.List()
+		if err != nil {
+			return removed, err
+		}
+
+		wanted := b.wanted(fw, decisions)
+		stale := 0
+
+		for _, entry := range entries {
+			if entry.Foreign {
+				continue
+			}
+
+			if _, ok := wanted[canonicalValue(entry.Value)]; ok {
+				continue
+			}
+
+			value := entry.Value
+			d := &models.Decision{Value: &value}
+
+			if err := fw.Delete(d); err != nil {
+				return removed, err
+			}
+
+			b.imported.release(d)
+
+			stale++
+		}
+
+		if stale == 0 {
+			continue
+		}
+
+		if err := fw.Commit(); err != nil {
+			return removed, err
+		}
+
+		removed += stale
+	}
+
+	return removed, nil
+}
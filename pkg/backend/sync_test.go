@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+func TestRemoveStale(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := b.Add(newDecision(value, "Ip", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delete of 192.0.2.2 was missed
+	removed, err := b.RemoveStale([]*models.Decision{newDecision("192.0.2.1", "Ip", time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Fatalf("%d bans removed, want 1", removed)
+	}
+
+	assertBanned(t, fw, "192.0.2.1")
+}
+
+func TestRemoveStaleKeepsForeignEntries(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	// added to the shared table by someone else
+	fw.table["198.51.100.1"] = true
+	fw.foreign["198.51.100.1"] = true
+
+	if err := b.Add(newDecision("192.0.2.1", "Ip", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := b.RemoveStale(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Fatalf("%d bans removed, want 1", removed)
+	}
+
+	assertBanned(t, fw, "198.51.100.1")
+}
+
+func TestShutDownOwned(t *testing.T) {
+	fw := newFakeFirewall()
+	fw.keep = true
+	fw.table["203.0.113.1"] = true
+
+	b := newTestBackend(fw)
+	b.flushOwned = true
+
+	for _, d := range []struct{ value, scope string }{{"192.0.2.1", "Ip"}, {"198.51.100.0/24", "Range"}} {
+		if err := b.Add(newDecision(d.value, d.scope, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the bans of the bouncer are removed
+	assertBanned(t, fw, "203.0.113.1")
+
+	if fw.shutdowns != 1 {
+		t.Fatalf("the firewall was shut down %d times", fw.shutdowns)
+	}
+}
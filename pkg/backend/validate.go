@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+// asnRe matches AS numbers, with or without the AS prefix
+var asnRe = regexp.MustCompile(`^(?i:as)?[0-9]+$`)
+
+func checkDecision(decision *models.Decision) error {
+	if decision.Value == nil {
+		return fmt.Errorf("missing value")
+	}
+
+	if decision.Duration != nil {
+		if _, err := time.ParseDuration(*decision.Duration); err != nil {
+			return fmt.Errorf("invalid duration '%s'", *decision.Duration)
+		}
+	}
+
+	scope := DecisionScope(decision)
+
+	switch scope {
+	case "ip":
+		if net.ParseIP(*decision.Value) == nil {
+			return fmt.Errorf("invalid IP address '%s'", *decision.Value)
+		}
+	case "range":
+		if _, _, err := net.ParseCIDR(*decision.Value); err != nil {
+			return fmt.Errorf("invalid range '%s'", *decision.Value)
+		}
+	case "country":
+		if len(*decision.Value) != 2 {
+			return fmt.Errorf("invalid country code '%s'", *decision.Value)
+		}
+	case "as":
+		if !asnRe.MatchString(*decision.Value) {
+			return fmt.Errorf("invalid AS number '%s'", *decision.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported scope '%s'", scope)
+	}
+
+	return nil
+}
+
+// checkScope makes sure the scope of a decision is one the firewalls can apply: the
+// decisions for sessions, usernames, etc. are skipped instead of being taken for IPs.
+// The country and AS scopes need their database.
+func (b *BackendCTX) checkScope(decision *models.Decision) error {
+	if decision.Scope == nil {
+		return nil
+	}
+
+	switch DecisionScope(decision) {
+	case "ip", "range":
+		return nil
+	case "country":
+		if b.geoip != nil {
+			return nil
+		}
+	case "as":
+		if b.asn != nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: unsupported scope '%s'", ErrSkipped, *decision.Scope)
+}
+
+// checkPrefix refuses the ranges larger than min_prefix_length, ie. from a broken list
+// banning 0.0.0.0/1. They are logged, since they are never expected.
+func (b *BackendCTX) checkPrefix(decision *models.Decision) error {
+	prefix, err := netip.ParsePrefix(*decision.Value)
+	if err != nil {
+		// addresses, countries and AS
+		return nil
+	}
+
+	family := "ipv4"
+	if prefix.Addr().Is6() {
+		family = "ipv6"
+	}
+
+	limit := b.minPrefix[family]
+	if prefix.Bits() >= limit {
+		return nil
+	}
+
+	log.Warningf("refusing the decision for '%s', min_prefix_length is /%d for %s", *decision.Value, limit, family)
+
+	return fmt.Errorf("%w: '%s' is larger than /%d", ErrSkipped, *decision.Value, limit)
+}
+
+// validateDecision makes sure a decision can be applied to the firewall, counting
+// the malformed ones since they hint at a problem with the LAPI.
+func validateDecision(decision *models.Decision) error {
+	err := checkDecision(decision)
+	if err == nil {
+		return nil
+	}
+
+	metrics.TotalDecisionParseErrors.Inc()
+	log.Debugf("malformed decision: %+v", *decision)
+
+	return fmt.Errorf("malformed decision: %w", err)
+}
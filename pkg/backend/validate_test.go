@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnsupportedScope(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	// without geoip database, the countries are skipped too
+	for _, scope := range []string{"Session", "Username", "Country"} {
+		err := b.Add(newDecision("c0ffee", scope, time.Hour))
+		if !errors.Is(err, ErrSkipped) {
+			t.Fatalf("scope %s: got %v, want a skipped decision", scope, err)
+		}
+	}
+
+	for _, d := range []struct{ value, scope string }{{"192.0.2.1", "Ip"}, {"192.0.2.2", "ip"}, {"198.51.100.0/24", "Range"}} {
+		if err := b.Add(newDecision(d.value, d.scope, time.Hour)); err != nil {
+			t.Fatalf("scope %s: %s", d.scope, err)
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1", "192.0.2.2", "198.51.100.0/24")
+}
+
+func TestMinPrefix(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+	b.minPrefix = map[string]int{"ipv4": 16, "ipv6": 32}
+
+	tests := []struct {
+		value    string
+		accepted bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.0/24", true},
+		{"10.1.0.0/16", true},
+		{"10.0.0.0/15", false},
+		{"10.0.0.0/8", false},
+		{"0.0.0.0/0", false},
+		{"2001:db8::1", true},
+		{"2001:db8::/32", true},
+		{"2001:db8::/31", false},
+		{"::/0", false},
+		// the ipv4 limit applies to the mapped ranges
+		{"::ffff:172.16.0.0/108", false},
+	}
+
+	for _, tt := range tests {
+		scope := "Range"
+		if !strings.Contains(tt.value, "/") {
+			scope = "Ip"
+		}
+
+		err := b.Add(newDecision(tt.value, scope, time.Hour))
+
+		if tt.accepted && err != nil {
+			t.Fatalf("%s: %s", tt.value, err)
+		}
+
+		if !tt.accepted && !errors.Is(err, ErrSkipped) {
+			t.Fatalf("%s: got %v, want a skipped decision", tt.value, err)
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertBanned(t, fw, "192.0.2.1", "192.0.2.0/24", "10.1.0.0/16", "2001:db8::1", "2001:db8::/32")
+}
+
+func TestMinPrefixUnset(t *testing.T) {
+	fw := newFakeFirewall()
+	b := newTestBackend(fw)
+
+	for _, value := range []string{"10.0.0.0/8", "2001::/16"} {
+		if err := b.Add(newDecision(value, "Range", time.Hour)); err != nil {
+			t.Fatalf("%s: %s", value, err)
+		}
+	}
+}
@@ -3,9 +3,16 @@ package cfg
 import (
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v2"
 
 	"github.com/crowdsecurity/go-cs-lib/pkg/csstring"
@@ -17,6 +24,93 @@ type PrometheusConfig struct {
 	Enabled       bool   `yaml:"enabled"`
 	ListenAddress string `yaml:"listen_addr"`
 	ListenPort    string `yaml:"listen_port"`
+	Interval      string `yaml:"interval"`
+	// serve the applied bans at /debug/bans, only to the requests with the token if set
+	DebugBans  bool   `yaml:"debug_bans"`
+	DebugToken string `yaml:"debug_token"`
+}
+
+// MinPrefixLengthConfig is the shortest prefix of the range decisions per address family,
+// the larger ranges are refused. 0 means no limit.
+type MinPrefixLengthConfig struct {
+	Ipv4 int `yaml:"ipv4"`
+	Ipv6 int `yaml:"ipv6"`
+}
+
+// RateLimitConfig bounds how fast the decisions of the LAPI are applied, 0 means no limit.
+// The decisions beyond the rate wait in a queue of QueueSize decisions, a warning is
+// logged when it's more than HighWaterMark percent full.
+type RateLimitConfig struct {
+	DecisionsPerSecond int `yaml:"decisions_per_second"`
+	QueueSize          int `yaml:"queue_size"`
+	HighWaterMark      int `yaml:"high_water_mark"`
+}
+
+// what to do with new decisions when max_banned_ips is reached
+const (
+	EvictOldest = "evict-oldest"
+	RejectNew   = "reject"
+)
+
+// how the decisions are received from the LAPI
+const (
+	LAPIModeStream   = "stream"
+	LAPIModePoll     = "poll"
+	LAPIModeDatabase = "database"
+)
+
+// the databases of CrowdSec the decisions can be read from, in lapi_mode database
+const (
+	DatabaseSQLite   = "sqlite"
+	DatabasePostgres = "postgresql"
+	DatabaseMySQL    = "mysql"
+)
+
+// DatabaseConfig is the CrowdSec database the decisions are read from, instead of the LAPI.
+type DatabaseConfig struct {
+	Type string `yaml:"type"`
+	DSN  string `yaml:"dsn"`
+}
+
+// MaxBannedIPsConfig bounds the number of bans per address family, 0 means no limit.
+type MaxBannedIPsConfig struct {
+	Ipv4   int    `yaml:"ipv4"`
+	Ipv6   int    `yaml:"ipv6"`
+	Policy string `yaml:"policy"`
+}
+
+// NotifierConfig is where the bans are sent, as JSON, when they are applied.
+type NotifierConfig struct {
+	Command   string `yaml:"command"`
+	URL       string `yaml:"url"`
+	QueueSize int    `yaml:"queue_size"`
+}
+
+// MetricsPushConfig sends the counters of the firewall every interval, to the LAPI as
+// usage metrics and/or as JSON to a URL.
+type MetricsPushConfig struct {
+	LAPI     bool   `yaml:"lapi"`
+	URL      string `yaml:"url"`
+	Interval string `yaml:"interval"`
+}
+
+// Enabled tells whether the metrics are sent anywhere.
+func (c MetricsPushConfig) Enabled() bool {
+	return c.LAPI || c.URL != ""
+}
+
+// DurationOverride replaces the duration of the decisions whose scenario starts with
+// Scenario. An empty Scenario matches all the decisions.
+type DurationOverride struct {
+	Scenario string `yaml:"scenario"`
+	Duration string `yaml:"duration"`
+}
+
+// DecisionPriority gives a priority to the decisions whose scenario matches the glob
+// pattern Scenario. The decisions with the highest priority are applied first.
+type DecisionPriority struct {
+	Scenario string `yaml:"scenario"`
+	Priority int    `yaml:"priority"`
 }
 
 type nftablesFamilyConfig struct {
@@ -27,31 +121,151 @@ type nftablesFamilyConfig struct {
 	Priority int    `yaml:"priority"`
 }
 
+// OriginBlacklists are the tables or sets holding the decisions of an origin.
+type OriginBlacklists struct {
+	Ipv4 string `yaml:"ipv4"`
+	Ipv6 string `yaml:"ipv6"`
+}
+
 const (
 	IpsetMode    = "ipset"
 	IptablesMode = "iptables"
 	NftablesMode = "nftables"
 	PfMode       = "pf"
+	WindowsMode  = "windows"
+	ExaBGPMode   = "exabgp"
 	DryRunMode   = "dry-run"
 )
 
+// what is removed from the firewall on shutdown: the whole sets and tables, or only the
+// bans of the bouncer, when the sets are shared with another tool
+const (
+	FlushModeTable = "table"
+	FlushModeOwned = "owned"
+)
+
+// how the decisions are applied with extra_modes: whatever the other firewalls do, or
+// only if all of them accept them
+const (
+	BestEffort   = "best-effort"
+	AllOrNothing = "all-or-nothing"
+)
+
+// where the iptables rules are added in their chains
+const (
+	RulePositionInsert = "insert"
+	RulePositionAppend = "append"
+)
+
+// where the iptables and nftables rules deny the banned traffic: with the usual filtering
+// rules, or in the raw table / priority, before connection tracking
+const (
+	DenyStageFilter = "filter"
+	DenyStageRaw    = "raw"
+)
+
+// how the pf block rules are expected to use the tables of both families: one rule on
+// both ('from { <v4> <v6> }'), or a rule per family
+const (
+	TableRulesJoined = "joined"
+	TableRulesSplit  = "split"
+)
+
+// ipset_type selecting a hash:ip set for the addresses and a hash:net one for the ranges, behind
+// a list:set matched by the iptables rules
+const SetTypeAuto = "auto"
+
+// the nftables priority of the raw stage (NF_IP_PRI_RAW), conntrack is at -200
+const nftablesRawPriority = -300
+
 type BouncerConfig struct {
 	Mode            string        `yaml:"mode"`    // ipset,iptables,tc
 	PidDir          string        `yaml:"pid_dir"` // unused
 	UpdateFrequency string        `yaml:"update_frequency"`
 	Daemon          *bool         `yaml:"daemonize"` // unused
 	Logging         LoggingConfig `yaml:",inline"`
+	DisableIPV4     bool          `yaml:"disable_ipv4"`
 	DisableIPV6     bool          `yaml:"disable_ipv6"`
+	DryRun          bool          `yaml:"dry_run"`
+	FlushOnShutdown *bool         `yaml:"flush_on_shutdown"`
+	FlushOnStartup  *bool         `yaml:"flush_on_startup"`
+	FlushMode       string        `yaml:"flush_mode"`
+	ShutdownTimeout string        `yaml:"shutdown_timeout"`
 	DenyAction      string        `yaml:"deny_action"`
 	DenyLog         bool          `yaml:"deny_log"`
 	DenyLogPrefix   string        `yaml:"deny_log_prefix"`
+	AuditMode       bool          `yaml:"audit_mode"`
+	DenyStage       string        `yaml:"deny_stage"`
+	Interface       string        `yaml:"interface"`
+	RuleComment     string        `yaml:"rule_comment"`
 	BlacklistsIpv4  string        `yaml:"blacklists_ipv4"`
 	BlacklistsIpv6  string        `yaml:"blacklists_ipv6"`
 	SetType         string        `yaml:"ipset_type"`
 	SetSize         int           `yaml:"ipset_size"`
+	GeoIPDatabase   string        `yaml:"geoip_database"`
+	ASNDatabase     string        `yaml:"asn_database"`
+	// the banned IPs can still ping, for diagnostics: their ICMP echo requests are accepted before the deny rule
+	AllowICMPEcho bool `yaml:"allow_icmp_echo"`
+	// log each new ban with its scenario, the kernel logs of deny_log only have deny_log_prefix
+	BanReasonLog       bool   `yaml:"ban_reason_log"`
+	BanReasonLogFormat string `yaml:"ban_reason_log_format"`
+	// how many times to retry the connection to the LAPI at startup, and the maximum delay between two attempts
+	LAPIRetries    *int   `yaml:"lapi_retries"`
+	LAPIMaxBackoff string `yaml:"lapi_max_backoff"`
+	// how long to wait before touching the firewall and the LAPI, and for the LAPI to answer
+	StartupDelay string `yaml:"startup_delay"`
+	WaitForLAPI  string `yaml:"wait_for_lapi"`
+	// the LAPI is reached through this unix socket, api_url only gives the scheme and the path
+	APIUnixSocket string `yaml:"api_unix_socket"`
+	// live decision stream, or all the decisions pulled every update_frequency, from the LAPI or its database
+	LAPIMode string         `yaml:"lapi_mode"`
+	Database DatabaseConfig `yaml:"database"`
+	// how often to check that the firewall tables still exist, disabled if empty
+	ReconcileInterval string `yaml:"reconcile_interval"`
+	// how much the intervals of the periodic tasks vary, in percent, to spread the load of a fleet
+	IntervalJitter int `yaml:"interval_jitter"`
+	// unix socket to inspect and change the bans at runtime, disabled if empty
+	ControlSocket string             `yaml:"control_socket"`
+	MaxBannedIPs  MaxBannedIPsConfig `yaml:"max_banned_ips"`
+	// protects against a broken list banning the whole internet
+	MinPrefixLength MinPrefixLengthConfig `yaml:"min_prefix_length"`
+	// protects the firewall against a flood of decisions
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// files listing IPs or ranges to ban, read again on SIGHUP
+	BlocklistFiles []string `yaml:"blocklist_files"`
+	// IPs and ranges that are never banned
+	Allowlist []string `yaml:"allowlist"`
+	// how many firewall commands (pfctl, iptables, ipset) may run at the same time, GOMAXPROCS if 0
+	ExecConcurrency int `yaml:"exec_concurrency"`
+	// remove the bans without a decision at startup, for firewalls that are not flushed
+	SyncOnStartup bool `yaml:"sync_on_startup"`
+	// read the bans left in the firewall at startup, so that the decisions replayed for them are not added again
+	ImportExistingBans bool `yaml:"import_existing_bans"`
+	// check at startup that the firewall rules use the tables
+	SelfTest bool `yaml:"self_test"`
+	// merge the overlapping and adjacent networks before applying them
+	CoalesceRanges bool `yaml:"coalesce_ranges"`
+	// the first matching override sets the duration of a ban
+	DurationOverrides []DurationOverride `yaml:"duration_overrides"`
+	// glob patterns of the scenarios to apply (all if empty) and to ignore, exclude wins
+	IncludeScenarios []string `yaml:"include_scenarios"`
+	ExcludeScenarios []string `yaml:"exclude_scenarios"`
+	// the first matching pattern gives the priority of a decision, 0 if none matches
+	DecisionPriorities []DecisionPriority `yaml:"decision_priorities"`
+	// ignore the decisions that have already expired when they are received, true by default
+	SkipExpiredDecisions *bool `yaml:"skip_expired_decisions"`
+	// the longest ban applied for a LAPI decision, no limit if empty or 0
+	MaxDuration string `yaml:"max_duration"`
+	// decisions from these origins go to their own tables instead of the blacklists above
+	OriginBlacklists map[string]OriginBlacklists `yaml:"origin_blacklists"`
+	// firewalls receiving the decisions along with the one of mode
+	ExtraModes       []string `yaml:"extra_modes"`
+	ExtraModesPolicy string   `yaml:"extra_modes_policy"`
 
 	// specific to iptables, following https://github.com/asians-cloud/firewall-bouncer/issues/19
 	IptablesChains          []string `yaml:"iptables_chains"`
+	IptablesRulePosition    string   `yaml:"iptables_rule_position"`
+	IptablesRuleIndex       int      `yaml:"iptables_rule_index"`
 	SupportedDecisionsTypes []string `yaml:"supported_decisions_types"`
 	// specific to nftables, following https://github.com/asians-cloud/firewall-bouncer/issues/74
 	Nftables struct {
@@ -60,10 +274,40 @@ type BouncerConfig struct {
 	} `yaml:"nftables"`
 	NftablesHooks []string `yaml:"nftables_hooks"`
 	PF            struct {
-		AnchorName string `yaml:"anchor_name"`
-		BatchSize  int    `yaml:"batch_size"`
+		AnchorName    string `yaml:"anchor_name"`
+		BatchSize     int    `yaml:"batch_size"`
+		SweepInterval string `yaml:"sweep_interval"`
+		RetryCount    int    `yaml:"retry_count"`
+		RetryBackoff  string `yaml:"retry_backoff"`
+		ExecTimeout   string `yaml:"exec_timeout"`
+		PfctlPath     string `yaml:"pfctl_path"`
+		// the longest batch given to pfctl as arguments, the larger ones are written to its standard input
+		MaxArgsPerCommand int `yaml:"max_args_per_command"`
+		// existing table holding both families (ie. a pfSense or OPNsense alias), instead of the blacklists
+		Alias string `yaml:"alias"`
+		// the tables belong to the appliance: they are not flushed, only the bans added by the bouncer are removed
+		KeepTables bool `yaml:"keep_tables"`
+		// false for tables that are only filled by the bouncer, the same as keep_tables
+		ManageTableLifecycle *bool `yaml:"manage_table_lifecycle"`
+		// the deadlines of the bans are saved there, to keep sweeping them after a restart without flush
+		ExpiryFile string `yaml:"expiry_file"`
+		// the ipv6 ranges go to this table, and only the ipv6 addresses to blacklists_ipv6
+		IPv6NetworksTable string `yaml:"ipv6_networks_table"`
+		// the block rules expected to reference the tables, checked at startup: joined or split
+		TableRules string `yaml:"table_rules"`
 	} `yaml:"pf"`
-	PrometheusConfig PrometheusConfig `yaml:"prometheus"`
+	// the bans are announced as blackhole routes to an ExaBGP process
+	ExaBGP struct {
+		// named pipe of the ExaBGP API, stdout if empty (when the bouncer is run by ExaBGP)
+		Pipe          string   `yaml:"pipe"`
+		NextHop       string   `yaml:"next_hop"`
+		NextHopIPv6   string   `yaml:"next_hop_ipv6"`
+		Communities   []string `yaml:"communities"`
+		SweepInterval string   `yaml:"sweep_interval"`
+	} `yaml:"exabgp"`
+	PrometheusConfig PrometheusConfig  `yaml:"prometheus"`
+	Notifier         NotifierConfig    `yaml:"notifier"`
+	MetricsPush      MetricsPushConfig `yaml:"metrics_push"`
 }
 
 // MergedConfig() returns the byte content of the patched configuration file (with .yaml.local).
@@ -76,6 +320,11 @@ func MergedConfig(configPath string) ([]byte, error) {
 	return data, nil
 }
 
+// ExpandEnv replaces the ${VAR} references of a configuration with the environment variables.
+func ExpandEnv(content []byte) []byte {
+	return []byte(csstring.StrictExpand(string(content), os.LookupEnv))
+}
+
 func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 	config := &BouncerConfig{}
 
@@ -84,9 +333,7 @@ func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 		return nil, err
 	}
 
-	configBuff := csstring.StrictExpand(string(fcontent), os.LookupEnv)
-
-	err = yaml.Unmarshal([]byte(configBuff), &config)
+	err = yaml.Unmarshal(ExpandEnv(fcontent), &config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal: %w", err)
 	}
@@ -103,6 +350,43 @@ func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 		config.SupportedDecisionsTypes = []string{"ban"}
 	}
 
+	// decision types are compared in lower case
+	for i, t := range config.SupportedDecisionsTypes {
+		config.SupportedDecisionsTypes[i] = strings.ToLower(t)
+	}
+
+	if config.FlushOnShutdown == nil {
+		config.FlushOnShutdown = ptr.Of(true)
+	}
+
+	if config.FlushOnStartup == nil {
+		config.FlushOnStartup = ptr.Of(true)
+	}
+
+	if config.SkipExpiredDecisions == nil {
+		config.SkipExpiredDecisions = ptr.Of(true)
+	}
+
+	switch config.FlushMode {
+	case "":
+		config.FlushMode = FlushModeTable
+	case FlushModeTable, FlushModeOwned:
+	default:
+		return nil, fmt.Errorf("flush_mode must be '%s' or '%s'", FlushModeTable, FlushModeOwned)
+	}
+
+	if config.ShutdownTimeout == "" {
+		config.ShutdownTimeout = "30s"
+	}
+
+	if d, err := time.ParseDuration(config.ShutdownTimeout); err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid shutdown_timeout '%s'", config.ShutdownTimeout)
+	}
+
+	if config.DisableIPV4 && config.DisableIPV6 {
+		return nil, fmt.Errorf("both disable_ipv4 and disable_ipv6 are set, doing nothing")
+	}
+
 	if config.PidDir != "" {
 		log.Debug("Ignoring deprecated 'pid_dir' option")
 	}
@@ -111,6 +395,10 @@ func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 		config.DenyLogPrefix = "crowdsec drop: "
 	}
 
+	if config.BanReasonLog && config.BanReasonLogFormat == "" {
+		config.BanReasonLogFormat = "{prefix}{value} banned for {duration} by {scenario} (origin {origin})"
+	}
+
 	// for config file backward compatibility
 	if config.BlacklistsIpv4 == "" {
 		config.BlacklistsIpv4 = "crowdsec-blacklists"
@@ -119,6 +407,15 @@ func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 	if config.BlacklistsIpv6 == "" {
 		config.BlacklistsIpv6 = "crowdsec6-blacklists"
 	}
+	originBlacklists := make(map[string]OriginBlacklists, len(config.OriginBlacklists))
+	for origin, blacklists := range config.OriginBlacklists {
+		if blacklists.Ipv4 == "" || blacklists.Ipv6 == "" {
+			return nil, fmt.Errorf("origin_blacklists: both ipv4 and ipv6 are required for origin '%s'", origin)
+		}
+		originBlacklists[strings.ToLower(origin)] = blacklists
+	}
+	config.OriginBlacklists = originBlacklists
+
 	if config.SetType == "" {
 		config.SetType = "nethash"
 	}
@@ -127,44 +424,446 @@ func NewConfig(reader io.Reader) (*BouncerConfig, error) {
 		config.SetSize = 65536
 	}
 
-	switch config.Mode {
-	case NftablesMode:
-		err := nftablesConfig(config)
+	if config.LAPIRetries == nil {
+		config.LAPIRetries = ptr.Of(10)
+	}
+
+	if *config.LAPIRetries < 0 {
+		return nil, fmt.Errorf("lapi_retries can't be negative")
+	}
+
+	if config.LAPIMaxBackoff == "" {
+		config.LAPIMaxBackoff = "1m"
+	}
+
+	if _, err := time.ParseDuration(config.LAPIMaxBackoff); err != nil {
+		return nil, fmt.Errorf("invalid lapi_max_backoff '%s': %w", config.LAPIMaxBackoff, err)
+	}
+
+	for option, value := range map[string]string{"startup_delay": config.StartupDelay, "wait_for_lapi": config.WaitForLAPI} {
+		if value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
 		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s': %w", option, value, err)
+		}
+
+		if d < 0 {
+			return nil, fmt.Errorf("%s can't be negative", option)
+		}
+	}
+
+	switch config.DenyStage {
+	case "":
+		config.DenyStage = DenyStageFilter
+	case DenyStageFilter, DenyStageRaw:
+	default:
+		return nil, fmt.Errorf("deny_stage must be '%s' or '%s'", DenyStageFilter, DenyStageRaw)
+	}
+
+	switch config.LAPIMode {
+	case "":
+		config.LAPIMode = LAPIModeStream
+	case LAPIModeStream, LAPIModePoll:
+	case LAPIModeDatabase:
+		if err := config.validateDatabase(); err != nil {
 			return nil, err
 		}
-	case IpsetMode, IptablesMode:
-		// nothing specific to do
-	case PfMode:
-		err := pfConfig(config)
+	default:
+		return nil, fmt.Errorf("lapi_mode must be '%s', '%s' or '%s'", LAPIModeStream, LAPIModePoll, LAPIModeDatabase)
+	}
+
+	if config.MaxBannedIPs.Ipv4 < 0 || config.MaxBannedIPs.Ipv6 < 0 {
+		return nil, fmt.Errorf("max_banned_ips can't be negative")
+	}
+
+	if config.MinPrefixLength.Ipv4 < 0 || config.MinPrefixLength.Ipv4 > 32 {
+		return nil, fmt.Errorf("min_prefix_length.ipv4 must be between 0 and 32")
+	}
+
+	if config.MinPrefixLength.Ipv6 < 0 || config.MinPrefixLength.Ipv6 > 128 {
+		return nil, fmt.Errorf("min_prefix_length.ipv6 must be between 0 and 128")
+	}
+
+	if config.RateLimit.DecisionsPerSecond < 0 || config.RateLimit.QueueSize < 0 {
+		return nil, fmt.Errorf("rate_limit can't be negative")
+	}
+
+	if config.RateLimit.QueueSize == 0 {
+		config.RateLimit.QueueSize = 100000
+	}
+
+	if config.RateLimit.HighWaterMark == 0 {
+		config.RateLimit.HighWaterMark = 80
+	}
+
+	if config.RateLimit.HighWaterMark < 0 || config.RateLimit.HighWaterMark > 100 {
+		return nil, fmt.Errorf("rate_limit.high_water_mark must be between 1 and 100 (percent)")
+	}
+
+	switch config.MaxBannedIPs.Policy {
+	case "":
+		config.MaxBannedIPs.Policy = EvictOldest
+	case EvictOldest, RejectNew:
+	default:
+		return nil, fmt.Errorf("max_banned_ips.policy must be '%s' or '%s'", EvictOldest, RejectNew)
+	}
+
+	if config.ExecConcurrency < 0 {
+		return nil, fmt.Errorf("exec_concurrency can't be negative")
+	}
+
+	for _, o := range config.DurationOverrides {
+		if _, err := time.ParseDuration(o.Duration); err != nil {
+			return nil, fmt.Errorf("invalid duration_overrides duration '%s' for scenario '%s': %w", o.Duration, o.Scenario, err)
+		}
+	}
+
+	for _, pattern := range append(slices.Clone(config.IncludeScenarios), config.ExcludeScenarios...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid scenario pattern '%s': %w", pattern, err)
+		}
+	}
+
+	for _, p := range config.DecisionPriorities {
+		if _, err := path.Match(p.Scenario, ""); err != nil {
+			return nil, fmt.Errorf("decision_priorities: invalid scenario pattern '%s': %w", p.Scenario, err)
+		}
+	}
+
+	if config.MaxDuration != "" {
+		if d, err := time.ParseDuration(config.MaxDuration); err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid max_duration '%s'", config.MaxDuration)
+		}
+	}
+
+	if config.IntervalJitter < 0 || config.IntervalJitter > 50 {
+		return nil, fmt.Errorf("interval_jitter must be between 0 and 50 (percent)")
+	}
+
+	if config.ReconcileInterval != "" {
+		if _, err := time.ParseDuration(config.ReconcileInterval); err != nil {
+			return nil, fmt.Errorf("invalid reconcile_interval '%s': %w", config.ReconcileInterval, err)
+		}
+	}
+
+	if config.PrometheusConfig.Interval != "" {
+		if _, err := time.ParseDuration(config.PrometheusConfig.Interval); err != nil {
+			return nil, fmt.Errorf("invalid prometheus interval '%s': %w", config.PrometheusConfig.Interval, err)
+		}
+	}
+
+	if config.MetricsPush.Enabled() {
+		if config.MetricsPush.Interval == "" {
+			config.MetricsPush.Interval = "30m"
+		}
+
+		interval, err := time.ParseDuration(config.MetricsPush.Interval)
 		if err != nil {
+			return nil, fmt.Errorf("invalid metrics_push.interval '%s': %w", config.MetricsPush.Interval, err)
+		}
+
+		if interval <= 0 {
+			return nil, fmt.Errorf("metrics_push.interval must be positive")
+		}
+	}
+
+	for _, mode := range append([]string{config.Mode}, config.ExtraModes...) {
+		if err := modeConfig(config, mode); err != nil {
 			return nil, err
 		}
-	case DryRunMode:
-		// nothing specific to do
+	}
+
+	switch config.ExtraModesPolicy {
+	case "":
+		config.ExtraModesPolicy = BestEffort
+	case BestEffort, AllOrNothing:
 	default:
-		log.Warningf("unexpected %s mode", config.Mode)
+		return nil, fmt.Errorf("extra_modes_policy must be '%s' or '%s'", BestEffort, AllOrNothing)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
 	return config, nil
 }
 
+// RestartRequired returns the name of the options that differ between two configurations
+// and can't be applied without restarting the bouncer. Logging options are applied
+// as soon as a configuration is loaded.
+func (c *BouncerConfig) RestartRequired(other *BouncerConfig) []string {
+	ret := []string{}
+
+	// the metrics interval and the pf retries are reloaded
+	prometheus, otherPrometheus := c.PrometheusConfig, other.PrometheusConfig
+	prometheus.Interval, otherPrometheus.Interval = "", ""
+
+	pf, otherPF := c.PF, other.PF
+	pf.RetryCount, otherPF.RetryCount = 0, 0
+	pf.RetryBackoff, otherPF.RetryBackoff = "", ""
+
+	options := []struct {
+		name    string
+		changed bool
+	}{
+		{"mode", c.Mode != other.Mode},
+		{"extra_modes", !reflect.DeepEqual(c.ExtraModes, other.ExtraModes)},
+		{"extra_modes_policy", c.ExtraModesPolicy != other.ExtraModesPolicy},
+		{"update_frequency", c.UpdateFrequency != other.UpdateFrequency},
+		{"disable_ipv4", c.DisableIPV4 != other.DisableIPV4},
+		{"disable_ipv6", c.DisableIPV6 != other.DisableIPV6},
+		{"dry_run", c.DryRun != other.DryRun},
+		{"flush_on_shutdown", *c.FlushOnShutdown != *other.FlushOnShutdown},
+		{"flush_on_startup", *c.FlushOnStartup != *other.FlushOnStartup},
+		{"flush_mode", c.FlushMode != other.FlushMode},
+		{"shutdown_timeout", c.ShutdownTimeout != other.ShutdownTimeout},
+		{"deny_action", c.DenyAction != other.DenyAction},
+		{"deny_log", c.DenyLog != other.DenyLog},
+		{"deny_log_prefix", c.DenyLogPrefix != other.DenyLogPrefix},
+		{"ban_reason_log", c.BanReasonLog != other.BanReasonLog},
+		{"ban_reason_log_format", c.BanReasonLogFormat != other.BanReasonLogFormat},
+		{"audit_mode", c.AuditMode != other.AuditMode},
+		{"deny_stage", c.DenyStage != other.DenyStage},
+		{"interface", c.Interface != other.Interface},
+		{"rule_comment", c.RuleComment != other.RuleComment},
+		{"allow_icmp_echo", c.AllowICMPEcho != other.AllowICMPEcho},
+		{"blacklists_ipv4", c.BlacklistsIpv4 != other.BlacklistsIpv4},
+		{"blacklists_ipv6", c.BlacklistsIpv6 != other.BlacklistsIpv6},
+		{"ipset_type", c.SetType != other.SetType},
+		{"ipset_size", c.SetSize != other.SetSize},
+		{"geoip_database", c.GeoIPDatabase != other.GeoIPDatabase},
+		{"asn_database", c.ASNDatabase != other.ASNDatabase},
+		{"lapi_retries", *c.LAPIRetries != *other.LAPIRetries},
+		{"lapi_max_backoff", c.LAPIMaxBackoff != other.LAPIMaxBackoff},
+		{"startup_delay", c.StartupDelay != other.StartupDelay},
+		{"wait_for_lapi", c.WaitForLAPI != other.WaitForLAPI},
+		{"api_unix_socket", c.APIUnixSocket != other.APIUnixSocket},
+		{"lapi_mode", c.LAPIMode != other.LAPIMode},
+		{"database", c.Database != other.Database},
+		{"max_banned_ips", c.MaxBannedIPs != other.MaxBannedIPs},
+		{"min_prefix_length", c.MinPrefixLength != other.MinPrefixLength},
+		{"rate_limit", c.RateLimit != other.RateLimit},
+		{"interval_jitter", c.IntervalJitter != other.IntervalJitter},
+		{"reconcile_interval", c.ReconcileInterval != other.ReconcileInterval},
+		{"control_socket", c.ControlSocket != other.ControlSocket},
+		{"blocklist_files", !reflect.DeepEqual(c.BlocklistFiles, other.BlocklistFiles)},
+		{"exec_concurrency", c.ExecConcurrency != other.ExecConcurrency},
+		{"sync_on_startup", c.SyncOnStartup != other.SyncOnStartup},
+		{"import_existing_bans", c.ImportExistingBans != other.ImportExistingBans},
+		{"self_test", c.SelfTest != other.SelfTest},
+		{"skip_expired_decisions", *c.SkipExpiredDecisions != *other.SkipExpiredDecisions},
+		{"coalesce_ranges", c.CoalesceRanges != other.CoalesceRanges},
+		{"duration_overrides", !reflect.DeepEqual(c.DurationOverrides, other.DurationOverrides)},
+		{"max_duration", c.MaxDuration != other.MaxDuration},
+		{"include_scenarios", !reflect.DeepEqual(c.IncludeScenarios, other.IncludeScenarios)},
+		{"exclude_scenarios", !reflect.DeepEqual(c.ExcludeScenarios, other.ExcludeScenarios)},
+		{"decision_priorities", !reflect.DeepEqual(c.DecisionPriorities, other.DecisionPriorities)},
+		{"origin_blacklists", !reflect.DeepEqual(c.OriginBlacklists, other.OriginBlacklists)},
+		{"iptables_chains", !reflect.DeepEqual(c.IptablesChains, other.IptablesChains)},
+		{"iptables_rule_position", c.IptablesRulePosition != other.IptablesRulePosition},
+		{"iptables_rule_index", c.IptablesRuleIndex != other.IptablesRuleIndex},
+		{"supported_decisions_types", !reflect.DeepEqual(c.SupportedDecisionsTypes, other.SupportedDecisionsTypes)},
+		{"nftables", !reflect.DeepEqual(c.Nftables, other.Nftables)},
+		{"nftables_hooks", !reflect.DeepEqual(c.NftablesHooks, other.NftablesHooks)},
+		{"pf", !reflect.DeepEqual(pf, otherPF)},
+		{"exabgp", !reflect.DeepEqual(c.ExaBGP, other.ExaBGP)},
+		{"prometheus", prometheus != otherPrometheus},
+		{"notifier", c.Notifier != other.Notifier},
+		{"metrics_push", c.MetricsPush != other.MetricsPush},
+	}
+
+	for _, o := range options {
+		if o.changed {
+			ret = append(ret, o.name)
+		}
+	}
+
+	return ret
+}
+
+// modeConfig sets the defaults and checks the options specific to a firewall mode.
+func modeConfig(config *BouncerConfig, mode string) error {
+	switch mode {
+	case NftablesMode:
+		return nftablesConfig(config)
+	case IptablesMode:
+		return iptablesConfig(config)
+	case PfMode:
+		return pfConfig(config)
+	case ExaBGPMode:
+		return exabgpConfig(config)
+	case IpsetMode, WindowsMode, DryRunMode:
+		// nothing specific to do
+	}
+
+	return nil
+}
+
+func iptablesConfig(config *BouncerConfig) error {
+	switch config.IptablesRulePosition {
+	case "":
+		config.IptablesRulePosition = RulePositionInsert
+	case RulePositionInsert, RulePositionAppend:
+	default:
+		return fmt.Errorf("iptables_rule_position must be '%s' or '%s'", RulePositionInsert, RulePositionAppend)
+	}
+
+	if config.IptablesRuleIndex < 0 {
+		return fmt.Errorf("iptables_rule_index can't be negative")
+	}
+
+	if config.IptablesRuleIndex > 0 && config.IptablesRulePosition == RulePositionAppend {
+		return fmt.Errorf("iptables_rule_index can't be used with iptables_rule_position '%s'", RulePositionAppend)
+	}
+
+	if config.DenyStage != DenyStageRaw {
+		return nil
+	}
+
+	if len(config.IptablesChains) == 0 {
+		config.IptablesChains = []string{"PREROUTING"}
+	}
+
+	for _, chain := range config.IptablesChains {
+		switch chain {
+		case "PREROUTING", "OUTPUT":
+		default:
+			return fmt.Errorf("iptables_chains: '%s' is not a chain of the raw table (PREROUTING or OUTPUT)", chain)
+		}
+	}
+
+	return nil
+}
+
 func pfConfig(config *BouncerConfig) error {
+	if config.PF.PfctlPath == "" {
+		config.PF.PfctlPath = "/sbin/pfctl"
+	}
+
+	if config.PF.SweepInterval == "" {
+		config.PF.SweepInterval = "1m"
+	}
+
+	if _, err := time.ParseDuration(config.PF.SweepInterval); err != nil {
+		return fmt.Errorf("invalid pf sweep_interval '%s': %w", config.PF.SweepInterval, err)
+	}
+
+	if config.PF.RetryCount < 0 {
+		return fmt.Errorf("pf retry_count can't be negative")
+	}
+
+	if config.PF.MaxArgsPerCommand < 0 {
+		return fmt.Errorf("pf max_args_per_command can't be negative")
+	}
+
+	if config.PF.MaxArgsPerCommand == 0 {
+		config.PF.MaxArgsPerCommand = 2000
+	}
+
+	if config.PF.RetryBackoff == "" {
+		config.PF.RetryBackoff = "100ms"
+	}
+
+	if _, err := time.ParseDuration(config.PF.RetryBackoff); err != nil {
+		return fmt.Errorf("invalid pf retry_backoff '%s': %w", config.PF.RetryBackoff, err)
+	}
+
+	if config.PF.ExecTimeout == "" {
+		config.PF.ExecTimeout = "10s"
+	}
+
+	if _, err := time.ParseDuration(config.PF.ExecTimeout); err != nil {
+		return fmt.Errorf("invalid pf exec_timeout '%s': %w", config.PF.ExecTimeout, err)
+	}
+
+	if config.PF.ManageTableLifecycle != nil && !*config.PF.ManageTableLifecycle {
+		config.PF.KeepTables = true
+	}
+
+	if table := config.PF.IPv6NetworksTable; table != "" {
+		if config.PF.Alias != "" {
+			return fmt.Errorf("pf ipv6_networks_table can't be used with pf alias")
+		}
+
+		if table == config.BlacklistsIpv4 || table == config.BlacklistsIpv6 {
+			return fmt.Errorf("pf ipv6_networks_table must differ from blacklists_ipv4 and blacklists_ipv6")
+		}
+	}
+
+	switch config.PF.TableRules {
+	case "":
+	case TableRulesJoined, TableRulesSplit:
+		// a table shared by both families is referenced the same way by any rule
+		if config.PF.Alias != "" || config.DisableIPV4 || config.DisableIPV6 || config.BlacklistsIpv4 == config.BlacklistsIpv6 {
+			return fmt.Errorf("pf table_rules requires a table for each family, without alias")
+		}
+	default:
+		return fmt.Errorf("pf table_rules must be '%s' or '%s'", TableRulesJoined, TableRulesSplit)
+	}
+
+	return nil
+}
+
+// communityRe matches a standard BGP community
+var communityRe = regexp.MustCompile(`^[0-9]{1,5}:[0-9]{1,5}$`)
+
+func exabgpConfig(config *BouncerConfig) error {
+	if config.ExaBGP.Pipe == "" && config.Logging.LogMode == "stdout" {
+		return fmt.Errorf("exabgp reads its commands from stdout without a pipe, log_mode must be 'file'")
+	}
+
+	nextHops := []struct {
+		option   string
+		value    string
+		disabled bool
+	}{
+		{"next_hop", config.ExaBGP.NextHop, config.DisableIPV4},
+		{"next_hop_ipv6", config.ExaBGP.NextHopIPv6, config.DisableIPV6},
+	}
+
+	for _, nh := range nextHops {
+		if nh.disabled {
+			continue
+		}
+
+		if net.ParseIP(nh.value) == nil {
+			return fmt.Errorf("exabgp %s: invalid or missing address '%s'", nh.option, nh.value)
+		}
+	}
+
+	if config.ExaBGP.Communities == nil {
+		// BLACKHOLE, RFC 7999
+		config.ExaBGP.Communities = []string{"65535:666"}
+	}
+
+	for _, c := range config.ExaBGP.Communities {
+		if !communityRe.MatchString(c) {
+			return fmt.Errorf("exabgp communities: invalid community '%s'", c)
+		}
+	}
+
+	if config.ExaBGP.SweepInterval == "" {
+		config.ExaBGP.SweepInterval = "1m"
+	}
+
+	if _, err := time.ParseDuration(config.ExaBGP.SweepInterval); err != nil {
+		return fmt.Errorf("invalid exabgp sweep_interval '%s': %w", config.ExaBGP.SweepInterval, err)
+	}
+
 	return nil
 }
 
 func nftablesConfig(config *BouncerConfig) error {
 	// deal with defaults in a backward compatible way
 	if config.Nftables.Ipv4.Enabled == nil {
-		config.Nftables.Ipv4.Enabled = ptr.Of(true)
+		config.Nftables.Ipv4.Enabled = ptr.Of(!config.DisableIPV4)
 	}
 
 	if config.Nftables.Ipv6.Enabled == nil {
-		if config.DisableIPV6 {
-			config.Nftables.Ipv4.Enabled = ptr.Of(false)
-		} else {
-			config.Nftables.Ipv6.Enabled = ptr.Of(true)
-		}
+		config.Nftables.Ipv6.Enabled = ptr.Of(!config.DisableIPV6)
 	}
 
 	if *config.Nftables.Ipv4.Enabled {
@@ -191,9 +890,39 @@ func nftablesConfig(config *BouncerConfig) error {
 		return fmt.Errorf("both IPv4 and IPv6 disabled, doing nothing")
 	}
 
+	if config.DenyStage == DenyStageRaw {
+		return nftablesRawConfig(config)
+	}
+
 	if config.NftablesHooks == nil || len(config.NftablesHooks) == 0 {
 		config.NftablesHooks = []string{"input"}
 	}
 
 	return nil
 }
+
+// nftablesRawConfig makes the chains of the bouncer come before conntrack: in the
+// prerouting and output hooks, with the raw priority unless one is set.
+func nftablesRawConfig(config *BouncerConfig) error {
+	if len(config.NftablesHooks) == 0 {
+		config.NftablesHooks = []string{"prerouting"}
+	}
+
+	for _, hook := range config.NftablesHooks {
+		if hook != "prerouting" && hook != "output" {
+			return fmt.Errorf("nftables_hooks: '%s' comes after conntrack, the raw stage needs prerouting or output", hook)
+		}
+	}
+
+	for _, family := range []*nftablesFamilyConfig{&config.Nftables.Ipv4, &config.Nftables.Ipv6} {
+		if family.Priority == 0 {
+			family.Priority = nftablesRawPriority
+		}
+
+		if family.Priority >= -200 {
+			return fmt.Errorf("nftables priority %d comes after conntrack (-200), the raw stage needs a lower one", family.Priority)
+		}
+	}
+
+	return nil
+}
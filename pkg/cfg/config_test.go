@@ -0,0 +1,188 @@
+package cfg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBothFamiliesDisabled(t *testing.T) {
+	_, err := loadConfig(t, "mode: nftables\ndisable_ipv4: true\ndisable_ipv6: true\n")
+	if err == nil || !strings.Contains(err.Error(), "doing nothing") {
+		t.Fatalf("both families disabled gives %v", err)
+	}
+}
+
+func TestIPv6Only(t *testing.T) {
+	config, err := loadConfig(t, "mode: nftables\ndisable_ipv4: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *config.Nftables.Ipv4.Enabled || !*config.Nftables.Ipv6.Enabled {
+		t.Fatalf("nftables ipv4 enabled: %t, ipv6 enabled: %t", *config.Nftables.Ipv4.Enabled, *config.Nftables.Ipv6.Enabled)
+	}
+}
+
+func TestInvalidDurationOverride(t *testing.T) {
+	_, err := loadConfig(t, "mode: dry-run\nduration_overrides:\n  - scenario: crowdsecurity/ssh-\n    duration: forever\n")
+	if err == nil || !strings.Contains(err.Error(), "invalid duration_overrides duration 'forever'") {
+		t.Fatalf("an invalid override duration gives %v", err)
+	}
+}
+
+func TestInvalidMaxDuration(t *testing.T) {
+	for _, value := range []string{"forever", "-1h"} {
+		if _, err := loadConfig(t, "mode: dry-run\nmax_duration: "+value+"\n"); err == nil {
+			t.Fatalf("max_duration '%s' is accepted", value)
+		}
+	}
+
+	if _, err := loadConfig(t, "mode: dry-run\nmax_duration: 0s\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidScenarioPattern(t *testing.T) {
+	if _, err := loadConfig(t, "mode: dry-run\ninclude_scenarios:\n  - \"crowdsecurity/[ssh\"\n"); err == nil {
+		t.Fatal("an invalid scenario pattern is accepted")
+	}
+}
+
+func TestExtraModesPolicy(t *testing.T) {
+	config, err := loadConfig(t, "mode: dry-run\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.ExtraModesPolicy != BestEffort {
+		t.Fatalf("extra_modes_policy defaults to '%s'", config.ExtraModesPolicy)
+	}
+
+	if _, err := loadConfig(t, "mode: dry-run\nextra_modes_policy: sometimes\n"); err == nil {
+		t.Fatal("an invalid extra_modes_policy is accepted")
+	}
+}
+
+func TestInvalidMinPrefixLength(t *testing.T) {
+	for _, value := range []string{"ipv4: 33", "ipv4: -1", "ipv6: 129"} {
+		if _, err := loadConfig(t, "mode: dry-run\nmin_prefix_length:\n  "+value+"\n"); err == nil {
+			t.Fatalf("min_prefix_length %s is accepted", value)
+		}
+	}
+}
+
+func TestInvalidIntervalJitter(t *testing.T) {
+	for _, value := range []string{"-1", "51"} {
+		if _, err := loadConfig(t, "mode: dry-run\ninterval_jitter: "+value+"\n"); err == nil {
+			t.Fatalf("interval_jitter %s is accepted", value)
+		}
+	}
+}
+
+func TestSkipExpiredDecisionsDefault(t *testing.T) {
+	config, err := loadConfig(t, "mode: dry-run\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !*config.SkipExpiredDecisions {
+		t.Fatal("the expired decisions are applied by default")
+	}
+
+	config, err = loadConfig(t, "mode: dry-run\nskip_expired_decisions: false\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *config.SkipExpiredDecisions {
+		t.Fatal("skip_expired_decisions: false is ignored")
+	}
+}
+
+func TestPFMaxArgsPerCommand(t *testing.T) {
+	config, err := loadConfig(t, "mode: pf\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.PF.MaxArgsPerCommand != 2000 {
+		t.Fatalf("max_args_per_command defaults to %d", config.PF.MaxArgsPerCommand)
+	}
+
+	if _, err := loadConfig(t, "mode: pf\npf:\n  max_args_per_command: -1\n"); err == nil {
+		t.Fatal("a negative max_args_per_command is accepted")
+	}
+}
+
+func TestPFTableRules(t *testing.T) {
+	for _, mode := range []string{TableRulesJoined, TableRulesSplit} {
+		if _, err := loadConfig(t, "mode: pf\npf:\n  table_rules: "+mode+"\n"); err != nil {
+			t.Fatalf("table_rules %s: %s", mode, err)
+		}
+
+		if _, err := loadConfig(t, "mode: pf\ndisable_ipv6: true\npf:\n  table_rules: "+mode+"\n"); err == nil {
+			t.Fatalf("table_rules %s is accepted with a single family", mode)
+		}
+
+		if _, err := loadConfig(t, "mode: pf\npf:\n  alias: crowdsec\n  table_rules: "+mode+"\n"); err == nil {
+			t.Fatalf("table_rules %s is accepted with an alias", mode)
+		}
+	}
+
+	if _, err := loadConfig(t, "mode: pf\npf:\n  table_rules: both\n"); err == nil {
+		t.Fatal("an unknown table_rules is accepted")
+	}
+}
+
+func TestInvalidStartupWait(t *testing.T) {
+	for _, option := range []string{"startup_delay", "wait_for_lapi"} {
+		for _, value := range []string{"soon", "-1s"} {
+			if _, err := loadConfig(t, "mode: dry-run\n"+option+": "+value+"\n"); err == nil {
+				t.Fatalf("%s '%s' is accepted", option, value)
+			}
+		}
+
+		if _, err := loadConfig(t, "mode: dry-run\n"+option+": 30s\n"); err != nil {
+			t.Fatalf("%s: %s", option, err)
+		}
+	}
+}
+
+func TestFlushOnStartup(t *testing.T) {
+	config, err := loadConfig(t, "mode: pf\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !*config.FlushOnStartup {
+		t.Fatal("flush_on_startup defaults to false")
+	}
+
+	if _, err := loadConfig(t, "mode: pf\nflush_on_startup: false\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfig(t, "mode: nftables\nflush_on_startup: false\n"); err == nil {
+		t.Fatal("flush_on_startup: false is accepted by the nftables mode")
+	}
+}
+
+func TestMetricsPush(t *testing.T) {
+	config, err := loadConfig(t, "mode: pf\nmetrics_push:\n  url: http://127.0.0.1:8080/metrics\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.MetricsPush.Interval != "30m" {
+		t.Fatalf("metrics_push.interval defaults to '%s'", config.MetricsPush.Interval)
+	}
+
+	for _, content := range []string{
+		"mode: pf\nmetrics_push:\n  lapi: true\n  interval: 0s\n",
+		"mode: dry-run\nmetrics_push:\n  lapi: true\n",
+	} {
+		if _, err := loadConfig(t, content); err == nil {
+			t.Fatalf("%q is accepted", content)
+		}
+	}
+}
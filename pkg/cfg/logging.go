@@ -14,13 +14,15 @@ import (
 )
 
 type LoggingConfig struct {
-	LogLevel     *log.Level `yaml:"log_level"`
-	LogMode      string     `yaml:"log_mode"`
-	LogDir       string     `yaml:"log_dir"`
-	LogMaxSize   int        `yaml:"log_max_size,omitempty"`
-	LogMaxFiles  int        `yaml:"log_max_files,omitempty"`
-	LogMaxAge    int        `yaml:"log_max_age,omitempty"`
-	CompressLogs *bool      `yaml:"compress_logs,omitempty"`
+	LogLevel      *log.Level `yaml:"log_level"`
+	LogMode       string     `yaml:"log_mode"`
+	LogFormat     string     `yaml:"log_format"`
+	LogDir        string     `yaml:"log_dir"`
+	LogMaxSize    int        `yaml:"log_max_size,omitempty"`
+	LogMaxFiles   int        `yaml:"log_max_files,omitempty"`
+	LogMaxBackups int        `yaml:"log_max_backups,omitempty"` // alias of log_max_files
+	LogMaxAge     int        `yaml:"log_max_age,omitempty"`
+	CompressLogs  *bool      `yaml:"compress_logs,omitempty"`
 }
 
 func (c *LoggingConfig) LoggerForFile(fileName string) (io.Writer, error) {
@@ -47,6 +49,10 @@ func (c *LoggingConfig) setDefaults() {
 		c.LogMode = "stdout"
 	}
 
+	if c.LogFormat == "" {
+		c.LogFormat = "text"
+	}
+
 	if c.LogDir == "" {
 		c.LogDir = "/var/log/"
 	}
@@ -59,6 +65,10 @@ func (c *LoggingConfig) setDefaults() {
 		c.LogMaxSize = 500
 	}
 
+	if c.LogMaxFiles == 0 {
+		c.LogMaxFiles = c.LogMaxBackups
+	}
+
 	if c.LogMaxFiles == 0 {
 		c.LogMaxFiles = 3
 	}
@@ -76,6 +86,21 @@ func (c *LoggingConfig) validate() error {
 	if c.LogMode != "stdout" && c.LogMode != "file" {
 		return fmt.Errorf("log_mode should be either 'stdout' or 'file'")
 	}
+
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format should be either 'text' or 'json'")
+	}
+
+	if c.LogMode == "file" {
+		// fail now rather than losing the logs
+		f, err := os.CreateTemp(c.LogDir, ".crowdsec-firewall-bouncer-*")
+		if err != nil {
+			return fmt.Errorf("log_dir %s is not writable: %w", c.LogDir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+
 	return nil
 }
 
@@ -86,12 +111,24 @@ func (c *LoggingConfig) setup(fileName string) error {
 	}
 	log.SetLevel(*c.LogLevel)
 
+	// set either way, a reload may switch from json back to text
+	switch {
+	case c.LogFormat == "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case c.LogMode == "stdout":
+		log.SetFormatter(&log.TextFormatter{})
+	default:
+		log.SetFormatter(&log.TextFormatter{TimestampFormat: "02-01-2006 15:04:05", FullTimestamp: true})
+	}
+
+	// the hook of a previous log_mode file
+	log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
 	if c.LogMode == "stdout" {
+		log.SetOutput(os.Stderr)
 		return nil
 	}
 
-	log.SetFormatter(&log.TextFormatter{TimestampFormat: "02-01-2006 15:04:05", FullTimestamp: true})
-
 	logger, err := c.LoggerForFile(fileName)
 	if err != nil {
 		return err
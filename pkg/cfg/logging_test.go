@@ -0,0 +1,48 @@
+package cfg
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSetupLogFormatReload(t *testing.T) {
+	defer log.SetFormatter(log.StandardLogger().Formatter)
+
+	json := &LoggingConfig{LogFormat: "json"}
+	if err := json.setup("test.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok {
+		t.Fatalf("formatter is %T with log_format json", log.StandardLogger().Formatter)
+	}
+
+	// reloaded without log_format, which defaults to text
+	text := &LoggingConfig{}
+	if err := text.setup("test.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := log.StandardLogger().Formatter.(*log.TextFormatter); !ok {
+		t.Fatalf("formatter is %T after switching back to text", log.StandardLogger().Formatter)
+	}
+}
+
+func TestSetupLogModeReload(t *testing.T) {
+	defer log.SetOutput(log.StandardLogger().Out)
+
+	file := &LoggingConfig{LogMode: "file", LogDir: t.TempDir()}
+	if err := file.setup("test.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := &LoggingConfig{}
+	if err := stdout.setup("test.log"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log.StandardLogger().Hooks) != 0 {
+		t.Fatalf("the hooks of log_mode file are kept: %v", log.StandardLogger().Hooks)
+	}
+}
@@ -0,0 +1,329 @@
+package cfg
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// ipset and pf both limit the names of sets and tables to 31 characters.
+const maxSetNameLength = 31
+
+// nftables limits the comments of the rules to 128 bytes, including the NUL terminator.
+const maxRuleCommentLength = 127
+
+var setNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// BanReasonFields are the placeholders of ban_reason_log_format, ie. {scenario}, replaced
+// by deny_log_prefix and the fields of the decisions.
+var BanReasonFields = []string{"prefix", "value", "scope", "scenario", "origin", "duration", "backend"}
+
+var placeholderRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+func validateSetName(option string, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	if !setNameRe.MatchString(name) {
+		return fmt.Errorf("%s: invalid name '%s', only letters, digits, '_', '-' and '.' are allowed", option, name)
+	}
+
+	if len(name) > maxSetNameLength {
+		return fmt.Errorf("%s: name '%s' is longer than %d characters", option, name, maxSetNameLength)
+	}
+
+	return nil
+}
+
+func validateNetwork(value string) error {
+	if strings.Contains(value, "/") {
+		_, _, err := net.ParseCIDR(value)
+		return err
+	}
+
+	if net.ParseIP(value) == nil {
+		return fmt.Errorf("invalid IP address '%s'", value)
+	}
+
+	return nil
+}
+
+// validateDenyAction checks that the REJECT target can be used where the rules are
+// added: iptables and nftables only allow it in the input, forward and output hooks.
+func (c *BouncerConfig) validateDenyAction() error {
+	switch strings.ToUpper(c.DenyAction) {
+	case "", "DROP":
+		return nil
+	case "REJECT":
+	default:
+		return fmt.Errorf("deny_action must be DROP or REJECT, not '%s'", c.DenyAction)
+	}
+
+	if c.DenyStage == DenyStageRaw {
+		return fmt.Errorf("deny_action: REJECT can't be used in the raw stage")
+	}
+
+	switch c.Mode {
+	case IptablesMode:
+		for _, chain := range c.IptablesChains {
+			switch strings.ToUpper(chain) {
+			case "PREROUTING", "POSTROUTING":
+				return fmt.Errorf("deny_action: REJECT can't be used in the %s chain", chain)
+			}
+		}
+	case NftablesMode:
+		for _, hook := range c.NftablesHooks {
+			switch hook {
+			case "input", "forward", "output":
+			default:
+				return fmt.Errorf("deny_action: REJECT can't be used in the %s hook", hook)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateModes checks mode and extra_modes: each firewall must appear once, and
+// the iptables and ipset modes can't be combined since they manage the same sets.
+func (c *BouncerConfig) validateModes() error {
+	seen := make(map[string]bool)
+
+	for _, mode := range append([]string{c.Mode}, c.ExtraModes...) {
+		switch mode {
+		case IpsetMode, IptablesMode, NftablesMode, PfMode, WindowsMode, ExaBGPMode, DryRunMode:
+		default:
+			return fmt.Errorf("unknown mode '%s'", mode)
+		}
+
+		if seen[mode] {
+			return fmt.Errorf("mode '%s' is used more than once", mode)
+		}
+
+		seen[mode] = true
+	}
+
+	if seen[IptablesMode] && seen[IpsetMode] {
+		return fmt.Errorf("the iptables and ipset modes can't be used together, they manage the same sets")
+	}
+
+	return nil
+}
+
+// validateDatabase checks the database the decisions are read from in lapi_mode database,
+// and defaults update_frequency, which is only read by the bouncer library otherwise.
+func (c *BouncerConfig) validateDatabase() error {
+	switch c.Database.Type {
+	case DatabaseSQLite, DatabasePostgres, DatabaseMySQL:
+	case "":
+		return fmt.Errorf("lapi_mode '%s' requires database.type", LAPIModeDatabase)
+	default:
+		return fmt.Errorf("database.type must be '%s', '%s' or '%s'", DatabaseSQLite, DatabasePostgres, DatabaseMySQL)
+	}
+
+	if c.Database.DSN == "" {
+		return fmt.Errorf("lapi_mode '%s' requires database.dsn", LAPIModeDatabase)
+	}
+
+	if c.UpdateFrequency == "" {
+		c.UpdateFrequency = "10s"
+	}
+
+	frequency, err := time.ParseDuration(c.UpdateFrequency)
+	if err != nil {
+		return fmt.Errorf("invalid update_frequency '%s': %w", c.UpdateFrequency, err)
+	}
+
+	if frequency <= 0 {
+		return fmt.Errorf("update_frequency must be positive")
+	}
+
+	return nil
+}
+
+// CheckInterface makes sure the interface the rules are restricted to exists, when the
+// backend adding the rules starts.
+func (c *BouncerConfig) CheckInterface() error {
+	if c.Interface == "" {
+		return nil
+	}
+
+	if _, err := net.InterfaceByName(c.Interface); err != nil {
+		return fmt.Errorf("interface '%s': %w", c.Interface, err)
+	}
+
+	return nil
+}
+
+// validateAutoSetType checks that the sets of ipset_type auto can be created: the ipset mode
+// only fills existing sets, and their names get a suffix.
+func (c *BouncerConfig) validateAutoSetType(names map[string]string) error {
+	if c.Mode == IpsetMode || slices.Contains(c.ExtraModes, IpsetMode) {
+		return fmt.Errorf("ipset_type '%s' can't be used with the ipset mode, which doesn't create the sets", SetTypeAuto)
+	}
+
+	for option, name := range names {
+		if option != "blacklists_ipv4" && option != "blacklists_ipv6" && !strings.HasPrefix(option, "origin_blacklists.") {
+			continue
+		}
+
+		// the longest of the "-ip" and "-net" suffixes
+		if err := validateSetName(option, name+"-net"); err != nil {
+			return fmt.Errorf("%w (ipset_type '%s' adds '-ip' and '-net' to it)", err, SetTypeAuto)
+		}
+	}
+
+	return nil
+}
+
+// usesSetNames tells whether the blacklists are ipset sets or pf tables, whose names are limited.
+func (c *BouncerConfig) usesSetNames() bool {
+	for _, mode := range append([]string{c.Mode}, c.ExtraModes...) {
+		switch mode {
+		case IpsetMode, IptablesMode, PfMode:
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateImport checks that the bans of the firewalls can be read back for import_existing_bans.
+func (c *BouncerConfig) validateImport() error {
+	for _, mode := range append([]string{c.Mode}, c.ExtraModes...) {
+		switch mode {
+		case IpsetMode, IptablesMode, NftablesMode, PfMode, ExaBGPMode:
+		default:
+			return fmt.Errorf("import_existing_bans: the bans of the %s mode can't be read back", mode)
+		}
+	}
+
+	// the merged ranges don't match the decisions, and would be removed on the first commit
+	if c.CoalesceRanges {
+		return fmt.Errorf("import_existing_bans can't be used with coalesce_ranges")
+	}
+
+	return nil
+}
+
+// Validate checks the options that can't be checked while loading them, such as
+// the names of the firewall objects. It doesn't touch the firewall.
+func (c *BouncerConfig) Validate() error {
+	if err := c.validateModes(); err != nil {
+		return err
+	}
+
+	// the names of the ipset sets and pf tables, nftables allows longer ones
+	names := map[string]string{
+		"pf.anchor_name":         c.PF.AnchorName,
+		"pf.alias":               c.PF.Alias,
+		"pf.ipv6_networks_table": c.PF.IPv6NetworksTable,
+	}
+
+	if c.usesSetNames() {
+		names["blacklists_ipv4"] = c.BlacklistsIpv4
+		names["blacklists_ipv6"] = c.BlacklistsIpv6
+
+		for origin, blacklists := range c.OriginBlacklists {
+			names["origin_blacklists."+origin+".ipv4"] = blacklists.Ipv4
+			names["origin_blacklists."+origin+".ipv6"] = blacklists.Ipv6
+		}
+	}
+
+	for option, name := range names {
+		// pf anchors can be nested, ie. "crowdsec/blacklists"
+		if option == "pf.anchor_name" {
+			name = strings.ReplaceAll(name, "/", "_")
+		}
+
+		if err := validateSetName(option, name); err != nil {
+			return err
+		}
+	}
+
+	// ipset and nftables sets hold a single address family, unlike pf tables
+	if c.BlacklistsIpv4 == c.BlacklistsIpv6 && !c.DisableIPV4 && !c.DisableIPV6 && c.Mode != PfMode {
+		return fmt.Errorf("blacklists_ipv4 and blacklists_ipv6 must be different, both are '%s'", c.BlacklistsIpv4)
+	}
+
+	if c.SetType == SetTypeAuto {
+		if err := c.validateAutoSetType(names); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateDenyAction(); err != nil {
+		return err
+	}
+
+	// the other modes don't manage the rules referencing the sets
+	if c.AuditMode && c.Mode != IptablesMode && c.Mode != NftablesMode {
+		return fmt.Errorf("audit_mode is only supported by the iptables and nftables modes")
+	}
+
+	if c.DenyStage == DenyStageRaw && c.Mode != IptablesMode && c.Mode != NftablesMode {
+		return fmt.Errorf("deny_stage '%s' is only supported by the iptables and nftables modes", DenyStageRaw)
+	}
+
+	// pf and the ipset mode use the rules of the user, which can match an interface themselves
+	if c.Interface != "" && c.Mode != IptablesMode && c.Mode != NftablesMode {
+		return fmt.Errorf("interface is only supported by the iptables and nftables modes")
+	}
+
+	if c.AllowICMPEcho && c.Mode != IptablesMode && c.Mode != NftablesMode {
+		return fmt.Errorf("allow_icmp_echo is only supported by the iptables and nftables modes")
+	}
+
+	if c.RuleComment != "" {
+		if c.Mode != IptablesMode && c.Mode != NftablesMode {
+			return fmt.Errorf("rule_comment is only supported by the iptables and nftables modes")
+		}
+
+		// the limit of nftables, iptables allows 255
+		if len(c.RuleComment) > maxRuleCommentLength {
+			return fmt.Errorf("rule_comment is longer than %d characters", maxRuleCommentLength)
+		}
+	}
+
+	// the other modes create their sets again at startup
+	if !*c.FlushOnStartup && c.Mode != PfMode {
+		return fmt.Errorf("flush_on_startup: false is only supported by the pf mode")
+	}
+
+	// the bans left in the tables are imported
+	if c.ImportExistingBans || !*c.FlushOnStartup {
+		if err := c.validateImport(); err != nil {
+			return err
+		}
+	}
+
+	if c.MetricsPush.Enabled() {
+		// the same firewalls as the prometheus exporter
+		if c.Mode == IpsetMode || c.Mode == DryRunMode {
+			return fmt.Errorf("metrics_push: the %s mode doesn't report metrics", c.Mode)
+		}
+
+		if c.MetricsPush.LAPI && c.LAPIMode == LAPIModeDatabase {
+			return fmt.Errorf("metrics_push.lapi can't be used with lapi_mode '%s'", LAPIModeDatabase)
+		}
+	}
+
+	for _, match := range placeholderRe.FindAllStringSubmatch(c.BanReasonLogFormat, -1) {
+		if !slices.Contains(BanReasonFields, match[1]) {
+			return fmt.Errorf("ban_reason_log_format: unknown field '%s', the fields are {%s}", match[0], strings.Join(BanReasonFields, "}, {"))
+		}
+	}
+
+	for _, entry := range c.Allowlist {
+		if err := validateNetwork(strings.TrimSpace(entry)); err != nil {
+			return fmt.Errorf("allowlist: %w", err)
+		}
+	}
+
+	return nil
+}
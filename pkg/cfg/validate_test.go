@@ -0,0 +1,83 @@
+package cfg
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func loadConfig(t *testing.T, content string) (*BouncerConfig, error) {
+	t.Helper()
+
+	return NewConfig(strings.NewReader(content))
+}
+
+func TestLongNftablesNames(t *testing.T) {
+	// nftables doesn't limit the names of its tables, chains and sets to 31 characters
+	_, err := loadConfig(t, `mode: nftables
+blacklists_ipv4: crowdsec-blacklists-with-a-long-name
+nftables:
+  ipv4:
+    table: crowdsec-table-with-a-long-name-indeed
+    chain: crowdsec-chain-with-a-long-name-indeed
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLongSetName(t *testing.T) {
+	for _, mode := range []string{"ipset", "iptables", "pf"} {
+		_, err := loadConfig(t, "mode: "+mode+"\nblacklists_ipv4: crowdsec-blacklists-with-a-long-name\n")
+		if err == nil || !strings.Contains(err.Error(), "longer than 31 characters") {
+			t.Fatalf("mode %s: a 36 characters set name gives %v", mode, err)
+		}
+	}
+}
+
+func TestInvalidSetName(t *testing.T) {
+	_, err := loadConfig(t, "mode: iptables\nblacklists_ipv4: 'crowdsec blacklists'\n")
+	if err == nil || !strings.Contains(err.Error(), "invalid name") {
+		t.Fatalf("a set name with a space gives %v", err)
+	}
+}
+
+func TestRuleCommentLength(t *testing.T) {
+	// nftables keeps 128 bytes, the NUL terminator included
+	if _, err := loadConfig(t, "mode: nftables\nrule_comment: "+strings.Repeat("c", 127)+"\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadConfig(t, "mode: nftables\nrule_comment: "+strings.Repeat("c", 128)+"\n")
+	if err == nil || !strings.Contains(err.Error(), "longer than 127 characters") {
+		t.Fatalf("a 128 characters comment gives %v", err)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil || len(interfaces) == 0 {
+		t.Skip("no network interface")
+	}
+
+	config, err := loadConfig(t, "mode: nftables\ninterface: "+interfaces[0].Name+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.CheckInterface(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Interface = "crowdsec-none0"
+
+	if err := config.CheckInterface(); err == nil {
+		t.Fatal("a missing interface is accepted")
+	}
+
+	for _, mode := range []string{"ipset", "pf"} {
+		if _, err := loadConfig(t, "mode: "+mode+"\ninterface: lo\n"); err == nil {
+			t.Fatalf("mode %s: interface is accepted", mode)
+		}
+	}
+}
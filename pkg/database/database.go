@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	_ "modernc.org/sqlite"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/pkg/ptr"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// the columns of the decisions table of CrowdSec (ent schema), read as they are: a
+// CrowdSec version renaming or removing one of them breaks this mode
+const columns = "value, scope, type, origin, scenario, until"
+
+// the active decisions, as returned by the LAPI: not expired nor simulated. The times
+// are compared by the database since each one stores them differently.
+var queries = map[string]string{
+	cfg.DatabaseSQLite:   "SELECT " + columns + " FROM decisions WHERE simulated = 0 AND julianday(until) > julianday('now')",
+	cfg.DatabasePostgres: "SELECT " + columns + " FROM decisions WHERE NOT simulated AND until > now()",
+	cfg.DatabaseMySQL:    "SELECT " + columns + " FROM decisions WHERE simulated = 0 AND until > UTC_TIMESTAMP()",
+}
+
+// the drivers registered by the imports above
+var drivers = map[string]string{
+	cfg.DatabaseSQLite:   "sqlite",
+	cfg.DatabasePostgres: "pgx",
+	cfg.DatabaseMySQL:    "mysql",
+}
+
+// Reader reads the active decisions from the database of the LAPI, when the bouncer runs
+// on the same host. It never writes to it.
+type Reader struct {
+	db    *sql.DB
+	query string
+}
+
+// dsn returns the data source name to give the driver. A plain SQLite path is opened read-only,
+// waiting for the LAPI to finish its writes, and the MySQL times must be parsed.
+func dsn(config cfg.DatabaseConfig) (string, error) {
+	switch config.Type {
+	case cfg.DatabaseSQLite:
+		if strings.HasPrefix(config.DSN, "file:") {
+			return config.DSN, nil
+		}
+
+		return "file:" + config.DSN + "?mode=ro&_pragma=busy_timeout(5000)", nil
+	case cfg.DatabaseMySQL:
+		c, err := mysql.ParseDSN(config.DSN)
+		if err != nil {
+			return "", err
+		}
+
+		c.ParseTime = true
+
+		return c.FormatDSN(), nil
+	}
+
+	return config.DSN, nil
+}
+
+// Open connects to the database and makes sure its schema has the columns read by the bouncer.
+func Open(ctx context.Context, config cfg.DatabaseConfig) (*Reader, error) {
+	source, err := dsn(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database.dsn: %w", err)
+	}
+
+	db, err := sql.Open(drivers[config.Type], source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the %s database: %w", config.Type, err)
+	}
+
+	r := &Reader{db: db, query: queries[config.Type]}
+
+	rows, err := db.QueryContext(ctx, "SELECT "+columns+" FROM decisions LIMIT 0")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to read the decisions table of the %s database, is it the one of a supported CrowdSec version? %w", config.Type, err)
+	}
+
+	rows.Close()
+
+	return r, nil
+}
+
+// the formats of the times stored as text by SQLite
+var timeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// timestamp is a time read from text, for SQLite, or from the time types of the other databases.
+type timestamp time.Time
+
+func (t *timestamp) Scan(src any) error {
+	var text string
+
+	switch v := src.(type) {
+	case time.Time:
+		*t = timestamp(v)
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("unexpected time %T", src)
+	}
+
+	for _, format := range timeFormats {
+		if parsed, err := time.Parse(format, text); err == nil {
+			*t = timestamp(parsed)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid time '%s'", text)
+}
+
+// Decisions returns the active decisions of the database, their duration is the time left
+// before they expire.
+func (r *Reader) Decisions(ctx context.Context) ([]*models.Decision, error) {
+	rows, err := r.db.QueryContext(ctx, r.query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the decisions from the database: %w", err)
+	}
+	defer rows.Close()
+
+	ret := []*models.Decision{}
+	now := time.Now()
+
+	for rows.Next() {
+		var (
+			value, scope, decisionType, origin string
+			scenario                           sql.NullString
+			until                              timestamp
+		)
+
+		if err := rows.Scan(&value, &scope, &decisionType, &origin, &scenario, &until); err != nil {
+			return nil, fmt.Errorf("unable to read a decision from the database: %w", err)
+		}
+
+		left := time.Time(until).Sub(now).Round(time.Second)
+		if left <= 0 {
+			continue
+		}
+
+		ret = append(ret, &models.Decision{
+			Value:    ptr.Of(value),
+			Scope:    ptr.Of(scope),
+			Type:     ptr.Of(decisionType),
+			Origin:   ptr.Of(origin),
+			Scenario: ptr.Of(scenario.String),
+			Duration: ptr.Of(left.String()),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to get the decisions from the database: %w", err)
+	}
+
+	return ret, nil
+}
+
+func (r *Reader) Close() error {
+	return r.db.Close()
+}
@@ -27,15 +27,24 @@ func (d *dryRun) Commit() error {
 }
 
 func (d *dryRun) Add(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
 	log.Infof("backend.Add() called with %s", *decision.Value)
 	return nil
 }
 
-func (d *dryRun) CollectMetrics() {
+func (d *dryRun) CollectMetrics() (types.Metrics, error) {
 	log.Infof("backend.CollectMetrics() called")
+	return types.Metrics{}, nil
 }
 
 func (d *dryRun) Delete(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
 	log.Infof("backend.Delete() called with %s", *decision.Value)
 	return nil
 }
@@ -0,0 +1,396 @@
+package exabgp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// exaBGP announces a blackhole route for each ban to an ExaBGP process, which
+// distributes them to its BGP peers (RTBH). The commands are written to the named
+// pipe of the ExaBGP API, or to stdout when the bouncer is run by ExaBGP itself.
+type exaBGP struct {
+	pipe        string
+	nextHop     string
+	nextHop6    string
+	communities string
+	disableIPV4 bool
+	disableIPV6 bool
+	dryRun      bool
+	out         io.WriteCloser
+	mu          sync.Mutex
+	// the announced routes, with the time they expire (zero if never)
+	routes   map[string]time.Time
+	announce *pending
+	withdraw *pending
+	sweep    time.Duration
+}
+
+// openTimeout is how long Init waits for ExaBGP to open the reading end of the pipe.
+const openTimeout = 30 * time.Second
+
+// pending are the routes to announce or withdraw on the next commit, in the order of the decisions.
+type pending struct {
+	order     []string
+	deadlines map[string]time.Time
+}
+
+func newPending() *pending {
+	return &pending{deadlines: make(map[string]time.Time)}
+}
+
+func (p *pending) push(route string, deadline time.Time) {
+	if _, ok := p.deadlines[route]; !ok {
+		p.order = append(p.order, route)
+	}
+
+	p.deadlines[route] = deadline
+}
+
+func (p *pending) remove(route string) {
+	if _, ok := p.deadlines[route]; !ok {
+		return
+	}
+
+	delete(p.deadlines, route)
+
+	if i := slices.Index(p.order, route); i >= 0 {
+		p.order = slices.Delete(p.order, i, i+1)
+	}
+}
+
+func NewExaBGP(config *cfg.BouncerConfig) (types.Backend, error) {
+	// already validated by the config loader
+	sweep, _ := time.ParseDuration(config.ExaBGP.SweepInterval)
+
+	e := &exaBGP{
+		pipe:        config.ExaBGP.Pipe,
+		nextHop:     config.ExaBGP.NextHop,
+		nextHop6:    config.ExaBGP.NextHopIPv6,
+		communities: strings.Join(config.ExaBGP.Communities, " "),
+		disableIPV4: config.DisableIPV4,
+		disableIPV6: config.DisableIPV6,
+		dryRun:      config.DryRun,
+		sweep:       sweep,
+	}
+	e.reset()
+
+	return e, nil
+}
+
+func (e *exaBGP) reset() {
+	e.routes = make(map[string]time.Time)
+	e.announce = newPending()
+	e.withdraw = newPending()
+}
+
+// nopCloser keeps stdout open when the backend shuts down.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (e *exaBGP) Init() error {
+	switch {
+	case e.dryRun:
+		log.Infof("dry-run: not opening the exabgp pipe")
+	case e.pipe == "":
+		e.out = nopCloser{os.Stdout}
+	default:
+		f, err := openPipe(e.pipe, time.Now().Add(openTimeout))
+		if err != nil {
+			return fmt.Errorf("unable to open the exabgp pipe: %w", err)
+		}
+
+		e.out = f
+	}
+
+	log.Infof("exabgp initiated")
+
+	return nil
+}
+
+// openPipe opens the writing end of a named pipe. Opening it without blocking fails with
+// ENXIO until ExaBGP has opened the reading end, which is retried until the deadline.
+func openPipe(path string, deadline time.Time) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			return f, nil
+		}
+
+		if !errors.Is(err, syscall.ENXIO) || time.Now().After(deadline) {
+			return nil, err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// route returns the prefix to announce for a decision, or an empty string if its family is disabled.
+func (e *exaBGP) route(decision *models.Decision) (string, error) {
+	value := *decision.Value
+
+	v6, err := types.IsIPv6(value)
+	if err != nil {
+		return "", err
+	}
+
+	if v6 && e.disableIPV6 || !v6 && e.disableIPV4 {
+		log.Debugf("ignoring '%s' because its address family is disabled", value)
+		return "", nil
+	}
+
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network.String(), nil
+	}
+
+	if v6 {
+		return net.ParseIP(value).String() + "/128", nil
+	}
+
+	return net.ParseIP(value).To4().String() + "/32", nil
+}
+
+func (e *exaBGP) Add(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	route, err := e.route(decision)
+	if err != nil || route == "" {
+		return err
+	}
+
+	var deadline time.Time
+
+	if decision.Duration != nil {
+		duration, err := time.ParseDuration(*decision.Duration)
+		if err != nil {
+			return err
+		}
+
+		deadline = time.Now().Add(duration)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.withdraw.remove(route)
+	e.announce.push(route, deadline)
+
+	return nil
+}
+
+func (e *exaBGP) Delete(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	route, err := e.route(decision)
+	if err != nil || route == "" {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.announce.remove(route)
+	e.withdraw.push(route, time.Time{})
+
+	return nil
+}
+
+func (e *exaBGP) nextHopFor(route string) string {
+	if strings.Contains(route, ":") {
+		return e.nextHop6
+	}
+
+	return e.nextHop
+}
+
+func (e *exaBGP) announceCommand(route string) string {
+	cmd := "announce route " + route + " next-hop " + e.nextHopFor(route)
+	if e.communities != "" {
+		cmd += " community [" + e.communities + "]"
+	}
+
+	return cmd
+}
+
+func (e *exaBGP) withdrawCommand(route string) string {
+	return "withdraw route " + route + " next-hop " + e.nextHopFor(route)
+}
+
+// write sends the commands to ExaBGP in a single write, one per line.
+func (e *exaBGP) write(commands []string) error {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	if e.dryRun {
+		for _, cmd := range commands {
+			log.Infof("dry-run: %s", cmd)
+		}
+
+		return nil
+	}
+
+	if _, err := io.WriteString(e.out, strings.Join(commands, "\n")+"\n"); err != nil {
+		return fmt.Errorf("unable to send %d commands to exabgp: %w", len(commands), err)
+	}
+
+	return nil
+}
+
+// Commit withdraws then announces the routes changed since the last commit, in the order
+// of the decisions. A route is announced again when its ban is extended, ExaBGP treats it
+// as an update.
+func (e *exaBGP) Commit() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	commands := make([]string, 0, len(e.withdraw.order)+len(e.announce.order))
+
+	for _, route := range e.withdraw.order {
+		if _, ok := e.routes[route]; ok {
+			commands = append(commands, e.withdrawCommand(route))
+		}
+	}
+
+	for _, route := range e.announce.order {
+		commands = append(commands, e.announceCommand(route))
+	}
+
+	if err := e.write(commands); err != nil {
+		return err
+	}
+
+	for _, route := range e.withdraw.order {
+		delete(e.routes, route)
+	}
+
+	for route, deadline := range e.announce.deadlines {
+		e.routes[route] = deadline
+	}
+
+	log.Debugf("exabgp: %d routes withdrawn, %d announced", len(e.withdraw.order), len(e.announce.order))
+
+	e.announce = newPending()
+	e.withdraw = newPending()
+
+	return nil
+}
+
+// SweepInterval is how often the expired routes are withdrawn, since BGP routes don't time out.
+func (e *exaBGP) SweepInterval() time.Duration {
+	return e.sweep
+}
+
+// Expired returns the addresses whose ban is over, their routes are withdrawn by the next commit.
+func (e *exaBGP) Expired(now time.Time) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ret := []string{}
+
+	for route, deadline := range e.routes {
+		if !deadline.IsZero() && deadline.Before(now) {
+			ret = append(ret, value(route))
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// value returns the address or network of a route, as in the decisions.
+func value(route string) string {
+	if strings.Contains(route, ":") {
+		return strings.TrimSuffix(route, "/128")
+	}
+
+	return strings.TrimSuffix(route, "/32")
+}
+
+// List returns the announced routes, with the time left before they are withdrawn.
+func (e *exaBGP) List() ([]types.Entry, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	ret := make([]types.Entry, 0, len(e.routes))
+
+	for route, deadline := range e.routes {
+		entry := types.Entry{Value: value(route)}
+		if !deadline.IsZero() {
+			entry.TTL = deadline.Sub(now)
+		}
+
+		ret = append(ret, entry)
+	}
+
+	return ret, nil
+}
+
+func (e *exaBGP) CollectMetrics() (types.Metrics, error) {
+	ret := types.Metrics{BannedByFamily: map[string]float64{"ipv4": 0, "ipv6": 0}}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for route := range e.routes {
+		if strings.Contains(route, ":") {
+			ret.BannedByFamily["ipv6"]++
+		} else {
+			ret.BannedByFamily["ipv4"]++
+		}
+	}
+
+	return ret, nil
+}
+
+// ShutDown withdraws all the routes announced by the bouncer.
+func (e *exaBGP) ShutDown() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	commands := make([]string, 0, len(e.routes))
+	for route := range e.routes {
+		commands = append(commands, e.withdrawCommand(route))
+	}
+
+	sort.Strings(commands)
+
+	log.Infof("withdrawing %d exabgp routes", len(commands))
+
+	err := e.write(commands)
+	e.reset()
+
+	if e.out != nil {
+		if cerr := e.out.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+
+		e.out = nil
+	}
+
+	return err
+}
@@ -0,0 +1,125 @@
+package exabgp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+type buffer struct {
+	bytes.Buffer
+}
+
+func (*buffer) Close() error { return nil }
+
+func newTestExaBGP() (*exaBGP, *buffer) {
+	out := &buffer{}
+	e := &exaBGP{nextHop: "192.0.2.254", nextHop6: "100::1", out: out}
+	e.reset()
+
+	return e, out
+}
+
+func newDecision(value string, duration time.Duration) *models.Decision {
+	d := duration.String()
+
+	return &models.Decision{Value: &value, Duration: &d}
+}
+
+func TestCommitOrder(t *testing.T) {
+	e, out := newTestExaBGP()
+
+	for _, value := range []string{"198.51.100.1", "192.0.2.1"} {
+		if err := e.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+
+	if err := e.Add(newDecision("2001:db8::1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"198.51.100.1", "192.0.2.1"} {
+		if err := e.Delete(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"withdraw route 198.51.100.1/32 next-hop 192.0.2.254",
+		"withdraw route 192.0.2.1/32 next-hop 192.0.2.254",
+		"announce route 2001:db8::1/128 next-hop 100::1",
+	}
+
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	e, out := newTestExaBGP()
+
+	for value, duration := range map[string]time.Duration{"192.0.2.1": time.Minute, "2001:db8::/32": time.Minute, "192.0.2.2": time.Hour} {
+		if err := e.Add(newDecision(value, duration)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := e.Expired(time.Now().Add(10 * time.Minute))
+	if strings.Join(expired, ",") != "192.0.2.1,2001:db8::/32" {
+		t.Fatalf("expired %v", expired)
+	}
+
+	out.Reset()
+
+	// as the backend sweeps them
+	for _, value := range expired {
+		if err := e.Delete(newDecision(value, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(out.String(), "withdraw route") != 2 || len(e.routes) != 1 {
+		t.Fatalf("sent %q, %d routes left", out.String(), len(e.routes))
+	}
+}
+
+func TestIPv6Only(t *testing.T) {
+	e, out := newTestExaBGP()
+	e.disableIPV4 = true
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::1"} {
+		if err := e.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := out.String(); got != "announce route 2001:db8::1/128 next-hop 100::1\n" {
+		t.Fatalf("sent %q", got)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+
+package exabgp
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenPipeWaitsForReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exabgp.in")
+
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := make(chan *os.File, 1)
+
+	go func() {
+		// ExaBGP opens the pipe after the bouncer started
+		time.Sleep(200 * time.Millisecond)
+
+		r, _ := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		reader <- r
+	}()
+
+	f, err := openPipe(path, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	if r := <-reader; r != nil {
+		r.Close()
+	}
+}
+
+func TestOpenPipeTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exabgp.in")
+
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openPipe(path, time.Now().Add(200*time.Millisecond)); err == nil {
+		t.Fatal("the pipe was opened without a reader")
+	}
+}
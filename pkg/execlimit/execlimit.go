@@ -0,0 +1,59 @@
+package execlimit
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// Limiter bounds the number of commands a backend runs at the same time. A nil
+// Limiter doesn't limit anything.
+type Limiter struct {
+	slots chan struct{}
+}
+
+// New returns a limiter allowing n commands at once, GOMAXPROCS if n is 0.
+func New(n int) *Limiter {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	return &Limiter{slots: make(chan struct{}, n)}
+}
+
+func (l *Limiter) acquire() {
+	if l != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+func (l *Limiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// Do calls fn when a slot is available, ie. to start the timeout of a command only
+// once it can run.
+func (l *Limiter) Do(fn func() error) error {
+	l.acquire()
+	defer l.release()
+
+	return fn()
+}
+
+// Output runs the command when a slot is available, and returns its standard output.
+func (l *Limiter) Output(cmd *exec.Cmd) ([]byte, error) {
+	l.acquire()
+	defer l.release()
+
+	return cmd.Output()
+}
+
+// CombinedOutput runs the command when a slot is available, and returns its standard
+// output and error.
+func (l *Limiter) CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	l.acquire()
+	defer l.release()
+
+	return cmd.CombinedOutput()
+}
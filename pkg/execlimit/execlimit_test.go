@@ -0,0 +1,60 @@
+package execlimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	l := New(2)
+
+	var running, max atomic.Int32
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			l.Do(func() error {
+				n := running.Add(1)
+				defer running.Add(-1)
+
+				for {
+					m := max.Load()
+					if n <= m || max.CompareAndSwap(m, n) {
+						break
+					}
+				}
+
+				time.Sleep(20 * time.Millisecond)
+
+				return nil
+			})
+		}()
+	}
+
+	wg.Wait()
+
+	if got := max.Load(); got > 2 {
+		t.Fatalf("%d functions ran at once with 2 slots", got)
+	}
+
+	// both slots were used
+	if got := max.Load(); got != 2 {
+		t.Fatalf("%d functions ran at once, want 2", got)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+
+	called := false
+	if err := l.Do(func() error { called = true; return nil }); err != nil || !called {
+		t.Fatalf("a nil limiter called the function %v, %v", called, err)
+	}
+}
@@ -0,0 +1,170 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// Resolver maps country codes (or AS numbers) to the networks allocated to them,
+// according to a MaxMind country (or ASN) database. The networks of a key are read
+// the first time they are requested, and read again if the database file has changed
+// since then.
+type Resolver struct {
+	path     string
+	kind     string
+	mu       sync.Mutex
+	modTime  time.Time
+	networks map[string][]string
+	// keyOf returns the current network and its key
+	keyOf func(networks *maxminddb.Networks) (*net.IPNet, string, error)
+}
+
+func newResolver(path string, kind string, keyOf func(*maxminddb.Networks) (*net.IPNet, string, error)) (*Resolver, error) {
+	r := &Resolver{
+		path:     path,
+		kind:     kind,
+		networks: make(map[string][]string),
+		keyOf:    keyOf,
+	}
+
+	if err := r.refresh(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// NewResolver returns a resolver for a country database.
+func NewResolver(path string) (*Resolver, error) {
+	return newResolver(path, "country", func(networks *maxminddb.Networks) (*net.IPNet, string, error) {
+		record := countryRecord{}
+
+		network, err := networks.Network(&record)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return network, strings.ToUpper(record.Country.ISOCode), nil
+	})
+}
+
+// NewASNResolver returns a resolver for an ASN database.
+func NewASNResolver(path string) (*Resolver, error) {
+	return newResolver(path, "AS", func(networks *maxminddb.Networks) (*net.IPNet, string, error) {
+		record := asnRecord{}
+
+		network, err := networks.Network(&record)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return network, strconv.FormatUint(uint64(record.Number), 10), nil
+	})
+}
+
+// refresh drops the cached networks if the database has been modified.
+func (r *Resolver) refresh() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("geoip database: %w", err)
+	}
+
+	if !info.ModTime().Equal(r.modTime) {
+		if !r.modTime.IsZero() {
+			log.Infof("geoip database %s has changed, reloading it", r.path)
+		}
+
+		r.modTime = info.ModTime()
+		r.networks = make(map[string][]string)
+	}
+
+	return nil
+}
+
+func (r *Resolver) load(key string) ([]string, error) {
+	reader, err := maxminddb.Open(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening geoip database: %w", err)
+	}
+	defer reader.Close()
+
+	ret := []string{}
+
+	networks := reader.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		network, k, err := r.keyOf(networks)
+		if err != nil {
+			return nil, fmt.Errorf("while reading geoip database: %w", err)
+		}
+
+		if k == key {
+			ret = append(ret, network.String())
+		}
+	}
+
+	if err := networks.Err(); err != nil {
+		return nil, fmt.Errorf("while reading geoip database: %w", err)
+	}
+
+	log.Debugf("found %d networks for %s %s", len(ret), r.kind, key)
+
+	return ret, nil
+}
+
+// normalize returns the key of a country code or AS number, as found in the database.
+func (r *Resolver) normalize(value string) string {
+	value = strings.ToUpper(value)
+
+	if r.kind == "AS" {
+		value = strings.TrimPrefix(value, "AS")
+	}
+
+	return value
+}
+
+// Networks returns the ranges, in CIDR notation, allocated to a country or announced by an AS.
+func (r *Resolver) Networks(value string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := r.normalize(value)
+
+	if err := r.refresh(); err != nil {
+		return nil, err
+	}
+
+	if networks, ok := r.networks[key]; ok {
+		return networks, nil
+	}
+
+	networks, err := r.load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("no network found for %s '%s'", r.kind, value)
+	}
+
+	r.networks[key] = networks
+
+	return networks, nil
+}
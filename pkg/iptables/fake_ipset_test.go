@@ -0,0 +1,257 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/execlimit"
+)
+
+// fakeIpsetScript keeps the sets in files, one member per line, in the directory of the
+// script. A restore fails at the line of the fail file, once, and stops there as ipset
+// does. With the strict file, -exist is ignored and a restore also fails at an element
+// already added or not there. 'list -o xml' only reports the number of entries. Each
+// command line is appended to the calls file.
+const fakeIpsetScript = `#!/bin/sh
+dir="$(dirname "$0")"
+echo "$*" >> "$dir/calls"
+
+exist=0
+if [ "$1" = "-exist" ]; then
+	exist=1
+	shift
+fi
+if [ -f "$dir/strict" ]; then
+	exist=0
+fi
+
+case "$1" in
+restore)
+	fail=0
+	if [ -f "$dir/fail" ]; then
+		fail=$(cat "$dir/fail")
+		rm "$dir/fail"
+	fi
+	n=0
+	while read -r op set value rest; do
+		n=$((n + 1))
+		if [ "$n" -eq "$fail" ]; then
+			echo "ipset v7.15: Error in line $n: Syntax error: '$value' is invalid" >&2
+			exit 1
+		fi
+		f="$dir/sets/$set"
+		if [ ! -f "$f" ]; then
+			echo "ipset v7.15: Error in line $n: The set with the given name does not exist" >&2
+			exit 1
+		fi
+		case "$op" in
+		add)
+			if grep -qxF "$value" "$f"; then
+				if [ "$exist" -eq 0 ]; then
+					echo "ipset v7.15: Error in line $n: Element cannot be added to the set: it's already added" >&2
+					exit 1
+				fi
+			else
+				echo "$value" >> "$f"
+			fi
+			;;
+		del)
+			if ! grep -qxF "$value" "$f" && [ "$exist" -eq 0 ]; then
+				echo "ipset v7.15: Error in line $n: Element cannot be deleted from the set: it's not added" >&2
+				exit 1
+			fi
+			grep -vxF "$value" "$f" > "$f.tmp"; mv "$f.tmp" "$f"
+			;;
+		esac
+	done
+	;;
+create)
+	touch "$dir/sets/$2"
+	;;
+flush)
+	[ -f "$dir/sets/$2" ] && : > "$dir/sets/$2"
+	;;
+destroy)
+	rm -f "$dir/sets/$2"
+	;;
+add)
+	;;
+-L)
+	[ -f "$dir/sets/$2" ] || exit 1
+	;;
+list)
+	if [ "$2" = "-o" ]; then
+		echo "<ipsets>"
+		for f in "$dir"/sets/*; do
+			[ -f "$f" ] || continue
+			echo "<ipset name=\"$(basename "$f")\"><header><numentries>$(grep -c . "$f")</numentries></header></ipset>"
+		done
+		echo "</ipsets>"
+		exit 0
+	fi
+	if [ "$2" = "-t" ]; then
+		set="$3"
+	else
+		set="$2"
+	fi
+	f="$dir/sets/$set"
+	if [ ! -f "$f" ]; then
+		echo "ipset v7.15: The set with the given name does not exist" >&2
+		exit 1
+	fi
+	echo "Name: $set"
+	echo "Number of entries: $(grep -c . "$f")"
+	if [ "$2" != "-t" ]; then
+		echo "Members:"
+		sed 's/$/ timeout 3600/' "$f"
+	fi
+	;;
+*)
+	echo "fake ipset: unsupported command $*" >&2
+	exit 2
+	;;
+esac
+`
+
+// fakeIpset is an ipset script working on the sets of a temporary directory.
+type fakeIpset struct {
+	t    testing.TB
+	dir  string
+	path string
+}
+
+func newFakeIpset(t testing.TB) *fakeIpset {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ipset")
+
+	if err := os.WriteFile(path, []byte(fakeIpsetScript), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sets"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	return &fakeIpset{t: t, dir: dir, path: path}
+}
+
+func (f *fakeIpset) write(name string, content string) {
+	f.t.Helper()
+
+	if err := os.WriteFile(filepath.Join(f.dir, name), []byte(content), 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// createSet creates a set holding members.
+func (f *fakeIpset) createSet(set string, members ...string) {
+	content := ""
+	for _, m := range members {
+		content += m + "\n"
+	}
+
+	f.write(filepath.Join("sets", set), content)
+}
+
+// fail makes the next restore fail at a line, counted from 1.
+func (f *fakeIpset) fail(line int) {
+	f.write("fail", strconv.Itoa(line))
+}
+
+// strict makes the restores fail at the elements already added or not there, despite -exist.
+func (f *fakeIpset) strict() {
+	f.write("strict", "")
+}
+
+// set returns the sorted members of a set, nil if it doesn't exist.
+func (f *fakeIpset) set(set string) []string {
+	f.t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(f.dir, "sets", set))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	ret := []string{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			ret = append(ret, line)
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// calls returns the command lines the script was run with.
+func (f *fakeIpset) calls() []string {
+	f.t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(f.dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func (f *fakeIpset) assertSet(set string, want ...string) {
+	f.t.Helper()
+
+	got := f.set(set)
+	sort.Strings(want)
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		f.t.Fatalf("set %s holds %v, want %v", set, got, want)
+	}
+}
+
+// newTestIPTables returns an ipset mode backend using the fake ipset, with the
+// crowdsec-blacklists and crowdsec6-blacklists sets.
+func newTestIPTables(f *fakeIpset) *iptables {
+	limiter := execlimit.New(0)
+
+	newContext := func(version string, set string) *ipTablesContext {
+		f.createSet(set)
+
+		return &ipTablesContext{
+			Name:             "ipset",
+			version:          version,
+			ipsetBin:         f.path,
+			SetName:          set,
+			ipsetContentOnly: true,
+			limiter:          limiter,
+			flushOnStartup:   true,
+		}
+	}
+
+	return &iptables{
+		v4: newContext("v4", "crowdsec-blacklists"),
+		v6: newContext("v6", "crowdsec6-blacklists"),
+	}
+}
+
+func newDecision(value string, duration string) *models.Decision {
+	return &models.Decision{Value: &value, Duration: &duration}
+}
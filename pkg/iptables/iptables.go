@@ -4,15 +4,19 @@
 package iptables
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 
 	"github.com/asians-cloud/crowdsec/pkg/models"
 
 	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/execlimit"
 	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
@@ -26,9 +30,93 @@ type iptables struct {
 	v6 *ipTablesContext
 }
 
+// icmpEcho matches the ping requests of a family.
+func icmpEcho(version string) []string {
+	if version == "v6" {
+		return []string{"-p", "ipv6-icmp", "--icmpv6-type", "echo-request"}
+	}
+
+	return []string{"-p", "icmp", "--icmp-type", "echo-request"}
+}
+
+// setRules prepares the commands adding the rules matching the set to the chains, and removing them.
+// The ACCEPT rule of the pings and the LOG rule, if any, must come before the one denying the traffic.
+func setRules(ctx *ipTablesContext, config *cfg.BouncerConfig, target string) {
+	ctx.Chains = config.IptablesChains
+	ctx.Table = config.DenyStage
+	table := []string{"-t", ctx.Table}
+
+	for _, chain := range config.IptablesChains {
+		match := []string{"-m", "set", "--match-set", ctx.SetName, "src"}
+		if config.Interface != "" {
+			// the output chains only know the interface the packets leave from
+			direction := "-i"
+			switch strings.ToUpper(chain) {
+			case "OUTPUT", "POSTROUTING":
+				direction = "-o"
+			}
+
+			match = append([]string{direction, config.Interface}, match...)
+		}
+
+		if config.RuleComment != "" {
+			match = append(match, "-m", "comment", "--comment", config.RuleComment)
+		}
+
+		deny := slices.Clone(match)
+		// without a target, the rule only counts the packets
+		if target != "" {
+			deny = append(deny, "-j", target)
+		}
+
+		logged := append(slices.Clone(match), "-j", "LOG", "--log-prefix", config.DenyLogPrefix)
+
+		// an audit rule doesn't change the verdict, neither must the pings
+		allowEcho := config.AllowICMPEcho && target != ""
+		echo := append(append(slices.Clone(match), icmpEcho(ctx.version)...), "-j", "ACCEPT")
+
+		var position []string
+
+		// inserted rules end up in the reverse order
+		specs := [][]string{deny}
+		if config.DenyLog {
+			specs = append(specs, logged)
+		}
+
+		if allowEcho {
+			specs = append(specs, echo)
+		}
+
+		switch {
+		case config.IptablesRulePosition == cfg.RulePositionAppend:
+			position = append(table, "-A", chain)
+			specs = [][]string{deny}
+
+			if config.DenyLog {
+				specs = append([][]string{logged}, specs...)
+			}
+
+			if allowEcho {
+				specs = append([][]string{echo}, specs...)
+			}
+		case config.IptablesRuleIndex > 0:
+			position = append(table, "-I", chain, strconv.Itoa(config.IptablesRuleIndex))
+		default:
+			position = append(table, "-I", chain)
+		}
+
+		for _, spec := range specs {
+			ctx.StartupCmds = append(ctx.StartupCmds, append(slices.Clone(position), spec...))
+			ctx.ShutdownCmds = append(ctx.ShutdownCmds, append(append(slices.Clone(table), "-D", chain), spec...))
+			ctx.CheckIptableCmds = append(ctx.CheckIptableCmds, append(append(slices.Clone(table), "-C", chain), spec...))
+		}
+	}
+}
+
 func NewIPTables(config *cfg.BouncerConfig) (types.Backend, error) {
 	var err error
 	ret := &iptables{}
+	limiter := execlimit.New(config.ExecConcurrency)
 	ipv4Ctx := &ipTablesContext{
 		Name:             "ipset",
 		version:          "v4",
@@ -39,6 +127,10 @@ func NewIPTables(config *cfg.BouncerConfig) (types.Backend, error) {
 		ShutdownCmds:     [][]string{},
 		CheckIptableCmds: [][]string{},
 		Chains:           []string{},
+		dryRun:           config.DryRun,
+		limiter:          limiter,
+		// the config loader defaults it
+		flushOnStartup: *config.FlushOnStartup,
 	}
 	ipv6Ctx := &ipTablesContext{
 		Name:             "ipset",
@@ -50,183 +142,186 @@ func NewIPTables(config *cfg.BouncerConfig) (types.Backend, error) {
 		ShutdownCmds:     [][]string{},
 		CheckIptableCmds: [][]string{},
 		Chains:           []string{},
+		dryRun:           config.DryRun,
+		limiter:          limiter,
+		// the config loader defaults it
+		flushOnStartup: *config.FlushOnStartup,
 	}
 
 	var target string
-	if strings.EqualFold(config.DenyAction, "REJECT") {
+
+	switch {
+	case config.AuditMode:
+	case strings.EqualFold(config.DenyAction, "REJECT"):
 		target = "REJECT"
-	} else {
+	default:
 		target = "DROP"
 	}
 
+	if err := config.CheckInterface(); err != nil {
+		return nil, err
+	}
+
 	ipsetBin, err := exec.LookPath("ipset")
 	if err != nil {
 		return nil, fmt.Errorf("unable to find ipset")
 	}
-	ipv4Ctx.ipsetBin = ipsetBin
-	if config.Mode == cfg.IpsetMode {
-		ipv4Ctx.ipsetContentOnly = true
-	} else {
-		ipv4Ctx.iptablesBin, err = exec.LookPath("iptables")
-		if err != nil {
-			return nil, fmt.Errorf("unable to find iptables")
-		}
-		ipv4Ctx.Chains = config.IptablesChains
-		for _, v := range config.IptablesChains {
-			ipv4Ctx.StartupCmds = append(ipv4Ctx.StartupCmds,
-				[]string{"-I", v, "-m", "set", "--match-set", ipv4Ctx.SetName, "src", "-j", target})
-			ipv4Ctx.ShutdownCmds = append(ipv4Ctx.ShutdownCmds,
-				[]string{"-D", v, "-m", "set", "--match-set", ipv4Ctx.SetName, "src", "-j", target})
-			ipv4Ctx.CheckIptableCmds = append(ipv4Ctx.CheckIptableCmds,
-				[]string{"-C", v, "-m", "set", "--match-set", ipv4Ctx.SetName, "src", "-j", target})
-			if config.DenyLog {
-				ipv4Ctx.StartupCmds = append(ipv4Ctx.StartupCmds,
-					[]string{"-I", v, "-m", "set", "--match-set", ipv4Ctx.SetName, "src", "-j", "LOG", "--log-prefix", config.DenyLogPrefix})
-				ipv4Ctx.ShutdownCmds = append(ipv4Ctx.ShutdownCmds,
-					[]string{"-D", v, "-m", "set", "--match-set", ipv4Ctx.SetName, "src", "-j", "LOG", "--log-prefix", config.DenyLogPrefix})
-				ipv4Ctx.CheckIptableCmds = append(ipv4Ctx.CheckIptableCmds,
-					[]string{"-C", v, "-m", "set", "--match-set", ipv4Ctx.SetName, "src", "-j", "LOG", "--log-prefix", config.DenyLogPrefix})
+	if !config.DisableIPV4 {
+		ipv4Ctx.ipsetBin = ipsetBin
+		if config.Mode == cfg.IpsetMode {
+			ipv4Ctx.ipsetContentOnly = true
+			ipv4Ctx.keepSet = config.FlushMode == cfg.FlushModeOwned
+		} else {
+			ipv4Ctx.iptablesBin, err = exec.LookPath("iptables")
+			if err != nil {
+				return nil, fmt.Errorf("unable to find iptables")
 			}
+			setRules(ipv4Ctx, config, target)
 		}
+		ret.v4 = ipv4Ctx
 	}
-	ret.v4 = ipv4Ctx
-	if config.DisableIPV6 {
-		return ret, nil
-	}
-	ipv6Ctx.ipsetBin = ipsetBin
-	if config.Mode == cfg.IpsetMode {
-		ipv6Ctx.ipsetContentOnly = true
-	} else {
-		ipv6Ctx.iptablesBin, err = exec.LookPath("ip6tables")
-		if err != nil {
-			return nil, fmt.Errorf("unable to find ip6tables")
-		}
-		ipv6Ctx.Chains = config.IptablesChains
-		for _, v := range config.IptablesChains {
-			ipv6Ctx.StartupCmds = append(ipv6Ctx.StartupCmds,
-				[]string{"-I", v, "-m", "set", "--match-set", ipv6Ctx.SetName, "src", "-j", target})
-			ipv6Ctx.ShutdownCmds = append(ipv6Ctx.ShutdownCmds,
-				[]string{"-D", v, "-m", "set", "--match-set", ipv6Ctx.SetName, "src", "-j", target})
-			ipv6Ctx.CheckIptableCmds = append(ipv6Ctx.CheckIptableCmds,
-				[]string{"-C", v, "-m", "set", "--match-set", ipv6Ctx.SetName, "src", "-j", target})
-			if config.DenyLog {
-				ipv6Ctx.StartupCmds = append(ipv6Ctx.StartupCmds,
-					[]string{"-I", v, "-m", "set", "--match-set", ipv6Ctx.SetName, "src", "-j", "LOG", "--log-prefix", config.DenyLogPrefix})
-				ipv6Ctx.ShutdownCmds = append(ipv6Ctx.ShutdownCmds,
-					[]string{"-D", v, "-m", "set", "--match-set", ipv6Ctx.SetName, "src", "-j", "LOG", "--log-prefix", config.DenyLogPrefix})
-				ipv6Ctx.CheckIptableCmds = append(ipv6Ctx.CheckIptableCmds,
-					[]string{"-C", v, "-m", "set", "--match-set", ipv6Ctx.SetName, "src", "-j", "LOG", "--log-prefix", config.DenyLogPrefix})
+
+	if !config.DisableIPV6 {
+		ipv6Ctx.ipsetBin = ipsetBin
+		if config.Mode == cfg.IpsetMode {
+			ipv6Ctx.ipsetContentOnly = true
+			ipv6Ctx.keepSet = config.FlushMode == cfg.FlushModeOwned
+		} else {
+			ipv6Ctx.iptablesBin, err = exec.LookPath("ip6tables")
+			if err != nil {
+				return nil, fmt.Errorf("unable to find ip6tables")
 			}
+			setRules(ipv6Ctx, config, target)
 		}
+		ret.v6 = ipv6Ctx
 	}
-	ret.v6 = ipv6Ctx
 
 	return ret, nil
 }
 
-func (ipt *iptables) Init() error {
-	var err error
+// contexts returns the contexts of the enabled families.
+func (ipt *iptables) contexts() []*ipTablesContext {
+	ret := []*ipTablesContext{}
 
-	log.Printf("iptables for ipv4 initiated")
-	// flush before init
-	if err := ipt.v4.shutDown(); err != nil {
-		return fmt.Errorf("iptables shutdown failed: %w", err)
+	for _, ctx := range []*ipTablesContext{ipt.v4, ipt.v6} {
+		if ctx != nil {
+			ret = append(ret, ctx)
+		}
 	}
 
-	// Create iptable to rule to attach the set
-	if err := ipt.v4.CheckAndCreate(); err != nil {
-		return fmt.Errorf("iptables init failed: %w", err)
-	}
+	return ret
+}
 
-	if ipt.v6 != nil {
-		log.Printf("iptables for ipv6 initiated")
-		err = ipt.v6.shutDown() // flush before init
-		if err != nil {
-			return fmt.Errorf("iptables shutdown failed: %w", err)
+func (ipt *iptables) Init() error {
+	for _, ctx := range ipt.contexts() {
+		log.Printf("iptables for ip%s initiated", ctx.version)
+		// flush before init
+		if ctx.flushOnStartup {
+			if err := ctx.shutDown(); err != nil {
+				return fmt.Errorf("iptables shutdown failed: %w", err)
+			}
 		}
 
 		// Create iptable to rule to attach the set
-		if err := ipt.v6.CheckAndCreate(); err != nil {
+		if err := ctx.CheckAndCreate(); err != nil {
 			return fmt.Errorf("iptables init failed: %w", err)
 		}
 	}
+
 	return nil
 }
 
 func (ipt *iptables) Commit() error {
-	return nil
+	var errs []error
+
+	for _, ctx := range ipt.contexts() {
+		if err := ctx.commit(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func (ipt *iptables) Add(decision *models.Decision) error {
-	done := false
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
 
-	if strings.HasPrefix(*decision.Type, "simulation:") {
+	if decision.Type != nil && strings.HasPrefix(*decision.Type, "simulation:") {
 		log.Debugf("measure against '%s' is in simulation mode, skipping it", *decision.Value)
 		return nil
 	}
 
-	// we now have to know if ba is for an ipv4 or ipv6 the obvious way
-	// would be to get the len of net.ParseIp(ba) but this is 16 internally
-	// even for ipv4. so we steal the ugly hack from
-	// https://github.com/asaskevich/govalidator/blob/3b2665001c4c24e3b076d1ca8c428049ecbb925b/validator.go#L501
-	if strings.Contains(*decision.Value, ":") {
+	v6, err := types.IsIPv6(*decision.Value)
+	if err != nil {
+		return fmt.Errorf("failed inserting ban: %w", err)
+	}
+
+	if v6 {
 		if ipt.v6 == nil {
 			log.Debugf("not adding '%s' because ipv6 is disabled", *decision.Value)
 			return nil
 		}
 		if err := ipt.v6.add(decision); err != nil {
-			return fmt.Errorf("failed inserting ban ip '%s' for iptables ipv4 rule", *decision.Value)
-		}
-		done = true
-	}
-	if strings.Contains(*decision.Value, ".") {
-		if err := ipt.v4.add(decision); err != nil {
-			return fmt.Errorf("failed inserting ban ip '%s' for iptables ipv6 rule", *decision.Value)
+			return fmt.Errorf("failed inserting ban ip '%s' for iptables ipv6 rule: %w", *decision.Value, err)
 		}
-		done = true
+
+		return nil
 	}
 
-	if !done {
-		return fmt.Errorf("failed inserting ban: ip %s was not recognized", *decision.Value)
+	if ipt.v4 == nil {
+		log.Debugf("not adding '%s' because ipv4 is disabled", *decision.Value)
+		return nil
+	}
+	if err := ipt.v4.add(decision); err != nil {
+		return fmt.Errorf("failed inserting ban ip '%s' for iptables ipv4 rule: %w", *decision.Value, err)
 	}
 
 	return nil
 }
 
 func (ipt *iptables) ShutDown() error {
-	err := ipt.v4.shutDown()
-	if err != nil {
-		return fmt.Errorf("iptables for ipv4 shutdown failed: %w", err)
-	}
-	if ipt.v6 != nil {
-		err = ipt.v6.shutDown()
-		if err != nil {
-			return fmt.Errorf("iptables for ipv6 shutdown failed: %w", err)
+	var errs []error
+
+	for _, ctx := range ipt.contexts() {
+		if err := ctx.shutDown(); err != nil {
+			errs = append(errs, fmt.Errorf("iptables for ip%s shutdown failed: %w", ctx.version, err))
 		}
 	}
-	return nil
+
+	return errors.Join(errs...)
 }
 
 func (ipt *iptables) Delete(decision *models.Decision) error {
-	done := false
-	if strings.Contains(*decision.Value, ":") {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	v6, err := types.IsIPv6(*decision.Value)
+	if err != nil {
+		return fmt.Errorf("failed deleting ban: %w", err)
+	}
+
+	if v6 {
 		if ipt.v6 == nil {
 			log.Debugf("not deleting '%s' because ipv6 is disabled", *decision.Value)
 			return nil
 		}
 		if err := ipt.v6.delete(decision); err != nil {
-			return fmt.Errorf("failed deleting ban")
+			return fmt.Errorf("failed deleting ban ip '%s' for iptables ipv6 rule: %w", *decision.Value, err)
 		}
-		done = true
+
+		return nil
 	}
-	if strings.Contains(*decision.Value, ".") {
-		if err := ipt.v4.delete(decision); err != nil {
-			return fmt.Errorf("failed deleting ban")
-		}
-		done = true
+
+	if ipt.v4 == nil {
+		log.Debugf("not deleting '%s' because ipv4 is disabled", *decision.Value)
+		return nil
 	}
-	if !done {
-		return fmt.Errorf("failed deleting ban: ip %s was not recognized", *decision.Value)
+	if err := ipt.v4.delete(decision); err != nil {
+		return fmt.Errorf("failed deleting ban ip '%s' for iptables ipv4 rule: %w", *decision.Value, err)
 	}
+
 	return nil
 }
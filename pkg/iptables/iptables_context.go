@@ -6,12 +6,17 @@ package iptables
 import (
 	"fmt"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/execlimit"
 )
 
 type ipTablesContext struct {
@@ -27,6 +32,98 @@ type ipTablesContext struct {
 	CheckIptableCmds [][]string
 	ipsetContentOnly bool
 	Chains           []string
+	Table            string // filter, or raw to deny before conntrack
+	dryRun           bool
+	// ipset restore commands waiting for the next commit
+	pending []string
+	// shared by both families
+	limiter *execlimit.Limiter
+	// flush_mode owned: the set is shared, the bouncer removes its bans itself instead of flushing it
+	keepSet bool
+	// the set and the rules are removed by Init before being created again
+	flushOnStartup bool
+}
+
+// maxPending is the number of queued set changes above which they are applied without waiting for a commit.
+const maxPending = 10000
+
+// matches the error reported by ipset restore, ie. "ipset v7.15: Error in line 3: ..."
+var restoreErrorRe = regexp.MustCompile(`Error in line (\d+): (.*)`)
+
+// matches the errors of ipset when an address is already in the set, or not in it anymore:
+// -exist should hide them, the change is done either way
+var benignRestoreErrorRe = regexp.MustCompile(`it's already added|it's not added`)
+
+// run executes a command that changes the state of the firewall, or only logs it in dry-run mode.
+func (ctx *ipTablesContext) run(cmd *exec.Cmd) ([]byte, error) {
+	if ctx.dryRun {
+		log.Infof("dry-run: %s", cmd.String())
+		return nil, nil
+	}
+
+	return ctx.limiter.CombinedOutput(cmd)
+}
+
+// the sets of the addresses and of the ranges with ipset_type auto, named after the set of the rules
+const (
+	hostSetSuffix = "-ip"
+	netSetSuffix  = "-net"
+)
+
+// memberSets returns the sets holding the bans: the set of the rules, or with ipset_type
+// auto the ones it's made of.
+func (ctx *ipTablesContext) memberSets() []string {
+	if ctx.SetType != cfg.SetTypeAuto {
+		return []string{ctx.SetName}
+	}
+
+	return []string{ctx.SetName + hostSetSuffix, ctx.SetName + netSetSuffix}
+}
+
+// setFor returns the set a value is added to and deleted from. With ipset_type auto, the
+// addresses go to a hash:ip set and the ranges to a hash:net one.
+func (ctx *ipTablesContext) setFor(value string) string {
+	if ctx.SetType != cfg.SetTypeAuto {
+		return ctx.SetName
+	}
+
+	host := "32"
+	if ctx.version == "v6" {
+		host = "128"
+	}
+
+	if _, bits, ok := strings.Cut(value, "/"); !ok || bits == host {
+		return ctx.SetName + hostSetSuffix
+	}
+
+	return ctx.SetName + netSetSuffix
+}
+
+// createCmds returns the commands creating the set. With ipset_type auto, it's a list:set
+// of the hash:ip and hash:net sets, so that the same rules match both.
+func (ctx *ipTablesContext) createCmds() []*exec.Cmd {
+	create := func(name string, setType string) *exec.Cmd {
+		args := []string{"-exist", "create", name, setType, "timeout", "300"}
+		if ctx.version == "v6" {
+			args = append(args, "family", "inet6")
+		}
+
+		return exec.Command(ctx.ipsetBin, append(args, "maxelem", strconv.Itoa(ctx.SetSize))...)
+	}
+
+	if ctx.SetType != cfg.SetTypeAuto {
+		return []*exec.Cmd{create(ctx.SetName, ctx.SetType)}
+	}
+
+	hosts, networks := ctx.SetName+hostSetSuffix, ctx.SetName+netSetSuffix
+
+	return []*exec.Cmd{
+		create(hosts, "hash:ip"),
+		create(networks, "hash:net"),
+		exec.Command(ctx.ipsetBin, "-exist", "create", ctx.SetName, "list:set"),
+		exec.Command(ctx.ipsetBin, "-exist", "add", ctx.SetName, hosts),
+		exec.Command(ctx.ipsetBin, "-exist", "add", ctx.SetName, networks),
+	}
 }
 
 func (ctx *ipTablesContext) CheckAndCreate() error {
@@ -41,16 +138,11 @@ func (ctx *ipTablesContext) CheckAndCreate() error {
 			log.Errorf("set %s doesn't exist, can't manage content", ctx.SetName)
 			return fmt.Errorf("set %s doesn't exist: %w", ctx.SetName, err)
 		}
-		if ctx.version == "v6" {
-			cmd = exec.Command(ctx.ipsetBin, "-exist", "create", ctx.SetName, ctx.SetType, "timeout", "300", "family",
-				"inet6", "maxelem", fmt.Sprintf("%d", ctx.SetSize))
-		} else {
-			cmd = exec.Command(ctx.ipsetBin, "-exist", "create", ctx.SetName, ctx.SetType, "timeout", "300",
-				"maxelem", fmt.Sprintf("%d", ctx.SetSize))
-		}
-		log.Infof("ipset set-up : %s", cmd.String())
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("error while creating set : %w --> %s", err, string(out))
+		for _, cmd := range ctx.createCmds() {
+			log.Infof("ipset set-up : %s", cmd.String())
+			if out, err := ctx.run(cmd); err != nil {
+				return fmt.Errorf("error while creating set : %w --> %s", err, string(out))
+			}
 		}
 	}
 
@@ -78,7 +170,7 @@ func (ctx *ipTablesContext) CheckAndCreate() error {
 		for _, startCmd := range ctx.StartupCmds {
 			cmd = exec.Command(ctx.iptablesBin, startCmd...)
 			log.Infof("iptables set-up : %s", cmd.String())
-			if out, err := cmd.CombinedOutput(); err != nil {
+			if out, err := ctx.run(cmd); err != nil {
 				log.Warningf("Error inserting set in iptables (%s): %v : %s", cmd.String(), err, string(out))
 				return fmt.Errorf("while inserting set in iptables: %w", err)
 			}
@@ -88,7 +180,9 @@ func (ctx *ipTablesContext) CheckAndCreate() error {
 }
 
 func (ctx *ipTablesContext) add(decision *models.Decision) error {
-	/*Create our set*/
+	if decision.Duration == nil {
+		return fmt.Errorf("decision for '%s' has no duration", *decision.Value)
+	}
 
 	banDuration, err := time.ParseDuration(*decision.Duration)
 	if err != nil {
@@ -99,12 +193,78 @@ func (ctx *ipTablesContext) add(decision *models.Decision) error {
 		log.Warnf("Ban duration too long (%d seconds), maximum for ipset is 2147483, setting duration to 2147482", int(banDuration.Seconds()))
 		banDuration = time.Duration(2147482) * time.Second
 	}
-	cmd := exec.Command(ctx.ipsetBin, "-exist", "add", ctx.SetName, *decision.Value, "timeout", fmt.Sprintf("%d", int(banDuration.Seconds())))
-	log.Debugf("ipset add : %s", cmd.String())
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Infof("Error while inserting in set (%s): %v --> %s", cmd.String(), err, string(out))
+
+	return ctx.queue(fmt.Sprintf("add %s %s timeout %d", ctx.setFor(*decision.Value), *decision.Value, int(banDuration.Seconds())))
+}
+
+// queue records a set change, to be applied with the others by a single ipset restore.
+func (ctx *ipTablesContext) queue(line string) error {
+	ctx.pending = append(ctx.pending, line)
+
+	if len(ctx.pending) >= maxPending {
+		log.Debugf("%d pending changes for %s, applying them now", len(ctx.pending), ctx.SetName)
+		return ctx.commit()
+	}
+
+	return nil
+}
+
+// restore feeds the lines to ipset restore. When a line fails, ipset stops there: the
+// index of the failed line is returned with its error, the previous lines are applied.
+func (ctx *ipTablesContext) restore(lines []string) (int, error) {
+	cmd := exec.Command(ctx.ipsetBin, "-exist", "restore")
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+
+	if ctx.dryRun {
+		log.Infof("dry-run: %s with %d changes", cmd.String(), len(lines))
+		return 0, nil
+	}
+
+	out, err := ctx.limiter.CombinedOutput(cmd)
+	if err == nil {
+		return 0, nil
+	}
+
+	if m := restoreErrorRe.FindSubmatch(out); m != nil {
+		if n, convErr := strconv.Atoi(string(m[1])); convErr == nil && n >= 1 && n <= len(lines) {
+			return n - 1, fmt.Errorf("%s", m[2])
+		}
+	}
+
+	return -1, fmt.Errorf("%s: %w --> %s", cmd.String(), err, string(out))
+}
+
+// commit applies the pending set changes, skipping the ones refused by ipset.
+func (ctx *ipTablesContext) commit() error {
+	lines := ctx.pending
+	ctx.pending = nil
+
+	failed := 0
+
+	for len(lines) > 0 {
+		n, err := ctx.restore(lines)
+		if err == nil {
+			break
+		}
+
+		if n < 0 {
+			return fmt.Errorf("while updating set %s: %w", ctx.SetName, err)
+		}
+
+		if benignRestoreErrorRe.MatchString(err.Error()) {
+			log.Debugf("set %s: '%s' ignored: %s", ctx.SetName, lines[n], err)
+		} else {
+			log.Errorf("set %s: '%s' failed: %s", ctx.SetName, lines[n], err)
+			failed++
+		}
+
+		lines = lines[n+1:]
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d changes to set %s failed", failed, ctx.SetName)
 	}
-	// ipset -exist add test 192.168.0.1 timeout 600
+
 	return nil
 }
 
@@ -115,7 +275,7 @@ func (ctx *ipTablesContext) shutDown() error {
 	for _, startCmd := range ctx.ShutdownCmds {
 		cmd = exec.Command(ctx.iptablesBin, startCmd...)
 		log.Infof("iptables clean-up : %s", cmd.String())
-		if out, err := cmd.CombinedOutput(); err != nil {
+		if out, err := ctx.run(cmd); err != nil {
 			if strings.Contains(string(out), "Set "+ctx.SetName+" doesn't exist.") {
 				log.Infof("ipset '%s' doesn't exist, skip", ctx.SetName)
 			} else {
@@ -124,6 +284,11 @@ func (ctx *ipTablesContext) shutDown() error {
 		}
 	}
 
+	if ctx.keepSet {
+		log.Infof("leaving the other entries of %s in place", ctx.SetName)
+		return nil
+	}
+
 	/*clean ipset set*/
 	var ipsetCmd string
 	if ctx.ipsetContentOnly {
@@ -131,28 +296,64 @@ func (ctx *ipTablesContext) shutDown() error {
 	} else {
 		ipsetCmd = "destroy"
 	}
-	cmd = exec.Command(ctx.ipsetBin, "-exist", ipsetCmd, ctx.SetName)
-	log.Infof("ipset clean-up : %s", cmd.String())
-	if out, err := cmd.CombinedOutput(); err != nil {
-		if strings.Contains(string(out), "The set with the given name does not exist") {
-			log.Infof("ipset '%s' doesn't exist, skip", ctx.SetName)
-		} else {
-			log.Errorf("set %s error : %v - %s", ipsetCmd, err, string(out))
+	if count, err := ctx.countEntries(); err == nil {
+		log.Infof("%d entries removed from %s", count, ctx.SetName)
+	}
+
+	// the list:set of ipset_type auto goes first, its members can't be destroyed while it references them
+	sets := []string{ctx.SetName}
+	if ctx.SetType == cfg.SetTypeAuto {
+		sets = append(sets, ctx.memberSets()...)
+	}
+
+	for _, set := range sets {
+		cmd = exec.Command(ctx.ipsetBin, "-exist", ipsetCmd, set)
+		log.Infof("ipset clean-up : %s", cmd.String())
+		if out, err := ctx.run(cmd); err != nil {
+			if strings.Contains(string(out), "The set with the given name does not exist") {
+				log.Infof("ipset '%s' doesn't exist, skip", set)
+			} else {
+				log.Errorf("set %s error : %v - %s", ipsetCmd, err, string(out))
+			}
 		}
 	}
 	return nil
 }
 
+// countEntries returns the number of bans in the sets, as reported by the ipset headers.
+func (ctx *ipTablesContext) countEntries() (int, error) {
+	total := 0
+
+	for _, set := range ctx.memberSets() {
+		count, err := countSetEntries(ctx.ipsetBin, set)
+		if err != nil {
+			return 0, err
+		}
+
+		total += count
+	}
+
+	return total, nil
+}
+
+// countSetEntries returns the number of entries in a set, as reported by its ipset header.
+func countSetEntries(ipsetBin string, set string) (int, error) {
+	out, err := exec.Command(ipsetBin, "list", "-t", set).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("while listing set %s: %w --> %s", set, err, string(out))
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if count, found := strings.CutPrefix(line, "Number of entries:"); found {
+			return strconv.Atoi(strings.TrimSpace(count))
+		}
+	}
+
+	return 0, fmt.Errorf("no entry count found for set %s", set)
+}
+
 func (ctx *ipTablesContext) delete(decision *models.Decision) error {
-	/*
-		ipset -exist delete test 192.168.0.1 timeout 600
-		ipset -exist add test 192.168.0.1 timeout 600
-	*/
 	log.Debugf("ipset del ban for [%s]", *decision.Value)
-	cmd := exec.Command(ctx.ipsetBin, "-exist", "del", ctx.SetName, *decision.Value)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Infof("Error while deleting from set (%s): %v --> %s", cmd.String(), err, string(out))
-	}
-	// ipset -exist add test 192.168.0.1 timeout 600
-	return nil
+
+	return ctx.queue(fmt.Sprintf("del %s %s", ctx.setFor(*decision.Value), *decision.Value))
 }
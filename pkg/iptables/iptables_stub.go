@@ -4,10 +4,12 @@
 package iptables
 
 import (
+	"fmt"
+
 	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
 	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
 func NewIPTables(config *cfg.BouncerConfig) (types.Backend, error) {
-	return nil, nil
+	return nil, fmt.Errorf("iptables and ipset backends are not supported on this platform")
 }
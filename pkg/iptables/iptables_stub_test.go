@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package iptables
+
+import (
+	"testing"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+func TestStub(t *testing.T) {
+	fw, err := NewIPTables(&cfg.BouncerConfig{})
+	if err == nil || fw != nil {
+		t.Fatalf("NewIPTables returned %v, %v on this platform", fw, err)
+	}
+}
@@ -0,0 +1,257 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+func TestCommit(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	for _, value := range []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::1"} {
+		if err := ipt.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists", "192.0.2.1", "198.51.100.0/24")
+	f.assertSet("crowdsec6-blacklists", "2001:db8::1")
+
+	if err := ipt.Delete(newDecision("192.0.2.1", "1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists", "198.51.100.0/24")
+}
+
+func TestDryRun(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	for _, ctx := range ipt.contexts() {
+		ctx.dryRun = true
+	}
+
+	if err := ipt.Add(newDecision("192.0.2.1", "1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ipt.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists")
+
+	// the sets are only read
+	for _, call := range f.calls() {
+		if !strings.HasPrefix(call, "list ") {
+			t.Fatalf("ipset ran '%s' in dry-run", call)
+		}
+	}
+}
+
+func TestMalformedDecision(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	value := "192.0.2.1"
+
+	for _, d := range []*models.Decision{nil, {}, {Value: &value}} {
+		if err := ipt.Add(d); err == nil {
+			t.Fatalf("added %+v", d)
+		}
+	}
+
+	for _, d := range []*models.Decision{nil, {}} {
+		if err := ipt.Delete(d); err == nil {
+			t.Fatalf("deleted %+v", d)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists")
+}
+
+func TestCommitSingleRestore(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if err := ipt.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists", "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	// nothing is restored for the ipv6 set without changes
+	if calls := f.calls(); len(calls) != 1 || calls[0] != "-exist restore" {
+		t.Fatalf("ipset ran %q", calls)
+	}
+}
+
+func TestCommitFailedLine(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if err := ipt.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second line is refused, the following ones are restored again
+	f.fail(2)
+
+	err := ipt.Commit()
+	if err == nil || !strings.Contains(err.Error(), "1 changes to set crowdsec-blacklists failed") {
+		t.Fatalf("commit returned %v", err)
+	}
+
+	f.assertSet("crowdsec-blacklists", "192.0.2.1", "192.0.2.3")
+}
+
+func TestCommitBenignErrors(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.DebugLevel)
+
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+	f.createSet("crowdsec-blacklists", "192.0.2.1")
+	f.strict()
+
+	// already added, then added, then not there anymore
+	if err := ipt.Add(newDecision("192.0.2.1", "1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ipt.Add(newDecision("192.0.2.2", "1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ipt.Delete(newDecision("192.0.2.3", "1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists", "192.0.2.1", "192.0.2.2")
+
+	ignored := 0
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.InfoLevel {
+			t.Fatalf("logged at %s: %s", entry.Level, entry.Message)
+		}
+
+		if strings.Contains(entry.Message, "ignored") {
+			ignored++
+		}
+	}
+
+	if ignored != 2 {
+		t.Fatalf("%d changes ignored at debug, want 2", ignored)
+	}
+}
+
+func TestQueueFlushesAtMaxPending(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+	// the fake ipset would take a while to restore them
+	ipt.v4.dryRun = true
+
+	for i := 0; i < maxPending+1; i++ {
+		if err := ipt.Add(newDecision(fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff), "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// applied without waiting for the commit
+	if len(ipt.v4.pending) != 1 {
+		t.Fatalf("%d changes pending", len(ipt.v4.pending))
+	}
+}
+
+// BenchmarkCommit compares a commit per address to a single restore, with the fake ipset.
+func BenchmarkCommit(b *testing.B) {
+	for _, perCommit := range []int{1, 100} {
+		b.Run(fmt.Sprintf("perCommit=%d", perCommit), func(b *testing.B) {
+			f := newFakeIpset(b)
+			ipt := newTestIPTables(f)
+
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 100; j++ {
+					if err := ipt.Add(newDecision(fmt.Sprintf("10.0.0.%d", j), "1h")); err != nil {
+						b.Fatal(err)
+					}
+
+					if (j+1)%perCommit == 0 {
+						if err := ipt.Commit(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIPv6Only(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+	// DisableIPV4
+	ipt.v4 = nil
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::1"} {
+		if err := ipt.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists")
+	f.assertSet("crowdsec6-blacklists", "2001:db8::1")
+
+	if err := ipt.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec6-blacklists")
+}
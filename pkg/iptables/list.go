@@ -0,0 +1,85 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// list returns the members of the sets, such as "1.2.3.4 timeout 3599". The members of
+// a set shared with someone else (flush_mode owned) are foreign.
+func (ctx *ipTablesContext) list() ([]types.Entry, error) {
+	ret := []types.Entry{}
+
+	for _, set := range ctx.memberSets() {
+		entries, err := listSet(ctx.ipsetBin, set)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			entry.Foreign = ctx.keepSet
+			ret = append(ret, entry)
+		}
+	}
+
+	return ret, nil
+}
+
+func listSet(ipsetBin string, set string) ([]types.Entry, error) {
+	out, err := exec.Command(ipsetBin, "list", set).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("while listing set %s: %w --> %s", set, err, string(out))
+	}
+
+	ret := []types.Entry{}
+	members := false
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if !members {
+			members = strings.HasPrefix(line, "Members:")
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		entry := types.Entry{Value: fields[0]}
+
+		for i := 1; i < len(fields)-1; i++ {
+			if fields[i] == "timeout" {
+				if seconds, err := strconv.Atoi(fields[i+1]); err == nil {
+					entry.TTL = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+
+		ret = append(ret, entry)
+	}
+
+	return ret, nil
+}
+
+func (ipt *iptables) List() ([]types.Entry, error) {
+	ret := []types.Entry{}
+
+	for _, ctx := range ipt.contexts() {
+		entries, err := ctx.list()
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, entries...)
+	}
+
+	return ret, nil
+}
@@ -5,14 +5,14 @@ package iptables
 
 import (
 	"encoding/xml"
+	"fmt"
 	"os/exec"
 	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
 type Ipsets struct {
@@ -24,16 +24,17 @@ type Ipsets struct {
 	} `xml:"ipset"`
 }
 
-func collectDroppedPackets(binaryPath string, chains []string, setName string) (float64, float64) {
+func collectDroppedPackets(binaryPath string, table string, chains []string, setName string) (float64, float64) {
 	var droppedPackets, droppedBytes float64
 	for _, chain := range chains {
-		out, err := exec.Command(binaryPath, "-L", chain, "-v", "-x").CombinedOutput()
+		out, err := exec.Command(binaryPath, "-t", table, "-L", chain, "-v", "-x").CombinedOutput()
 		if err != nil {
 			log.Error(string(out), err)
 			continue
 		}
 		for _, line := range strings.Split(string(out), "\n") {
-			if !strings.Contains(line, setName) || strings.Contains(line, "LOG") {
+			// the LOG rule and the ACCEPT rule of the pings don't drop anything
+			if !strings.Contains(line, setName) || strings.Contains(line, "LOG") || strings.Contains(line, "ACCEPT") {
 				continue
 			}
 			parts := strings.Fields(line)
@@ -52,41 +53,40 @@ func collectDroppedPackets(binaryPath string, chains []string, setName string) (
 	return droppedPackets, droppedBytes
 }
 
-func (ipt *iptables) CollectMetrics() {
-	t := time.NewTicker(metrics.MetricCollectionInterval)
-	var ip4DroppedPackets, ip4DroppedBytes, ip6DroppedPackets, ip6DroppedBytes float64
-	for range t.C {
-		ip4DroppedPackets, ip4DroppedBytes = collectDroppedPackets(ipt.v4.iptablesBin, ipt.v4.Chains, ipt.v4.SetName)
-		if ipt.v6 != nil {
-			ip6DroppedPackets, ip6DroppedBytes = collectDroppedPackets(ipt.v6.iptablesBin, ipt.v6.Chains, ipt.v6.SetName)
+func (ipt *iptables) CollectMetrics() (types.Metrics, error) {
+	ret := types.Metrics{BannedByFamily: make(map[string]float64)}
+
+	contexts := ipt.contexts()
+	families := make(map[string]string)
+	for _, ctx := range contexts {
+		for _, set := range ctx.memberSets() {
+			families[set] = "ip" + ctx.version
 		}
-		metrics.TotalDroppedPackets.Set(ip4DroppedPackets + ip6DroppedPackets)
-		metrics.TotalDroppedBytes.Set(ip6DroppedBytes + ip4DroppedBytes)
+		packets, bytes := collectDroppedPackets(ctx.iptablesBin, ctx.Table, ctx.Chains, ctx.SetName)
+		ret.DroppedPackets += packets
+		ret.DroppedBytes += bytes
+	}
 
-		out, err := exec.Command(ipt.v4.ipsetBin, "list", "-o", "xml").CombinedOutput()
-		if err != nil {
-			log.Error(err)
+	out, err := exec.Command(contexts[0].ipsetBin, "list", "-o", "xml").CombinedOutput()
+	if err != nil {
+		return types.Metrics{}, fmt.Errorf("while listing the ipsets: %w", err)
+	}
+	ipsets := Ipsets{}
+	if err := xml.Unmarshal(out, &ipsets); err != nil {
+		return types.Metrics{}, err
+	}
+	// with ipset_type auto, a family has two sets
+	for _, ipset := range ipsets.Ipset {
+		family, ok := families[ipset.Name]
+		if !ok || ipset.Header.Numentries == "" {
 			continue
 		}
-		ipsets := Ipsets{}
-		if err := xml.Unmarshal(out, &ipsets); err != nil {
-			log.Error(err)
+		count, err := strconv.ParseFloat(ipset.Header.Numentries, 64)
+		if err != nil {
+			log.Errorf("error while parsing  Numentries from ipsets: %s", err)
 			continue
 		}
-		newCount := float64(0)
-		for _, ipset := range ipsets.Ipset {
-			if ipset.Name == ipt.v4.SetName || (ipt.v6 != nil && ipset.Name == ipt.v6.SetName) {
-				if ipset.Header.Numentries == "" {
-					continue
-				}
-				count, err := strconv.ParseFloat(ipset.Header.Numentries, 64)
-				if err != nil {
-					log.Errorf("error while parsing  Numentries from ipsets: %s", err)
-					continue
-				}
-				newCount += count
-			}
-		}
-		metrics.TotalActiveBannedIPs.Set(newCount)
+		ret.BannedByFamily[family] += count
 	}
+	return ret, nil
 }
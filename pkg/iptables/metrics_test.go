@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeIptablesScript lists the counters of the rules of both families, whatever the chain.
+const fakeIptablesScript = `#!/bin/sh
+echo 'Chain INPUT (policy ACCEPT 0 packets, 0 bytes)'
+echo '    pkts      bytes target     prot opt in     out     source               destination'
+echo '       3      252 ACCEPT     icmp --  *      *       0.0.0.0/0            0.0.0.0/0            match-set crowdsec-blacklists src icmptype 8'
+echo '       5      300 LOG        all  --  *      *       0.0.0.0/0            0.0.0.0/0            match-set crowdsec-blacklists src LOG flags 0 level 4 prefix "crowdsec drop: "'
+echo '      12      720 DROP       all  --  *      *       0.0.0.0/0            0.0.0.0/0            match-set crowdsec-blacklists src'
+echo '       2       80 DROP       all  --  *      *       ::/0                 ::/0                 match-set crowdsec6-blacklists src'
+echo '       7      999 DROP       all  --  *      *       0.0.0.0/0            0.0.0.0/0            match-set other-set src'
+`
+
+func TestCollectMetrics(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	iptablesBin := filepath.Join(f.dir, "iptables")
+	if err := os.WriteFile(iptablesBin, []byte(fakeIptablesScript), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ctx := range ipt.contexts() {
+		ctx.iptablesBin = iptablesBin
+		ctx.Table = "filter"
+		ctx.Chains = []string{"INPUT"}
+	}
+
+	f.createSet("crowdsec-blacklists", "192.0.2.1", "192.0.2.2", "198.51.100.0/24")
+	f.createSet("crowdsec6-blacklists", "2001:db8::1")
+	f.createSet("other-set", "203.0.113.1")
+
+	snapshot, err := ipt.CollectMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the LOG and ACCEPT rules don't drop anything, the sets of the user are not counted
+	if snapshot.DroppedPackets != 14 || snapshot.DroppedBytes != 800 {
+		t.Fatalf("dropped %v packets and %v bytes, want 14 and 800", snapshot.DroppedPackets, snapshot.DroppedBytes)
+	}
+
+	if len(snapshot.BannedByFamily) != 2 || snapshot.BannedByFamily["ipv4"] != 3 || snapshot.BannedByFamily["ipv6"] != 1 {
+		t.Fatalf("banned by family %v", snapshot.BannedByFamily)
+	}
+
+	if snapshot.Banned() != 4 {
+		t.Fatalf("%v banned, want 4", snapshot.Banned())
+	}
+}
+
+func TestCollectMetricsSetTypeAuto(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestAutoIPTables(f)
+
+	f.createSet("crowdsec-blacklists-ip", "192.0.2.1", "192.0.2.2")
+	f.createSet("crowdsec-blacklists-net", "198.51.100.0/24")
+
+	snapshot, err := ipt.CollectMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the list:set only holds the two sets of the family
+	if snapshot.BannedByFamily["ipv4"] != 3 || snapshot.BannedByFamily["ipv6"] != 0 {
+		t.Fatalf("banned by family %v", snapshot.BannedByFamily)
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"os/exec"
+)
+
+// missing tells whether the set, or one of the rules using it, have been removed.
+func (ctx *ipTablesContext) missing() bool {
+	if ctx.dryRun {
+		return false
+	}
+
+	if err := exec.Command(ctx.ipsetBin, "-L", ctx.SetName).Run(); err != nil {
+		return true
+	}
+
+	for _, checkCmd := range ctx.CheckIptableCmds {
+		if err := exec.Command(ctx.iptablesBin, checkCmd...).Run(); err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ipt *iptables) Missing() (bool, error) {
+	for _, ctx := range ipt.contexts() {
+		if ctx.missing() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Recreate creates the missing sets and rules, the existing ones are kept.
+func (ipt *iptables) Recreate() error {
+	for _, ctx := range ipt.contexts() {
+		if !ctx.missing() {
+			continue
+		}
+
+		if err := ctx.CheckAndCreate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
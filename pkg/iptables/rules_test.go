@@ -0,0 +1,126 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+func rules(t *testing.T, yaml string) []string {
+	t.Helper()
+
+	config, err := cfg.NewConfig(strings.NewReader(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &ipTablesContext{version: "v4", SetName: "crowdsec-blacklists"}
+	setRules(ctx, config, "DROP")
+
+	ret := []string{}
+	for _, cmd := range ctx.StartupCmds {
+		ret = append(ret, strings.Join(cmd, " "))
+	}
+
+	return ret
+}
+
+func TestRulesInterface(t *testing.T) {
+	got := rules(t, "mode: iptables\ninterface: eth0\niptables_chains:\n  - INPUT\n  - FORWARD\n  - OUTPUT\n")
+
+	want := []string{
+		"-t filter -I INPUT -i eth0 -m set --match-set crowdsec-blacklists src -j DROP",
+		"-t filter -I FORWARD -i eth0 -m set --match-set crowdsec-blacklists src -j DROP",
+		// the packets leaving through the interface
+		"-t filter -I OUTPUT -o eth0 -m set --match-set crowdsec-blacklists src -j DROP",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("rules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRulesComment(t *testing.T) {
+	got := rules(t, "mode: iptables\nrule_comment: crowdsec\nallow_icmp_echo: true\ndeny_log: true\ndeny_log_prefix: \"crowdsec: \"\niptables_chains:\n  - INPUT\n")
+
+	// the deny, LOG and echo rules all carry the comment
+	want := []string{
+		"-t filter -I INPUT -m set --match-set crowdsec-blacklists src -m comment --comment crowdsec -j DROP",
+		"-t filter -I INPUT -m set --match-set crowdsec-blacklists src -m comment --comment crowdsec -j LOG --log-prefix crowdsec: ",
+		"-t filter -I INPUT -m set --match-set crowdsec-blacklists src -m comment --comment crowdsec -p icmp --icmp-type echo-request -j ACCEPT",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("rules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRulesWithoutInterface(t *testing.T) {
+	got := rules(t, "mode: iptables\niptables_chains:\n  - INPUT\n")
+
+	if len(got) != 1 || got[0] != "-t filter -I INPUT -m set --match-set crowdsec-blacklists src -j DROP" {
+		t.Fatalf("rules: %v", got)
+	}
+}
+
+func TestRulesAllowEcho(t *testing.T) {
+	got := rules(t, "mode: iptables\nallow_icmp_echo: true\niptables_chains:\n  - INPUT\n")
+
+	// each rule is inserted at the top of the chain, the last one ends up first
+	want := []string{
+		"-t filter -I INPUT -m set --match-set crowdsec-blacklists src -j DROP",
+		"-t filter -I INPUT -m set --match-set crowdsec-blacklists src -p icmp --icmp-type echo-request -j ACCEPT",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("rules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRulesAllowEchoAppend(t *testing.T) {
+	got := rules(t, "mode: iptables\nallow_icmp_echo: true\ndeny_log: true\ndeny_log_prefix: \"crowdsec: \"\niptables_rule_position: append\niptables_chains:\n  - INPUT\n")
+
+	// appended in the order they are evaluated: the pings, the log, then the drop
+	want := []string{
+		"-t filter -A INPUT -m set --match-set crowdsec-blacklists src -p icmp --icmp-type echo-request -j ACCEPT",
+		"-t filter -A INPUT -m set --match-set crowdsec-blacklists src -j LOG --log-prefix crowdsec: ",
+		"-t filter -A INPUT -m set --match-set crowdsec-blacklists src -j DROP",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("rules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRulesAllowEchoIPv6(t *testing.T) {
+	config, err := cfg.NewConfig(strings.NewReader("mode: iptables\nallow_icmp_echo: true\niptables_chains:\n  - INPUT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &ipTablesContext{version: "v6", SetName: "crowdsec6-blacklists"}
+	setRules(ctx, config, "DROP")
+
+	if got := strings.Join(ctx.StartupCmds[1], " "); !strings.Contains(got, "-p ipv6-icmp --icmpv6-type echo-request -j ACCEPT") {
+		t.Fatalf("the ipv6 pings are accepted with %s", got)
+	}
+}
+
+func TestRulesAllowEchoAudit(t *testing.T) {
+	config, err := cfg.NewConfig(strings.NewReader("mode: iptables\nallow_icmp_echo: true\niptables_chains:\n  - INPUT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &ipTablesContext{version: "v4", SetName: "crowdsec-blacklists"}
+	// the audit rules only count the packets
+	setRules(ctx, config, "")
+
+	if len(ctx.StartupCmds) != 1 {
+		t.Fatalf("audit rules: %v", ctx.StartupCmds)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"fmt"
+)
+
+// SelfTest makes sure the sets exist and the rules using them are in place.
+func (ipt *iptables) SelfTest() error {
+	for _, ctx := range ipt.contexts() {
+		if ctx.missing() {
+			return fmt.Errorf("the set %s or the %s rules using it are missing", ctx.SetName, ctx.iptablesBin)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// newTestAutoIPTables returns an ipset mode backend with ipset_type auto, the addresses
+// and the ranges going to the -ip and -net sets of crowdsec-blacklists and crowdsec6-blacklists.
+func newTestAutoIPTables(f *fakeIpset) *iptables {
+	ipt := newTestIPTables(f)
+
+	for _, ctx := range ipt.contexts() {
+		ctx.SetType = cfg.SetTypeAuto
+
+		for _, set := range ctx.memberSets() {
+			f.createSet(set)
+		}
+	}
+
+	return ipt
+}
+
+func TestSetTypeAuto(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestAutoIPTables(f)
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2/32", "198.51.100.0/24", "2001:db8::1", "2001:db8::2/128", "2001:db8:1::/48"} {
+		if err := ipt.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists-ip", "192.0.2.1", "192.0.2.2/32")
+	f.assertSet("crowdsec-blacklists-net", "198.51.100.0/24")
+	f.assertSet("crowdsec6-blacklists-ip", "2001:db8::1", "2001:db8::2/128")
+	f.assertSet("crowdsec6-blacklists-net", "2001:db8:1::/48")
+
+	// the deletes go to the set holding the value
+	for _, value := range []string{"192.0.2.1", "198.51.100.0/24", "2001:db8:1::/48"} {
+		if err := ipt.Delete(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists-ip", "192.0.2.2/32")
+	f.assertSet("crowdsec-blacklists-net")
+	f.assertSet("crowdsec6-blacklists-ip", "2001:db8::1", "2001:db8::2/128")
+	f.assertSet("crowdsec6-blacklists-net")
+}
+
+func TestSetFor(t *testing.T) {
+	ctx := &ipTablesContext{version: "v6", SetName: "crowdsec6-blacklists", SetType: cfg.SetTypeAuto}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"2001:db8::1", "crowdsec6-blacklists-ip"},
+		{"2001:db8::1/128", "crowdsec6-blacklists-ip"},
+		{"2001:db8::/64", "crowdsec6-blacklists-net"},
+		// /32 is a range in ipv6
+		{"2001:db8::/32", "crowdsec6-blacklists-net"},
+	}
+
+	for _, tt := range tests {
+		if got := ctx.setFor(tt.value); got != tt.want {
+			t.Fatalf("%s goes to %s, want %s", tt.value, got, tt.want)
+		}
+	}
+
+	ctx.SetType = "hash:net"
+
+	if got := ctx.setFor("2001:db8::/64"); got != "crowdsec6-blacklists" {
+		t.Fatalf("with ipset_type hash:net, a range goes to %s", got)
+	}
+}
+
+func TestCreateCmdsAuto(t *testing.T) {
+	ctx := &ipTablesContext{version: "v4", ipsetBin: "ipset", SetName: "crowdsec-blacklists", SetType: cfg.SetTypeAuto, SetSize: 65536}
+
+	got := []string{}
+	for _, cmd := range ctx.createCmds() {
+		got = append(got, strings.Join(cmd.Args[1:], " "))
+	}
+
+	want := []string{
+		"-exist create crowdsec-blacklists-ip hash:ip timeout 300 maxelem 65536",
+		"-exist create crowdsec-blacklists-net hash:net timeout 300 maxelem 65536",
+		"-exist create crowdsec-blacklists list:set",
+		"-exist add crowdsec-blacklists crowdsec-blacklists-ip",
+		"-exist add crowdsec-blacklists crowdsec-blacklists-net",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("create commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
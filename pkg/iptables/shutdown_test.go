@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShutDownOwned(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	for _, ctx := range ipt.contexts() {
+		ctx.keepSet = true
+	}
+
+	f.createSet("crowdsec-blacklists", "198.51.100.1")
+
+	// the bans of the bouncer are removed before, by the backend
+	for _, value := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := ipt.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := ipt.Delete(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ipt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ipt.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertSet("crowdsec-blacklists", "198.51.100.1")
+
+	for _, call := range f.calls() {
+		if strings.Contains(call, "flush") || strings.Contains(call, "destroy") {
+			t.Fatalf("a shared set is cleared: %s", call)
+		}
+	}
+}
+
+func TestShutDownFlush(t *testing.T) {
+	f := newFakeIpset(t)
+	ipt := newTestIPTables(f)
+
+	f.createSet("crowdsec-blacklists", "198.51.100.1", "192.0.2.1")
+
+	if err := ipt.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ipset mode: the set of the user is flushed, not destroyed
+	f.assertSet("crowdsec-blacklists")
+}
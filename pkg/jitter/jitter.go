@@ -0,0 +1,78 @@
+package jitter
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Percent is how much the intervals of the tickers vary around their base, so that the
+// periodic tasks of a fleet of bouncers don't run at the same time. It's set by the configuration.
+var Percent = 0
+
+// Interval returns interval shifted randomly by up to percent of it, in either direction.
+func Interval(interval time.Duration, percent int) time.Duration {
+	spread := int64(interval) * int64(percent) / 100
+	if spread <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// Ticker is a time.Ticker whose each interval is drawn again within Percent of the base one.
+// Like time.Ticker, it drops the ticks a slow receiver misses.
+type Ticker struct {
+	C     <-chan time.Time
+	stop  chan struct{}
+	reset chan time.Duration
+	once  sync.Once
+}
+
+// NewTicker returns a ticker around interval, with the jitter of Percent.
+func NewTicker(interval time.Duration) *Ticker {
+	c := make(chan time.Time, 1)
+	t := &Ticker{C: c, stop: make(chan struct{}), reset: make(chan time.Duration)}
+
+	go t.run(c, interval, Percent)
+
+	return t
+}
+
+func (t *Ticker) run(c chan<- time.Time, interval time.Duration, percent int) {
+	timer := time.NewTimer(Interval(interval, percent))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case interval = <-t.reset:
+			if !timer.Stop() {
+				<-timer.C
+			}
+
+			timer.Reset(Interval(interval, percent))
+		case now := <-timer.C:
+			select {
+			case c <- now:
+			default:
+			}
+
+			timer.Reset(Interval(interval, percent))
+		}
+	}
+}
+
+// Reset changes the base interval of the ticker, the next tick is drawn from it.
+func (t *Ticker) Reset(interval time.Duration) {
+	select {
+	case t.reset <- interval:
+	case <-t.stop:
+	}
+}
+
+// Stop turns off the ticker, no more ticks are sent.
+func (t *Ticker) Stop() {
+	t.once.Do(func() { close(t.stop) })
+}
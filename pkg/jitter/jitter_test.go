@@ -0,0 +1,81 @@
+package jitter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTickerReset(t *testing.T) {
+	ticker := NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	ticker.Reset(10 * time.Millisecond)
+
+	select {
+	case <-ticker.C:
+	case <-time.After(time.Second):
+		t.Fatal("no tick after resetting the ticker to 10ms")
+	}
+}
+
+func TestTickerResetStopped(t *testing.T) {
+	ticker := NewTicker(time.Hour)
+	ticker.Stop()
+
+	// doesn't block once the ticker is stopped
+	ticker.Reset(time.Second)
+}
+
+func TestInterval(t *testing.T) {
+	base := time.Minute
+	low, high := false, false
+
+	for i := 0; i < 10000; i++ {
+		got := Interval(base, 20)
+
+		if got < 48*time.Second || got > 72*time.Second {
+			t.Fatalf("interval %s is not within 20%% of %s", got, base)
+		}
+
+		low = low || got < 54*time.Second
+		high = high || got > 66*time.Second
+	}
+
+	if !low || !high {
+		t.Fatal("the intervals are not spread on both sides of the base one")
+	}
+}
+
+func TestIntervalWithoutJitter(t *testing.T) {
+	for _, percent := range []int{0, -10} {
+		if got := Interval(time.Minute, percent); got != time.Minute {
+			t.Fatalf("interval %s with a jitter of %d%%", got, percent)
+		}
+	}
+
+	// too short to be spread
+	if got := Interval(time.Nanosecond, 10); got != time.Nanosecond {
+		t.Fatalf("interval %s for 1ns", got)
+	}
+}
+
+func TestTickerJitter(t *testing.T) {
+	defer func(percent int) { Percent = percent }(Percent)
+	Percent = 50
+
+	ticker := NewTicker(40 * time.Millisecond)
+	defer ticker.Stop()
+
+	last := time.Now()
+
+	for i := 0; i < 10; i++ {
+		now := <-ticker.C
+
+		// the timers fire late under load, never early
+		if elapsed := now.Sub(last); elapsed < 20*time.Millisecond {
+			t.Fatalf("tick after %s, want at least 20ms", elapsed)
+		}
+
+		last = now
+	}
+}
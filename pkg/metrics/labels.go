@@ -0,0 +1,46 @@
+package metrics
+
+import "sync"
+
+// OtherLabel replaces the values of a label once it has too many distinct ones.
+const OtherLabel = "other"
+
+// boundedLabel limits the distinct values of a label, to keep the number of series in
+// check: the community blocklists alone span hundreds of scenarios.
+type boundedLabel struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+func newBoundedLabel(max int) *boundedLabel {
+	return &boundedLabel{max: max, seen: make(map[string]struct{})}
+}
+
+// value returns the label value to report, the first values seen are kept.
+func (l *boundedLabel) value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+
+	if len(l.seen) >= l.max {
+		return OtherLabel
+	}
+
+	l.seen[v] = struct{}{}
+
+	return v
+}
+
+var (
+	originLabel   = newBoundedLabel(20)
+	scenarioLabel = newBoundedLabel(100)
+)
+
+// SourceLabels returns the origin and scenario labels of a decision.
+func SourceLabels(origin string, scenario string) (string, string) {
+	return originLabel.value(origin), scenarioLabel.value(scenario)
+}
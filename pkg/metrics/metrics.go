@@ -6,7 +6,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-const MetricCollectionInterval = time.Second * 10
+// DefaultMetricCollectionInterval is used when the configuration doesn't set prometheus.interval.
+const DefaultMetricCollectionInterval = time.Second * 10
+
+// MetricCollectionInterval is how often the backends refresh their metrics, it can be changed by the configuration.
+var MetricCollectionInterval = DefaultMetricCollectionInterval
 
 var TotalDroppedPackets = prometheus.NewGauge(prometheus.GaugeOpts{
 	Name: "fw_bouncer_dropped_packets",
@@ -22,3 +26,70 @@ var TotalActiveBannedIPs = prometheus.NewGauge(prometheus.GaugeOpts{
 	Name: "fw_bouncer_banned_ips",
 	Help: "Denotes the number of IPs which are currently banned",
 })
+
+var ActiveBannedIPsByFamily = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fw_bouncer_banned_ips_by_family",
+	Help: "Denotes the number of IPs which are currently banned, by address family",
+}, []string{"ip_type"})
+
+var TotalProcessedDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "fw_bouncer_processed_decisions",
+	Help: "Denotes the number of decisions applied to the firewall, by action",
+}, []string{"action"})
+
+var DecisionApplyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name: "fw_bouncer_decision_apply_duration_seconds",
+	Help: "Denotes the time taken to add the decisions to the firewall and commit them",
+	// from 1ms to about 16s
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+})
+
+var TotalLAPIAuthErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "fw_bouncer_lapi_auth_errors_total",
+	Help: "Denotes the number of LAPI requests refused because of the credentials of the bouncer (HTTP 401 or 403)",
+})
+
+var TotalDecisionParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "fw_bouncer_decision_parse_errors_total",
+	Help: "Denotes the number of decisions ignored because their value, scope or duration is malformed",
+})
+
+var TotalDroppedNotifications = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "fw_bouncer_dropped_notifications_total",
+	Help: "Denotes the number of ban notifications dropped because the queue was full",
+})
+
+var DecisionQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fw_bouncer_decision_queue_depth",
+	Help: "Denotes the number of decisions waiting for the rate limit, by backend",
+}, []string{"backend"})
+
+var DecisionQueueCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fw_bouncer_decision_queue_capacity",
+	Help: "Denotes the number of decisions the rate limit queue can hold, by backend",
+}, []string{"backend"})
+
+var TotalDroppedDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "fw_bouncer_dropped_decisions_total",
+	Help: "Denotes the number of decisions dropped because the rate limit queue was full, by backend",
+}, []string{"backend"})
+
+var TotalExpiredDecisions = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "fw_bouncer_expired_decisions_total",
+	Help: "Denotes the number of decisions skipped because they had already expired when received",
+})
+
+var TotalFilteredDecisions = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "fw_bouncer_filtered_decisions_total",
+	Help: "Denotes the number of decisions skipped because of their scenario",
+})
+
+var ProcessedDecisionsBySource = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "fw_bouncer_processed_decisions_by_source",
+	Help: "Denotes the number of decisions applied to the firewall, by action, origin and scenario",
+}, []string{"action", "origin", "scenario"})
+
+var ActiveBansBySource = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "fw_bouncer_banned_ips_by_source",
+	Help: "Denotes the number of decisions currently applied to the firewall, by origin and scenario",
+}, []string{"origin", "scenario"})
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// loadSet looks up an existing set, without creating anything.
+func (c *nftContext) loadSet() error {
+	table, err := c.lookupTable()
+	if err != nil {
+		return err
+	}
+
+	set, err := c.conn.GetSetByName(table, c.blacklists)
+	if err != nil {
+		return fmt.Errorf("nftables: could not find set '%s' in table '%s': %w", c.blacklists, c.tableName, err)
+	}
+
+	c.table = table
+	c.set = set
+
+	return nil
+}
+
+// List returns the content of the sets. The kernel only reports the timeout the
+// elements were added with, so their remaining time is unknown. The elements of a
+// set-only set may have been added by someone else, they are foreign.
+func (n *nft) List() ([]types.Entry, error) {
+	ret := []types.Entry{}
+
+	for _, c := range []*nftContext{n.v4, n.v6} {
+		if c.conn == nil {
+			continue
+		}
+
+		if c.set == nil {
+			if err := c.loadSet(); err != nil {
+				return nil, err
+			}
+		}
+
+		banned := make(map[string]struct{})
+		if err := c.setBanned(banned); err != nil {
+			return nil, err
+		}
+
+		for value := range banned {
+			ret = append(ret, types.Entry{Value: value, Foreign: c.setOnly})
+		}
+	}
+
+	return ret, nil
+}
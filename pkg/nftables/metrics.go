@@ -7,11 +7,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
 type Counter struct {
@@ -90,7 +89,7 @@ func (c *nftContext) collectActiveBannedIPs(path string) (int, error) {
 }
 
 func (c *nftContext) collectDropped(path string, hooks []string) (int, int, int) {
-	if c.conn == nil {
+	if c.conn == nil || c.dryRun {
 		return 0, 0, 0
 	}
 
@@ -122,28 +121,23 @@ func (c *nftContext) collectDropped(path string, hooks []string) (int, int, int)
 	return droppedPackets, droppedBytes, banned
 }
 
-func (n *nft) CollectMetrics() {
+func (n *nft) CollectMetrics() (types.Metrics, error) {
 	path, err := exec.LookPath("nft")
 	if err != nil {
-		log.Error("can't monitor dropped packets: ", err)
-		return
+		return types.Metrics{}, fmt.Errorf("%w: %w", types.ErrMetricsUnsupported, err)
 	}
 
 	cmd := exec.Command(path, "-j", "list", "tables")
-	_, err = cmd.CombinedOutput()
-	if err != nil {
-		log.Warningf("nft -j is not supported (requires 0.9.7), nftables metrics are disabled")
-		return
+	if _, err := cmd.CombinedOutput(); err != nil {
+		return types.Metrics{}, fmt.Errorf("%w: nft -j is not supported (requires 0.9.7)", types.ErrMetricsUnsupported)
 	}
 
-	t := time.NewTicker(metrics.MetricCollectionInterval)
-
-	for range t.C {
-		ip4DroppedPackets, ip4DroppedBytes, bannedIP4 := n.v4.collectDropped(path, n.Hooks)
-		ip6DroppedPackets, ip6DroppedBytes, bannedIP6 := n.v6.collectDropped(path, n.Hooks)
+	ip4DroppedPackets, ip4DroppedBytes, bannedIP4 := n.v4.collectDropped(path, n.Hooks)
+	ip6DroppedPackets, ip6DroppedBytes, bannedIP6 := n.v6.collectDropped(path, n.Hooks)
 
-		metrics.TotalDroppedPackets.Set(float64(ip4DroppedPackets + ip6DroppedPackets))
-		metrics.TotalDroppedBytes.Set(float64(ip6DroppedBytes + ip4DroppedBytes))
-		metrics.TotalActiveBannedIPs.Set(float64(bannedIP4 + bannedIP6))
-	}
+	return types.Metrics{
+		DroppedPackets: float64(ip4DroppedPackets + ip6DroppedPackets),
+		DroppedBytes:   float64(ip4DroppedBytes + ip6DroppedBytes),
+		BannedByFamily: map[string]float64{"ipv4": float64(bannedIP4), "ipv6": float64(bannedIP6)},
+	}, nil
 }
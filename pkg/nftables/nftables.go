@@ -4,9 +4,8 @@
 package nftables
 
 import (
+	"errors"
 	"fmt"
-	"net"
-	"strings"
 	"time"
 
 	"github.com/google/nftables"
@@ -15,6 +14,7 @@ import (
 	"github.com/asians-cloud/crowdsec/pkg/models"
 
 	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
 const (
@@ -30,16 +30,22 @@ type nft struct {
 	DenyAction        string
 	DenyLog           bool
 	DenyLogPrefix     string
+	AuditMode         bool
 	Hooks             []string
 }
 
-func NewNFTables(config *cfg.BouncerConfig) (*nft, error) {
+func NewNFTables(config *cfg.BouncerConfig) (types.Backend, error) {
+	if err := config.CheckInterface(); err != nil {
+		return nil, err
+	}
+
 	ret := &nft{
 		v4:            NewNFTV4Context(config),
 		v6:            NewNFTV6Context(config),
 		DenyAction:    config.DenyAction,
 		DenyLog:       config.DenyLog,
 		DenyLogPrefix: config.DenyLogPrefix,
+		AuditMode:     config.AuditMode,
 		Hooks:         config.NftablesHooks,
 	}
 
@@ -49,11 +55,11 @@ func NewNFTables(config *cfg.BouncerConfig) (*nft, error) {
 func (n *nft) Init() error {
 	log.Debug("nftables: Init()")
 
-	if err := n.v4.init(n.Hooks, n.DenyLog, n.DenyLogPrefix, n.DenyAction); err != nil {
+	if err := n.v4.init(n.Hooks, n.DenyLog, n.DenyLogPrefix, n.DenyAction, n.AuditMode); err != nil {
 		return err
 	}
 
-	if err := n.v6.init(n.Hooks, n.DenyLog, n.DenyLogPrefix, n.DenyAction); err != nil {
+	if err := n.v6.init(n.Hooks, n.DenyLog, n.DenyLogPrefix, n.DenyAction, n.AuditMode); err != nil {
 		return err
 	}
 
@@ -63,21 +69,41 @@ func (n *nft) Init() error {
 }
 
 func (n *nft) Add(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
 	n.decisionsToAdd = append(n.decisionsToAdd, decision)
 	return nil
 }
 
-func (n *nft) getBannedState() (map[string]struct{}, error) {
+// getBannedState returns the values in the sets, and the errors of the sets that can't be listed:
+// the decisions of the other family are still applied.
+func (n *nft) getBannedState() (map[string]struct{}, map[*nftContext]error) {
 	banned := make(map[string]struct{})
-	if err := n.v4.setBanned(banned); err != nil {
-		return nil, err
+	failed := make(map[*nftContext]error)
+
+	for _, c := range []*nftContext{n.v4, n.v6} {
+		if err := c.setBanned(banned); err != nil {
+			failed[c] = err
+		}
 	}
 
-	if err := n.v6.setBanned(banned); err != nil {
-		return nil, err
+	return banned, failed
+}
+
+// stateErrors returns the errors of the sets that couldn't be listed, for the number of
+// decisions of each one that were not applied.
+func (n *nft) stateErrors(action string, skipped map[*nftContext]int, failed map[*nftContext]error) []error {
+	var errs []error
+
+	for _, c := range []*nftContext{n.v4, n.v6} {
+		if skipped[c] > 0 {
+			errs = append(errs, fmt.Errorf("not %s %d ip%s elements, failed to get current state: %w", action, skipped[c], c.version, failed[c]))
+		}
 	}
 
-	return banned, nil
+	return errs
 }
 
 func (n *nft) reset() {
@@ -85,118 +111,137 @@ func (n *nft) reset() {
 	n.decisionsToDelete = make([]*models.Decision, 0)
 }
 
-func (n *nft) commitDeletedDecisions() error {
-	banned, err := n.getBannedState()
-	if err != nil {
-		return fmt.Errorf("failed to get current state: %w", err)
+// contextFor returns the context handling a canonical decision value.
+func (n *nft) contextFor(value string) *nftContext {
+	// already validated
+	if v6, _ := types.IsIPv6(value); v6 {
+		return n.v6
 	}
 
-	ip4 := []nftables.SetElement{}
-	ip6 := []nftables.SetElement{}
+	return n.v4
+}
+
+func (n *nft) commitDeletedDecisions() error {
+	banned, failed := n.getBannedState()
+	skipped := make(map[*nftContext]int)
+
+	ip4 := [][]nftables.SetElement{}
+	ip6 := [][]nftables.SetElement{}
 
 	n.decisionsToDelete = normalizedDecisions(n.decisionsToDelete)
 
 	for _, decision := range n.decisionsToDelete {
-		ip := net.ParseIP(*decision.Value)
-		if _, ok := banned[ip.String()]; !ok {
-			log.Debugf("not deleting %s since it's not in the set", ip)
+		value := *decision.Value
+
+		c := n.contextFor(value)
+		if _, ok := failed[c]; ok {
+			skipped[c]++
 			continue
 		}
 
-		if strings.Contains(ip.String(), ":") {
-			if n.v6.conn != nil {
-				log.Tracef("adding %s to buffer", ip)
+		if _, ok := banned[value]; !ok {
+			log.Debugf("not deleting %s since it's not in the set", value)
+			continue
+		}
 
-				ip6 = append(ip6, nftables.SetElement{Key: ip.To16()})
-			}
+		if c.conn == nil {
+			continue
+		}
 
+		els, err := c.setElements(value, 0)
+		if err != nil {
+			log.Errorf("not deleting %s: %s", value, err)
 			continue
 		}
 
-		if n.v4.conn != nil {
-			log.Tracef("adding %s to buffer", ip)
+		log.Tracef("adding %s to buffer", value)
 
-			ip4 = append(ip4, nftables.SetElement{Key: ip.To4()})
+		if c == n.v6 {
+			ip6 = append(ip6, els)
+		} else {
+			ip4 = append(ip4, els)
 		}
 	}
 
+	errs := n.stateErrors("deleting", skipped, failed)
+
 	if len(ip4) > 0 {
 		log.Debugf("removing %d ip%s elements from set", len(ip4), n.v4.version)
 		if err := n.v4.deleteElements(ip4); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 
 	if len(ip6) > 0 {
 		log.Debugf("removing %d ip%s elements from set", len(ip6), n.v6.version)
 		if err := n.v6.deleteElements(ip6); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (n *nft) commitAddedDecisions() error {
-	banned, err := n.getBannedState()
-	if err != nil {
-		return fmt.Errorf("failed to get current state: %w", err)
-	}
+	banned, failed := n.getBannedState()
+	skipped := make(map[*nftContext]int)
 
-	ip4 := []nftables.SetElement{}
-	ip6 := []nftables.SetElement{}
+	ip4 := [][]nftables.SetElement{}
+	ip6 := [][]nftables.SetElement{}
 
 	n.decisionsToAdd = normalizedDecisions(n.decisionsToAdd)
 
 	for _, decision := range n.decisionsToAdd {
-		ip := net.ParseIP(*decision.Value)
-		if _, ok := banned[ip.String()]; ok {
-			log.Debugf("not adding %s since it's already in the set", ip)
+		value := *decision.Value
+
+		c := n.contextFor(value)
+		if _, ok := failed[c]; ok {
+			skipped[c]++
 			continue
 		}
 
-		t, _ := time.ParseDuration(*decision.Duration)
+		if _, ok := banned[value]; ok {
+			log.Debugf("not adding %s since it's already in the set", value)
+			continue
+		}
+
+		if c.conn == nil {
+			continue
+		}
 
-		if strings.Contains(ip.String(), ":") {
-			if n.v6.conn != nil {
-				log.Tracef("adding %s to buffer", ip)
+		t, _ := time.ParseDuration(*decision.Duration)
 
-				ip6 = append(ip6, nftables.SetElement{Timeout: t, Key: ip.To16()})
-			}
+		// the kernel counts timeouts in milliseconds, and a zero timeout means the element never expires
+		if t < time.Millisecond {
+			log.Debugf("not adding %s since its decision has already expired (%s)", value, t)
+			continue
+		}
 
+		els, err := c.setElements(value, t)
+		if err != nil {
+			log.Errorf("not adding %s: %s", value, err)
 			continue
 		}
 
-		if n.v4.conn != nil {
-			log.Tracef("adding %s to buffer", ip)
+		log.Tracef("adding %s to buffer", value)
 
-			ip4 = append(ip4, nftables.SetElement{Timeout: t, Key: ip.To4()})
+		if c == n.v6 {
+			ip6 = append(ip6, els)
+		} else {
+			ip4 = append(ip4, els)
 		}
 	}
 
-	if err := n.v4.addElements(ip4); err != nil {
-		return err
-	}
+	errs := n.stateErrors("adding", skipped, failed)
 
-	if err := n.v6.addElements(ip6); err != nil {
-		return err
-	}
-
-	return nil
+	return errors.Join(append(errs, n.v4.addElements(ip4), n.v6.addElements(ip6))...)
 }
 
+// Commit applies the deletions then the additions to both sets, even if some of them fail.
 func (n *nft) Commit() error {
 	defer n.reset()
 
-	if err := n.commitDeletedDecisions(); err != nil {
-		return err
-	}
-
-	if err := n.commitAddedDecisions(); err != nil {
-		return err
-	}
-
-	return nil
+	return errors.Join(n.commitDeletedDecisions(), n.commitAddedDecisions())
 }
 
 // remove duplicates, normalize decision timeouts, keep the longest decision when dups are present.
@@ -205,13 +250,23 @@ func normalizedDecisions(decisions []*models.Decision) []*models.Decision {
 	finalDecisions := make([]*models.Decision, 0)
 
 	for _, d := range decisions {
-		t, err := time.ParseDuration(*d.Duration)
+		duration := defaultTimeout
+		if d.Duration != nil {
+			duration = *d.Duration
+		}
+
+		t, err := time.ParseDuration(duration)
 		if err != nil {
 			t, _ = time.ParseDuration(defaultTimeout)
 		}
 
-		*d.Value = strings.Split(*d.Value, "/")[0]
-		vals[*d.Value] = maxTime(t, vals[*d.Value])
+		value, err := types.CanonicalValue(*d.Value)
+		if err != nil {
+			log.Errorf("ignoring decision: %s", err)
+			continue
+		}
+
+		vals[value] = maxTime(t, vals[value])
 	}
 
 	for ip, duration := range vals {
@@ -228,20 +283,16 @@ func normalizedDecisions(decisions []*models.Decision) []*models.Decision {
 }
 
 func (n *nft) Delete(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
 	n.decisionsToDelete = append(n.decisionsToDelete, decision)
 	return nil
 }
 
 func (n *nft) ShutDown() error {
-	if err := n.v4.shutDown(); err != nil {
-		return err
-	}
-
-	if err := n.v6.shutDown(); err != nil {
-		return err
-	}
-
-	return nil
+	return errors.Join(n.v4.shutDown(), n.v6.shutDown())
 }
 
 func maxTime(a time.Duration, b time.Duration) time.Duration {
@@ -4,9 +4,14 @@
 package nftables
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
@@ -41,6 +46,15 @@ type nftContext struct {
 	chainName     string
 	tableName     string
 	setOnly       bool
+	dryRun        bool
+	// the rules only match the packets of this interface, if set
+	iface string
+	// flush_mode owned: the set-only set is shared, the bouncer removes its bans itself instead of flushing it
+	keepSet bool
+	// comment of the rules, if set
+	comment string
+	// accept the pings of the banned IPs before denying their traffic
+	allowEcho bool
 }
 
 // convert a binary representation of an IP (4 or 16 bytes) to a string.
@@ -48,6 +62,55 @@ func reprIP(ip []byte) string {
 	return net.IP(ip).String()
 }
 
+// nextIP returns the address following ip, and false if ip is the last address of its family.
+func nextIP(ip net.IP) (net.IP, bool) {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next, true
+		}
+	}
+
+	return nil, false
+}
+
+// rangeValue converts the interval [start, end) to a canonical decision value.
+// A nil end means the interval goes up to the last address of the family.
+func rangeValue(start net.IP, end net.IP) string {
+	bits := len(start) * 8
+
+	for ones := bits; ones >= 0; ones-- {
+		mask := net.CIDRMask(ones, bits)
+		if !start.Mask(mask).Equal(start) {
+			continue
+		}
+
+		last := make(net.IP, len(start))
+		for i := range start {
+			last[i] = start[i] | ^mask[i]
+		}
+
+		next, ok := nextIP(last)
+		if (end == nil && !ok) || (end != nil && ok && next.Equal(end)) {
+			if ones == bits {
+				return start.String()
+			}
+
+			return (&net.IPNet{IP: start, Mask: mask}).String()
+		}
+	}
+
+	// not a prefix, we didn't create it
+	if end == nil {
+		return start.String() + "-"
+	}
+
+	return start.String() + "-" + end.String()
+}
+
 func NewNFTV4Context(config *cfg.BouncerConfig) *nftContext {
 	if !*config.Nftables.Ipv4.Enabled {
 		log.Debug("nftables: ipv4 disabled")
@@ -69,6 +132,11 @@ func NewNFTV4Context(config *cfg.BouncerConfig) *nftContext {
 		blacklists:    config.BlacklistsIpv4,
 		setOnly:       config.Nftables.Ipv4.SetOnly,
 		priority:      config.Nftables.Ipv4.Priority,
+		dryRun:        config.DryRun,
+		iface:         config.Interface,
+		keepSet:       config.Nftables.Ipv4.SetOnly && config.FlushMode == cfg.FlushModeOwned,
+		comment:       config.RuleComment,
+		allowEcho:     config.AllowICMPEcho,
 	}
 
 	log.Debugf("nftables: ipv4: %t, table: %s, chain: %s, blacklist: %s, set-only: %t",
@@ -98,6 +166,11 @@ func NewNFTV6Context(config *cfg.BouncerConfig) *nftContext {
 		blacklists:    config.BlacklistsIpv6,
 		setOnly:       config.Nftables.Ipv6.SetOnly,
 		priority:      config.Nftables.Ipv6.Priority,
+		dryRun:        config.DryRun,
+		iface:         config.Interface,
+		keepSet:       config.Nftables.Ipv6.SetOnly && config.FlushMode == cfg.FlushModeOwned,
+		comment:       config.RuleComment,
+		allowEcho:     config.AllowICMPEcho,
 	}
 
 	log.Debugf("nftables: ipv6: %t, table6: %s, chain6: %s, blacklist: %s, set-only6: %t",
@@ -108,7 +181,7 @@ func NewNFTV6Context(config *cfg.BouncerConfig) *nftContext {
 
 // setBanned retrieves the list of banned IPs from the nftables set and adds them to the banned map.
 func (c *nftContext) setBanned(banned map[string]struct{}) error {
-	if c.conn == nil {
+	if c.conn == nil || c.dryRun {
 		return nil
 	}
 
@@ -117,13 +190,87 @@ func (c *nftContext) setBanned(banned map[string]struct{}) error {
 		return err
 	}
 
-	for _, el := range elements {
-		banned[net.IP(el.Key).String()] = struct{}{}
+	if !c.set.Interval {
+		for _, el := range elements {
+			banned[net.IP(el.Key).String()] = struct{}{}
+		}
+
+		return nil
+	}
+
+	// interval sets contain the start of each range, followed by the first address after it.
+	// When two ranges are adjacent, the end of the first one comes before the start of the next.
+	sort.Slice(elements, func(i, j int) bool {
+		if c := bytes.Compare(elements[i].Key, elements[j].Key); c != 0 {
+			return c < 0
+		}
+
+		return elements[i].IntervalEnd && !elements[j].IntervalEnd
+	})
+
+	for i, el := range elements {
+		if el.IntervalEnd {
+			continue
+		}
+
+		var end net.IP
+		if i+1 < len(elements) && elements[i+1].IntervalEnd {
+			end = elements[i+1].Key
+		}
+
+		banned[rangeValue(el.Key, end)] = struct{}{}
 	}
 
 	return nil
 }
 
+// setElements returns the elements to add or remove from the set for a canonical decision value.
+// Interval sets need the start of the range and the first address after it, flagged as interval end.
+func (c *nftContext) setElements(value string, timeout time.Duration) ([]nftables.SetElement, error) {
+	if !strings.Contains(value, "/") {
+		value += "/" + strconv.Itoa(int(c.payloadLength)*8)
+	}
+
+	_, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, err
+	}
+
+	start := ipnet.IP.To16()
+	if c.version == "v4" {
+		start = ipnet.IP.To4()
+	}
+
+	if start == nil {
+		return nil, fmt.Errorf("%s is not an ip%s range", value, c.version)
+	}
+
+	ones, bits := ipnet.Mask.Size()
+
+	// in dry-run mode the set is never created
+	if c.set != nil && !c.set.Interval {
+		if ones != bits {
+			return nil, fmt.Errorf("set '%s' doesn't support ranges (flags interval), can't add %s", c.set.Name, value)
+		}
+
+		return []nftables.SetElement{{Key: start, Timeout: timeout}}, nil
+	}
+
+	ret := []nftables.SetElement{{Key: start, Timeout: timeout}}
+
+	mask := net.CIDRMask(ones, bits)
+	last := make(net.IP, len(start))
+	for i := range start {
+		last[i] = start[i] | ^mask[i]
+	}
+
+	if end, ok := nextIP(last); ok {
+		ret = append(ret, nftables.SetElement{Key: end, IntervalEnd: true})
+	}
+
+	return ret, nil
+}
+
 func (c *nftContext) initSetOnly() error {
 	var err error
 
@@ -144,6 +291,7 @@ func (c *nftContext) initSetOnly() error {
 			Table:      c.table,
 			KeyType:    c.typeIPAddr,
 			HasTimeout: true,
+			Interval:   true,
 		}
 
 		if err := c.conn.AddSet(set, []nftables.SetElement{}); err != nil {
@@ -161,7 +309,7 @@ func (c *nftContext) initSetOnly() error {
 	return nil
 }
 
-func (c *nftContext) initOwnTable(hooks []string, denyLog bool, denyLogPrefix string, denyAction string) error {
+func (c *nftContext) initOwnTable(hooks []string, denyLog bool, denyLogPrefix string, denyAction string, audit bool) error {
 	log.Debugf("nftables: ip%s own table", c.version)
 
 	c.table = c.conn.AddTable(&nftables.Table{
@@ -174,6 +322,7 @@ func (c *nftContext) initOwnTable(hooks []string, denyLog bool, denyLogPrefix st
 		Table:      c.table,
 		KeyType:    c.typeIPAddr,
 		HasTimeout: true,
+		Interval:   true,
 	}
 
 	if err := c.conn.AddSet(set, []nftables.SetElement{}); err != nil {
@@ -191,8 +340,17 @@ func (c *nftContext) initOwnTable(hooks []string, denyLog bool, denyLogPrefix st
 			Priority: nftables.ChainPriority(c.priority),
 		})
 
+		// the chain is kept by a shutdown without flush, replace its rule
+		c.conn.FlushChain(chain)
+
 		log.Debugf("nftables: ip%s chain '%s' created", c.version, chain.Name)
-		r := c.createRule(chain, set, denyLog, denyLogPrefix, denyAction)
+
+		// the rules are evaluated in the order they are added, an audit chain only counts the packets
+		if c.allowEcho && !audit {
+			c.conn.AddRule(c.createEchoRule(chain, set))
+		}
+
+		r := c.createRule(chain, set, denyLog, denyLogPrefix, denyAction, audit)
 		c.conn.AddRule(r)
 	}
 
@@ -205,19 +363,24 @@ func (c *nftContext) initOwnTable(hooks []string, denyLog bool, denyLogPrefix st
 	return nil
 }
 
-func (c *nftContext) init(hooks []string, denyLog bool, denyLogPrefix string, denyAction string) error {
+func (c *nftContext) init(hooks []string, denyLog bool, denyLogPrefix string, denyAction string, audit bool) error {
 	if c.conn == nil {
 		return nil
 	}
 
 	log.Debugf("nftables: ip%s init starting", c.version)
 
+	if c.dryRun {
+		log.Infof("dry-run: not creating ip%s table '%s', chain '%s' and set '%s'", c.version, c.tableName, c.chainName, c.blacklists)
+		return nil
+	}
+
 	var err error
 
 	if c.setOnly {
 		err = c.initSetOnly()
 	} else {
-		err = c.initOwnTable(hooks, denyLog, denyLogPrefix, denyAction)
+		err = c.initOwnTable(hooks, denyLog, denyLogPrefix, denyAction, audit)
 	}
 
 	if err != nil && strings.Contains(err.Error(), "out of range") {
@@ -244,14 +407,54 @@ func (c *nftContext) lookupTable() (*nftables.Table, error) {
 	return nil, fmt.Errorf("nftables: could not find table '%s'", c.tableName)
 }
 
-func (c *nftContext) createRule(chain *nftables.Chain, set *nftables.Set,
-	denyLog bool, denyLogPrefix string, denyAction string,
-) *nftables.Rule {
+// ruleComment returns the user data of a rule holding a comment, as the nft command writes
+// it: a NFTNL_UDATA_RULE_COMMENT attribute with the zero terminated text.
+func ruleComment(comment string) []byte {
+	const udataRuleComment = 0
+
+	b := []byte{udataRuleComment, byte(len(comment) + 1)}
+	b = append(b, comment...)
+
+	return append(b, 0)
+}
+
+// ifname returns an interface name as nftables compares it, padded with zeros to IFNAMSIZ.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+
+	return b
+}
+
+// newRule returns a rule of the chain matching the packets of the interface, if any,
+// coming from the IPs of the set.
+func (c *nftContext) newRule(chain *nftables.Chain, set *nftables.Set) *nftables.Rule {
 	r := &nftables.Rule{
 		Table: c.table,
 		Chain: chain,
 		Exprs: []expr.Any{},
 	}
+
+	if c.comment != "" {
+		r.UserData = ruleComment(c.comment)
+	}
+
+	if c.iface != "" {
+		// [ meta load iifname => reg 1 ], the output hooks only know the interface the packets leave from
+		key := expr.MetaKeyIIFNAME
+		if chain.Hooknum == nftables.ChainHookOutput || chain.Hooknum == nftables.ChainHookPostrouting {
+			key = expr.MetaKeyOIFNAME
+		}
+
+		r.Exprs = append(r.Exprs, &expr.Meta{Key: key, Register: 1})
+		// [ cmp eq reg 1 "eth0\x00..." ], the names are compared on IFNAMSIZ bytes
+		r.Exprs = append(r.Exprs, &expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifname(c.iface),
+		})
+	}
+
 	// [ payload load 4b @ network header + 16 => reg 1 ]
 	r.Exprs = append(r.Exprs, &expr.Payload{
 		DestRegister: 1,
@@ -266,6 +469,42 @@ func (c *nftContext) createRule(chain *nftables.Chain, set *nftables.Set,
 		SetID:          set.ID,
 	})
 
+	return r
+}
+
+// createEchoRule returns the rule accepting the ICMP echo requests of the banned IPs. It has
+// no counter, the metrics read the one of the rule denying the traffic.
+func (c *nftContext) createEchoRule(chain *nftables.Chain, set *nftables.Set) *nftables.Rule {
+	proto, echoRequest := byte(unix.IPPROTO_ICMP), byte(8)
+	if c.version == "v6" {
+		proto, echoRequest = byte(unix.IPPROTO_ICMPV6), byte(128)
+	}
+
+	r := c.newRule(chain, set)
+
+	// [ meta load l4proto => reg 1 ]
+	r.Exprs = append(r.Exprs, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1})
+	// [ cmp eq reg 1 0x00000001 ]
+	r.Exprs = append(r.Exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}})
+	// [ payload load 1b @ transport header + 0 => reg 1 ], the ICMP type
+	r.Exprs = append(r.Exprs, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       0,
+		Len:          1,
+	})
+	// [ cmp eq reg 1 0x00000008 ]
+	r.Exprs = append(r.Exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{echoRequest}})
+	r.Exprs = append(r.Exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+
+	return r
+}
+
+func (c *nftContext) createRule(chain *nftables.Chain, set *nftables.Set,
+	denyLog bool, denyLogPrefix string, denyAction string, audit bool,
+) *nftables.Rule {
+	r := c.newRule(chain, set)
+
 	r.Exprs = append(r.Exprs, &expr.Counter{})
 
 	if denyLog {
@@ -275,12 +514,15 @@ func (c *nftContext) createRule(chain *nftables.Chain, set *nftables.Set,
 		})
 	}
 
-	if strings.EqualFold(denyAction, "REJECT") {
+	// in audit mode, the rule only counts the packets matching the set
+	switch {
+	case audit:
+	case strings.EqualFold(denyAction, "REJECT"):
 		r.Exprs = append(r.Exprs, &expr.Reject{
 			Type: unix.NFT_REJECT_ICMP_UNREACH,
 			Code: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED,
 		})
-	} else {
+	default:
 		r.Exprs = append(r.Exprs, &expr.Verdict{
 			Kind: expr.VerdictDrop,
 		})
@@ -289,32 +531,60 @@ func (c *nftContext) createRule(chain *nftables.Chain, set *nftables.Set,
 	return r
 }
 
-func (c *nftContext) deleteElementChunk(els []nftables.SetElement) error {
-	if err := c.conn.SetDeleteElements(c.set, els); err != nil {
+// flatten concatenates the elements of several decisions.
+func flatten(groups [][]nftables.SetElement) []nftables.SetElement {
+	ret := []nftables.SetElement{}
+	for _, g := range groups {
+		ret = append(ret, g...)
+	}
+
+	return ret
+}
+
+// deleteElementChunk removes the elements of a chunk of decisions, each group
+// holding the elements of a single decision.
+func (c *nftContext) deleteElementChunk(groups [][]nftables.SetElement) error {
+	if err := c.conn.SetDeleteElements(c.set, flatten(groups)); err != nil {
 		return fmt.Errorf("failed to remove ip%s elements from set: %w", c.version, err)
 	}
 	if err := c.conn.Flush(); err != nil {
-		if len(els) == 1 {
-			log.Debugf("deleting %s, failed to flush: %s", reprIP(els[0].Key), err)
-			return nil
+		// the element is not in the set, ie. it expired or the set was flushed
+		missing := errors.Is(err, unix.ENOENT)
+		if len(groups) == 1 {
+			if missing {
+				log.Debugf("deleting %s, not in the ip%s set", reprIP(groups[0][0].Key), c.version)
+				return nil
+			}
+			return fmt.Errorf("failed to remove %s from ip%s set: %w", reprIP(groups[0][0].Key), c.version, err)
 		}
-		log.Infof("failed to flush chunk of %d elements, will retry each one: %s", len(els), err)
-		for _, el := range els {
-			if err := c.deleteElementChunk([]nftables.SetElement{el}); err != nil {
-				return err
+		if missing {
+			log.Debugf("some of the %d elements are not in the ip%s set, will delete each one: %s", len(groups), c.version, err)
+		} else {
+			log.Infof("failed to flush chunk of %d elements, will retry each one: %s", len(groups), err)
+		}
+		var errs []error
+		for _, g := range groups {
+			if err := c.deleteElementChunk([][]nftables.SetElement{g}); err != nil {
+				errs = append(errs, err)
 			}
 		}
+		return errors.Join(errs...)
 	}
 	return nil
 }
 
-func (c *nftContext) deleteElements(els []nftables.SetElement) error {
-	if len(els) <= chunkSize {
-		return c.deleteElementChunk(els)
+func (c *nftContext) deleteElements(groups [][]nftables.SetElement) error {
+	if c.dryRun {
+		log.Infof("dry-run: not removing %d ip%s elements from set '%s'", len(groups), c.version, c.blacklists)
+		return nil
 	}
 
-	log.Debugf("splitting %d elements into chunks of %d", len(els), chunkSize)
-	for _, chunk := range slicetools.Chunks(els, chunkSize) {
+	if len(groups) <= chunkSize {
+		return c.deleteElementChunk(groups)
+	}
+
+	log.Debugf("splitting %d elements into chunks of %d", len(groups), chunkSize)
+	for _, chunk := range slicetools.Chunks(groups, chunkSize) {
 		if err := c.deleteElementChunk(chunk); err != nil {
 			return err
 		}
@@ -322,20 +592,53 @@ func (c *nftContext) deleteElements(els []nftables.SetElement) error {
 	return nil
 }
 
-func (c *nftContext) addElements(els []nftables.SetElement) error {
-	for _, chunk := range slicetools.Chunks(els, chunkSize) {
-		log.Debugf("adding %d ip%s elements to set", len(chunk), c.version)
+// addElementChunk adds the elements of a chunk of decisions. If the chunk is
+// rejected, for example because of overlapping ranges, each decision is retried
+// on its own so that a single conflict doesn't prevent the others from being applied.
+func (c *nftContext) addElementChunk(groups [][]nftables.SetElement) error {
+	log.Debugf("adding %d ip%s elements to set", len(groups), c.version)
+
+	if err := c.conn.SetAddElements(c.set, flatten(groups)); err != nil {
+		return fmt.Errorf("failed to add ip%s elements to set: %w", c.version, err)
+	}
 
-		if err := c.conn.SetAddElements(c.set, chunk); err != nil {
-			return fmt.Errorf("failed to add ip%s elements to set: %w", c.version, err)
+	err := c.conn.Flush()
+	if err == nil {
+		return nil
+	}
+
+	if len(groups) == 1 {
+		return fmt.Errorf("failed to add %s to ip%s set: %w", reprIP(groups[0][0].Key), c.version, err)
+	}
+
+	log.Infof("failed to flush chunk of %d elements, will retry each one: %s", len(groups), err)
+
+	var errs []error
+	for _, g := range groups {
+		if err := c.addElementChunk([][]nftables.SetElement{g}); err != nil {
+			errs = append(errs, err)
 		}
+	}
 
-		if err := c.conn.Flush(); err != nil {
-			return fmt.Errorf("failed to flush ip%s conn: %w", c.version, err)
+	return errors.Join(errs...)
+}
+
+func (c *nftContext) addElements(groups [][]nftables.SetElement) error {
+	if c.dryRun {
+		if len(groups) > 0 {
+			log.Infof("dry-run: not adding %d ip%s elements to set '%s'", len(groups), c.version, c.blacklists)
 		}
+		return nil
 	}
 
-	return nil
+	var errs []error
+	for _, chunk := range slicetools.Chunks(groups, chunkSize) {
+		if err := c.addElementChunk(chunk); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func (c *nftContext) shutDown() error {
@@ -343,6 +646,22 @@ func (c *nftContext) shutDown() error {
 		return nil
 	}
 
+	if c.dryRun {
+		log.Infof("dry-run: not removing ip%s table '%s'", c.version, c.tableName)
+		return nil
+	}
+
+	if c.keepSet {
+		log.Infof("leaving the other elements of ip%s set '%s' in place", c.version, c.blacklists)
+		return nil
+	}
+
+	if c.set != nil {
+		if elements, err := c.conn.GetSetElements(c.set); err == nil {
+			log.Infof("%d elements removed from ip%s set '%s'", len(elements), c.version, c.set.Name)
+		}
+	}
+
 	if c.setOnly {
 		// Flush blacklist4 set empty
 		log.Infof("flushing '%s' set in '%s' table", c.set.Name, c.table.Name)
@@ -0,0 +1,331 @@
+//go:build linux && integration
+// +build linux,integration
+
+package nftables
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	gonftables "github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// testConfig uses tables of their own, not to disturb the ones of a running bouncer.
+const testConfig = `mode: nftables
+nftables:
+  ipv4:
+    table: crowdsec-test
+    chain: crowdsec-test-chain
+  ipv6:
+    table: crowdsec6-test
+    chain: crowdsec6-test-chain
+`
+
+// newTestNFTables returns an initialized backend, or skips the test without the privileges
+// to change the nftables ruleset. The tables are removed at the end of the test.
+func newTestNFTables(t *testing.T, extra string) *nft {
+	t.Helper()
+
+	config, err := cfg.NewConfig(strings.NewReader(testConfig + extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewNFTables(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := backend.(*nft)
+
+	if err := n.Init(); err != nil {
+		if errors.Is(err, os.ErrPermission) || strings.Contains(err.Error(), "operation not permitted") {
+			t.Skipf("can't change the nftables ruleset: %s", err)
+		}
+
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := n.ShutDown(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return n
+}
+
+func newDecision(value string, duration string) *models.Decision {
+	return &models.Decision{Value: &value, Duration: &duration}
+}
+
+// listed returns the sorted values in the sets.
+func listed(t *testing.T, n *nft) []string {
+	t.Helper()
+
+	entries, err := n.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := []string{}
+	for _, e := range entries {
+		ret = append(ret, e.Value)
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+func TestElementTimeout(t *testing.T) {
+	n := newTestNFTables(t, "")
+
+	for value, duration := range map[string]string{"192.0.2.1": "1s", "192.0.2.2": "1h", "192.0.2.3": "0s", "192.0.2.4": "-5s"} {
+		if err := n.Add(newDecision(value, duration)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := n.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the expired decisions are not added, a zero timeout would never expire
+	if got := strings.Join(listed(t, n), ","); got != "192.0.2.1,192.0.2.2" {
+		t.Fatalf("the sets hold %s", got)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	// removed by the kernel
+	if got := strings.Join(listed(t, n), ","); got != "192.0.2.2" {
+		t.Fatalf("the sets hold %s after the timeout", got)
+	}
+}
+
+func TestDeleteMissingElement(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+
+	n := newTestNFTables(t, "")
+
+	// loading the configuration sets the log level
+	log.SetLevel(log.DebugLevel)
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := n.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := n.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	// not in the sets when they are listed
+	for _, value := range []string{"192.0.2.3", "2001:db8::1"} {
+		if err := n.Delete(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := n.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// gone since they were listed, ie. expired: alone, then in a chunk with elements that are there
+	groups := func(values ...string) [][]gonftables.SetElement {
+		ret := [][]gonftables.SetElement{}
+
+		for _, value := range values {
+			els, err := n.v4.setElements(value, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ret = append(ret, els)
+		}
+
+		return ret
+	}
+
+	if err := n.v4.deleteElementChunk(groups("192.0.2.4")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.v4.deleteElementChunk(groups("192.0.2.1", "192.0.2.4", "192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := listed(t, n); len(got) != 0 {
+		t.Fatalf("the sets hold %v", got)
+	}
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.InfoLevel {
+			t.Fatalf("logged at %s: %s", entry.Level, entry.Message)
+		}
+	}
+}
+
+func TestCommitOneSetFails(t *testing.T) {
+	n := newTestNFTables(t, "")
+
+	if err := n.Add(newDecision("2001:db8::1", "1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ipv4 set can't be listed nor changed anymore
+	set := n.v4.set
+	n.v4.set = &gonftables.Set{Table: set.Table, Name: "crowdsec-test-missing", KeyType: set.KeyType}
+	defer func() { n.v4.set = set }()
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::2"} {
+		if err := n.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := n.Delete(newDecision("2001:db8::1", "1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := n.Commit()
+	if err == nil || !strings.Contains(err.Error(), "not adding 1 ipv4 elements") {
+		t.Fatalf("commit returned %v", err)
+	}
+
+	// the ipv6 set was updated anyway
+	if got := strings.Join(listed6(t, n), ","); got != "2001:db8::2" {
+		t.Fatalf("the ipv6 set holds %s", got)
+	}
+}
+
+// listed6 returns the sorted values in the ipv6 set.
+func listed6(t *testing.T, n *nft) []string {
+	t.Helper()
+
+	banned := make(map[string]struct{})
+	if err := n.v6.setBanned(banned); err != nil {
+		t.Fatal(err)
+	}
+
+	ret := []string{}
+	for value := range banned {
+		ret = append(ret, value)
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+func TestDecisionWithoutDuration(t *testing.T) {
+	n := newTestNFTables(t, "")
+
+	value := "192.0.2.1"
+	if err := n.Add(&models.Decision{Value: &value}); err != nil {
+		t.Fatal(err)
+	}
+
+	// applied with the default timeout
+	if err := n.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(listed(t, n), ","); got != value {
+		t.Fatalf("the sets hold %s", got)
+	}
+}
+
+func TestIPv6Only(t *testing.T) {
+	n := newTestNFTables(t, "disable_ipv4: true\n")
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::1"} {
+		if err := n.Add(newDecision(value, "1h")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := n.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(listed(t, n), ","); got != "2001:db8::1" {
+		t.Fatalf("the sets hold %s", got)
+	}
+}
+
+// verdicts returns the verdicts of the rules of the chains of a context, in their order.
+func verdicts(t *testing.T, c *nftContext) []string {
+	t.Helper()
+
+	chains, err := c.conn.ListChainsOfTableFamily(c.tableFamily)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := []string{}
+
+	for _, chain := range chains {
+		if chain.Table.Name != c.tableName {
+			continue
+		}
+
+		rules, err := c.conn.GetRules(chain.Table, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range rules {
+			verdict := "none"
+			if v, ok := r.Exprs[len(r.Exprs)-1].(*expr.Verdict); ok {
+				verdict = map[expr.VerdictKind]string{expr.VerdictAccept: "accept", expr.VerdictDrop: "drop"}[v.Kind]
+			}
+
+			ret = append(ret, verdict)
+		}
+	}
+
+	return ret
+}
+
+func TestEchoRuleOrder(t *testing.T) {
+	n := newTestNFTables(t, "allow_icmp_echo: true\n")
+
+	// the pings are accepted before the traffic of the set is dropped, in both families
+	for _, c := range []*nftContext{n.v4, n.v6} {
+		if got := strings.Join(verdicts(t, c), ","); got != "accept,drop" {
+			t.Fatalf("ip%s rules: %s, want accept,drop", c.version, got)
+		}
+	}
+}
+
+func TestEchoRuleAudit(t *testing.T) {
+	n := newTestNFTables(t, "allow_icmp_echo: true\naudit_mode: true\n")
+
+	// an audit rule doesn't change the verdict, neither do the pings
+	for _, c := range []*nftContext{n.v4, n.v6} {
+		if got := strings.Join(verdicts(t, c), ","); got != "none" {
+			t.Fatalf("ip%s rules: %s, want a single rule without verdict", c.version, got)
+		}
+	}
+}
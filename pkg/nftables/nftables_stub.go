@@ -4,10 +4,12 @@
 package nftables
 
 import (
+	"fmt"
+
 	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
 	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
 func NewNFTables(config *cfg.BouncerConfig) (types.Backend, error) {
-	return nil, nil
+	return nil, fmt.Errorf("nftables backend is not supported on this platform")
 }
@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+package nftables
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+func TestMalformedDecision(t *testing.T) {
+	n := &nft{}
+
+	for _, d := range []*models.Decision{nil, {}} {
+		if err := n.Add(d); err == nil {
+			t.Fatalf("added %+v", d)
+		}
+
+		if err := n.Delete(d); err == nil {
+			t.Fatalf("deleted %+v", d)
+		}
+	}
+}
+
+func TestRangeValue(t *testing.T) {
+	for _, tc := range []struct {
+		start string
+		end   string
+		want  string
+	}{
+		{"192.0.2.1", "192.0.2.2", "192.0.2.1"},
+		{"192.0.2.0", "192.0.3.0", "192.0.2.0/24"},
+		{"2001:db8::", "2001:db9::", "2001:db8::/32"},
+		// not a prefix
+		{"192.0.2.1", "192.0.2.3", "192.0.2.1-192.0.2.3"},
+		// up to the last address of the family
+		{"255.255.255.0", "", "255.255.255.0/24"},
+		{"0.0.0.0", "", "0.0.0.0/0"},
+	} {
+		start := net.ParseIP(tc.start).To4()
+		if start == nil {
+			start = net.ParseIP(tc.start)
+		}
+
+		var end net.IP
+		if tc.end != "" {
+			end = net.ParseIP(tc.end)
+			if v4 := end.To4(); v4 != nil {
+				end = v4
+			}
+		}
+
+		if got := rangeValue(start, end); got != tc.want {
+			t.Fatalf("[%s, %s): %s, want %s", tc.start, tc.end, got, tc.want)
+		}
+	}
+}
+
+func TestSetElements(t *testing.T) {
+	v4 := &nftContext{version: "v4", payloadLength: 4, set: &nftables.Set{Name: "crowdsec-blacklists", Interval: true}}
+	v6 := &nftContext{version: "v6", payloadLength: 16, set: &nftables.Set{Name: "crowdsec6-blacklists", Interval: true}}
+
+	for _, tc := range []struct {
+		c     *nftContext
+		value string
+		// the keys of the elements, the second one ending the interval
+		want []string
+	}{
+		{v4, "192.0.2.1", []string{"192.0.2.1", "192.0.2.2"}},
+		{v4, "192.0.2.0/24", []string{"192.0.2.0", "192.0.3.0"}},
+		{v6, "2001:db8::/32", []string{"2001:db8::", "2001:db9::"}},
+		// nothing after the last address
+		{v4, "255.255.255.0/24", []string{"255.255.255.0"}},
+	} {
+		els, err := tc.c.setElements(tc.value, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.value, err)
+		}
+
+		if len(els) != len(tc.want) {
+			t.Fatalf("%s: %d elements, want %d", tc.value, len(els), len(tc.want))
+		}
+
+		for i, el := range els {
+			if !bytes.Equal(el.Key, ipBytes(tc.want[i])) || el.IntervalEnd != (i == 1) {
+				t.Fatalf("%s: element %d is %v (end %v), want %s", tc.value, i, net.IP(el.Key), el.IntervalEnd, tc.want[i])
+			}
+		}
+	}
+
+	// the family of the context
+	if _, err := v4.setElements("2001:db8::1", 0); err == nil {
+		t.Fatal("an ipv6 address is turned into ipv4 elements")
+	}
+
+	// a set without the interval flag only holds addresses
+	v4.set.Interval = false
+
+	if els, err := v4.setElements("192.0.2.1", 0); err != nil || len(els) != 1 {
+		t.Fatalf("%d elements for an address, %v", len(els), err)
+	}
+
+	if _, err := v4.setElements("192.0.2.0/24", 0); err == nil {
+		t.Fatal("a range is added to a set without the interval flag")
+	}
+}
+
+// ipBytes returns an address on the length of its family.
+func ipBytes(s string) []byte {
+	ip := net.ParseIP(s)
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+
+	return ip
+}
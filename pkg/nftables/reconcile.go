@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package nftables
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// missing tells whether the table or the set of the context have been removed.
+func (c *nftContext) missing() bool {
+	if c.conn == nil || c.dryRun {
+		return false
+	}
+
+	table, err := c.lookupTable()
+	if err != nil {
+		return true
+	}
+
+	if _, err := c.conn.GetSetByName(table, c.blacklists); err != nil {
+		return true
+	}
+
+	return false
+}
+
+// recreate creates the table, or the set in set-only mode, again.
+func (c *nftContext) recreate(hooks []string, denyLog bool, denyLogPrefix string, denyAction string, audit bool) error {
+	if !c.setOnly {
+		// the set may be gone while the table remains, start from scratch
+		if table, err := c.lookupTable(); err == nil {
+			c.conn.DelTable(table)
+			if err := c.conn.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.init(hooks, denyLog, denyLogPrefix, denyAction, audit)
+}
+
+func (n *nft) Missing() (bool, error) {
+	return n.v4.missing() || n.v6.missing(), nil
+}
+
+func (n *nft) Recreate() error {
+	for _, c := range []*nftContext{n.v4, n.v6} {
+		if !c.missing() {
+			continue
+		}
+
+		log.Infof("nftables: creating ip%s table '%s' again", c.version, c.tableName)
+
+		if err := c.recreate(n.Hooks, n.DenyLog, n.DenyLogPrefix, n.DenyAction, n.AuditMode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package nftables
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestRuleInterface(t *testing.T) {
+	c := &nftContext{iface: "eth0", payloadOffset: 12, payloadLength: 4}
+	set := &nftables.Set{Name: "crowdsec-blacklists", ID: 1}
+
+	for hook, key := range map[nftables.ChainHook]expr.MetaKey{
+		nftables.ChainHookInput:       expr.MetaKeyIIFNAME,
+		nftables.ChainHookPrerouting:  expr.MetaKeyIIFNAME,
+		nftables.ChainHookForward:     expr.MetaKeyIIFNAME,
+		nftables.ChainHookOutput:      expr.MetaKeyOIFNAME,
+		nftables.ChainHookPostrouting: expr.MetaKeyOIFNAME,
+	} {
+		r := c.newRule(&nftables.Chain{Name: "crowdsec-chain", Hooknum: hook}, set)
+
+		if len(r.Exprs) != 4 {
+			t.Fatalf("hook %d: %d expressions, want the interface, payload and lookup ones", hook, len(r.Exprs))
+		}
+
+		meta, ok := r.Exprs[0].(*expr.Meta)
+		if !ok || meta.Key != key {
+			t.Fatalf("hook %d: the rule doesn't start with the interface, %+v", hook, r.Exprs[0])
+		}
+
+		cmp, ok := r.Exprs[1].(*expr.Cmp)
+		if !ok || cmp.Op != expr.CmpOpEq || !bytes.Equal(cmp.Data, ifname("eth0")) || len(cmp.Data) != 16 {
+			t.Fatalf("hook %d: the interface isn't compared on IFNAMSIZ bytes, %+v", hook, r.Exprs[1])
+		}
+
+		if lookup, ok := r.Exprs[3].(*expr.Lookup); !ok || lookup.SetName != set.Name {
+			t.Fatalf("hook %d: the rule doesn't look up the set, %+v", hook, r.Exprs[3])
+		}
+	}
+}
+
+func TestRuleWithoutInterface(t *testing.T) {
+	c := &nftContext{payloadOffset: 12, payloadLength: 4}
+	r := c.newRule(&nftables.Chain{Name: "crowdsec-chain", Hooknum: nftables.ChainHookInput}, &nftables.Set{Name: "crowdsec-blacklists"})
+
+	if len(r.Exprs) != 2 {
+		t.Fatalf("%d expressions, want the payload and lookup ones", len(r.Exprs))
+	}
+
+	if _, ok := r.Exprs[0].(*expr.Payload); !ok {
+		t.Fatalf("the rule starts with %+v", r.Exprs[0])
+	}
+}
+
+func TestRuleComment(t *testing.T) {
+	for comment, want := range map[string][]byte{
+		"":         {0, 1, 0},
+		"crowdsec": {0, 9, 'c', 'r', 'o', 'w', 'd', 's', 'e', 'c', 0},
+	} {
+		if got := ruleComment(comment); !bytes.Equal(got, want) {
+			t.Fatalf("%q: user data %v, want %v", comment, got, want)
+		}
+	}
+
+	chain := &nftables.Chain{Name: "crowdsec-chain", Hooknum: nftables.ChainHookInput}
+	set := &nftables.Set{Name: "crowdsec-blacklists"}
+
+	c := &nftContext{comment: "crowdsec", payloadOffset: 12, payloadLength: 4}
+	if r := c.newRule(chain, set); !bytes.Equal(r.UserData, ruleComment("crowdsec")) {
+		t.Fatalf("the rule holds the user data %v", r.UserData)
+	}
+
+	// without a comment, the rule has no user data
+	c.comment = ""
+	if r := c.newRule(chain, set); r.UserData != nil {
+		t.Fatalf("the rule holds the user data %v", r.UserData)
+	}
+}
+
+func TestEchoRule(t *testing.T) {
+	set := &nftables.Set{Name: "crowdsec-blacklists"}
+	chain := &nftables.Chain{Name: "crowdsec-chain", Hooknum: nftables.ChainHookInput}
+
+	for version, want := range map[string][2]byte{"v4": {unix.IPPROTO_ICMP, 8}, "v6": {unix.IPPROTO_ICMPV6, 128}} {
+		c := &nftContext{version: version, payloadOffset: 12, payloadLength: 4}
+		r := c.createEchoRule(chain, set)
+
+		// payload, lookup, then the protocol and the type of the ICMP message
+		if len(r.Exprs) != 7 {
+			t.Fatalf("%s: %d expressions", version, len(r.Exprs))
+		}
+
+		if proto, ok := r.Exprs[3].(*expr.Cmp); !ok || !bytes.Equal(proto.Data, []byte{want[0]}) {
+			t.Fatalf("%s: the protocol isn't matched, %+v", version, r.Exprs[3])
+		}
+
+		if echo, ok := r.Exprs[5].(*expr.Cmp); !ok || !bytes.Equal(echo.Data, []byte{want[1]}) {
+			t.Fatalf("%s: the echo request isn't matched, %+v", version, r.Exprs[5])
+		}
+
+		if verdict, ok := r.Exprs[6].(*expr.Verdict); !ok || verdict.Kind != expr.VerdictAccept {
+			t.Fatalf("%s: the echo requests aren't accepted, %+v", version, r.Exprs[6])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/expr"
+)
+
+// setUsed tells whether a rule of the table looks up addresses in the set.
+func (c *nftContext) setUsed() (bool, error) {
+	chains, err := c.conn.ListChainsOfTableFamily(c.table.Family)
+	if err != nil {
+		return false, err
+	}
+
+	for _, chain := range chains {
+		if chain.Table.Name != c.table.Name {
+			continue
+		}
+
+		rules, err := c.conn.GetRules(c.table, chain)
+		if err != nil {
+			return false, err
+		}
+
+		for _, rule := range rules {
+			for _, e := range rule.Exprs {
+				if lookup, ok := e.(*expr.Lookup); ok && lookup.SetName == c.blacklists {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// SelfTest makes sure a rule uses each set, which matters in set-only mode since
+// the rules are then managed by the user.
+func (n *nft) SelfTest() error {
+	for _, c := range []*nftContext{n.v4, n.v6} {
+		if c.conn == nil || c.dryRun {
+			continue
+		}
+
+		used, err := c.setUsed()
+		if err != nil {
+			return fmt.Errorf("nftables: unable to list the rules of table '%s': %w", c.tableName, err)
+		}
+
+		if !used {
+			return fmt.Errorf("nftables: no rule of table '%s' uses the set '%s'", c.tableName, c.blacklists)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/metrics"
+)
+
+const (
+	defaultQueueSize = 100
+	timeout          = 10 * time.Second
+)
+
+// Event describes a ban applied to the firewall.
+type Event struct {
+	Value    string `json:"value"`
+	Scope    string `json:"scope,omitempty"`
+	Scenario string `json:"scenario,omitempty"`
+	Origin   string `json:"origin,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Backend  string `json:"backend"`
+}
+
+// Notifier sends the bans to a command (on its standard input) or an HTTP endpoint,
+// in the background. Events are dropped when the queue is full.
+type Notifier struct {
+	command string
+	url     string
+	backend string
+	queue   chan Event
+	client  *http.Client
+}
+
+// New returns nil if no notification is configured, a nil Notifier ignores all events.
+func New(config *cfg.BouncerConfig) *Notifier {
+	if config.Notifier.Command == "" && config.Notifier.URL == "" {
+		return nil
+	}
+
+	size := config.Notifier.QueueSize
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+
+	return &Notifier{
+		command: config.Notifier.Command,
+		url:     config.Notifier.URL,
+		backend: config.Mode,
+		queue:   make(chan Event, size),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func newEvent(d *models.Decision, backend string) Event {
+	e := Event{
+		Value:   *d.Value,
+		Backend: backend,
+	}
+
+	if d.Scope != nil {
+		e.Scope = *d.Scope
+	}
+
+	if d.Scenario != nil {
+		e.Scenario = *d.Scenario
+	}
+
+	if d.Origin != nil {
+		e.Origin = *d.Origin
+	}
+
+	if d.Duration != nil {
+		e.Duration = *d.Duration
+	}
+
+	return e
+}
+
+// Banned queues the notification of a ban, without blocking.
+func (n *Notifier) Banned(d *models.Decision) {
+	if n == nil {
+		return
+	}
+
+	select {
+	case n.queue <- newEvent(d, n.backend):
+	default:
+		metrics.TotalDroppedNotifications.Inc()
+		log.Debugf("notification queue is full, dropping notification for '%s'", *d.Value)
+	}
+}
+
+// send delivers an event to the command and the URL, a failure of one doesn't prevent
+// the other. Each of them has its own timeout.
+func (n *Notifier) send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	if n.command != "" {
+		errs = append(errs, n.runCommand(body))
+	}
+
+	if n.url != "" {
+		errs = append(errs, n.post(body))
+	}
+
+	return errors.Join(errs...)
+}
+
+// runCommand gives the event to the command on its standard input.
+func (n *Notifier) runCommand(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.command)
+	cmd.Stdin = bytes.NewReader(body)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w --> %s", n.command, err, out)
+	}
+
+	return nil
+}
+
+// post sends the event to the URL.
+func (n *Notifier) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: unexpected response status %d", n.url, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Run sends the queued notifications until the context is done.
+func (n *Notifier) Run(ctx context.Context) {
+	if n == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-n.queue:
+			if err := n.send(e); err != nil {
+				log.Errorf("unable to send notification for '%s': %s", e.Value, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package notifier
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+func newTestNotifier(t *testing.T, command string) (*Notifier, chan Event) {
+	t.Helper()
+
+	received := make(chan Event, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- e
+	}))
+	t.Cleanup(server.Close)
+
+	config := &cfg.BouncerConfig{Mode: "pf"}
+	config.Notifier.Command = command
+	config.Notifier.URL = server.URL
+
+	return New(config), received
+}
+
+func TestSendEvent(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "event.json")
+	command := filepath.Join(t.TempDir(), "notify")
+
+	if err := os.WriteFile(command, []byte("#!/bin/sh\ncat > "+out+"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	n, received := newTestNotifier(t, command)
+
+	value, scenario, duration := "192.0.2.1", "crowdsecurity/ssh-bf", "4h"
+	if err := n.send(newEvent(&models.Decision{Value: &value, Scenario: &scenario, Duration: &duration}, "pf")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Event{Value: value, Scenario: scenario, Duration: duration, Backend: "pf"}
+
+	if e := <-received; e != want {
+		t.Fatalf("the URL received %+v, want %+v", e, want)
+	}
+
+	body, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil || e != want {
+		t.Fatalf("the command received %s (%v)", body, err)
+	}
+}
+
+func TestSendURLWhenCommandFails(t *testing.T) {
+	n, received := newTestNotifier(t, "false")
+
+	value := "192.0.2.1"
+	if err := n.send(newEvent(&models.Decision{Value: &value}, "pf")); err == nil {
+		t.Fatal("no error for the failed command")
+	}
+
+	select {
+	case e := <-received:
+		if e.Value != value {
+			t.Fatalf("the URL received %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the URL was not notified after the command failed")
+	}
+}
+
+func TestNilNotifier(t *testing.T) {
+	var n *Notifier
+
+	value := "192.0.2.1"
+	n.Banned(&models.Decision{Value: &value})
+
+	if New(&cfg.BouncerConfig{}) != nil {
+		t.Fatal("a notifier is returned without command nor URL")
+	}
+}
@@ -0,0 +1,171 @@
+package pf
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// expiry keeps track of the deadline of the addresses added to the pf tables,
+// since pf has no notion of timeout for table entries.
+type expiry struct {
+	mu        sync.Mutex
+	deadlines map[string]time.Time
+	// the deadlines changed since they were last saved
+	dirty bool
+}
+
+func newExpiry() *expiry {
+	return &expiry{
+		deadlines: make(map[string]time.Time),
+	}
+}
+
+// set records the deadline of an address, keeping the latest one if the address is already known.
+func (e *expiry) set(value string, deadline time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if current, ok := e.deadlines[value]; ok && current.After(deadline) {
+		return
+	}
+
+	e.deadlines[value] = deadline
+	e.dirty = true
+}
+
+func (e *expiry) remove(value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.deadlines[value]; ok {
+		delete(e.deadlines, value)
+		e.dirty = true
+	}
+}
+
+func (e *expiry) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.dirty = e.dirty || len(e.deadlines) > 0
+	e.deadlines = make(map[string]time.Time)
+}
+
+// expired returns the addresses whose deadline is before now, and forgets them.
+func (e *expiry) expired(now time.Time) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ret := []string{}
+
+	for value, deadline := range e.deadlines {
+		if deadline.Before(now) {
+			ret = append(ret, value)
+			delete(e.deadlines, value)
+			e.dirty = true
+		}
+	}
+
+	return ret
+}
+
+func (e *expiry) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return len(e.deadlines)
+}
+
+// save writes the deadlines to a JSON file, if they changed since the last call. The file
+// is replaced at once, a crash leaves the previous version in place.
+func (e *expiry) save(path string) error {
+	e.mu.Lock()
+
+	if !e.dirty {
+		e.mu.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(e.deadlines)
+	e.dirty = false
+	e.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// load adds the deadlines saved in a file, a missing file holds none. It returns
+// the number of deadlines read.
+func (e *expiry) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	deadlines := make(map[string]time.Time)
+	if err := json.Unmarshal(data, &deadlines); err != nil {
+		return 0, err
+	}
+
+	for value, deadline := range deadlines {
+		e.set(value, deadline)
+	}
+
+	return len(deadlines), nil
+}
+
+// live returns the time left of the addresses whose deadline is after now.
+func (e *expiry) live(now time.Time) map[string]time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ret := make(map[string]time.Duration, len(e.deadlines))
+
+	for value, deadline := range e.deadlines {
+		if deadline.After(now) {
+			ret[value] = deadline.Sub(now)
+		}
+	}
+
+	return ret
+}
+
+// values returns the tracked addresses.
+func (e *expiry) values() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ret := make([]string, 0, len(e.deadlines))
+	for value := range e.deadlines {
+		ret = append(ret, value)
+	}
+
+	return ret
+}
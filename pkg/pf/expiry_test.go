@@ -0,0 +1,146 @@
+package pf
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expiry.json")
+	now := time.Now()
+
+	e := newExpiry()
+	e.set("192.0.2.1", now.Add(time.Hour))
+	e.set("2001:db8::/64", now.Add(4*time.Hour))
+
+	if err := e.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newExpiry()
+
+	n, err := restored.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Fatalf("%d deadlines restored, want 2", n)
+	}
+
+	for value, deadline := range e.deadlines {
+		if !restored.deadlines[value].Equal(deadline) {
+			t.Fatalf("%s: restored deadline %s, want %s", value, restored.deadlines[value], deadline)
+		}
+	}
+}
+
+func TestExpirySaveUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expiry.json")
+
+	// nothing changed, the file isn't written
+	if err := newExpiry().save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the file is written without any deadline: %v", err)
+	}
+
+	// a missing file holds no deadline
+	if n, err := newExpiry().load(path); n != 0 || err != nil {
+		t.Fatalf("loading a missing file gives %d, %v", n, err)
+	}
+}
+
+func TestExpiryLoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expiry.json")
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newExpiry().load(path); err == nil {
+		t.Fatal("an invalid file is loaded")
+	}
+}
+
+func TestExpiryAfterRestart(t *testing.T) {
+	f := newFakePfctl(t)
+	f.createTable("crowdsec")
+	f.createTable("crowdsec6")
+
+	path := filepath.Join(t.TempDir(), "expiry.json")
+
+	newPF := func() *pf {
+		p := newTestPF(f)
+		p.expiryFile = path
+
+		for _, ctx := range p.contexts() {
+			ctx.flushOnStartup = false
+		}
+
+		if err := p.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	p := newPF()
+
+	for value, duration := range map[string]time.Duration{"192.0.2.1": time.Minute, "192.0.2.2": time.Hour, "2001:db8::1": time.Minute} {
+		if err := p.Add(newDecision(value, duration)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bouncer is restarted, the tables are kept
+	restarted := newPF()
+
+	expired := restarted.Expired(time.Now().Add(2 * time.Minute))
+	sort.Strings(expired)
+
+	if strings.Join(expired, ",") != "192.0.2.1,2001:db8::1" {
+		t.Fatalf("expired after the restart: %v", expired)
+	}
+
+	if got := restarted.expiry.values(); len(got) != 1 || got[0] != "192.0.2.2" {
+		t.Fatalf("still tracked after the restart: %v", got)
+	}
+}
+
+func TestExpiryFlushedOnStartup(t *testing.T) {
+	f := newFakePfctl(t)
+	f.createTable("crowdsec")
+	f.createTable("crowdsec6")
+
+	path := filepath.Join(t.TempDir(), "expiry.json")
+
+	e := newExpiry()
+	e.set("192.0.2.1", time.Now().Add(time.Hour))
+
+	if err := e.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPF(f)
+	p.expiryFile = path
+
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the flushed tables don't hold the addresses of the file anymore
+	if n := p.expiry.len(); n != 0 {
+		t.Fatalf("%d deadlines restored into flushed tables", n)
+	}
+}
@@ -0,0 +1,264 @@
+package pf
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/execlimit"
+)
+
+// fakePfctlScript keeps the tables in files, one address per line, in the directory of the
+// script. It fails with "Device busy" as many times as the busy file says, sleeps for the
+// duration of the sleep file, and appends each command line to the calls file.
+const fakePfctlScript = `#!/bin/sh
+dir="$(dirname "$0")"
+echo "$*" >> "$dir/calls"
+
+if [ -f "$dir/sleep" ]; then
+	sleep "$(cat "$dir/sleep")"
+fi
+
+if [ -f "$dir/busy" ]; then
+	n=$(cat "$dir/busy")
+	if [ "$n" -gt 0 ]; then
+		echo $((n - 1)) > "$dir/busy"
+		echo "pfctl: Device busy" >&2
+		exit 1
+	fi
+fi
+
+if [ "$1" = "-a" ]; then
+	shift 2
+fi
+
+case "$1" in
+-s)
+	case "$2" in
+	Tables) ls "$dir/tables" 2>/dev/null ;;
+	Anchors) cat "$dir/anchors" 2>/dev/null ;;
+	esac
+	exit 0
+	;;
+-vvsr)
+	cat "$dir/rules" 2>/dev/null
+	exit 0
+	;;
+-k)
+	exit 0
+	;;
+-t)
+	table="$dir/tables/$2"
+	op="$4"
+	shift 4
+	;;
+*)
+	echo "fake pfctl: unsupported command $*" >&2
+	exit 2
+	;;
+esac
+
+if [ "$1" = "-f" ]; then
+	input="$(cat)"
+else
+	input="$(printf '%s\n' "$@")"
+fi
+
+case "$op" in
+add)
+	mkdir -p "$dir/tables"
+	touch "$table"
+	printf '%s\n' "$input" | awk -v t="$table" '
+		BEGIN { while ((getline l < t) > 0) s[l] = 1; close(t) }
+		$0 != "" { total++; if (!($0 in s)) { s[$0] = 1; print >> t; done++ } }
+		END { printf "%d/%d addresses added.\n", done, total > "/dev/stderr" }'
+	;;
+delete)
+	if [ ! -f "$table" ]; then
+		echo "pfctl: Table does not exist." >&2
+		exit 1
+	fi
+	printf '%s\n' "$input" | awk -v t="$table" '
+		BEGIN { while ((getline l < t) > 0) s[l] = 1; close(t) }
+		$0 != "" { total++; if ($0 in s) { delete s[$0]; done++ } }
+		END {
+			printf "" > t
+			for (l in s) print l >> t
+			printf "%d/%d addresses deleted.\n", done, total > "/dev/stderr"
+		}'
+	;;
+show)
+	if [ ! -f "$table" ]; then
+		echo "pfctl: Table does not exist." >&2
+		exit 1
+	fi
+	cat "$table"
+	;;
+flush)
+	n=0
+	if [ -f "$table" ]; then
+		n=$(grep -c . "$table")
+		: > "$table"
+	fi
+	echo "$n addresses deleted." >&2
+	;;
+esac
+`
+
+// fakePfctl is a pfctl script working on the tables of a temporary directory.
+type fakePfctl struct {
+	t    testing.TB
+	dir  string
+	path string
+}
+
+func newFakePfctl(t testing.TB) *fakePfctl {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pfctl")
+
+	if err := os.WriteFile(path, []byte(fakePfctlScript), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "tables"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Init checks that pf is there
+	saved := pfDevice
+	pfDevice = dir
+	t.Cleanup(func() { pfDevice = saved })
+
+	return &fakePfctl{t: t, dir: dir, path: path}
+}
+
+func (f *fakePfctl) write(name string, content string) {
+	f.t.Helper()
+
+	if err := os.WriteFile(filepath.Join(f.dir, name), []byte(content), 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// createTable creates a table holding addresses.
+func (f *fakePfctl) createTable(table string, addresses ...string) {
+	content := ""
+	for _, a := range addresses {
+		content += a + "\n"
+	}
+
+	f.write(filepath.Join("tables", table), content)
+}
+
+// removeTable removes a table, like 'pfctl -F all' does with the tables that are not persist.
+func (f *fakePfctl) removeTable(table string) {
+	f.t.Helper()
+
+	if err := os.Remove(filepath.Join(f.dir, "tables", table)); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// busy makes the next n commands fail with a transient error.
+func (f *fakePfctl) busy(n int) {
+	f.write("busy", strconv.Itoa(n))
+}
+
+// sleep makes each command run for d.
+func (f *fakePfctl) sleep(d time.Duration) {
+	f.write("sleep", strconv.FormatFloat(d.Seconds(), 'f', 3, 64))
+}
+
+// table returns the sorted addresses of a table, nil if it doesn't exist.
+func (f *fakePfctl) table(table string) []string {
+	f.t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(f.dir, "tables", table))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	ret := []string{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			ret = append(ret, line)
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// calls returns the command lines the script was run with.
+func (f *fakePfctl) calls() []string {
+	f.t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(f.dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func (f *fakePfctl) assertTable(table string, want ...string) {
+	f.t.Helper()
+
+	got := f.table(table)
+	sort.Strings(want)
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		f.t.Fatalf("table %s holds %v, want %v", table, got, want)
+	}
+}
+
+// newTestPF returns a pf backend using the fake pfctl, with the crowdsec and crowdsec6 tables.
+func newTestPF(f *fakePfctl) *pf {
+	retry := &retryOptions{}
+	opts := execOptions{limiter: execlimit.New(0)}
+
+	newContext := func(table string, proto string, version string) *pfContext {
+		return &pfContext{
+			pfctl:          f.path,
+			table:          table,
+			proto:          proto,
+			version:        version,
+			batchSize:      2000,
+			maxArgs:        1000,
+			retry:          retry,
+			exec:           opts,
+			flushOnStartup: true,
+		}
+	}
+
+	return &pf{
+		inet:   newContext("crowdsec", "inet", "ipv4"),
+		inet6:  newContext("crowdsec6", "inet6", "ipv6"),
+		expiry: newExpiry(),
+		retry:  retry,
+	}
+}
+
+func newDecision(value string, duration time.Duration) *models.Decision {
+	d := duration.String()
+
+	return &models.Decision{Value: &value, Duration: &d}
+}
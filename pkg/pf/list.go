@@ -0,0 +1,38 @@
+package pf
+
+import (
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// canonical returns the canonical spelling of an address, or the address itself if it's invalid.
+func canonical(value string) string {
+	if c, err := types.CanonicalValue(value); err == nil {
+		return c
+	}
+
+	return value
+}
+
+// List returns the addresses in the tables, pf doesn't know when they expire. The ones of a
+// table kept across runs (keep_tables, alias) that the bouncer didn't add are foreign.
+func (pf *pf) List() ([]types.Entry, error) {
+	ret := []types.Entry{}
+
+	added := make(map[string]bool)
+	for _, value := range pf.expiry.values() {
+		added[canonical(value)] = true
+	}
+
+	for _, ctx := range pf.contexts() {
+		entries, err := ctx.entries()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			ret = append(ret, types.Entry{Value: e, Foreign: (ctx.keepTable || ctx.alias) && !added[canonical(e)]})
+		}
+	}
+
+	return ret, nil
+}
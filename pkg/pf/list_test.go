@@ -0,0 +1,44 @@
+package pf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListForeign(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	p.inet.keepTable = true
+
+	f.createTable("crowdsec", "198.51.100.1")
+	f.createTable("crowdsec6", "2001:db8::2")
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::1"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := p.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the kept table holds addresses added by someone else
+	want := map[string]bool{"192.0.2.1": false, "198.51.100.1": true, "2001:db8::1": false, "2001:db8::2": false}
+
+	if len(entries) != len(want) {
+		t.Fatalf("listed %v", entries)
+	}
+
+	for _, entry := range entries {
+		foreign, ok := want[entry.Value]
+		if !ok || entry.Foreign != foreign {
+			t.Fatalf("listed %s, foreign: %t", entry.Value, entry.Foreign)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package pf
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// parseBlockCounters extracts the packets and bytes from a statistics line such as
+// "In/Block:    [ Packets: 12                 Bytes: 720                ]".
+func parseBlockCounters(line string) (int, int) {
+	var packets, bytes int
+
+	fields := strings.Fields(line)
+	for i := 0; i < len(fields)-1; i++ {
+		switch fields[i] {
+		case "Packets:":
+			packets, _ = strconv.Atoi(fields[i+1])
+		case "Bytes:":
+			bytes, _ = strconv.Atoi(fields[i+1])
+		}
+	}
+
+	return packets, bytes
+}
+
+// collectTableStats returns the number of entries in the table and the number of
+// packets and bytes blocked because of them. The counters are only maintained by pf
+// if the table is declared with the "counters" keyword.
+func (ctx *pfContext) collectTableStats() (int, int, int, error) {
+	cmd := execPfctl(ctx.exec, ctx.pfctl, ctx.anchor, "-t", ctx.table, "-T", "show", "-vv")
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("while running %s: %w", cmd, err)
+	}
+
+	var banned, droppedPackets, droppedBytes int
+
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// statistics are indented with a tab, addresses are not
+		if !strings.HasPrefix(line, "\t") {
+			if strings.TrimSpace(line) != "" {
+				banned++
+			}
+
+			continue
+		}
+
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "In/Block:") || strings.HasPrefix(line, "Out/Block:") {
+			pkt, byt := parseBlockCounters(line)
+			droppedPackets += pkt
+			droppedBytes += byt
+		}
+	}
+
+	return banned, droppedPackets, droppedBytes, nil
+}
+
+func (pf *pf) CollectMetrics() (types.Metrics, error) {
+	ret := types.Metrics{BannedByFamily: map[string]float64{}}
+
+	// the ipv6 addresses and ranges may be in different tables
+	for _, ctx := range pf.contexts() {
+		banned, packets, bytes, err := ctx.collectTableStats()
+		if err != nil {
+			log.Errorf("can't collect metrics for %s from pf: %s", ctx.version, err)
+			continue
+		}
+
+		ret.BannedByFamily[ctx.version] += float64(banned)
+		ret.DroppedPackets += float64(packets)
+		ret.DroppedBytes += float64(bytes)
+	}
+
+	return ret, nil
+}
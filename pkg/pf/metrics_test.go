@@ -0,0 +1,58 @@
+package pf
+
+import "testing"
+
+func TestCollectMetrics(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	// as listed by 'pfctl -T show -vv' for a table declared with "counters"
+	f.createTable("crowdsec",
+		"   192.0.2.1",
+		"\tCleared:     Thu Oct  1 12:00:00 2026",
+		"\tIn/Block:    [ Packets: 12                 Bytes: 720                ]",
+		"\tIn/Pass:     [ Packets: 100                Bytes: 9000               ]",
+		"\tOut/Block:   [ Packets: 2                  Bytes: 80                 ]",
+		"   198.51.100.0/24",
+		"\tIn/Block:    [ Packets: 0                  Bytes: 0                  ]",
+	)
+	f.createTable("crowdsec6",
+		"   2001:db8::1",
+		"\tIn/Block:    [ Packets: 3                  Bytes: 252                ]",
+	)
+
+	snapshot, err := p.CollectMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the passed packets are not counted
+	if snapshot.DroppedPackets != 17 || snapshot.DroppedBytes != 1052 {
+		t.Fatalf("dropped %v packets and %v bytes, want 17 and 1052", snapshot.DroppedPackets, snapshot.DroppedBytes)
+	}
+
+	if len(snapshot.BannedByFamily) != 2 || snapshot.BannedByFamily["ipv4"] != 2 || snapshot.BannedByFamily["ipv6"] != 1 {
+		t.Fatalf("banned by family %v", snapshot.BannedByFamily)
+	}
+
+	if snapshot.Banned() != 3 {
+		t.Fatalf("%v banned, want 3", snapshot.Banned())
+	}
+}
+
+func TestCollectMetricsMissingTable(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	f.createTable("crowdsec", "   192.0.2.1")
+
+	// the table of a family not loaded yet doesn't hide the other one
+	snapshot, err := p.CollectMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.BannedByFamily["ipv4"] != 1 || snapshot.BannedByFamily["ipv6"] != 0 {
+		t.Fatalf("banned by family %v", snapshot.BannedByFamily)
+	}
+}
@@ -1,33 +1,75 @@
 package pf
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/asians-cloud/crowdsec/pkg/models"
 
 	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/execlimit"
 	"github.com/asians-cloud/firewall-bouncer/pkg/types"
 )
 
 type pf struct {
-	inet              *pfContext
-	inet6             *pfContext
+	inet  *pfContext
+	inet6 *pfContext
+	// the table of the ipv6 ranges, nil if they go to the one of inet6
+	inet6Net          *pfContext
 	decisionsToAdd    []*models.Decision
 	decisionsToDelete []*models.Decision
+	expiry            *expiry
+	sweepInterval     time.Duration
+	// protects the pending decisions
+	mu sync.Mutex
+	// serializes the commits, which run without mu: the retries back off without
+	// blocking Add, Delete and Missing
+	commitMu sync.Mutex
+	// where the deadlines are saved, for the tables that are not flushed on restart
+	expiryFile string
+	// how the block rules are expected to use the tables, not checked if empty
+	tableRules string
+	// the tables used by the block rules at startup, to notice when the rules are flushed
+	ruleTables []string
+	retry      *retryOptions
 }
 
-const (
-	pfctlCmd = "/sbin/pfctl"
-	pfDevice = "/dev/pf"
-)
+// pfDevice is checked by Init, a variable for the tests.
+var pfDevice = "/dev/pf"
 
 func NewPF(config *cfg.BouncerConfig) (types.Backend, error) {
-	ret := &pf{}
+	sweepInterval, err := time.ParseDuration(config.PF.SweepInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pf sweep_interval: %w", err)
+	}
+
+	// already validated by the config loader
+	retryBackoff, _ := time.ParseDuration(config.PF.RetryBackoff)
+	execTimeout, _ := time.ParseDuration(config.PF.ExecTimeout)
+
+	// shared by both families
+	opts := execOptions{
+		timeout: execTimeout,
+		limiter: execlimit.New(config.ExecConcurrency),
+	}
+	retry := &retryOptions{count: config.PF.RetryCount, backoff: retryBackoff}
+
+	ret := &pf{
+		retry:         retry,
+		expiry:        newExpiry(),
+		sweepInterval: sweepInterval,
+		expiryFile:    config.PF.ExpiryFile,
+		tableRules:    config.PF.TableRules,
+	}
 
 	batchSize := config.PF.BatchSize
 	if batchSize == 0 {
@@ -35,37 +77,200 @@ func NewPF(config *cfg.BouncerConfig) (types.Backend, error) {
 	}
 
 	inetCtx := &pfContext{
+		pfctl:     config.PF.PfctlPath,
 		table:     config.BlacklistsIpv4,
 		proto:     "inet",
 		anchor:    config.PF.AnchorName,
 		version:   "ipv4",
 		batchSize: batchSize,
+		maxArgs:   config.PF.MaxArgsPerCommand,
+		dryRun:    config.DryRun,
+		retry:     retry,
+		keepTable: config.PF.KeepTables || config.FlushMode == cfg.FlushModeOwned,
+		exec:      opts,
+		// the config loader defaults it
+		flushOnStartup: *config.FlushOnStartup,
 	}
 
 	inet6Ctx := &pfContext{
+		pfctl:     config.PF.PfctlPath,
 		table:     config.BlacklistsIpv6,
 		proto:     "inet6",
 		anchor:    config.PF.AnchorName,
 		version:   "ipv6",
 		batchSize: batchSize,
+		maxArgs:   config.PF.MaxArgsPerCommand,
+		dryRun:    config.DryRun,
+		retry:     retry,
+		keepTable: config.PF.KeepTables || config.FlushMode == cfg.FlushModeOwned,
+		exec:      opts,
+		// the config loader defaults it
+		flushOnStartup: *config.FlushOnStartup,
 	}
 
-	ret.inet = inetCtx
+	// pf tables can hold both families
+	if config.PF.Alias != "" {
+		inetCtx.table = config.PF.Alias
+		inet6Ctx.table = config.PF.Alias
+		inetCtx.alias = true
+		inet6Ctx.alias = true
+	}
+
+	if !config.DisableIPV4 {
+		ret.inet = inetCtx
+	}
 
 	if !config.DisableIPV6 {
 		ret.inet6 = inet6Ctx
+
+		if config.PF.IPv6NetworksTable != "" {
+			inet6NetCtx := *inet6Ctx
+			inet6NetCtx.table = config.PF.IPv6NetworksTable
+			ret.inet6Net = &inet6NetCtx
+		}
 	}
 
 	return ret, nil
 }
 
+// Reload applies the retry_count and retry_backoff of a reloaded configuration, the
+// other pf options require a restart.
+func (pf *pf) Reload(config *cfg.BouncerConfig) {
+	// already validated by the config loader
+	backoff, _ := time.ParseDuration(config.PF.RetryBackoff)
+
+	if count, current := pf.retry.get(); count != config.PF.RetryCount || current != backoff {
+		log.Infof("pf: retrying the pfctl commands %d times, from %s", config.PF.RetryCount, backoff)
+		pf.retry.set(config.PF.RetryCount, backoff)
+	}
+}
+
+// errTimeout is returned when pfctl is killed for running too long, ie. when pf is locked.
+var errTimeout = errors.New("pfctl timed out")
+
+// execOptions limit how long pfctl commands may run (0 for no limit), and how many
+// of them run at the same time.
+type execOptions struct {
+	timeout time.Duration
+	limiter *execlimit.Limiter
+}
+
+// pfctlCmd is a pfctl command that is killed if it doesn't complete in time. Its time
+// only starts once the limiter lets it run.
+type pfctlCmd struct {
+	path string
+	args []string
+	// given to pfctl on its standard input, if set
+	Stdin io.Reader
+	opts  execOptions
+	// the context of the last run, to tell a timeout from another failure
+	ctx context.Context
+}
+
 // execPfctl runs a pfctl command by prepending the anchor name if we have one.
-func execPfctl(anchor string, arg ...string) *exec.Cmd {
+func execPfctl(opts execOptions, pfctl string, anchor string, arg ...string) *pfctlCmd {
 	if anchor != "" {
 		arg = append([]string{"-a", anchor}, arg...)
 	}
-	log.Tracef("Running: %s %s", pfctlCmd, arg)
-	return exec.Command(pfctlCmd, arg...)
+	log.Tracef("Running: %s %s", pfctl, arg)
+
+	return &pfctlCmd{
+		path: pfctl,
+		args: arg,
+		opts: opts,
+	}
+}
+
+func (c *pfctlCmd) String() string {
+	return strings.Join(append([]string{c.path}, c.args...), " ")
+}
+
+// command returns the command to run right away, with its timeout started.
+func (c *pfctlCmd) command() (*exec.Cmd, context.CancelFunc) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if c.opts.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+	}
+
+	c.ctx = ctx
+
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Stdin = c.Stdin
+	// don't wait for the children of a killed pfctl to release its output
+	cmd.WaitDelay = time.Second
+
+	return cmd, cancel
+}
+
+// wrap marks the error of a command that timed out as transient, so that it's retried.
+func (c *pfctlCmd) wrap(err error) error {
+	if err != nil && errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w: %w", errTransient, errTimeout, err)
+	}
+
+	return err
+}
+
+// limited runs the command with output once the limiter gives it a slot.
+func (c *pfctlCmd) limited(output func(*exec.Cmd) ([]byte, error)) ([]byte, error) {
+	var out []byte
+
+	err := c.opts.limiter.Do(func() error {
+		cmd, cancel := c.command()
+		defer cancel()
+
+		var err error
+		out, err = output(cmd)
+
+		return c.wrap(err)
+	})
+
+	return out, err
+}
+
+func (c *pfctlCmd) Output() ([]byte, error) {
+	return c.limited((*exec.Cmd).Output)
+}
+
+func (c *pfctlCmd) CombinedOutput() ([]byte, error) {
+	return c.limited((*exec.Cmd).CombinedOutput)
+}
+
+// contexts returns the contexts of the enabled tables, only once for both
+// families if they share a table.
+func (pf *pf) contexts() []*pfContext {
+	ret := []*pfContext{}
+
+	for _, ctx := range []*pfContext{pf.inet, pf.inet6, pf.inet6Net} {
+		if ctx != nil && (len(ret) == 0 || ret[0].table != ctx.table) {
+			ret = append(ret, ctx)
+		}
+	}
+
+	return ret
+}
+
+// forEachContext runs fn on the ipv4 and ipv6 tables at the same time, since flushing
+// large tables can take a while. All the errors are returned.
+func (pf *pf) forEachContext(fn func(*pfContext) error) error {
+	contexts := pf.contexts()
+
+	errs := make([]error, len(contexts))
+
+	var wg sync.WaitGroup
+
+	for i, ctx := range contexts {
+		wg.Add(1)
+
+		go func(i int, ctx *pfContext) {
+			defer wg.Done()
+			errs[i] = fn(ctx)
+		}(i, ctx)
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 func (pf *pf) Init() error {
@@ -73,35 +278,117 @@ func (pf *pf) Init() error {
 		return fmt.Errorf("%s device not found: %w", pfDevice, err)
 	}
 
-	if _, err := exec.LookPath(pfctlCmd); err != nil {
-		return fmt.Errorf("%s command not found: %w", pfctlCmd, err)
+	// the anchor and pfctl are the same for both families
+	ctx := pf.contexts()[0]
+
+	if _, err := exec.LookPath(ctx.pfctl); err != nil {
+		return fmt.Errorf("%s command not found: %w", ctx.pfctl, err)
 	}
 
-	if err := pf.inet.init(); err != nil {
+	if anchor := ctx.anchor; anchor != "" {
+		if err := checkAnchor(ctx.pfctl, anchor, ctx.exec); err != nil {
+			return err
+		}
+	}
+
+	if err := pf.forEachContext((*pfContext).init); err != nil {
 		return err
 	}
 
-	if pf.inet6 != nil {
-		if err := pf.inet6.init(); err != nil {
-			return err
+	pf.checkRules()
+
+	if tables, err := pf.referencedTables(); err != nil {
+		log.Debugf("can't read the pf block rules: %s", err)
+	} else {
+		pf.ruleTables = tables
+	}
+
+	// the flushed tables don't hold the addresses of the file anymore
+	if pf.expiryFile != "" && (ctx.keepTable || !ctx.flushOnStartup) {
+		restored, err := pf.expiry.load(pf.expiryFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the pf expiry_file: %w", err)
 		}
+
+		log.Infof("%d expiry deadlines restored from %s", restored, pf.expiryFile)
 	}
 
 	return nil
 }
 
+// SweepInterval is how often the backend removes the addresses whose decision has expired,
+// in case the corresponding delete event was missed.
+func (pf *pf) SweepInterval() time.Duration {
+	return pf.sweepInterval
+}
+
+// Expired returns the addresses whose decision has expired, and forgets their deadline.
+func (pf *pf) Expired(now time.Time) []string {
+	return pf.expiry.expired(now)
+}
+
+// trackExpiry records the deadline of the given decisions.
+func (pf *pf) trackExpiry(decisions []*models.Decision) {
+	now := time.Now()
+
+	for _, d := range decisions {
+		if d.Duration == nil {
+			continue
+		}
+
+		duration, err := time.ParseDuration(*d.Duration)
+		if err != nil {
+			log.Debugf("not tracking expiry of '%s': %s", *d.Value, err)
+			continue
+		}
+
+		pf.expiry.set(*d.Value, now.Add(duration))
+	}
+}
+
+// Commit applies the deletions then the additions to every table, even if some of them
+// fail: a table that can't be updated doesn't prevent the bans of the others.
 func (pf *pf) Commit() error {
-	defer pf.reset()
-	if err := pf.commitDeletedDecisions(); err != nil {
-		return err
+	pf.commitMu.Lock()
+	defer pf.commitMu.Unlock()
+
+	toDelete, toAdd := pf.pending()
+
+	defer pf.saveExpiry()
+
+	return errors.Join(pf.commitDeletedDecisions(toDelete), pf.commitAddedDecisions(toAdd))
+}
+
+// pending returns the decisions to delete and to add, and forgets them.
+func (pf *pf) pending() ([]*models.Decision, []*models.Decision) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	toDelete, toAdd := pf.decisionsToDelete, pf.decisionsToAdd
+	pf.reset()
+
+	return toDelete, toAdd
+}
+
+// saveExpiry writes the deadlines to expiry_file, the bans keep expiring after a restart.
+func (pf *pf) saveExpiry() {
+	if pf.expiryFile == "" {
+		return
 	}
-	if err := pf.commitAddedDecisions(); err != nil {
-		return err
+
+	if err := pf.expiry.save(pf.expiryFile); err != nil {
+		log.Errorf("unable to save the expiry of the pf bans to %s: %s", pf.expiryFile, err)
 	}
-	return nil
 }
 
 func (pf *pf) Add(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
 	pf.decisionsToAdd = append(pf.decisionsToAdd, decision)
 	return nil
 }
@@ -111,88 +398,187 @@ func (pf *pf) reset() {
 	pf.decisionsToDelete = make([]*models.Decision, 0)
 }
 
-func (pf *pf) commitDeletedDecisions() error {
+// splitByFamily sorts the decisions between the inet and inet6 tables, discarding the malformed ones.
+func splitByFamily(decisions []*models.Decision) ([]*models.Decision, []*models.Decision) {
 	ipv4decisions := make([]*models.Decision, 0)
 	ipv6decisions := make([]*models.Decision, 0)
 
-	for _, d := range pf.decisionsToDelete {
-		if strings.Contains(*d.Value, ":") && pf.inet6 != nil {
+	for _, d := range decisions {
+		v6, err := types.IsIPv6(*d.Value)
+		if err != nil {
+			log.Errorf("ignoring decision: %s", err)
+			continue
+		}
+
+		if v6 {
 			ipv6decisions = append(ipv6decisions, d)
 		} else {
 			ipv4decisions = append(ipv4decisions, d)
 		}
 	}
 
+	return ipv4decisions, ipv6decisions
+}
+
+// isHost tells whether a decision bans a single address of its family, ie. "2001:db8::1"
+// or "2001:db8::1/128", but not "2001:db8::/32".
+func isHost(value string, v6 bool) bool {
+	host := "32"
+	if v6 {
+		host = "128"
+	}
+
+	_, bits, ok := strings.Cut(value, "/")
+
+	return !ok || bits == host
+}
+
+// contextFor returns the context of the table an address goes to, nil if its family is disabled.
+func (pf *pf) contextFor(value string) *pfContext {
+	v6, err := types.IsIPv6(value)
+	if err != nil {
+		return nil
+	}
+
+	if !v6 {
+		return pf.inet
+	}
+
+	if pf.inet6Net != nil && !isHost(value, true) {
+		return pf.inet6Net
+	}
+
+	return pf.inet6
+}
+
+// ipv6Batches returns the ipv6 decisions by table: the ranges go to their own table if
+// there is one, since pf looks up the addresses faster in a table without ranges.
+func (pf *pf) ipv6Batches(decisions []*models.Decision) map[*pfContext][]*models.Decision {
+	if pf.inet6Net == nil {
+		return map[*pfContext][]*models.Decision{pf.inet6: decisions}
+	}
+
+	ret := map[*pfContext][]*models.Decision{}
+
+	for _, d := range decisions {
+		if isHost(*d.Value, true) {
+			ret[pf.inet6] = append(ret[pf.inet6], d)
+		} else {
+			ret[pf.inet6Net] = append(ret[pf.inet6Net], d)
+		}
+	}
+
+	return ret
+}
+
+func (pf *pf) commitDeletedDecisions(decisions []*models.Decision) error {
+	for _, d := range decisions {
+		pf.expiry.remove(*d.Value)
+	}
+
+	ipv4decisions, ipv6decisions := splitByFamily(decisions)
+
+	var errs []error
+
 	if len(ipv6decisions) > 0 {
 		if pf.inet6 == nil {
 			log.Debugf("not removing '%d' decisions because ipv6 is disabled", len(ipv6decisions))
 		} else {
-			if err := pf.inet6.delete(ipv6decisions); err != nil {
-				return err
+			for ctx, batch := range pf.ipv6Batches(ipv6decisions) {
+				if err := ctx.delete(batch); err != nil {
+					errs = append(errs, err)
+				}
 			}
 		}
 	}
 
 	if len(ipv4decisions) > 0 {
-		if err := pf.inet.delete(ipv4decisions); err != nil {
-			return err
+		if pf.inet == nil {
+			log.Debugf("not removing '%d' decisions because ipv4 is disabled", len(ipv4decisions))
+		} else if err := pf.inet.delete(ipv4decisions); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func (pf *pf) commitAddedDecisions() error {
-	ipv4decisions := make([]*models.Decision, 0)
-	ipv6decisions := make([]*models.Decision, 0)
+func (pf *pf) commitAddedDecisions(decisions []*models.Decision) error {
+	ipv4decisions, ipv6decisions := splitByFamily(decisions)
 
-	for _, d := range pf.decisionsToAdd {
-		if strings.Contains(*d.Value, ":") && pf.inet6 != nil {
-			ipv6decisions = append(ipv6decisions, d)
-		} else {
-			ipv4decisions = append(ipv4decisions, d)
-		}
-	}
+	var errs []error
 
 	if len(ipv6decisions) > 0 {
 		if pf.inet6 == nil {
 			log.Debugf("not adding '%d' decisions because ipv6 is disabled", len(ipv6decisions))
 		} else {
-			if err := pf.inet6.add(ipv6decisions); err != nil {
-				return err
+			for ctx, batch := range pf.ipv6Batches(ipv6decisions) {
+				if err := ctx.add(batch); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				pf.trackExpiry(batch)
 			}
 		}
 	}
 
 	if len(ipv4decisions) > 0 {
-		if err := pf.inet.add(ipv4decisions); err != nil {
-			return err
+		if pf.inet == nil {
+			log.Debugf("not adding '%d' decisions because ipv4 is disabled", len(ipv4decisions))
+		} else if err := pf.inet.add(ipv4decisions); err != nil {
+			errs = append(errs, err)
+		} else {
+			pf.trackExpiry(ipv4decisions)
 		}
 	}
 
-	return nil
-}
-
-func (pf *pf) CollectMetrics() {
+	return errors.Join(errs...)
 }
 
 func (pf *pf) Delete(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
 	pf.decisionsToDelete = append(pf.decisionsToDelete, decision)
 	return nil
 }
 
 func (pf *pf) ShutDown() error {
-	log.Infof("flushing 'crowdsec' table(s)")
-
-	if err := pf.inet.shutDown(); err != nil {
-		return fmt.Errorf("unable to flush %s table (%s): ", pf.inet.version, pf.inet.table)
+	if pf.contexts()[0].keepTable {
+		return pf.removeTracked()
 	}
 
-	if pf.inet6 != nil {
-		if err := pf.inet6.shutDown(); err != nil {
-			return fmt.Errorf("unable to flush %s table (%s): ", pf.inet6.version, pf.inet6.table)
-		}
+	pf.expiry.reset()
+	pf.saveExpiry()
+
+	return pf.forEachContext(func(ctx *pfContext) error {
+		log.Infof("flushing '%s' table", ctx.table)
+
+		return ctx.shutDown()
+	})
+}
+
+// removeTracked removes the addresses added by the bouncer from tables it doesn't own.
+func (pf *pf) removeTracked() error {
+	pf.commitMu.Lock()
+	defer pf.commitMu.Unlock()
+
+	values := pf.expiry.values()
+
+	log.Infof("removing %d addresses from the pf tables", len(values))
+
+	decisions := make([]*models.Decision, 0, len(values))
+
+	for _, value := range values {
+		value := value
+		decisions = append(decisions, &models.Decision{Value: &value})
 	}
 
-	return nil
+	defer pf.saveExpiry()
+
+	return pf.commitDeletedDecisions(decisions)
 }
@@ -2,9 +2,13 @@ package pf
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -13,25 +17,123 @@ import (
 )
 
 type pfContext struct {
+	pfctl     string
 	proto     string
 	anchor    string
 	table     string
 	version   string
 	batchSize int
+	maxArgs   int
+	dryRun    bool
+	retry     *retryOptions
+	// the table is not flushed, it may hold addresses that don't come from the bouncer
+	keepTable bool
+	// the table is an existing alias, it holds addresses that don't come from the bouncer
+	alias bool
+	exec  execOptions
+	// the table is flushed by init, unless flush_on_startup: false keeps the bans of the previous run
+	flushOnStartup bool
 }
 
-const backendName = "pf"
+const (
+	backendName = "pf"
+)
+
+// retryOptions are how many times the transient pfctl failures are retried, and the delay
+// before the first retry, which doubles with each attempt. They are shared by the tables
+// and can be changed by a reload.
+type retryOptions struct {
+	mu      sync.Mutex
+	count   int
+	backoff time.Duration
+}
+
+func (o *retryOptions) get() (int, time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.count, o.backoff
+}
+
+func (o *retryOptions) set(count int, backoff time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.count, o.backoff = count, backoff
+}
+
+// errTransient marks the pfctl failures that are worth retrying.
+var errTransient = errors.New("transient pfctl error")
+
+// matches the errors returned by pfctl when the tables are locked by another operation
+var transientRe = regexp.MustCompile(`(?i)(device busy|resource busy|table in use|resource temporarily unavailable)`)
+
+// pfctlError returns the error of a pfctl command, marked as transient if pfctl may succeed later.
+func pfctlError(msg string, cmd *pfctlCmd, err error, out []byte) error {
+	if transientRe.Match(out) {
+		return fmt.Errorf("%s (%s): %w: %w --> %s", msg, cmd, errTransient, err, out)
+	}
+
+	return fmt.Errorf("%s (%s): %w --> %s", msg, cmd, err, out)
+}
+
+// matches the error of pfctl when the table is gone, ie. after 'pfctl -F all' removed a table
+// that isn't persist: the addresses to delete are not there anymore
+var missingTableRe = regexp.MustCompile(`(?i)table does not exist`)
+
+// matches the summary printed by pfctl after a table operation, ie. "3/4 addresses added."
+var tableSummaryRe = regexp.MustCompile(`(\d+)/(\d+) addresses (added|deleted)`)
+
+// matches the summary printed by pfctl after a table flush, ie. "12 addresses deleted."
+var flushSummaryRe = regexp.MustCompile(`(\d+) addresses deleted`)
+
+// parseTableSummary returns the number of addresses affected by a table operation and
+// the number of addresses given to pfctl. ok is false when no summary could be found.
+func parseTableSummary(out []byte) (done int, total int, ok bool) {
+	m := tableSummaryRe.FindSubmatch(out)
+	if m == nil {
+		return 0, 0, false
+	}
+
+	done, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	total, err = strconv.Atoi(string(m[2]))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return done, total, true
+}
+
+func (ctx *pfContext) tableExists() (bool, error) {
+	cmd := execPfctl(ctx.exec, ctx.pfctl, ctx.anchor, "-s", "Tables")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("pfctl error: %s - %w", out, err)
+	}
+
+	// one table per line, a table name may be part of another one (ie. crowdsec and crowdsec6)
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == ctx.table {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
 
 func (ctx *pfContext) checkTable() error {
 	log.Infof("Checking pf table: %s", ctx.table)
 
-	cmd := execPfctl(ctx.anchor, "-s", "Tables")
-	out, err := cmd.CombinedOutput()
+	exists, err := ctx.tableExists()
 	if err != nil {
-		return fmt.Errorf("pfctl error: %s - %w", out, err)
+		return err
 	}
 
-	if !strings.Contains(string(out), ctx.table) {
+	if !exists {
 		if ctx.anchor != "" {
 			return fmt.Errorf("table %s in anchor %s doesn't exist", ctx.table, ctx.anchor)
 		}
@@ -41,21 +143,112 @@ func (ctx *pfContext) checkTable() error {
 	return nil
 }
 
+// entries returns the addresses in the table.
+func (ctx *pfContext) entries() ([]string, error) {
+	cmd := execPfctl(ctx.exec, ctx.pfctl, ctx.anchor, "-t", ctx.table, "-T", "show")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("while running %s: %w", cmd, err)
+	}
+
+	ret := []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ret = append(ret, line)
+		}
+	}
+
+	return ret, nil
+}
+
+// run executes a pfctl command that changes the state of pf, or only logs it in dry-run mode.
+func (ctx *pfContext) run(cmd *pfctlCmd) ([]byte, error) {
+	if ctx.dryRun {
+		log.Infof("dry-run: %s", cmd)
+		return nil, nil
+	}
+
+	return cmd.CombinedOutput()
+}
+
+// withRetry calls fn until it succeeds, fails with a non transient error, or retry_count
+// retries have been done, doubling the delay between each attempt.
+func (ctx *pfContext) withRetry(fn func() error) error {
+	count, backoff := ctx.retry.get()
+
+	err := fn()
+	for i := 0; errors.Is(err, errTransient) && i < count; i++ {
+		log.Warningf("%s, retrying in %s (%d/%d)", err, backoff, i+1, count)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+
+	return err
+}
+
+// checkAnchor makes sure the anchor is referenced by the loaded ruleset, otherwise
+// the tables it contains would not be used by any rule.
+func checkAnchor(pfctl string, anchor string, opts execOptions) error {
+	log.Infof("Checking pf anchor: %s", anchor)
+
+	cmd := execPfctl(opts, pfctl, "", "-s", "Anchors", "-v")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pfctl error: %s - %w", out, err)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == anchor {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("anchor %s doesn't exist, please add 'anchor \"%s\"' to pf.conf", anchor, anchor)
+}
+
 func (ctx *pfContext) shutDown() error {
-	cmd := execPfctl(ctx.anchor, "-t", ctx.table, "-T", "flush")
+	cmd := execPfctl(ctx.exec, ctx.pfctl, ctx.anchor, "-t", ctx.table, "-T", "flush")
 	log.Infof("pf table clean-up: %s", cmd)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Errorf("Error while flushing table (%s): %v --> %s", cmd, err, out)
+	out, err := ctx.run(cmd)
+	if err != nil && missingTableRe.Match(out) {
+		log.Debugf("table %s doesn't exist, there is nothing to flush", ctx.table)
+		return nil
+	}
+
+	if err != nil {
+		return pfctlError(fmt.Sprintf("pf table flush failed for %s (%s)", ctx.version, ctx.table), cmd, err, out)
+	}
+
+	if m := flushSummaryRe.FindSubmatch(out); m != nil {
+		log.Infof("%s addresses removed from %s", m[1], ctx.table)
 	}
 
 	return nil
 }
 
+// stateAddr returns the address of an endpoint of the state table, without the port:
+// pfctl shows "192.0.2.1:22" and "2001:db8::1[22]".
+func stateAddr(endpoint string) string {
+	if addr, _, ok := strings.Cut(endpoint, "["); ok {
+		return addr
+	}
+
+	if addr, _, ok := strings.Cut(endpoint, ":"); ok && strings.Count(endpoint, ":") == 1 {
+		return addr
+	}
+
+	return endpoint
+}
+
 // getStateIPs returns a list of IPs that are currently in the state table.
-func getStateIPs() (map[string]bool, error) {
+func getStateIPs(pfctl string, opts execOptions) (map[string]bool, error) {
 	ret := make(map[string]bool)
 
-	cmd := exec.Command(pfctlCmd, "-s", "states")
+	cmd := execPfctl(opts, pfctl, "", "-s", "states")
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -68,20 +261,9 @@ func getStateIPs() (map[string]bool, error) {
 			continue
 		}
 
-		// right side
-		ip := fields[4]
-		if strings.Contains(ip, ":") {
-			ip = strings.Split(ip, ":")[0]
-		}
-		ret[ip] = true
-
-		// left side
-		ip = fields[2]
-		if strings.Contains(ip, ":") {
-			ip = strings.Split(ip, ":")[0]
-		}
-		ret[ip] = true
-
+		// right side, then left side
+		ret[stateAddr(fields[4])] = true
+		ret[stateAddr(fields[2])] = true
 	}
 
 	log.Tracef("Found IPs in state table: %v", len(ret))
@@ -89,13 +271,20 @@ func getStateIPs() (map[string]bool, error) {
 }
 
 func (ctx *pfContext) add(decisions []*models.Decision) error {
+	var errs []error
+
 	chunks := slicetools.Chunks(decisions, ctx.batchSize)
 	for _, chunk := range chunks {
-		if err := ctx.addChunk(chunk); err != nil {
-			log.Errorf("error while adding decision chunk: %s", err)
+		chunk := chunk
+		if err := ctx.withRetry(func() error { return ctx.addChunk(chunk) }); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
 	bannedIPs := make(map[string]bool)
 	for _, d := range decisions {
 		bannedIPs[*d.Value] = true
@@ -106,9 +295,14 @@ func (ctx *pfContext) add(decisions []*models.Decision) error {
 		return nil
 	}
 
+	if ctx.dryRun {
+		log.Infof("dry-run: not killing the states of %d addresses", len(bannedIPs))
+		return nil
+	}
+
 	log.Tracef("New banned IPs: %v", bannedIPs)
 
-	stateIPs, err := getStateIPs()
+	stateIPs, err := getStateIPs(ctx.pfctl, ctx.exec)
 	if err != nil {
 		return fmt.Errorf("error while getting state IPs: %w", err)
 	}
@@ -117,8 +311,8 @@ func (ctx *pfContext) add(decisions []*models.Decision) error {
 
 	for ip := range bannedIPs {
 		if stateIPs[ip] {
-			cmd := execPfctl("", "-k", ip)
-			if out, err := cmd.CombinedOutput(); err != nil {
+			cmd := execPfctl(ctx.exec, ctx.pfctl, "", "-k", ip)
+			if out, err := ctx.run(cmd); err != nil {
 				log.Errorf("Error while flushing state (%s): %v --> %s", cmd, err, out)
 			}
 		}
@@ -127,53 +321,91 @@ func (ctx *pfContext) add(decisions []*models.Decision) error {
 	return nil
 }
 
-func (ctx *pfContext) addChunk(decisions []*models.Decision) error {
-	addArgs := []string{"-t", ctx.table, "-T", "add"}
+// tableCmd returns the pfctl command adding or deleting addresses in the table. Beyond
+// maxArgs, the addresses are given with '-f -' on its standard input, since the arguments
+// of a command are limited by ARG_MAX.
+func (ctx *pfContext) tableCmd(op string, decisions []*models.Decision) *pfctlCmd {
+	args := []string{"-t", ctx.table, "-T", op}
+
+	if len(decisions) <= ctx.maxArgs {
+		for _, d := range decisions {
+			args = append(args, *d.Value)
+		}
+
+		return execPfctl(ctx.exec, ctx.pfctl, ctx.anchor, args...)
+	}
+
+	var addresses strings.Builder
 
-	log.Debugf("Adding chunk with %d decisions", len(decisions))
 	for _, d := range decisions {
-		addArgs = append(addArgs, *d.Value)
+		addresses.WriteString(*d.Value)
+		addresses.WriteByte('\n')
+	}
+
+	cmd := execPfctl(ctx.exec, ctx.pfctl, ctx.anchor, append(args, "-f", "-")...)
+	cmd.Stdin = strings.NewReader(addresses.String())
+
+	return cmd
+}
+
+func (ctx *pfContext) addChunk(decisions []*models.Decision) error {
+	log.Debugf("Adding chunk with %d decisions", len(decisions))
+
+	cmd := ctx.tableCmd("add", decisions)
+	out, err := ctx.run(cmd)
+	if err != nil {
+		return pfctlError("error while adding to table", cmd, err, out)
 	}
 
-	cmd := execPfctl(ctx.anchor, addArgs...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("error while adding to table (%s): %w --> %s", cmd, err, out)
+	if done, total, ok := parseTableSummary(out); ok && done < total {
+		log.Debugf("%d/%d addresses added to %s, the others were already present", done, total, ctx.table)
 	}
 
 	return nil
 }
 
 func (ctx *pfContext) delete(decisions []*models.Decision) error {
+	var errs []error
+
 	chunks := slicetools.Chunks(decisions, ctx.batchSize)
 	for _, chunk := range chunks {
-		if err := ctx.deleteChunk(chunk); err != nil {
-			log.Errorf("error while deleting decision chunk: %s", err)
+		chunk := chunk
+		if err := ctx.withRetry(func() error { return ctx.deleteChunk(chunk) }); err != nil {
+			errs = append(errs, err)
 		}
 	}
-	return nil
+
+	return errors.Join(errs...)
 }
 
 func (ctx *pfContext) deleteChunk(decisions []*models.Decision) error {
-	delArgs := []string{"-t", ctx.table, "-T", "delete"}
+	cmd := ctx.tableCmd("delete", decisions)
+	out, err := ctx.run(cmd)
+	if err != nil && missingTableRe.Match(out) {
+		log.Debugf("table %s doesn't exist, the %d addresses to delete are already gone", ctx.table, len(decisions))
+		return nil
+	}
 
-	for _, d := range decisions {
-		delArgs = append(delArgs, *d.Value)
+	if err != nil {
+		return pfctlError("error while deleting from table", cmd, err, out)
 	}
 
-	cmd := execPfctl(ctx.anchor, delArgs...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Infof("Error while deleting from table (%s): %v --> %s", cmd, err, out)
+	if done, total, ok := parseTableSummary(out); ok && done < total {
+		log.Debugf("%d/%d addresses deleted from %s, the others were not present", done, total, ctx.table)
 	}
 
 	return nil
 }
 
 func (ctx *pfContext) init() error {
-	if err := ctx.shutDown(); err != nil {
-		return fmt.Errorf("pf table flush failed: %w", err)
+	if !ctx.keepTable && ctx.flushOnStartup {
+		if err := ctx.shutDown(); err != nil {
+			return err
+		}
 	}
+
 	if err := ctx.checkTable(); err != nil {
-		return fmt.Errorf("pf init failed: %w", err)
+		return fmt.Errorf("pf init failed for %s: %w", ctx.version, err)
 	}
 
 	log.Infof("%s initiated for %s", backendName, ctx.version)
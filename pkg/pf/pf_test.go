@@ -0,0 +1,839 @@
+package pf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/execlimit"
+)
+
+func TestReloadRetry(t *testing.T) {
+	retry := &retryOptions{count: 1, backoff: 100 * time.Millisecond}
+	p := &pf{retry: retry, inet: &pfContext{retry: retry}, inet6: &pfContext{retry: retry}}
+
+	config := &cfg.BouncerConfig{}
+	config.PF.RetryCount = 5
+	config.PF.RetryBackoff = "1s"
+
+	p.Reload(config)
+
+	for _, ctx := range p.contexts() {
+		if count, backoff := ctx.retry.get(); count != 5 || backoff != time.Second {
+			t.Fatalf("%s retries %d times from %s after the reload", ctx.version, count, backoff)
+		}
+	}
+}
+
+func TestCommit(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	for _, value := range []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::1"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1", "198.51.100.0/24")
+	f.assertTable("crowdsec6", "2001:db8::1")
+
+	if err := p.Delete(newDecision("192.0.2.1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "198.51.100.0/24")
+
+	if p.expiry.len() != 2 {
+		t.Fatalf("%d deadlines tracked, want 2", p.expiry.len())
+	}
+}
+
+func TestCommitScopeCasings(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	// the table is picked from the value, whatever the spelling of the scope
+	for value, scope := range map[string]string{
+		"192.0.2.1":       "Ip",
+		"192.0.2.2":       "ip",
+		"192.0.2.3":       "IP",
+		"198.51.100.0/24": "range",
+		"2001:db8::1":     "IP",
+		"2001:db8:1::/48": "RANGE",
+	} {
+		scope := scope
+		d := newDecision(value, time.Hour)
+		d.Scope = &scope
+
+		if err := p.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1", "192.0.2.2", "192.0.2.3", "198.51.100.0/24")
+	f.assertTable("crowdsec6", "2001:db8::1", "2001:db8:1::/48")
+}
+
+func TestCommitRetry(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	p.retry.set(2, 10*time.Millisecond)
+
+	f.busy(2)
+
+	if err := p.Add(newDecision("192.0.2.1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1")
+}
+
+func TestCommitBenignErrors(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.DebugLevel)
+
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	f.createTable("crowdsec", "192.0.2.1")
+
+	// already added, not there anymore, and the crowdsec6 table flushed by 'pfctl -F all'
+	for _, value := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, value := range []string{"192.0.2.3", "2001:db8::1"} {
+		if err := p.Delete(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1", "192.0.2.2")
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.InfoLevel {
+			t.Fatalf("logged at %s: %s", entry.Level, entry.Message)
+		}
+	}
+
+	// the other errors are still reported
+	if err := p.Delete(newDecision("192.0.2.2", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	f.busy(1)
+
+	if err := p.Commit(); err == nil {
+		t.Fatal("a failed delete is not reported")
+	}
+}
+
+func TestRetryBackoffDoesntBlockAdd(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	p.retry.set(1, 500*time.Millisecond)
+
+	f.busy(1)
+
+	if err := p.Add(newDecision("192.0.2.1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- p.Commit() }()
+
+	// the first attempt has failed, the commit backs off
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.calls()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pfctl was not run")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+
+	if err := p.Add(newDecision("192.0.2.2", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("Add waited %s for the backoff of the commit", elapsed)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// added meanwhile, for the next commit
+	f.assertTable("crowdsec", "192.0.2.1")
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1", "192.0.2.2")
+}
+
+func TestTimeoutStartsWithSlot(t *testing.T) {
+	f := newFakePfctl(t)
+	f.sleep(200 * time.Millisecond)
+
+	// a single slot: the second command waits for the first one before its timeout starts
+	opts := execOptions{timeout: 300 * time.Millisecond, limiter: execlimit.New(1)}
+
+	errs := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := execPfctl(opts, f.path, "", "-s", "Tables").CombinedOutput()
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	f := newFakePfctl(t)
+	f.sleep(time.Second)
+
+	opts := execOptions{timeout: 100 * time.Millisecond, limiter: execlimit.New(1)}
+
+	_, err := execPfctl(opts, f.path, "", "-s", "Tables").CombinedOutput()
+	if !errors.Is(err, errTimeout) || !errors.Is(err, errTransient) {
+		t.Fatalf("got %v, want a transient timeout", err)
+	}
+}
+
+// withNetworksTable gives p a table for the ipv6 ranges, as ipv6_networks_table does.
+func withNetworksTable(p *pf) *pf {
+	inet6Net := *p.inet6
+	inet6Net.table = "crowdsec6_nets"
+	p.inet6Net = &inet6Net
+
+	return p
+}
+
+func TestNetworksTable(t *testing.T) {
+	f := newFakePfctl(t)
+	p := withNetworksTable(newTestPF(f))
+
+	// a /32 is a host only in ipv4
+	for _, value := range []string{"192.0.2.1/32", "2001:db8::1", "2001:db8::2/128", "2001:db8::/32", "2001:db8:1::/48"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1/32")
+	f.assertTable("crowdsec6", "2001:db8::1", "2001:db8::2/128")
+	f.assertTable("crowdsec6_nets", "2001:db8::/32", "2001:db8:1::/48")
+
+	if ctx := p.contextFor("2001:db8::/32"); ctx != p.inet6Net {
+		t.Fatalf("2001:db8::/32 goes to %s", ctx.table)
+	}
+}
+
+func BenchmarkIPv6Batches(b *testing.B) {
+	p := withNetworksTable(newTestPF(&fakePfctl{}))
+
+	decisions := make([]*models.Decision, 0, 50000)
+	for i := 0; i < cap(decisions); i++ {
+		value := fmt.Sprintf("2001:db8:%x::1", i)
+		if i%10 == 0 {
+			value = fmt.Sprintf("2001:db8:%x::/48", i)
+		}
+
+		decisions = append(decisions, newDecision(value, time.Hour))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p.ipv6Batches(decisions)
+	}
+}
+
+func TestAddFamilyDisabled(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+	}{
+		{"address", []string{"2001:db8::1"}},
+		{"network", []string{"2001:db8::/32"}},
+		{"several", []string{"2001:db8::1", "2001:db8::2/128", "2001:db8:1::/48"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakePfctl(t)
+			p := newTestPF(f)
+			// DisableIPV6
+			p.inet6 = nil
+
+			for _, value := range tt.values {
+				if err := p.Add(newDecision(value, time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := p.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, value := range tt.values {
+				if err := p.Delete(newDecision(value, time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := p.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if calls := f.calls(); len(calls) != 0 {
+				t.Fatalf("pfctl ran %q", calls)
+			}
+		})
+	}
+}
+
+func TestInitChecksBothTables(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	f.createTable("crowdsec", "192.0.2.1")
+	f.createTable("crowdsec6", "2001:db8::1")
+
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec")
+	f.assertTable("crowdsec6")
+
+	calls := strings.Join(f.calls(), "\n")
+	for _, table := range []string{"crowdsec", "crowdsec6"} {
+		if !strings.Contains(calls, "-t "+table+" -T flush") {
+			t.Fatalf("%s was not flushed by init, pfctl ran %q", table, calls)
+		}
+	}
+}
+
+func TestInitWithoutFlush(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	for _, ctx := range p.contexts() {
+		ctx.flushOnStartup = false
+	}
+
+	f.createTable("crowdsec", "192.0.2.1")
+	f.createTable("crowdsec6", "2001:db8::1")
+
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1")
+	f.assertTable("crowdsec6", "2001:db8::1")
+
+	if calls := strings.Join(f.calls(), "\n"); strings.Contains(calls, "-T flush") {
+		t.Fatalf("init flushed a table, pfctl ran %q", calls)
+	}
+
+	// the bans kept are listed, to seed the cache
+	entries, err := p.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []string{}
+	for _, e := range entries {
+		values = append(values, e.Value)
+	}
+
+	sort.Strings(values)
+
+	if strings.Join(values, ",") != "192.0.2.1,2001:db8::1" {
+		t.Fatalf("listed %v", values)
+	}
+}
+
+func TestInitKeepTable(t *testing.T) {
+	f := newFakePfctl(t)
+
+	config, err := cfg.NewConfig(strings.NewReader("mode: pf\npf:\n  pfctl_path: " + f.path + "\n  manage_table_lifecycle: false\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewPF(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tables of pf.conf, filled by something else than the bouncer
+	f.createTable("crowdsec-blacklists", "192.0.2.1")
+	f.createTable("crowdsec6-blacklists", "2001:db8::1")
+
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := strings.Join(f.calls(), "\n"); strings.Contains(calls, "-T flush") {
+		t.Fatalf("init flushed a table, pfctl ran %q", calls)
+	}
+
+	f.assertTable("crowdsec-blacklists", "192.0.2.1")
+	f.assertTable("crowdsec6-blacklists", "2001:db8::1")
+}
+
+func TestInitMissingPfctl(t *testing.T) {
+	f := newFakePfctl(t)
+	missing := filepath.Join(f.dir, "missing")
+
+	config, err := cfg.NewConfig(strings.NewReader("mode: pf\npf:\n  pfctl_path: " + missing + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the environment is only checked by init
+	backend, err := NewPF(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Init(); err == nil || !strings.Contains(err.Error(), missing+" command not found") {
+		t.Fatalf("init without pfctl returned %v", err)
+	}
+}
+
+func TestInitMissingIPv6Table(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	f.createTable("crowdsec")
+
+	err := p.Init()
+	if err == nil || !strings.Contains(err.Error(), "ipv6") || !strings.Contains(err.Error(), "crowdsec6") {
+		t.Fatalf("init without the ipv6 table returned %v", err)
+	}
+}
+
+func TestCommitBatches(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	p.inet.batchSize = 1000
+	p.inet.maxArgs = 500
+
+	want := make([]string, 0, 2500)
+	for i := 0; i < cap(want); i++ {
+		value := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		want = append(want, value)
+
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", want...)
+
+	// beyond maxArgs, the addresses are read from stdin: the last 500 are arguments
+	adds, stdin := 0, 0
+	for _, call := range f.calls() {
+		if strings.Contains(call, "-T add") {
+			adds++
+
+			if strings.HasSuffix(call, "-f -") {
+				stdin++
+			}
+		}
+	}
+
+	if adds != 3 || stdin != 2 {
+		t.Fatalf("%d pfctl add commands, %d with '-f -', want 3 and 2", adds, stdin)
+	}
+}
+
+func TestParseTableSummary(t *testing.T) {
+	tests := []struct {
+		out         string
+		done, total int
+		ok          bool
+	}{
+		{"3/4 addresses added.\n", 3, 4, true},
+		{"1 table created.\n2/2 addresses deleted.\n", 2, 2, true},
+		{"pfctl: Table does not exist.\n", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		done, total, ok := parseTableSummary([]byte(tt.out))
+		if done != tt.done || total != tt.total || ok != tt.ok {
+			t.Errorf("%q: got %d/%d %t", tt.out, done, total, ok)
+		}
+	}
+}
+
+// BenchmarkCommit compares one pfctl command per address to the batches, with the fake pfctl.
+func BenchmarkCommit(b *testing.B) {
+	for _, batchSize := range []int{1, 2000} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			f := newFakePfctl(b)
+			p := newTestPF(f)
+			p.inet.batchSize = batchSize
+
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 100; j++ {
+					if err := p.Add(newDecision(fmt.Sprintf("10.0.0.%d", j), time.Hour)); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				if err := p.Commit(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	p.inet.dryRun = true
+	p.inet6.dryRun = true
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::1"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Delete(newDecision("192.0.2.1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := f.calls(); len(calls) != 0 {
+		t.Fatalf("pfctl ran %q in dry-run", calls)
+	}
+}
+
+func TestForEachContextRunsAll(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	// the ipv4 table is missing, the ipv6 one is still flushed and checked
+	f.createTable("crowdsec6", "2001:db8::1")
+
+	err := p.Init()
+	if err == nil || !strings.Contains(err.Error(), "ipv4") {
+		t.Fatalf("init without the ipv4 table returned %v", err)
+	}
+
+	f.assertTable("crowdsec6")
+
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+
+	err = p.forEachContext(func(ctx *pfContext) error {
+		mu.Lock()
+		ran = append(ran, ctx.table)
+		mu.Unlock()
+
+		return errors.New(ctx.version + " failed")
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "ipv4 failed") || !strings.Contains(err.Error(), "ipv6 failed") {
+		t.Fatalf("forEachContext returned %v", err)
+	}
+
+	if len(ran) != 2 {
+		t.Fatalf("ran on %v", ran)
+	}
+}
+
+func TestCommitOneTableFails(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	f.createTable("crowdsec", "192.0.2.1")
+	f.createTable("crowdsec6", "2001:db8::1")
+
+	// the ipv4 table refuses every change
+	broken := filepath.Join(f.dir, "broken-pfctl")
+	if err := os.WriteFile(broken, []byte("#!/bin/sh\necho 'pfctl: Operation not permitted' >&2\nexit 1\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	p.inet.pfctl = broken
+
+	for _, value := range []string{"192.0.2.2", "2001:db8::2"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::1"} {
+		if err := p.Delete(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := p.Commit()
+	if err == nil || !strings.Contains(err.Error(), "Operation not permitted") {
+		t.Fatalf("commit returned %v", err)
+	}
+
+	// the deletion and the addition failed in ipv4, not in ipv6
+	if got := strings.Count(err.Error(), "Operation not permitted"); got != 2 {
+		t.Fatalf("%d errors returned, want 2: %s", got, err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1")
+	f.assertTable("crowdsec6", "2001:db8::2")
+
+	// only the deadline of the ban applied is tracked
+	if got := strings.Join(p.expiry.values(), ","); got != "2001:db8::2" {
+		t.Fatalf("deadlines tracked for %s", got)
+	}
+}
+
+func TestMalformedDecision(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	for _, d := range []*models.Decision{nil, {}, {Duration: newDecision("192.0.2.1", time.Hour).Duration}} {
+		if err := p.Add(d); err == nil {
+			t.Fatalf("added %+v", d)
+		}
+
+		if err := p.Delete(d); err == nil {
+			t.Fatalf("deleted %+v", d)
+		}
+	}
+
+	// without duration, the ban is applied but its expiry isn't tracked
+	value := "192.0.2.1"
+	if err := p.Add(&models.Decision{Value: &value}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1")
+}
+
+func TestIPv6Only(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	// DisableIPV4
+	p.inet = nil
+
+	f.createTable("crowdsec6")
+
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"192.0.2.1", "2001:db8::1"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec6", "2001:db8::1")
+
+	if f.table("crowdsec") != nil {
+		t.Fatal("the ipv4 table was created")
+	}
+
+	if err := p.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec6")
+}
+
+func TestCommitTimeoutRetried(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	p.retry.set(1, time.Millisecond)
+	p.inet.exec.timeout = 100 * time.Millisecond
+
+	// pfctl hangs, the script writing its output is waited for anyway
+	f.sleep(300 * time.Millisecond)
+
+	if err := p.Add(newDecision("192.0.2.1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(); !errors.Is(err, errTimeout) {
+		t.Fatalf("commit returned %v, want a timeout", err)
+	}
+
+	if calls := f.calls(); len(calls) != 2 {
+		t.Fatalf("pfctl ran %q, want an attempt and a retry", calls)
+	}
+}
+
+func TestSplitByFamily(t *testing.T) {
+	decisions := []*models.Decision{
+		newDecision("192.0.2.1", time.Hour),
+		newDecision("::ffff:198.51.100.1", time.Hour),
+		newDecision("203.0.113.0/24", time.Hour),
+		newDecision("2001:db8::1", time.Hour),
+		newDecision("2001:db8:1::/48", time.Hour),
+		newDecision("192.0.2.2:8080", time.Hour),
+		newDecision("fe80::1%em0", time.Hour),
+	}
+
+	ipv4, ipv6 := splitByFamily(decisions)
+
+	values := func(decisions []*models.Decision) string {
+		ret := []string{}
+		for _, d := range decisions {
+			ret = append(ret, *d.Value)
+		}
+
+		return strings.Join(ret, ",")
+	}
+
+	if got := values(ipv4); got != "192.0.2.1,::ffff:198.51.100.1,203.0.113.0/24" {
+		t.Fatalf("ipv4 decisions: %s", got)
+	}
+
+	if got := values(ipv6); got != "2001:db8::1,2001:db8:1::/48" {
+		t.Fatalf("ipv6 decisions: %s", got)
+	}
+}
+
+func TestCommitSplit(t *testing.T) {
+	tests := []struct {
+		batchSize, maxArgs int
+		calls, stdin       int
+	}{
+		// the defaults
+		{2000, 2000, 25, 0},
+		{2000, 500, 25, 25},
+		{5000, 2000, 10, 10},
+		{50000, 2000, 1, 1},
+	}
+
+	decisions := make([]*models.Decision, 0, 50000)
+	for i := 0; i < cap(decisions); i++ {
+		decisions = append(decisions, newDecision(fmt.Sprintf("10.%d.%d.%d", i/65536, i/256%256, i%256), time.Hour))
+	}
+
+	for _, tt := range tests {
+		f := newFakePfctl(t)
+		p := newTestPF(f)
+		p.inet.batchSize = tt.batchSize
+		p.inet.maxArgs = tt.maxArgs
+
+		for _, d := range decisions {
+			if err := p.Add(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := p.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		calls, stdin := 0, 0
+
+		for _, call := range f.calls() {
+			if !strings.HasPrefix(call, "-t crowdsec -T add") {
+				continue
+			}
+
+			calls++
+
+			if strings.HasSuffix(call, "-f -") {
+				stdin++
+			} else if args := len(strings.Fields(call)) - 4; args > tt.maxArgs {
+				t.Fatalf("batch_size %d, max_args_per_command %d: %d addresses in the arguments", tt.batchSize, tt.maxArgs, args)
+			}
+		}
+
+		if calls != tt.calls || stdin != tt.stdin {
+			t.Fatalf("batch_size %d, max_args_per_command %d: %d pfctl add commands, %d with '-f -', want %d and %d",
+				tt.batchSize, tt.maxArgs, calls, stdin, tt.calls, tt.stdin)
+		}
+
+		if n := len(f.table("crowdsec")); n != len(decisions) {
+			t.Fatalf("batch_size %d, max_args_per_command %d: %d addresses in the table", tt.batchSize, tt.maxArgs, n)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package pf
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+// expected returns the addresses added by the bouncer that have not expired, by table.
+func (pf *pf) expected(now time.Time) map[string][]string {
+	ret := make(map[string][]string)
+
+	for value := range pf.expiry.live(now) {
+		ctx := pf.contextFor(value)
+		if ctx == nil {
+			continue
+		}
+
+		ret[ctx.table] = append(ret[ctx.table], canonical(value))
+	}
+
+	return ret
+}
+
+// Missing tells whether a table has been removed, has lost addresses the bouncer added to
+// it, or isn't used by the block rules anymore (ie. after "pfctl -F all").
+func (pf *pf) Missing() (bool, error) {
+	// a commit in progress has removed the deadlines of the addresses it deletes, but
+	// hasn't added the new addresses yet
+	pf.commitMu.Lock()
+	defer pf.commitMu.Unlock()
+
+	contexts := pf.contexts()
+	if contexts[0].dryRun {
+		return false, nil
+	}
+
+	if len(pf.ruleTables) > 0 {
+		rules, err := contexts[0].blockRules()
+		if err != nil {
+			return false, err
+		}
+
+		for _, table := range pf.ruleTables {
+			if len(tableRules(rules, table)) == 0 {
+				log.Warningf("no pf block rule uses the table %s anymore, reload pf.conf to enforce its bans", table)
+				// the bouncer can't add the rules back, it only warns once
+				pf.ruleTables = nil
+
+				return true, nil
+			}
+		}
+	}
+
+	expected := pf.expected(time.Now())
+
+	for _, ctx := range contexts {
+		exists, err := ctx.tableExists()
+		if err != nil {
+			return false, err
+		}
+
+		if !exists {
+			log.Debugf("pf table %s is missing", ctx.table)
+			return true, nil
+		}
+
+		entries, err := ctx.entries()
+		if err != nil {
+			return false, err
+		}
+
+		present := make(map[string]bool, len(entries))
+
+		for _, entry := range entries {
+			present[canonical(entry)] = true
+		}
+
+		for _, value := range expected[ctx.table] {
+			if !present[value] {
+				log.Debugf("%s is missing from the pf table %s", value, ctx.table)
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Recreate adds the addresses the bouncer added to the tables again, pfctl creates the
+// tables that are gone. The bans of the decisions in the cache are added by the caller.
+func (pf *pf) Recreate() error {
+	pf.commitMu.Lock()
+	defer pf.commitMu.Unlock()
+
+	decisions := []*models.Decision{}
+
+	for value, left := range pf.expiry.live(time.Now()) {
+		value := value
+		duration := left.Round(time.Second).String()
+		decisions = append(decisions, &models.Decision{Value: &value, Duration: &duration})
+	}
+
+	log.Infof("adding %d addresses to the pf tables again", len(decisions))
+
+	defer pf.saveExpiry()
+
+	return pf.commitAddedDecisions(decisions)
+}
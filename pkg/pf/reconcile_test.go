@@ -0,0 +1,131 @@
+package pf
+
+import (
+	"testing"
+	"time"
+)
+
+// newReconciledPF returns a pf backend whose tables hold the given addresses.
+func newReconciledPF(t *testing.T, values ...string) (*fakePfctl, *pf) {
+	t.Helper()
+
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	f.createTable("crowdsec")
+	f.createTable("crowdsec6")
+
+	for _, value := range values {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f, p
+}
+
+func assertMissing(t *testing.T, p *pf, want bool) {
+	t.Helper()
+
+	missing, err := p.Missing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if missing != want {
+		t.Fatalf("Missing() = %t, want %t", missing, want)
+	}
+}
+
+func TestNotMissing(t *testing.T) {
+	_, p := newReconciledPF(t, "192.0.2.1", "2001:db8::1")
+
+	assertMissing(t, p, false)
+}
+
+func TestMissingTableRemoved(t *testing.T) {
+	f, p := newReconciledPF(t, "192.0.2.1", "2001:db8::1")
+
+	// pfctl -F all removes the tables that are not persist
+	f.removeTable("crowdsec")
+
+	assertMissing(t, p, true)
+
+	if err := p.Recreate(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1")
+	f.assertTable("crowdsec6", "2001:db8::1")
+	assertMissing(t, p, false)
+}
+
+func TestMissingTableFlushed(t *testing.T) {
+	f, p := newReconciledPF(t, "192.0.2.1", "192.0.2.2")
+
+	// the persist tables are flushed, and a ban is added before the reconciliation
+	f.createTable("crowdsec")
+
+	if err := p.Add(newDecision("192.0.2.3", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertMissing(t, p, true)
+
+	if err := p.Recreate(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec", "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	assertMissing(t, p, false)
+}
+
+func TestMissingIgnoresExpired(t *testing.T) {
+	f, p := newReconciledPF(t)
+
+	// its deadline is over, the sweep removes it
+	p.expiry.set("192.0.2.1", time.Now().Add(-time.Minute))
+	f.createTable("crowdsec")
+
+	assertMissing(t, p, false)
+}
+
+func TestMissingRules(t *testing.T) {
+	f, p := newReconciledPF(t, "192.0.2.1")
+
+	f.write("rules", "@0 block drop in quick from <crowdsec> to any\n  [ Evaluations: 0 ]\n")
+
+	tables, err := p.referencedTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.ruleTables = tables
+
+	assertMissing(t, p, false)
+
+	// pfctl -F all flushes the rules too
+	f.write("rules", "")
+
+	assertMissing(t, p, true)
+
+	// the bouncer can't add the rules back, it doesn't report them again
+	assertMissing(t, p, false)
+}
+
+func TestMissingDryRun(t *testing.T) {
+	f, p := newReconciledPF(t, "192.0.2.1")
+
+	p.inet.dryRun = true
+	f.removeTable("crowdsec")
+
+	assertMissing(t, p, false)
+}
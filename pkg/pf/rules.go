@@ -0,0 +1,154 @@
+package pf
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+// blockRules returns the block rules of the anchor (or the main ruleset), without their number.
+func (ctx *pfContext) blockRules() ([]string, error) {
+	cmd := execPfctl(ctx.exec, ctx.pfctl, ctx.anchor, "-vvsr")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("while running %s: %w", cmd, err)
+	}
+
+	ret := []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		// ie. "@0 block drop in quick from <crowdsec-blacklists> to any", the statistics
+		// of the rule follow on indented lines
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && strings.HasPrefix(fields[0], "@") && fields[1] == "block" {
+			ret = append(ret, strings.Join(fields[1:], " "))
+		}
+	}
+
+	return ret, nil
+}
+
+// tableRules returns the rules referencing a table, with the table replaced by "<>": pfctl
+// expands a rule on a list of tables into one rule per table, which then compare equal.
+func tableRules(rules []string, table string) []string {
+	ret := []string{}
+
+	for _, rule := range rules {
+		if strings.Contains(rule, "<"+table+">") {
+			ret = append(ret, strings.ReplaceAll(rule, "<"+table+">", "<>"))
+		}
+	}
+
+	return ret
+}
+
+// ruleFamily returns the address family a rule is restricted to, "inet" or "inet6", or ""
+// if it matches both.
+func ruleFamily(rule string) string {
+	for _, field := range strings.Fields(rule) {
+		if field == "inet" || field == "inet6" {
+			return field
+		}
+	}
+
+	return ""
+}
+
+// checkTableRules returns what's wrong with the way the block rules use the tables of the
+// contexts: with joined, a single rule must match all of them whatever the family, with
+// split each table needs a rule of its own family.
+func checkTableRules(rules []string, contexts []*pfContext, mode string) []string {
+	ret := []string{}
+
+	switch mode {
+	case cfg.TableRulesJoined:
+		tables := make([]string, 0, len(contexts))
+		common := map[string]bool{}
+
+		for i, ctx := range contexts {
+			tables = append(tables, "<"+ctx.table+">")
+
+			found := map[string]bool{}
+			for _, rule := range tableRules(rules, ctx.table) {
+				if ruleFamily(rule) == "" && (i == 0 || common[rule]) {
+					found[rule] = true
+				}
+			}
+
+			common = found
+		}
+
+		if len(common) == 0 {
+			ret = append(ret, fmt.Sprintf("no block rule uses the tables %s together, add 'block drop in quick from { %s } to any' to pf.conf",
+				strings.Join(tables, ", "), strings.Join(tables, " ")))
+		}
+	case cfg.TableRulesSplit:
+		for _, ctx := range contexts {
+			found := false
+
+			for _, rule := range tableRules(rules, ctx.table) {
+				if ruleFamily(rule) == ctx.proto {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				ret = append(ret, fmt.Sprintf("no %s block rule uses the table %s, add 'block drop in quick %s from <%s> to any' to pf.conf",
+					ctx.proto, ctx.table, ctx.proto, ctx.table))
+			}
+		}
+	}
+
+	return ret
+}
+
+// checkRules warns if the block rules don't use the tables as table_rules expects. The
+// rules belong to pf.conf, the bans still go to the tables.
+func (pf *pf) checkRules() {
+	if pf.tableRules == "" {
+		return
+	}
+
+	contexts := pf.contexts()
+
+	rules, err := contexts[0].blockRules()
+	if err != nil {
+		log.Warningf("can't check the pf block rules: %s", err)
+		return
+	}
+
+	problems := checkTableRules(rules, contexts, pf.tableRules)
+	for _, problem := range problems {
+		log.Warning(problem)
+	}
+
+	if len(problems) == 0 {
+		log.Infof("the pf block rules use the tables as expected (%s)", pf.tableRules)
+	}
+}
+
+// referencedTables returns the tables of the contexts that a block rule uses.
+func (pf *pf) referencedTables() ([]string, error) {
+	contexts := pf.contexts()
+
+	rules, err := contexts[0].blockRules()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+
+	for _, ctx := range contexts {
+		if len(tableRules(rules, ctx.table)) > 0 {
+			ret = append(ret, ctx.table)
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,117 @@
+package pf
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+func TestCheckTableRules(t *testing.T) {
+	// pfctl expands 'block drop in quick from { <crowdsec> <crowdsec6> } to any'
+	joined := []string{
+		"block drop in quick from <crowdsec> to any",
+		"block drop in quick from <crowdsec6> to any",
+	}
+
+	split := []string{
+		"block drop in quick inet from <crowdsec> to any",
+		"block drop in quick inet6 from <crowdsec6> to any",
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		rules []string
+		want  []string
+	}{
+		{"joined", cfg.TableRulesJoined, joined, nil},
+		{"joined with split rules", cfg.TableRulesJoined, split, []string{"no block rule uses the tables <crowdsec>, <crowdsec6> together"}},
+		{"joined with different rules", cfg.TableRulesJoined, []string{
+			"block drop in quick from <crowdsec> to any",
+			"block drop out quick from any to <crowdsec6>",
+		}, []string{"no block rule uses the tables <crowdsec>, <crowdsec6> together"}},
+		{"split", cfg.TableRulesSplit, split, nil},
+		{"split with joined rules", cfg.TableRulesSplit, joined, []string{
+			"no inet block rule uses the table crowdsec,",
+			"no inet6 block rule uses the table crowdsec6,",
+		}},
+		{"split with the ipv6 rule missing", cfg.TableRulesSplit, split[:1], []string{"no inet6 block rule uses the table crowdsec6,"}},
+		{"split with swapped families", cfg.TableRulesSplit, []string{
+			"block drop in quick inet6 from <crowdsec> to any",
+			"block drop in quick inet from <crowdsec6> to any",
+		}, []string{
+			"no inet block rule uses the table crowdsec,",
+			"no inet6 block rule uses the table crowdsec6,",
+		}},
+		{"no rules", cfg.TableRulesSplit, nil, []string{
+			"no inet block rule uses the table crowdsec,",
+			"no inet6 block rule uses the table crowdsec6,",
+		}},
+	}
+
+	p := newTestPF(newFakePfctl(t))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkTableRules(tt.rules, p.contexts(), tt.mode)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+	p.tableRules = cfg.TableRulesJoined
+
+	// as listed by 'pfctl -vvsr', with the statistics of each rule
+	f.write("rules", strings.Join([]string{
+		"@0 block drop in quick inet from <crowdsec> to any",
+		"  [ Evaluations: 10        Packets: 2         Bytes: 80          States: 0     ]",
+		"@1 pass in all flags S/SA keep state",
+		"",
+	}, "\n"))
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	p.checkRules()
+
+	warnings := []string{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+
+	want := "no block rule uses the tables <crowdsec>, <crowdsec6> together, add 'block drop in quick from { <crowdsec> <crowdsec6> } to any' to pf.conf"
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Fatalf("warned %q", warnings)
+	}
+
+	hook.Reset()
+
+	p.tableRules = cfg.TableRulesSplit
+	f.write("rules", "@0 block drop in quick inet from <crowdsec> to any\n@1 block drop in quick inet6 from <crowdsec6> to any\n")
+
+	p.checkRules()
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			t.Fatalf("warned %q", entry.Message)
+		}
+	}
+}
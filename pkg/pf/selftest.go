@@ -0,0 +1,63 @@
+package pf
+
+import (
+	"fmt"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+)
+
+// addresses from the documentation ranges, added to the tables to make sure they exist
+var selfTestAddresses = map[string]string{
+	"ipv4": "192.0.2.1",
+	"ipv6": "2001:db8::1",
+}
+
+// blockRuleExists tells whether a block rule of the anchor (or the main ruleset) uses the table.
+func (ctx *pfContext) blockRuleExists() (bool, error) {
+	rules, err := ctx.blockRules()
+	if err != nil {
+		return false, err
+	}
+
+	return len(tableRules(rules, ctx.table)) > 0, nil
+}
+
+func (ctx *pfContext) selfTest() error {
+	if ctx.dryRun {
+		return nil
+	}
+
+	value := selfTestAddresses[ctx.version]
+	test := []*models.Decision{{Value: &value}}
+
+	if err := ctx.addChunk(test); err != nil {
+		return err
+	}
+
+	found, err := ctx.blockRuleExists()
+
+	if err := ctx.deleteChunk(test); err != nil {
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("no block rule uses the table %s, add 'block drop in quick from <%s>' to pf.conf", ctx.table, ctx.table)
+	}
+
+	return nil
+}
+
+// SelfTest makes sure the tables are used by block rules.
+func (pf *pf) SelfTest() error {
+	for _, ctx := range pf.contexts() {
+		if err := ctx.selfTest(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
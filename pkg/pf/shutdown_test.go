@@ -0,0 +1,87 @@
+package pf
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutDownOwned(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	for _, ctx := range p.contexts() {
+		ctx.keepTable = true
+	}
+
+	f.createTable("crowdsec", "198.51.100.1")
+	f.createTable("crowdsec6", "2001:db8::2")
+
+	for _, value := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"} {
+		if err := p.Add(newDecision(value, time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the addresses of the other tools are left in place
+	f.assertTable("crowdsec", "198.51.100.1")
+	f.assertTable("crowdsec6", "2001:db8::2")
+
+	for _, call := range f.calls() {
+		if call == "-t crowdsec -T flush" || call == "-t crowdsec6 -T flush" {
+			t.Fatalf("a kept table is flushed: %s", call)
+		}
+	}
+}
+
+func TestShutDownTable(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	f.createTable("crowdsec", "198.51.100.1")
+	f.createTable("crowdsec6")
+
+	if err := p.Add(newDecision("192.0.2.1", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.ShutDown(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.assertTable("crowdsec")
+}
+
+func TestShutDownFlushFails(t *testing.T) {
+	f := newFakePfctl(t)
+	p := newTestPF(f)
+
+	f.createTable("crowdsec", "192.0.2.1")
+	f.createTable("crowdsec6", "2001:db8::1")
+
+	// both flushes fail
+	f.busy(2)
+
+	err := p.ShutDown()
+	if err == nil {
+		t.Fatal("the flush errors are not returned")
+	}
+
+	for _, want := range []string{"ipv4 (crowdsec)", "ipv6 (crowdsec6)", "Device busy"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("shutdown returned %q, without %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package pusher
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// the type of the remediation component, as the LAPI lists it
+const componentType = "crowdsec-firewall-bouncer"
+
+// the body of POST /v1/usage-metrics, accepted by crowdsec 1.6.3 and later
+type usageMetrics struct {
+	RemediationComponents []remediationComponent `json:"remediation_components"`
+}
+
+type remediationComponent struct {
+	Type                string          `json:"type"`
+	Version             string          `json:"version"`
+	FeatureFlags        []string        `json:"feature_flags"`
+	UtcStartupTimestamp int64           `json:"utc_startup_timestamp"`
+	Metrics             []detailedItems `json:"metrics"`
+}
+
+type detailedItems struct {
+	Meta  metricsMeta  `json:"meta"`
+	Items []metricItem `json:"items"`
+}
+
+type metricsMeta struct {
+	WindowSizeSeconds int64 `json:"window_size_seconds"`
+	UtcNowTimestamp   int64 `json:"utc_now_timestamp"`
+}
+
+type metricItem struct {
+	Name   string            `json:"name"`
+	Value  float64           `json:"value"`
+	Unit   string            `json:"unit"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// lapiSink sends the usage metrics to the LAPI. The drops are counted over each window,
+// since the last metrics it accepted.
+type lapiSink struct {
+	client  *http.Client
+	url     string
+	startup time.Time
+	// the counters and the time of the last metrics accepted, the startup at first
+	last     types.Metrics
+	lastSent time.Time
+}
+
+func newLAPISink(client *http.Client, url string, startup time.Time) *lapiSink {
+	return &lapiSink{
+		client:   client,
+		url:      url,
+		startup:  startup,
+		lastSent: startup,
+	}
+}
+
+// delta returns the increase of a counter, or all of it if the firewall reset it.
+func delta(current float64, previous float64) float64 {
+	if current < previous {
+		return current
+	}
+
+	return current - previous
+}
+
+func (s *lapiSink) payload(snapshot types.Metrics, version string, now time.Time) usageMetrics {
+	items := []metricItem{
+		{Name: "dropped", Value: delta(snapshot.DroppedPackets, s.last.DroppedPackets), Unit: "packet"},
+		{Name: "dropped", Value: delta(snapshot.DroppedBytes, s.last.DroppedBytes), Unit: "byte"},
+	}
+
+	families := make([]string, 0, len(snapshot.BannedByFamily))
+	for family := range snapshot.BannedByFamily {
+		families = append(families, family)
+	}
+
+	sort.Strings(families)
+
+	for _, family := range families {
+		items = append(items, metricItem{
+			Name:   "active_decisions",
+			Value:  snapshot.BannedByFamily[family],
+			Unit:   "ip",
+			Labels: map[string]string{"ip_type": family},
+		})
+	}
+
+	return usageMetrics{
+		RemediationComponents: []remediationComponent{{
+			Type:                componentType,
+			Version:             version,
+			FeatureFlags:        []string{},
+			UtcStartupTimestamp: s.startup.UTC().Unix(),
+			Metrics: []detailedItems{{
+				Meta: metricsMeta{
+					WindowSizeSeconds: int64(now.Sub(s.lastSent).Seconds()),
+					UtcNowTimestamp:   now.UTC().Unix(),
+				},
+				Items: items,
+			}},
+		}},
+	}
+}
+
+// send posts the metrics of the window ending now. The window goes on if they are refused.
+func (s *lapiSink) send(ctx context.Context, snapshot types.Metrics, version string, now time.Time) error {
+	if err := post(ctx, s.client, s.url, s.payload(snapshot, version, now)); err != nil {
+		return err
+	}
+
+	s.last = snapshot
+	s.lastSent = now
+
+	return nil
+}
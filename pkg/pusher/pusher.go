@@ -0,0 +1,143 @@
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/jitter"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+const timeout = 10 * time.Second
+
+// Report is the body sent to metrics_push.url: the counters of the firewall, as collected
+// for the prometheus exporter.
+type Report struct {
+	Backend   string    `json:"backend"`
+	Version   string    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Banned    float64   `json:"banned"`
+	types.Metrics
+}
+
+// Pusher sends the last counters collected from the firewall every interval, to the LAPI
+// and/or a URL. The counters are only collected while a Pusher or the exporter needs them.
+type Pusher struct {
+	url      string
+	client   *http.Client
+	lapi     *lapiSink
+	interval time.Duration
+	backend  string
+	version  string
+	snapshot func() (types.Metrics, bool)
+}
+
+// New returns nil if metrics_push is disabled, a nil Pusher does nothing. The LAPI client
+// and its usage metrics endpoint are only used with metrics_push.lapi.
+func New(config *cfg.BouncerConfig, version string, snapshot func() (types.Metrics, bool), lapiClient *http.Client, lapiURL string) *Pusher {
+	if !config.MetricsPush.Enabled() {
+		return nil
+	}
+
+	// already validated by the config loader
+	interval, _ := time.ParseDuration(config.MetricsPush.Interval)
+
+	p := &Pusher{
+		url:      config.MetricsPush.URL,
+		client:   &http.Client{Timeout: timeout},
+		interval: interval,
+		backend:  config.Mode,
+		version:  version,
+		snapshot: snapshot,
+	}
+
+	if config.MetricsPush.LAPI {
+		p.lapi = newLAPISink(lapiClient, lapiURL, time.Now())
+	}
+
+	return p
+}
+
+func post(ctx context.Context, client *http.Client, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: unexpected response status %d", url, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// push sends the last counters once, if any were collected yet.
+func (p *Pusher) push(ctx context.Context, now time.Time) {
+	snapshot, ok := p.snapshot()
+	if !ok {
+		log.Debug("no firewall metrics collected yet, nothing to push")
+		return
+	}
+
+	if p.url != "" {
+		report := Report{
+			Backend:   p.backend,
+			Version:   p.version,
+			Timestamp: now.UTC(),
+			Banned:    snapshot.Banned(),
+			Metrics:   snapshot,
+		}
+
+		if err := post(ctx, p.client, p.url, report); err != nil {
+			log.Errorf("unable to push the metrics: %s", err)
+		}
+	}
+
+	if p.lapi != nil {
+		if err := p.lapi.send(ctx, snapshot, p.version, now); err != nil {
+			log.Errorf("unable to send the usage metrics to the LAPI: %s", err)
+		}
+	}
+}
+
+// Run pushes the metrics every interval until the context is done.
+func (p *Pusher) Run(ctx context.Context) {
+	if p == nil {
+		return
+	}
+
+	t := jitter.NewTicker(p.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			p.push(ctx, now)
+		}
+	}
+}
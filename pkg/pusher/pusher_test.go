@@ -0,0 +1,193 @@
+package pusher
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// fakeSink records the bodies it receives, and answers with status.
+type fakeSink struct {
+	*httptest.Server
+	bodies chan map[string]any
+	status int
+}
+
+func newFakeSink(t *testing.T) *fakeSink {
+	t.Helper()
+
+	s := &fakeSink{bodies: make(chan map[string]any, 10), status: http.StatusOK}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("received %s with Content-Type %s", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		body := map[string]any{}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Errorf("invalid payload %s: %s", raw, err)
+		}
+
+		s.bodies <- body
+
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// next returns a body received and not read yet, nil if there is none.
+func (s *fakeSink) next() map[string]any {
+	select {
+	case body := <-s.bodies:
+		return body
+	default:
+		return nil
+	}
+}
+
+func testSnapshot() types.Metrics {
+	return types.Metrics{
+		DroppedPackets: 14,
+		DroppedBytes:   800,
+		BannedByFamily: map[string]float64{"ipv4": 3, "ipv6": 1},
+	}
+}
+
+func newTestPusher(t *testing.T, push cfg.MetricsPushConfig, lapiURL string, snapshot func() (types.Metrics, bool)) *Pusher {
+	t.Helper()
+
+	config := &cfg.BouncerConfig{Mode: cfg.PfMode, MetricsPush: push}
+	config.MetricsPush.Interval = "1m"
+
+	p := New(config, "v1.2.3", snapshot, http.DefaultClient, lapiURL)
+	if p == nil {
+		t.Fatal("metrics_push is disabled")
+	}
+
+	return p
+}
+
+func TestPushURL(t *testing.T) {
+	sink := newFakeSink(t)
+	p := newTestPusher(t, cfg.MetricsPushConfig{URL: sink.URL}, "", func() (types.Metrics, bool) { return testSnapshot(), true })
+
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	p.push(context.Background(), now)
+
+	want := map[string]any{
+		"backend":          "pf",
+		"version":          "v1.2.3",
+		"timestamp":        "2026-10-14T10:00:00Z",
+		"banned":           float64(4),
+		"dropped_packets":  float64(14),
+		"dropped_bytes":    float64(800),
+		"banned_by_family": map[string]any{"ipv4": float64(3), "ipv6": float64(1)},
+	}
+
+	if got := sink.next(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("pushed %v, want %v", got, want)
+	}
+}
+
+func TestPushWithoutSnapshot(t *testing.T) {
+	sink := newFakeSink(t)
+	p := newTestPusher(t, cfg.MetricsPushConfig{URL: sink.URL}, "", func() (types.Metrics, bool) { return types.Metrics{}, false })
+
+	// nothing collected yet
+	p.push(context.Background(), time.Now())
+
+	if got := sink.next(); got != nil {
+		t.Fatalf("pushed %v", got)
+	}
+}
+
+func TestPushLAPI(t *testing.T) {
+	sink := newFakeSink(t)
+
+	snapshot := testSnapshot()
+	url := sink.URL + "/v1/usage-metrics"
+	p := newTestPusher(t, cfg.MetricsPushConfig{LAPI: true}, url, func() (types.Metrics, bool) { return snapshot, true })
+
+	// started at a known time
+	startup := time.Unix(1_800_000_000, 0)
+	p.lapi = newLAPISink(http.DefaultClient, url, startup)
+
+	p.push(context.Background(), startup.Add(time.Minute))
+
+	component := func(body map[string]any) map[string]any {
+		t.Helper()
+
+		components, ok := body["remediation_components"].([]any)
+		if !ok || len(components) != 1 {
+			t.Fatalf("pushed %v", body)
+		}
+
+		return components[0].(map[string]any)
+	}
+
+	got := component(sink.next())
+
+	if got["type"] != componentType || got["version"] != "v1.2.3" || got["utc_startup_timestamp"] != float64(1_800_000_000) {
+		t.Fatalf("pushed the component %v", got)
+	}
+
+	want := []any{map[string]any{
+		"meta": map[string]any{"window_size_seconds": float64(60), "utc_now_timestamp": float64(1_800_000_060)},
+		"items": []any{
+			map[string]any{"name": "dropped", "value": float64(14), "unit": "packet"},
+			map[string]any{"name": "dropped", "value": float64(800), "unit": "byte"},
+			map[string]any{"name": "active_decisions", "value": float64(3), "unit": "ip", "labels": map[string]any{"ip_type": "ipv4"}},
+			map[string]any{"name": "active_decisions", "value": float64(1), "unit": "ip", "labels": map[string]any{"ip_type": "ipv6"}},
+		},
+	}}
+
+	if !reflect.DeepEqual(got["metrics"], want) {
+		t.Fatalf("pushed the metrics %v, want %v", got["metrics"], want)
+	}
+
+	// refused, the next window starts at the last metrics accepted
+	snapshot.DroppedPackets = 20
+	sink.status = http.StatusInternalServerError
+
+	p.push(context.Background(), startup.Add(2*time.Minute))
+	sink.next()
+
+	sink.status = http.StatusCreated
+	p.push(context.Background(), startup.Add(3*time.Minute))
+
+	metrics := component(sink.next())["metrics"].([]any)[0].(map[string]any)
+	items := metrics["items"].([]any)
+
+	if window := metrics["meta"].(map[string]any)["window_size_seconds"]; window != float64(120) {
+		t.Fatalf("window of %v seconds, want 120", window)
+	}
+
+	if dropped := items[0].(map[string]any)["value"]; dropped != float64(6) {
+		t.Fatalf("%v packets dropped over the window, want 6", dropped)
+	}
+}
+
+func TestNewDisabled(t *testing.T) {
+	if p := New(&cfg.BouncerConfig{}, "v1.2.3", nil, nil, ""); p != nil {
+		t.Fatal("a pusher is returned without metrics_push")
+	}
+
+	// does nothing
+	var p *Pusher
+	p.Run(context.Background())
+}
@@ -1,6 +1,12 @@
 package types
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
 	"github.com/asians-cloud/crowdsec/pkg/models"
 )
 
@@ -10,5 +16,124 @@ type Backend interface {
 	Add(*models.Decision) error
 	Delete(*models.Decision) error
 	Commit() error
-	CollectMetrics()
+	// CollectMetrics reads the counters of the firewall once, the exporter calls it
+	// every metrics interval.
+	CollectMetrics() (Metrics, error)
+}
+
+// ErrMetricsUnsupported is returned by CollectMetrics when the firewall can't report
+// its counters at all, ie. with an old nft. The exporter stops asking.
+var ErrMetricsUnsupported = errors.New("metrics are not supported")
+
+// Metrics is a snapshot of the counters of a backend.
+type Metrics struct {
+	// packets and bytes blocked by the rules using the sets, 0 if the firewall doesn't count them
+	DroppedPackets float64 `json:"dropped_packets"`
+	DroppedBytes   float64 `json:"dropped_bytes"`
+	// entries in the sets by address family, "ipv4" or "ipv6"
+	BannedByFamily map[string]float64 `json:"banned_by_family"`
+}
+
+// Banned returns the number of entries of all the families.
+func (m Metrics) Banned() float64 {
+	ret := float64(0)
+	for _, count := range m.BannedByFamily {
+		ret += count
+	}
+
+	return ret
+}
+
+// Reconciler is implemented by the backends that can detect that their tables or sets
+// have been removed behind their back (ie. by "nft flush ruleset"), and create them again.
+type Reconciler interface {
+	// Missing tells whether the tables or sets of the backend, or their content, are gone.
+	Missing() (bool, error)
+	// Recreate creates the missing tables or sets, they can be empty.
+	Recreate() error
+}
+
+// Entry is a ban read from the firewall.
+type Entry struct {
+	Value string
+	// time left before the ban expires, 0 if the firewall doesn't tell
+	TTL time.Duration
+	// the table is shared and the bouncer didn't add the value (ie. a pf alias or an nftables
+	// set-only set), it's never removed as stale
+	Foreign bool
+}
+
+// Lister is implemented by the backends that can read the bans back from the firewall.
+type Lister interface {
+	List() ([]Entry, error)
+}
+
+// SelfTester is implemented by the backends that can check their bans are enforced,
+// ie. that a blocking rule uses their tables.
+type SelfTester interface {
+	SelfTest() error
+}
+
+// Sweeper is implemented by the backends whose entries don't expire by themselves (ie. pf
+// tables). Every sweep interval, the values they returned as expired are deleted from them.
+type Sweeper interface {
+	// Expired returns the values whose ban is over at now, and forgets them.
+	Expired(now time.Time) []string
+	// SweepInterval is how often to look for expired values, 0 to never do it.
+	SweepInterval() time.Duration
+}
+
+// CheckDecision returns an error if a decision can't be handled by a backend,
+// instead of letting it dereference a missing field.
+func CheckDecision(decision *models.Decision) error {
+	if decision == nil || decision.Value == nil {
+		return fmt.Errorf("decision without value")
+	}
+
+	return nil
+}
+
+// CanonicalValue returns an address or a network in the form the firewalls list it: RFC 5952
+// for IPv6 (ie. "2001:db8::1" for "2001:0DB8:0000::0001"), IPv4 for the IPv4-mapped addresses,
+// the host bits of a network cleared, and no prefix length for a single address.
+func CanonicalValue(value string) (string, error) {
+	if addr, err := netip.ParseAddr(value); err == nil {
+		if addr.Zone() != "" {
+			return "", fmt.Errorf("'%s' has a zone, it can't be banned", value)
+		}
+
+		return addr.Unmap().String(), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return "", fmt.Errorf("'%s' is not a valid IP address or range", value)
+	}
+
+	addr, bits := prefix.Addr(), prefix.Bits()
+
+	// ie. ::ffff:192.0.2.0/120 is 192.0.2.0/24
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+
+	if bits == addr.BitLen() {
+		return addr.String(), nil
+	}
+
+	return netip.PrefixFrom(addr, bits).Masked().String(), nil
+}
+
+// IsIPv6 tells whether a decision value is an IPv6 address or range. IPv4-mapped
+// addresses are IPv4, values with a port or a zone are not valid.
+func IsIPv6(value string) (bool, error) {
+	if ip, _, err := net.ParseCIDR(value); err == nil {
+		return ip.To4() == nil, nil
+	}
+
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.To4() == nil, nil
+	}
+
+	return false, fmt.Errorf("'%s' is not a valid IP address or range", value)
 }
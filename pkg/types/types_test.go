@@ -0,0 +1,74 @@
+package types
+
+import "testing"
+
+func TestCanonicalValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1/32", "192.0.2.1"},
+		{"192.0.2.1/24", "192.0.2.0/24"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1/128", "192.0.2.1"},
+		{"::ffff:192.0.2.1/120", "192.0.2.0/24"},
+		{"2001:0DB8:0000::0001", "2001:db8::1"},
+		{"2001:db8::1/128", "2001:db8::1"},
+		{"2001:db8::1/64", "2001:db8::/64"},
+	}
+
+	for _, tt := range tests {
+		got, err := CanonicalValue(tt.value)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.value, err)
+		}
+
+		if got != tt.want {
+			t.Fatalf("%s: got %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalValueInvalid(t *testing.T) {
+	for _, value := range []string{"", "FR", "192.0.2.1:80", "192.0.2.0/33", "fe80::1%eth0"} {
+		if got, err := CanonicalValue(value); err == nil {
+			t.Fatalf("%s: got %s, want an error", value, got)
+		}
+	}
+}
+
+func TestIsIPv6(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"192.0.2.1", false},
+		{"192.0.2.0/24", false},
+		{"::ffff:192.0.2.1", false},
+		{"::ffff:192.0.2.0/120", false},
+		{"2001:db8::1", true},
+		{"2001:db8::/64", true},
+		{"::1", true},
+		{"::", true},
+	}
+
+	for _, tt := range tests {
+		got, err := IsIPv6(tt.value)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.value, err)
+		}
+
+		if got != tt.want {
+			t.Fatalf("%s: got %t, want %t", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsIPv6Invalid(t *testing.T) {
+	for _, value := range []string{"", "FR", "192.0.2.1:8080", "[2001:db8::1]:443", "fe80::1%eth0", "fe80::1%eth0/64", "2001:db8::/129"} {
+		if _, err := IsIPv6(value); err == nil {
+			t.Fatalf("%s: want an error", value)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+//go:build windows
+// +build windows
+
+package windows
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/asians-cloud/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/pkg/slicetools"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+// netsh accepts a limited number of addresses per rule
+const maxAddressesPerRule = 1000
+
+type windowsFirewall struct {
+	netshBin    string
+	ruleName    string
+	disableIPV4 bool
+	disableIPV6 bool
+	dryRun      bool
+	banned      map[string]struct{}
+	dirty       bool
+	rules       int
+	mu          sync.Mutex
+}
+
+func NewWindows(config *cfg.BouncerConfig) (types.Backend, error) {
+	netshBin, err := exec.LookPath("netsh")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find netsh")
+	}
+
+	return &windowsFirewall{
+		netshBin:    netshBin,
+		ruleName:    config.BlacklistsIpv4,
+		disableIPV4: config.DisableIPV4,
+		disableIPV6: config.DisableIPV6,
+		dryRun:      config.DryRun,
+		banned:      make(map[string]struct{}),
+	}, nil
+}
+
+func (w *windowsFirewall) netsh(args ...string) error {
+	cmd := exec.Command(w.netshBin, append([]string{"advfirewall", "firewall"}, args...)...)
+	if w.dryRun {
+		log.Infof("dry-run: %s", cmd.String())
+		return nil
+	}
+
+	log.Debugf("netsh: %s", cmd.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("while running %s: %w --> %s", cmd.String(), err, string(out))
+	}
+
+	return nil
+}
+
+func (w *windowsFirewall) name(i int) string {
+	return fmt.Sprintf("%s-%d", w.ruleName, i)
+}
+
+// deleteRules removes the rules numbered from `from`, including the ones left by a previous run.
+func (w *windowsFirewall) deleteRules(from int) {
+	for i := from; !w.dryRun || i < w.rules; i++ {
+		if err := w.netsh("delete", "rule", "name="+w.name(i)); err != nil {
+			// netsh fails when no rule matches, there is nothing left to remove
+			if i >= w.rules {
+				break
+			}
+			log.Errorf("unable to delete rule %s: %s", w.name(i), err)
+		}
+	}
+
+	if from < w.rules {
+		w.rules = from
+	}
+}
+
+func (w *windowsFirewall) Init() error {
+	log.Infof("removing existing '%s' rules", w.ruleName)
+	w.deleteRules(0)
+
+	log.Infof("windows firewall initiated")
+
+	return nil
+}
+
+func (w *windowsFirewall) Add(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	value, err := w.validate(decision)
+	if err != nil || value == "" {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.banned[value] = struct{}{}
+	w.dirty = true
+
+	return nil
+}
+
+func (w *windowsFirewall) Delete(decision *models.Decision) error {
+	if err := types.CheckDecision(decision); err != nil {
+		return err
+	}
+
+	value, err := w.validate(decision)
+	if err != nil || value == "" {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.banned, value)
+	w.dirty = true
+
+	return nil
+}
+
+// validate returns the address of a decision, or an empty string if it must be ignored.
+func (w *windowsFirewall) validate(decision *models.Decision) (string, error) {
+	value := *decision.Value
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		if _, ipnet, err := net.ParseCIDR(value); err == nil {
+			ip = ipnet.IP
+			value = ipnet.String()
+		}
+	}
+
+	if ip == nil {
+		return "", fmt.Errorf("'%s' is not a valid IP address or range", value)
+	}
+
+	if ip.To4() == nil && w.disableIPV6 {
+		log.Debugf("ignoring '%s' because ipv6 is disabled", value)
+		return "", nil
+	}
+
+	if ip.To4() != nil && w.disableIPV4 {
+		log.Debugf("ignoring '%s' because ipv4 is disabled", value)
+		return "", nil
+	}
+
+	return value, nil
+}
+
+// Commit rewrites the block rules with the current list of banned addresses.
+func (w *windowsFirewall) Commit() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+
+	values := maps.Keys(w.banned)
+	slices.Sort(values)
+
+	chunks := slicetools.Chunks(values, maxAddressesPerRule)
+
+	for i, chunk := range chunks {
+		remoteIP := "remoteip=" + strings.Join(chunk, ",")
+
+		if i < w.rules {
+			if err := w.netsh("set", "rule", "name="+w.name(i), "new", remoteIP); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := w.netsh("add", "rule", "name="+w.name(i), "dir=in", "action=block", remoteIP); err != nil {
+			return err
+		}
+		w.rules = i + 1
+	}
+
+	w.deleteRules(len(chunks))
+	w.dirty = false
+
+	return nil
+}
+
+func (w *windowsFirewall) CollectMetrics() (types.Metrics, error) {
+	ret := types.Metrics{BannedByFamily: map[string]float64{"ipv4": 0, "ipv6": 0}}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// the firewall doesn't count the blocked packets
+	for value := range w.banned {
+		if strings.Contains(value, ":") {
+			ret.BannedByFamily["ipv6"]++
+		} else {
+			ret.BannedByFamily["ipv4"]++
+		}
+	}
+
+	return ret, nil
+}
+
+func (w *windowsFirewall) ShutDown() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log.Infof("removing '%s' rules", w.ruleName)
+	w.deleteRules(0)
+	w.banned = make(map[string]struct{})
+
+	return nil
+}
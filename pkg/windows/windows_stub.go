@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package windows
+
+import (
+	"fmt"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+	"github.com/asians-cloud/firewall-bouncer/pkg/types"
+)
+
+func NewWindows(config *cfg.BouncerConfig) (types.Backend, error) {
+	return nil, fmt.Errorf("windows backend is not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package windows
+
+import (
+	"testing"
+
+	"github.com/asians-cloud/firewall-bouncer/pkg/cfg"
+)
+
+func TestStub(t *testing.T) {
+	fw, err := NewWindows(&cfg.BouncerConfig{})
+	if err == nil || fw != nil {
+		t.Fatalf("NewWindows returned %v, %v on this platform", fw, err)
+	}
+}